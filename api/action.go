@@ -0,0 +1,254 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+const (
+	// actionMaxPollInterval caps the backoff of the action watcher.
+	actionMaxPollInterval = 16 * time.Second
+
+	// actionPollTimeout bounds a single list call of the action watcher.
+	actionPollTimeout = 30 * time.Second
+
+	// actionMaxInitialDelay caps the time the watcher waits before it polls
+	// an action for the first time.
+	actionMaxInitialDelay = 10 * time.Second
+)
+
+// actionLister lists actions. It is implemented by hcloud.ActionClient.
+type actionLister interface {
+	AllWithOpts(ctx context.Context, opts hcloud.ActionListOpts) ([]*hcloud.Action, error)
+}
+
+// ActionWatcher waits for actions to complete. Instead of polling every
+// action on its own, all actions in flight are polled with a single list
+// call per tick and the results are fanned out to the waiters. The poll
+// interval backs off while nothing changes or the API fails and is reset
+// whenever a new action is watched.
+//
+// The watcher learns how long actions of each command typically take and
+// does not poll an action before most of that time has passed.
+type ActionWatcher struct {
+	logger      log.Logger
+	client      actionLister
+	interval    time.Duration
+	maxInterval time.Duration
+
+	mu      sync.Mutex
+	waiters map[int][]chan error
+	running bool
+	reset   chan struct{}
+
+	// durations holds the moving average of the durations of completed
+	// actions by command.
+	durations map[string]time.Duration
+}
+
+func NewActionWatcher(logger log.Logger, client *hcloud.Client, interval time.Duration) *ActionWatcher {
+	return newActionWatcher(logger, &client.Action, interval, actionMaxPollInterval)
+}
+
+func newActionWatcher(logger log.Logger, client actionLister, interval time.Duration, maxInterval time.Duration) *ActionWatcher {
+	if maxInterval < interval {
+		maxInterval = interval
+	}
+	return &ActionWatcher{
+		logger:      logger,
+		client:      client,
+		interval:    interval,
+		maxInterval: maxInterval,
+		waiters:     make(map[int][]chan error),
+		reset:       make(chan struct{}, 1),
+		durations:   make(map[string]time.Duration),
+	}
+}
+
+// Wait blocks until the action has completed and returns its error, if
+// any, or until ctx is done.
+func (w *ActionWatcher) Wait(ctx context.Context, action *hcloud.Action) error {
+	switch action.Status {
+	case hcloud.ActionStatusSuccess, hcloud.ActionStatusError:
+		return actionError(action)
+	}
+
+	if delay := w.initialDelay(action.Command); delay > 0 {
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+
+	ch := make(chan error, 1)
+	w.mu.Lock()
+	w.waiters[action.ID] = append(w.waiters[action.ID], ch)
+	if !w.running {
+		w.running = true
+		go w.run()
+	} else {
+		select {
+		case w.reset <- struct{}{}:
+		default:
+		}
+	}
+	w.mu.Unlock()
+
+	select {
+	case err := <-ch:
+		return err
+	case <-ctx.Done():
+		w.remove(action.ID, ch)
+		return ctx.Err()
+	}
+}
+
+// initialDelay returns how long to wait before polling an action of the
+// command for the first time, which is three quarters of the typical
+// duration of such actions.
+func (w *ActionWatcher) initialDelay(command string) time.Duration {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	delay := w.durations[command] * 3 / 4
+	if delay > actionMaxInitialDelay {
+		delay = actionMaxInitialDelay
+	}
+	return delay
+}
+
+// observe records the duration of a successfully completed action.
+func (w *ActionWatcher) observe(action *hcloud.Action) {
+	if action.Status != hcloud.ActionStatusSuccess || action.Started.IsZero() || !action.Finished.After(action.Started) {
+		return
+	}
+	d := action.Finished.Sub(action.Started)
+	if avg, ok := w.durations[action.Command]; ok {
+		d = (3*avg + d) / 4
+	}
+	w.durations[action.Command] = d
+}
+
+func (w *ActionWatcher) remove(id int, ch chan error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	waiters := w.waiters[id]
+	for i, waiter := range waiters {
+		if waiter == ch {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) == 0 {
+		delete(w.waiters, id)
+	} else {
+		w.waiters[id] = waiters
+	}
+}
+
+// run polls the actions until nobody waits for any action anymore.
+func (w *ActionWatcher) run() {
+	interval := w.interval
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+		case <-w.reset:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			interval = w.interval
+			timer.Reset(interval)
+			continue
+		}
+
+		w.mu.Lock()
+		ids := make([]int, 0, len(w.waiters))
+		for id := range w.waiters {
+			ids = append(ids, id)
+		}
+		if len(ids) == 0 {
+			w.running = false
+			w.mu.Unlock()
+			return
+		}
+		w.mu.Unlock()
+
+		completed, err := w.poll(ids)
+		if err != nil {
+			level.Info(w.logger).Log(
+				"msg", "failed to poll actions",
+				"actions", len(ids),
+				"err", err,
+			)
+		}
+		if err != nil || completed == 0 {
+			interval *= 2
+			if interval > w.maxInterval {
+				interval = w.maxInterval
+			}
+		} else {
+			interval = w.interval
+		}
+		timer.Reset(interval)
+	}
+}
+
+// poll lists the actions and notifies the waiters of completed actions. It
+// returns the number of completed actions.
+func (w *ActionWatcher) poll(ids []int) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), actionPollTimeout)
+	defer cancel()
+
+	actions, err := w.client.AllWithOpts(ctx, hcloud.ActionListOpts{
+		ListOpts: hcloud.ListOpts{PerPage: 50},
+		ID:       ids,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	completed := 0
+	for _, action := range actions {
+		if action.Status == hcloud.ActionStatusRunning {
+			continue
+		}
+		w.observe(action)
+		for _, ch := range w.waiters[action.ID] {
+			ch <- actionError(action)
+		}
+		delete(w.waiters, action.ID)
+		completed++
+	}
+	level.Debug(w.logger).Log(
+		"msg", "polled actions",
+		"actions", len(ids),
+		"completed", completed,
+	)
+	return completed, nil
+}
+
+func actionError(action *hcloud.Action) error {
+	if err := action.Error(); err != nil {
+		return err
+	}
+	if action.Status == hcloud.ActionStatusError {
+		return fmt.Errorf("action %d failed", action.ID)
+	}
+	return nil
+}
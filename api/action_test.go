@@ -0,0 +1,160 @@
+package api
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+// fakeActionLister completes every action after it has been listed the
+// given number of times.
+type fakeActionLister struct {
+	mu       sync.Mutex
+	polls    int
+	calls    [][]int
+	failures map[int]bool
+	seen     map[int]int
+	duration time.Duration
+}
+
+func (l *fakeActionLister) AllWithOpts(ctx context.Context, opts hcloud.ActionListOpts) ([]*hcloud.Action, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ids := append([]int(nil), opts.ID...)
+	sort.Ints(ids)
+	l.calls = append(l.calls, ids)
+
+	var actions []*hcloud.Action
+	for _, id := range opts.ID {
+		l.seen[id]++
+		action := &hcloud.Action{ID: id, Command: "attach_volume", Status: hcloud.ActionStatusRunning}
+		if l.seen[id] >= l.polls {
+			action.Status = hcloud.ActionStatusSuccess
+			action.Finished = time.Now()
+			action.Started = action.Finished.Add(-l.duration)
+			if l.failures[id] {
+				action.Status = hcloud.ActionStatusError
+				action.ErrorCode = "action_failed"
+				action.ErrorMessage = "Action failed"
+			}
+		}
+		actions = append(actions, action)
+	}
+	return actions, nil
+}
+
+func TestActionWatcher(t *testing.T) {
+	lister := &fakeActionLister{
+		polls:    2,
+		failures: map[int]bool{2: true},
+		seen:     make(map[int]int),
+	}
+	watcher := newActionWatcher(log.NewNopLogger(), lister, time.Millisecond, 4*time.Millisecond)
+
+	var wg sync.WaitGroup
+	errs := make([]error, 3)
+	for i, id := range []int{1, 2, 1} {
+		wg.Add(1)
+		go func(i int, id int) {
+			defer wg.Done()
+			errs[i] = watcher.Wait(context.Background(), &hcloud.Action{ID: id, Status: hcloud.ActionStatusRunning})
+		}(i, id)
+	}
+	wg.Wait()
+
+	if errs[0] != nil || errs[2] != nil {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+	if actionErr, ok := errs[1].(hcloud.ActionError); !ok || actionErr.Code != "action_failed" {
+		t.Errorf("unexpected error: %v", errs[1])
+	}
+
+	lister.mu.Lock()
+	defer lister.mu.Unlock()
+	for _, ids := range lister.calls {
+		for i := 1; i < len(ids); i++ {
+			if ids[i] == ids[i-1] {
+				t.Errorf("action listed twice in one call: %v", ids)
+			}
+		}
+	}
+	if lister.seen[1] > lister.polls+1 || lister.seen[2] > lister.polls+1 {
+		t.Errorf("actions polled too often: %v", lister.seen)
+	}
+}
+
+func TestActionWatcherCompleted(t *testing.T) {
+	lister := &fakeActionLister{seen: make(map[int]int)}
+	watcher := newActionWatcher(log.NewNopLogger(), lister, time.Millisecond, time.Millisecond)
+
+	if err := watcher.Wait(context.Background(), &hcloud.Action{ID: 1, Status: hcloud.ActionStatusSuccess}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := watcher.Wait(context.Background(), &hcloud.Action{ID: 2, Status: hcloud.ActionStatusError}); err == nil {
+		t.Error("expected error")
+	}
+	if len(lister.calls) != 0 {
+		t.Errorf("completed actions polled: %v", lister.calls)
+	}
+}
+
+func TestActionWatcherContextCanceled(t *testing.T) {
+	lister := &fakeActionLister{polls: 1 << 30, seen: make(map[int]int)}
+	watcher := newActionWatcher(log.NewNopLogger(), lister, time.Millisecond, time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := watcher.Wait(ctx, &hcloud.Action{ID: 1, Status: hcloud.ActionStatusRunning}); err != context.DeadlineExceeded {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// The watcher stops polling once nobody waits anymore.
+	time.Sleep(10 * time.Millisecond)
+	watcher.mu.Lock()
+	defer watcher.mu.Unlock()
+	if len(watcher.waiters) != 0 || watcher.running {
+		t.Errorf("watcher still running with waiters: %v", watcher.waiters)
+	}
+}
+
+func TestActionWatcherInitialDelay(t *testing.T) {
+	lister := &fakeActionLister{polls: 1, seen: make(map[int]int), duration: 40 * time.Millisecond}
+	watcher := newActionWatcher(log.NewNopLogger(), lister, time.Millisecond, time.Millisecond)
+
+	if delay := watcher.initialDelay("attach_volume"); delay != 0 {
+		t.Errorf("unexpected initial delay without history: %s", delay)
+	}
+	if err := watcher.Wait(context.Background(), &hcloud.Action{ID: 1, Command: "attach_volume", Status: hcloud.ActionStatusRunning}); err != nil {
+		t.Fatal(err)
+	}
+	if delay := watcher.initialDelay("attach_volume"); delay != 30*time.Millisecond {
+		t.Errorf("unexpected initial delay: %s", delay)
+	}
+	if delay := watcher.initialDelay("detach_volume"); delay != 0 {
+		t.Errorf("unexpected initial delay of other command: %s", delay)
+	}
+
+	start := time.Now()
+	if err := watcher.Wait(context.Background(), &hcloud.Action{ID: 2, Command: "attach_volume", Status: hcloud.ActionStatusRunning}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("action polled before initial delay: %s", elapsed)
+	}
+	if lister.seen[2] != 1 {
+		t.Errorf("unexpected number of polls: %d", lister.seen[2])
+	}
+
+	// The initial delay respects the context.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := watcher.Wait(ctx, &hcloud.Action{ID: 3, Command: "attach_volume", Status: hcloud.ActionStatusRunning}); err != context.Canceled {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
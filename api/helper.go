@@ -1,6 +1,9 @@
 package api
 
 import (
+	"sort"
+	"strings"
+
 	"github.com/hetznercloud/csi-driver/csi"
 	"github.com/hetznercloud/hcloud-go/hcloud"
 )
@@ -13,6 +16,11 @@ func toDomainVolume(hcloudVolume *hcloud.Volume) *csi.Volume {
 		Location:    hcloudVolume.Location.Name,
 		LinuxDevice: hcloudVolume.LinuxDevice,
 		Server:      toDomainServer(hcloudVolume.Server),
+		Labels:      hcloudVolume.Labels,
+		Created:     hcloudVolume.Created,
+
+		DeleteProtection: hcloudVolume.Protection.Delete,
+		Creating:         hcloudVolume.Status == hcloud.VolumeStatusCreating,
 	}
 }
 
@@ -20,7 +28,23 @@ func toDomainServer(hcloudServer *hcloud.Server) *csi.Server {
 	if hcloudServer == nil {
 		return nil
 	}
-	return &csi.Server{
-		ID: uint64(hcloudServer.ID),
+	server := &csi.Server{
+		ID:     uint64(hcloudServer.ID),
+		Name:   hcloudServer.Name,
+		Labels: hcloudServer.Labels,
+	}
+	if hcloudServer.Datacenter != nil && hcloudServer.Datacenter.Location != nil {
+		server.Location = hcloudServer.Datacenter.Location.Name
+	}
+	return server
+}
+
+// labelSelector returns a label selector matching all of the given labels.
+func labelSelector(labels map[string]string) string {
+	selectors := make([]string, 0, len(labels))
+	for key, value := range labels {
+		selectors = append(selectors, key+"="+value)
 	}
+	sort.Strings(selectors)
+	return strings.Join(selectors, ",")
 }
@@ -0,0 +1,203 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	retryMinBackoff  = 500 * time.Millisecond
+	retryMaxBackoff  = 10 * time.Second
+	retryMaxAttempts = 8
+)
+
+// RetryTransport retries requests to the hcloud API that failed because of
+// the rate limit or transient errors. Requests are retried with jittered
+// exponential backoff as long as the deadline of the request allows. Once
+// the rate limit is exhausted, the next attempt waits for the reset reported
+// by the API instead, as earlier attempts would fail anyway. Only
+// errors which guarantee that the request has not been executed are
+// retried for non-idempotent requests.
+//
+// The remaining rate limit budget reported by the API is exposed as gauge.
+type RetryTransport struct {
+	logger             log.Logger
+	next               http.RoundTripper
+	rateLimitRemaining prometheus.Gauge
+	minBackoff         time.Duration
+	maxBackoff         time.Duration
+}
+
+func NewRetryTransport(logger log.Logger, next http.RoundTripper, rateLimitRemaining prometheus.Gauge) *RetryTransport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &RetryTransport{
+		logger:             logger,
+		next:               next,
+		rateLimitRemaining: rateLimitRemaining,
+		minBackoff:         retryMinBackoff,
+		maxBackoff:         retryMaxBackoff,
+	}
+}
+
+func (t *RetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ctx := req.Context()
+	for attempt := 0; ; attempt++ {
+		r := req.Clone(ctx)
+		if body != nil {
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		resp, err := t.next.RoundTrip(r)
+		if resp != nil {
+			t.observeRateLimit(resp)
+		}
+
+		var reason string
+		if err != nil {
+			if !isIdempotent(req.Method) || ctx.Err() != nil {
+				return nil, err
+			}
+			reason = err.Error()
+		} else if reason = retryReason(req.Method, resp); reason == "" {
+			return resp, nil
+		}
+
+		backoff := t.backoff(attempt)
+		if delay, ok := rateLimitDelay(resp, time.Now()); ok {
+			backoff = delay
+		}
+		if attempt+1 >= retryMaxAttempts {
+			return resp, err
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(backoff).After(deadline) {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		level.Debug(t.logger).Log(
+			"msg", "retrying hcloud API request",
+			"method", req.Method,
+			"path", req.URL.Path,
+			"reason", reason,
+			"attempt", attempt+1,
+			"backoff", backoff,
+		)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// backoff returns the jittered delay before the next attempt, which is
+// between half and the full exponential delay.
+func (t *RetryTransport) backoff(attempt int) time.Duration {
+	d := t.minBackoff << uint(attempt)
+	if d > t.maxBackoff || d <= 0 {
+		d = t.maxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func (t *RetryTransport) observeRateLimit(resp *http.Response) {
+	if t.rateLimitRemaining == nil {
+		return
+	}
+	if h := resp.Header.Get("RateLimit-Remaining"); h != "" {
+		if remaining, err := strconv.Atoi(h); err == nil {
+			t.rateLimitRemaining.Set(float64(remaining))
+		}
+	}
+}
+
+// rateLimitDelay returns how long to wait for the reset of the rate limit if
+// the response reports it to be exhausted.
+func rateLimitDelay(resp *http.Response, now time.Time) (time.Duration, bool) {
+	if resp == nil || resp.Header.Get("RateLimit-Remaining") != "0" {
+		return 0, false
+	}
+	reset, err := strconv.ParseInt(resp.Header.Get("RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	delay := time.Unix(reset, 0).Sub(now)
+	if delay < 0 {
+		delay = 0
+	}
+	return delay, true
+}
+
+// retryReason returns why the request should be retried, or an empty
+// string if it should not. The response body is left readable.
+func retryReason(method string, resp *http.Response) string {
+	if resp.StatusCode < 400 {
+		return ""
+	}
+
+	var errResp struct {
+		Error struct {
+			Code hcloud.ErrorCode `json:"code"`
+		} `json:"error"`
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err == nil {
+		_ = json.Unmarshal(body, &errResp)
+	}
+
+	switch code := errResp.Error.Code; code {
+	// The API did not execute the request.
+	case hcloud.ErrorCodeRateLimitExceeded, hcloud.ErrorCodeConflict, hcloud.ErrorCodeLocked:
+		return string(code)
+	case hcloud.ErrorCodeServiceError, hcloud.ErrorCodeUnknownError, hcloud.ErrorCodeMaintenance:
+		if isIdempotent(method) {
+			return string(code)
+		}
+		return ""
+	case "":
+		if resp.StatusCode == http.StatusTooManyRequests {
+			return resp.Status
+		}
+		if resp.StatusCode >= 500 && isIdempotent(method) {
+			return resp.Status
+		}
+	}
+	return ""
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,163 @@
+package api
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newTestRetryTransport() (*RetryTransport, prometheus.Gauge) {
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test"})
+	transport := NewRetryTransport(log.NewNopLogger(), http.DefaultTransport, gauge)
+	transport.minBackoff = time.Millisecond
+	transport.maxBackoff = 4 * time.Millisecond
+	return transport, gauge
+}
+
+func TestRetryTransport(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Method   string
+		Status   int
+		Body     string
+		Attempts int32
+	}{
+		{Name: "success", Method: http.MethodGet, Status: http.StatusOK, Body: `{}`, Attempts: 1},
+		{Name: "rate limit", Method: http.MethodPost, Status: http.StatusTooManyRequests, Body: `{"error":{"code":"rate_limit_exceeded"}}`, Attempts: 3},
+		{Name: "locked", Method: http.MethodPost, Status: http.StatusLocked, Body: `{"error":{"code":"locked"}}`, Attempts: 3},
+		{Name: "conflict", Method: http.MethodPost, Status: http.StatusConflict, Body: `{"error":{"code":"conflict"}}`, Attempts: 3},
+		{Name: "uniqueness error", Method: http.MethodPost, Status: http.StatusConflict, Body: `{"error":{"code":"uniqueness_error"}}`, Attempts: 1},
+		{Name: "server error idempotent", Method: http.MethodGet, Status: http.StatusBadGateway, Body: `bad gateway`, Attempts: 3},
+		{Name: "server error not idempotent", Method: http.MethodPost, Status: http.StatusBadGateway, Body: `bad gateway`, Attempts: 1},
+		{Name: "not found", Method: http.MethodGet, Status: http.StatusNotFound, Body: `{"error":{"code":"not_found"}}`, Attempts: 1},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			var attempts int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				if string(body) != "request" {
+					t.Errorf("unexpected request body: %s", body)
+				}
+				w.Header().Set("RateLimit-Remaining", "42")
+				if atomic.AddInt32(&attempts, 1) < 3 {
+					w.WriteHeader(testCase.Status)
+					w.Write([]byte(testCase.Body))
+					return
+				}
+				w.Write([]byte(`{}`))
+			}))
+			defer server.Close()
+
+			transport, gauge := newTestRetryTransport()
+			client := &http.Client{Transport: transport}
+			req, _ := http.NewRequest(testCase.Method, server.URL, strings.NewReader("request"))
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if attempts != testCase.Attempts {
+				t.Errorf("unexpected number of attempts: %d", attempts)
+			}
+			if testCase.Attempts == 1 && string(body) != testCase.Body {
+				t.Errorf("unexpected response body: %s", body)
+			}
+			if value := testutil.ToFloat64(gauge); value != 42 {
+				t.Errorf("unexpected rate limit remaining: %v", value)
+			}
+		})
+	}
+}
+
+func TestRetryTransportDeadline(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"error":{"code":"rate_limit_exceeded"}}`))
+	}))
+	defer server.Close()
+
+	transport, _ := newTestRetryTransport()
+	transport.minBackoff = time.Second
+	transport.maxBackoff = time.Second
+	client := &http.Client{Transport: transport}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("unexpected status: %s", resp.Status)
+	}
+	if attempts != 1 {
+		t.Errorf("retried beyond the deadline: %d attempts", attempts)
+	}
+}
+
+func TestRetryTransportRateLimitReset(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Reset    time.Duration
+		Timeout  time.Duration
+		Attempts int32
+	}{
+		{Name: "waits for reset", Reset: time.Second, Timeout: 5 * time.Second, Attempts: 2},
+		{Name: "reset after deadline", Reset: time.Minute, Timeout: 5 * time.Second, Attempts: 1},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			var attempts int32
+			reset := time.Now().Add(testCase.Reset)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&attempts, 1) == 1 {
+					w.Header().Set("RateLimit-Remaining", "0")
+					w.Header().Set("RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+					w.WriteHeader(http.StatusTooManyRequests)
+					w.Write([]byte(`{"error":{"code":"rate_limit_exceeded"}}`))
+					return
+				}
+				w.Header().Set("RateLimit-Remaining", "3600")
+				w.Write([]byte(`{}`))
+			}))
+			defer server.Close()
+
+			transport, _ := newTestRetryTransport()
+			client := &http.Client{Transport: transport}
+
+			ctx, cancel := context.WithTimeout(context.Background(), testCase.Timeout)
+			defer cancel()
+			req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if attempts != testCase.Attempts {
+				t.Fatalf("unexpected number of attempts: %d", attempts)
+			}
+			if attempts > 1 && time.Now().Unix() < reset.Unix() {
+				t.Error("retried before the rate limit reset")
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package api
+
+import (
+	"context"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/hetznercloud/hcloud-go/hcloud"
+
+	"github.com/hetznercloud/csi-driver/csi"
+	"github.com/hetznercloud/csi-driver/volumes"
+)
+
+type ServerService struct {
+	logger log.Logger
+	client *hcloud.Client
+}
+
+func NewServerService(logger log.Logger, client *hcloud.Client) *ServerService {
+	return &ServerService{
+		logger: logger,
+		client: client,
+	}
+}
+
+func (s *ServerService) GetByID(ctx context.Context, id uint64) (*csi.Server, error) {
+	hcloudServer, _, err := s.client.Server.GetByID(ctx, int(id))
+	if err != nil {
+		level.Info(s.logger).Log(
+			"msg", "failed to get server",
+			"server-id", id,
+			"err", err,
+		)
+		return nil, err
+	}
+	if hcloudServer == nil {
+		level.Info(s.logger).Log(
+			"msg", "server not found",
+			"server-id", id,
+		)
+		return nil, volumes.ErrServerNotFound
+	}
+	return toDomainServer(hcloudServer), nil
+}
+
+func (s *ServerService) List(ctx context.Context) ([]*csi.Server, error) {
+	hcloudServers, err := s.client.Server.All(ctx)
+	if err != nil {
+		level.Info(s.logger).Log(
+			"msg", "failed to list servers",
+			"err", err,
+		)
+		return nil, err
+	}
+	servers := make([]*csi.Server, 0, len(hcloudServers))
+	for _, hcloudServer := range hcloudServers {
+		servers = append(servers, toDomainServer(hcloudServer))
+	}
+	return servers, nil
+}
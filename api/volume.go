@@ -2,7 +2,6 @@ package api
 
 import (
 	"context"
-	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
@@ -13,15 +12,34 @@ import (
 )
 
 type VolumeService struct {
-	logger log.Logger
-	client *hcloud.Client
+	logger  log.Logger
+	client  *hcloud.Client
+	actions *ActionWatcher
+
+	// volumes and servers look up the volumes and servers acted on. They
+	// query the API unless replaced with SetLookupServices.
+	volumes volumes.Service
+	servers volumes.ServerService
 }
 
-func NewVolumeService(logger log.Logger, client *hcloud.Client) *VolumeService {
-	return &VolumeService{
-		logger: logger,
-		client: client,
+func NewVolumeService(logger log.Logger, client *hcloud.Client, actions *ActionWatcher) *VolumeService {
+	s := &VolumeService{
+		logger:  logger,
+		client:  client,
+		actions: actions,
+		servers: NewServerService(logger, client),
 	}
+	s.volumes = s
+	return s
+}
+
+// SetLookupServices makes the service look up the volumes and servers it acts
+// on with the given services, like the caching services wrapping it, instead
+// of querying the API every time. Lookups for deleting and detaching volumes
+// always bypass caches.
+func (s *VolumeService) SetLookupServices(volumeService volumes.Service, serverService volumes.ServerService) {
+	s.volumes = volumeService
+	s.servers = serverService
 }
 
 func (s *VolumeService) Create(ctx context.Context, opts volumes.CreateOpts) (*csi.Volume, error) {
@@ -30,12 +48,17 @@ func (s *VolumeService) Create(ctx context.Context, opts volumes.CreateOpts) (*c
 		"volume-name", opts.Name,
 		"volume-size", opts.MinSize,
 		"volume-location", opts.Location,
+		"volume-delete-protection", opts.DeleteProtection,
 	)
 
+	// The labels record that the volume is being created until it is ready,
+	// so a retry after a crash does not mistake it for a ready volume.
+	labels := opts.JournalLabels(volumes.ProvisioningStateCreating)
 	result, _, err := s.client.Volume.Create(ctx, hcloud.VolumeCreateOpts{
 		Name:     opts.Name,
 		Size:     opts.MinSize,
 		Location: &hcloud.Location{Name: opts.Location},
+		Labels:   labels,
 	})
 	if err != nil {
 		level.Info(s.logger).Log(
@@ -49,18 +72,84 @@ func (s *VolumeService) Create(ctx context.Context, opts volumes.CreateOpts) (*c
 		return nil, err
 	}
 
-	_, errCh := s.client.Action.WatchProgress(ctx, result.Action)
-	if err := <-errCh; err != nil {
+	if err := s.actions.Wait(ctx, result.Action); err != nil {
 		level.Info(s.logger).Log(
 			"msg", "failed to create volume",
 			"volume-name", opts.Name,
 			"err", err,
 		)
-		_, _ = s.client.Volume.Delete(ctx, result.Volume) // fire and forget
+		s.failCreate(ctx, result.Volume, opts)
 		return nil, err
 	}
 
-	return toDomainVolume(result.Volume), nil
+	if opts.DeleteProtection {
+		if err := s.changeDeleteProtection(ctx, result.Volume, true); err != nil {
+			level.Info(s.logger).Log(
+				"msg", "failed to enable delete protection",
+				"volume-name", opts.Name,
+				"err", err,
+			)
+			s.failCreate(ctx, result.Volume, opts)
+			return nil, err
+		}
+	}
+
+	if opts.ProvisioningStateLabel != "" {
+		labels = opts.JournalLabels("")
+		if _, _, err := s.client.Volume.Update(ctx, result.Volume, hcloud.VolumeUpdateOpts{Labels: labels}); err != nil {
+			level.Info(s.logger).Log(
+				"msg", "failed to mark volume as ready",
+				"volume-name", opts.Name,
+				"err", err,
+			)
+			return nil, err
+		}
+	}
+
+	volume := toDomainVolume(result.Volume)
+	volume.Labels = labels
+	volume.DeleteProtection = opts.DeleteProtection
+	volume.Creating = false
+	return volume, nil
+}
+
+// failCreate marks a volume whose creation failed as failed and tries to
+// delete it. If the request was canceled, the creation may still succeed, so
+// the volume is left as is for a retry to pick up.
+func (s *VolumeService) failCreate(ctx context.Context, volume *hcloud.Volume, opts volumes.CreateOpts) {
+	if ctx.Err() != nil {
+		return
+	}
+	if opts.ProvisioningStateLabel != "" {
+		_, _, err := s.client.Volume.Update(ctx, volume, hcloud.VolumeUpdateOpts{
+			Labels: opts.JournalLabels(volumes.ProvisioningStateFailed),
+		})
+		if err != nil {
+			level.Info(s.logger).Log(
+				"msg", "failed to mark volume as failed",
+				"volume-id", volume.ID,
+				"err", err,
+			)
+		}
+	}
+	if _, err := s.client.Volume.Delete(ctx, volume); err != nil {
+		level.Error(s.logger).Log(
+			"msg", "failed to delete volume after failed creation",
+			"volume-id", volume.ID,
+			"volume-name", volume.Name,
+			"err", err,
+		)
+	}
+}
+
+func (s *VolumeService) changeDeleteProtection(ctx context.Context, volume *hcloud.Volume, enabled bool) error {
+	action, _, err := s.client.Volume.ChangeProtection(ctx, volume, hcloud.VolumeChangeProtectionOpts{
+		Delete: hcloud.Bool(enabled),
+	})
+	if err != nil {
+		return err
+	}
+	return s.actions.Wait(ctx, action)
 }
 
 func (s *VolumeService) GetByID(ctx context.Context, id uint64) (*csi.Volume, error) {
@@ -103,38 +192,59 @@ func (s *VolumeService) GetByName(ctx context.Context, name string) (*csi.Volume
 	return toDomainVolume(hcloudVolume), nil
 }
 
+func (s *VolumeService) List(ctx context.Context, opts volumes.ListOpts) ([]*csi.Volume, error) {
+	hcloudVolumes, err := s.client.Volume.AllWithOpts(ctx, hcloud.VolumeListOpts{
+		ListOpts: hcloud.ListOpts{
+			PerPage:       50,
+			LabelSelector: labelSelector(opts.Labels),
+		},
+	})
+	if err != nil {
+		level.Info(s.logger).Log(
+			"msg", "failed to list volumes",
+			"err", err,
+		)
+		return nil, err
+	}
+	result := make([]*csi.Volume, 0, len(hcloudVolumes))
+	for _, hcloudVolume := range hcloudVolumes {
+		result = append(result, toDomainVolume(hcloudVolume))
+	}
+	return result, nil
+}
+
 func (s *VolumeService) Delete(ctx context.Context, volume *csi.Volume) error {
 	level.Info(s.logger).Log(
 		"msg", "deleting volume",
 		"volume-id", volume.ID,
 	)
 
-	hcloudVolume, _, err := s.client.Volume.GetByID(ctx, int(volume.ID))
+	current, err := s.volumes.GetByID(volumes.WithoutCache(ctx), volume.ID)
 	if err != nil {
 		level.Info(s.logger).Log(
-			"msg", "failed to get volume",
+			"msg", "failed to get volume to delete",
 			"volume-id", volume.ID,
 			"err", err,
 		)
 		return err
 	}
-	if hcloudVolume == nil {
+	if current.Server != nil {
 		level.Info(s.logger).Log(
-			"msg", "volume to delete not found",
+			"msg", "volume is attached to a server",
 			"volume-id", volume.ID,
+			"server-id", current.Server.ID,
 		)
-		return volumes.ErrVolumeNotFound
+		return volumes.ErrAttached
 	}
-	if hcloudVolume.Server != nil {
+	if current.DeleteProtection {
 		level.Info(s.logger).Log(
-			"msg", "volume is attached to a server",
+			"msg", "volume is protected against deletion",
 			"volume-id", volume.ID,
-			"server-id", hcloudVolume.Server.ID,
 		)
-		return volumes.ErrAttached
+		return volumes.ErrDeleteProtected
 	}
 
-	if _, err := s.client.Volume.Delete(ctx, hcloudVolume); err != nil {
+	if _, err := s.client.Volume.Delete(ctx, &hcloud.Volume{ID: int(volume.ID)}); err != nil {
 		level.Info(s.logger).Log(
 			"msg", "failed to delete volume",
 			"volume-id", volume.ID,
@@ -143,6 +253,9 @@ func (s *VolumeService) Delete(ctx context.Context, volume *csi.Volume) error {
 		if hcloud.IsError(err, hcloud.ErrorCodeNotFound) {
 			return volumes.ErrVolumeNotFound
 		}
+		if hcloud.IsError(err, hcloud.ErrorCodeProtected) {
+			return volumes.ErrDeleteProtected
+		}
 		return err
 	}
 	level.Info(s.logger).Log(
@@ -160,60 +273,38 @@ func (s *VolumeService) Attach(ctx context.Context, volume *csi.Volume, server *
 		"server-id", server.ID,
 	)
 
-	hcloudVolume, _, err := s.client.Volume.GetByID(ctx, int(volume.ID))
+	current, err := s.volumes.GetByID(ctx, volume.ID)
 	if err != nil {
 		level.Info(s.logger).Log(
-			"msg", "failed to get volume",
+			"msg", "failed to get volume to attach",
 			"volume-id", volume.ID,
 			"err", err,
 		)
 		return err
 	}
-	if hcloudVolume == nil {
-		level.Info(s.logger).Log(
-			"msg", "volume to attach not found",
-			"volume-id", volume.ID,
-		)
-		return volumes.ErrVolumeNotFound
-	}
-
-	hcloudServer, _, err := s.client.Server.GetByID(ctx, int(server.ID))
-	if err != nil {
+	if _, err := s.servers.GetByID(ctx, server.ID); err != nil {
 		level.Info(s.logger).Log(
-			"msg", "failed to get server",
+			"msg", "failed to get server to attach volume to",
 			"volume-id", volume.ID,
 			"server-id", server.ID,
 			"err", err,
 		)
 		return err
 	}
-	if hcloudServer == nil {
-		level.Info(s.logger).Log(
-			"msg", "server to attach volume to not found",
-			"volume-id", volume.ID,
-			"server-id", server.ID,
-		)
-		return volumes.ErrServerNotFound
-	}
 
-	if hcloudVolume.Server != nil {
-		if hcloudVolume.Server.ID == hcloudServer.ID {
-			level.Info(s.logger).Log(
-				"msg", "volume is already attached to this server",
-				"volume-id", volume.ID,
-				"server-id", server.ID,
-			)
-			return nil
-		}
+	// The volume may have been looked up in a cache, so it is attached
+	// anyway if it appears to be attached to this server, in which case
+	// the API fails with volume_already_attached.
+	if current.Server != nil && current.Server.ID != server.ID {
 		level.Info(s.logger).Log(
 			"msg", "volume is already attached to another server",
 			"volume-id", volume.ID,
-			"server-id", hcloudVolume.Server.ID,
+			"server-id", current.Server.ID,
 		)
 		return volumes.ErrAttached
 	}
 
-	action, _, err := s.client.Volume.Attach(ctx, hcloudVolume, hcloudServer)
+	action, _, err := s.client.Volume.Attach(ctx, &hcloud.Volume{ID: int(volume.ID)}, &hcloud.Server{ID: int(server.ID)})
 	if err != nil {
 		level.Info(s.logger).Log(
 			"msg", "failed to attach volume",
@@ -232,9 +323,7 @@ func (s *VolumeService) Attach(ctx context.Context, volume *csi.Volume, server *
 		}
 		return err
 	}
-	time.Sleep(3 * time.Second) // We know that the Attach action will take some time, so we wait 3 seconds before starting polling the action status. Within these 3 seconds the volume attach action may be already finished.
-	_, errCh := s.client.Action.WatchProgress(ctx, action)
-	if err := <-errCh; err != nil {
+	if err := s.actions.Wait(ctx, action); err != nil {
 		level.Info(s.logger).Log(
 			"msg", "failed to attach volume",
 			"volume-id", volume.ID,
@@ -260,16 +349,10 @@ func (s *VolumeService) Detach(ctx context.Context, volume *csi.Volume, server *
 		)
 	}
 
-	hcloudVolume, _, err := s.client.Volume.GetByID(ctx, int(volume.ID))
+	// The volume is never looked up in a cache, so it is not detached from
+	// a server it has been attached to since.
+	current, err := s.volumes.GetByID(volumes.WithoutCache(ctx), volume.ID)
 	if err != nil {
-		if hcloud.IsError(err, hcloud.ErrorCodeNotFound) {
-			level.Info(s.logger).Log(
-				"msg", "volume to detach not found",
-				"volume-id", volume.ID,
-				"err", err,
-			)
-			return volumes.ErrVolumeNotFound
-		}
 		level.Info(s.logger).Log(
 			"msg", "failed to get volume to detach",
 			"volume-id", volume.ID,
@@ -277,15 +360,7 @@ func (s *VolumeService) Detach(ctx context.Context, volume *csi.Volume, server *
 		)
 		return err
 	}
-	if hcloudVolume == nil {
-		level.Info(s.logger).Log(
-			"msg", "volume to detach not found",
-			"volume-id", volume.ID,
-			"err", err,
-		)
-		return volumes.ErrVolumeNotFound
-	}
-	if hcloudVolume.Server == nil {
+	if current.Server == nil {
 		level.Info(s.logger).Log(
 			"msg", "volume not attached to a server",
 			"volume-id", volume.ID,
@@ -295,17 +370,17 @@ func (s *VolumeService) Detach(ctx context.Context, volume *csi.Volume, server *
 
 	// If a server is provided, only detach if the volume is actually attached
 	// to that server.
-	if server != nil && hcloudVolume.Server.ID != int(server.ID) {
+	if server != nil && current.Server.ID != server.ID {
 		level.Info(s.logger).Log(
 			"msg", "volume not attached to provided server",
 			"volume-id", volume.ID,
 			"detach-from-server-id", server.ID,
-			"attached-to-server-id", hcloudVolume.Server.ID,
+			"attached-to-server-id", current.Server.ID,
 		)
 		return volumes.ErrAttached
 	}
 
-	action, _, err := s.client.Volume.Detach(ctx, hcloudVolume)
+	action, _, err := s.client.Volume.Detach(ctx, &hcloud.Volume{ID: int(volume.ID)})
 	if err != nil {
 		level.Info(s.logger).Log(
 			"msg", "failed to detach volume",
@@ -318,8 +393,7 @@ func (s *VolumeService) Detach(ctx context.Context, volume *csi.Volume, server *
 		return err
 	}
 
-	_, errCh := s.client.Action.WatchProgress(ctx, action)
-	if err := <-errCh; err != nil {
+	if err := s.actions.Wait(ctx, action); err != nil {
 		level.Info(s.logger).Log(
 			"msg", "failed to detach volume",
 			"volume-id", volume.ID,
@@ -337,25 +411,27 @@ func (s *VolumeService) Resize(ctx context.Context, volume *csi.Volume, size int
 		"requested-size", size,
 	)
 
-	hcloudVolume, _, err := s.client.Volume.GetByID(ctx, int(volume.ID))
-	if err != nil {
+	if _, err := s.volumes.GetByID(ctx, volume.ID); err != nil {
 		level.Info(s.logger).Log(
-			"msg", "failed to get volume",
+			"msg", "failed to get volume to resize",
 			"volume-id", volume.ID,
 			"err", err,
 		)
 		return err
 	}
-	if hcloudVolume == nil {
+
+	action, _, err := s.client.Volume.Resize(ctx, &hcloud.Volume{ID: int(volume.ID)}, size)
+	if err != nil {
 		level.Info(s.logger).Log(
-			"msg", "volume to resize not found",
+			"msg", "failed to resize volume",
 			"volume-id", volume.ID,
+			"size", size,
+			"err", err,
 		)
-		return volumes.ErrVolumeNotFound
+		return err
 	}
 
-	action, _, err := s.client.Volume.Resize(ctx, hcloudVolume, size)
-	if err != nil {
+	if err := s.actions.Wait(ctx, action); err != nil {
 		level.Info(s.logger).Log(
 			"msg", "failed to resize volume",
 			"volume-id", volume.ID,
@@ -364,15 +440,47 @@ func (s *VolumeService) Resize(ctx context.Context, volume *csi.Volume, size int
 		)
 		return err
 	}
+	return nil
+}
+
+func (s *VolumeService) SetDeleteProtection(ctx context.Context, volume *csi.Volume, enabled bool) error {
+	level.Info(s.logger).Log(
+		"msg", "changing volume delete protection",
+		"volume-id", volume.ID,
+		"delete-protection", enabled,
+	)
 
-	_, errCh := s.client.Action.WatchProgress(ctx, action)
-	if err := <-errCh; err != nil {
+	hcloudVolume := &hcloud.Volume{ID: int(volume.ID)}
+	if err := s.changeDeleteProtection(ctx, hcloudVolume, enabled); err != nil {
 		level.Info(s.logger).Log(
-			"msg", "failed to resize volume",
+			"msg", "failed to change volume delete protection",
 			"volume-id", volume.ID,
-			"size", size,
 			"err", err,
 		)
+		if hcloud.IsError(err, hcloud.ErrorCodeNotFound) {
+			return volumes.ErrVolumeNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *VolumeService) SetLabels(ctx context.Context, volume *csi.Volume, labels map[string]string) error {
+	level.Info(s.logger).Log(
+		"msg", "setting volume labels",
+		"volume-id", volume.ID,
+	)
+
+	hcloudVolume := &hcloud.Volume{ID: int(volume.ID)}
+	if _, _, err := s.client.Volume.Update(ctx, hcloudVolume, hcloud.VolumeUpdateOpts{Labels: labels}); err != nil {
+		level.Info(s.logger).Log(
+			"msg", "failed to set volume labels",
+			"volume-id", volume.ID,
+			"err", err,
+		)
+		if hcloud.IsError(err, hcloud.ErrorCodeNotFound) {
+			return volumes.ErrVolumeNotFound
+		}
 		return err
 	}
 	return nil
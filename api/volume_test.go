@@ -1,7 +1,80 @@
 package api
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/hetznercloud/hcloud-go/hcloud"
+
+	"github.com/hetznercloud/csi-driver/csi"
+	"github.com/hetznercloud/csi-driver/mock"
 	"github.com/hetznercloud/csi-driver/volumes"
 )
 
 var _ volumes.Service = (*VolumeService)(nil)
+
+var _ volumes.ServerService = (*ServerService)(nil)
+
+func TestVolumeServiceLookupServices(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"action": {"id": 1, "status": "success"}}`))
+	}))
+	defer server.Close()
+
+	client := hcloud.NewClient(hcloud.WithEndpoint(server.URL), hcloud.WithToken("token"))
+	service := NewVolumeService(log.NewNopLogger(), client, NewActionWatcher(log.NewNopLogger(), client, 0))
+
+	lookups := 0
+	volumeService := volumes.NewCachingService(log.NewNopLogger(), &mock.VolumeService{
+		GetByIDFunc: func(ctx context.Context, id uint64) (*csi.Volume, error) {
+			lookups++
+			volume := &csi.Volume{ID: id}
+			if lookups > 1 {
+				volume.Server = &csi.Server{ID: 2}
+			}
+			return volume, nil
+		},
+	}, time.Minute, nil, nil)
+	serverService := &mock.ServerService{
+		GetByIDFunc: func(ctx context.Context, id uint64) (*csi.Server, error) {
+			return &csi.Server{ID: id}, nil
+		},
+	}
+	service.SetLookupServices(volumeService, serverService)
+
+	ctx := context.Background()
+	if err := service.Attach(ctx, &csi.Volume{ID: 1}, &csi.Server{ID: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := service.Resize(ctx, &csi.Volume{ID: 1}, 20); err != nil {
+		t.Fatal(err)
+	}
+	// Volumes to detach are never looked up in the cache.
+	if err := service.Detach(ctx, &csi.Volume{ID: 1}, &csi.Server{ID: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"POST /volumes/1/actions/attach",
+		"POST /volumes/1/actions/resize",
+		"POST /volumes/1/actions/detach",
+	}
+	if len(requests) != len(expected) {
+		t.Fatalf("unexpected requests: %v", requests)
+	}
+	for i, request := range expected {
+		if requests[i] != request {
+			t.Errorf("unexpected request %d: %s", i, requests[i])
+		}
+	}
+	if lookups != 2 {
+		t.Errorf("expected 2 volume lookups, got %d", lookups)
+	}
+}
@@ -0,0 +1,122 @@
+// Command backup backs up a volume attached to the local server to the
+// object storage configured by the BACKUP_S3_* env vars. It is run inside
+// the node plugin container of the node the volume is attached to.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/hetznercloud/csi-driver/csi"
+	"github.com/hetznercloud/csi-driver/s3"
+	"github.com/hetznercloud/csi-driver/volumes"
+)
+
+func main() {
+	logger := log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr))
+	logger = log.With(logger, "ts", log.DefaultTimestampUTC)
+
+	volumeID := flag.Uint64("volume-id", 0, "ID of the volume to back up")
+	name := flag.String("name", "", "name of the backup")
+	mode := flag.String("mode", csi.BackupModeFilesystem, "what to back up: the files of the mounted volume (filesystem) or the raw device (block)")
+	flag.Parse()
+
+	if *volumeID == 0 || *name == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if !volumes.IsValidBackupName(*name) {
+		level.Error(logger).Log(
+			"msg", "invalid backup name, must consist of lower case alphanumeric characters, '-' and '.'",
+		)
+		os.Exit(2)
+	}
+
+	store, err := s3.NewClient(
+		os.Getenv("BACKUP_S3_ENDPOINT"),
+		os.Getenv("BACKUP_S3_REGION"),
+		os.Getenv("BACKUP_S3_BUCKET"),
+		os.Getenv("BACKUP_S3_ACCESS_KEY"),
+		os.Getenv("BACKUP_S3_SECRET_KEY"),
+	)
+	if err != nil {
+		level.Error(logger).Log(
+			"msg", "invalid object storage configuration in BACKUP_S3_* env vars",
+			"err", err,
+		)
+		os.Exit(2)
+	}
+
+	volume := &csi.Volume{
+		ID:          *volumeID,
+		LinuxDevice: csi.LinuxDevicePath(*volumeID),
+	}
+	if volume.Size, err = deviceSize(volume.LinuxDevice); err != nil {
+		level.Error(logger).Log(
+			"msg", "volume is not attached to this server",
+			"err", err,
+		)
+		os.Exit(1)
+	}
+
+	path := volume.LinuxDevice
+	if *mode == csi.BackupModeFilesystem {
+		mountService := volumes.NewLinuxMountService(
+			log.With(logger, "component", "linux-mount-service"),
+			nil,
+		)
+		if path, err = mountService.MountPath(volume); err != nil {
+			level.Error(logger).Log(
+				"msg", "failed to find mounted volume",
+				"err", err,
+			)
+			os.Exit(1)
+		}
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	backupService := volumes.NewObjectStoreBackupService(
+		log.With(logger, "component", "object-store-backup-service"),
+		store,
+		volumes.DefaultBackupChunkSize,
+	)
+	backup, err := backupService.Backup(ctx, volumes.BackupOpts{
+		Name:   *name,
+		Volume: volume,
+		Mode:   *mode,
+		Path:   path,
+	})
+	if err != nil {
+		level.Error(logger).Log(
+			"msg", "failed to back up volume",
+			"err", err,
+		)
+		os.Exit(1)
+	}
+	fmt.Printf("backup-%s\n", backup.Name)
+}
+
+// deviceSize returns the size of the device in GB.
+func deviceSize(device string) (int, error) {
+	f, err := os.Open(device)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	const gb = 1024 * 1024 * 1024
+	return int((size + gb - 1) / gb), nil
+}
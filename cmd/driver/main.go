@@ -13,13 +13,19 @@ import (
 	proto "github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	protov1 "github.com/golang/protobuf/proto"
 	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
 	"github.com/hetznercloud/hcloud-go/hcloud"
 	"google.golang.org/grpc"
+	protov2 "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
 
 	"github.com/hetznercloud/csi-driver/api"
+	"github.com/hetznercloud/csi-driver/csi"
 	"github.com/hetznercloud/csi-driver/driver"
+	"github.com/hetznercloud/csi-driver/k8s"
 	"github.com/hetznercloud/csi-driver/metrics"
+	"github.com/hetznercloud/csi-driver/s3"
 	"github.com/hetznercloud/csi-driver/volumes"
 )
 
@@ -54,72 +60,58 @@ func main() {
 		os.Exit(1)
 	}
 
-	apiToken := os.Getenv("HCLOUD_TOKEN")
-	if apiToken == "" {
-		level.Error(logger).Log(
-			"msg", "you need to provide an API token via the HCLOUD_TOKEN env var",
-		)
-		os.Exit(2)
-	}
-
-	if len(apiToken) != 64 {
-		level.Error(logger).Log(
-			"msg", "entered token is invalid (must be exactly 64 characters long)",
-		)
-		os.Exit(2)
-	}
-
-	opts := []hcloud.ClientOption{
-		hcloud.WithToken(apiToken),
-		hcloud.WithApplication("csi-driver", driver.PluginVersion),
+	metricsEndpoint := os.Getenv("METRICS_ENDPOINT")
+	if metricsEndpoint == "" {
+		// Use a default endpoint
+		metricsEndpoint = ":9189"
 	}
 
-	enableDebug := os.Getenv("HCLOUD_DEBUG")
-	if enableDebug != "" {
-		opts = append(opts, hcloud.WithDebugWriter(os.Stdout))
-	}
+	metrics := metrics.New(
+		log.With(logger, "component", "metrics-service"),
+		metricsEndpoint,
+	)
 
-	pollingInterval := 1
-	if customPollingInterval := os.Getenv("HCLOUD_POLLING_INTERVAL_SECONDS"); customPollingInterval != "" {
-		tmp, err := strconv.Atoi(customPollingInterval)
-		if err != nil || tmp < 1 {
+	// Without an API token only the node service is started, which gets
+	// by with what the controller and the metadata service tell it.
+	pollingInterval := getPollingInterval()
+	var hcloudClient *hcloud.Client
+	if apiToken := os.Getenv("HCLOUD_TOKEN"); apiToken != "" {
+		if len(apiToken) != 64 {
 			level.Error(logger).Log(
-				"msg", "entered polling interval configuration is not a integer that is higher than 1",
+				"msg", "entered token is invalid (must be exactly 64 characters long)",
 			)
 			os.Exit(2)
 		}
+		hcloudClient = newHcloudClient(apiToken, pollingInterval, metrics)
+	} else {
 		level.Info(logger).Log(
-			"msg", "got custom configuration for polling interval",
-			"interval", customPollingInterval,
+			"msg", "no API token provided via the HCLOUD_TOKEN env var, running node service only",
 		)
-
-		pollingInterval = tmp
 	}
-	opts = append(opts, hcloud.WithPollInterval(time.Duration(pollingInterval)*time.Second))
 
-	hcloudClient := hcloud.NewClient(opts...)
+	clusterID := os.Getenv("HCLOUD_CLUSTER_ID")
+	if !driver.IsValidLabelValue(clusterID) {
+		level.Error(logger).Log(
+			"msg", "invalid cluster id in HCLOUD_CLUSTER_ID env var, must be a valid label value",
+		)
+		os.Exit(2)
+	}
 
-	hcloudServerID := getServerID(hcloudClient)
-	level.Debug(logger).Log("msg", "fetching server")
-	server, _, err := hcloudClient.Server.GetByID(context.Background(), hcloudServerID)
+	clusterServerLabels, err := driver.ParseLabels(os.Getenv("HCLOUD_CLUSTER_SERVER_LABELS"))
 	if err != nil {
 		level.Error(logger).Log(
-			"msg", "failed to fetch server",
+			"msg", "invalid labels in HCLOUD_CLUSTER_SERVER_LABELS env var",
 			"err", err,
 		)
-		os.Exit(1)
+		os.Exit(2)
 	}
-	level.Info(logger).Log("msg", "fetched server", "server-name", server.Name)
 
-	volumeService := volumes.NewIdempotentService(
-		log.With(logger, "component", "idempotent-volume-service"),
-		api.NewVolumeService(
-			log.With(logger, "component", "api-volume-service"),
-			hcloudClient,
-		),
-	)
+	server := getServer(hcloudClient)
+
+	backupService := newBackupService()
 	volumeMountService := volumes.NewLinuxMountService(
 		log.With(logger, "component", "linux-mount-service"),
+		metrics,
 	)
 	volumeResizeService := volumes.NewLinuxResizeService(
 		log.With(logger, "component", "linux-resize-service"),
@@ -127,23 +119,93 @@ func main() {
 	volumeStatsService := volumes.NewLinuxStatsService(
 		log.With(logger, "component", "linux-stats-service"),
 	)
-	controllerService := driver.NewControllerService(
-		log.With(logger, "component", "driver-controller-service"),
-		volumeService,
-		server.Datacenter.Location.Name,
-	)
 	identityService := driver.NewIdentityService(
 		log.With(logger, "component", "driver-identity-service"),
 	)
 	nodeService := driver.NewNodeService(
 		log.With(logger, "component", "driver-node-service"),
 		server,
-		volumeService,
 		volumeMountService,
 		volumeResizeService,
 		volumeStatsService,
+		backupService,
 	)
 
+	var controllerService *driver.ControllerService
+	if hcloudClient != nil {
+		apiVolumeService := api.NewVolumeService(
+			log.With(logger, "component", "api-volume-service"),
+			hcloudClient,
+			api.NewActionWatcher(
+				log.With(logger, "component", "api-action-watcher"),
+				hcloudClient,
+				pollingInterval,
+			),
+		)
+		var volumeService volumes.Service = apiVolumeService
+		var serverService volumes.ServerService = api.NewServerService(
+			log.With(logger, "component", "api-server-service"),
+			hcloudClient,
+		)
+		if cacheTTL := getCacheTTL(); cacheTTL > 0 {
+			volumeService = volumes.NewCachingService(
+				log.With(logger, "component", "caching-volume-service"),
+				volumeService,
+				cacheTTL,
+				metrics.CacheHits("volume"),
+				metrics.CacheMisses("volume"),
+			)
+			serverService = volumes.NewCachingServerService(
+				log.With(logger, "component", "caching-server-service"),
+				serverService,
+				cacheTTL,
+				metrics.CacheHits("server"),
+				metrics.CacheMisses("server"),
+			)
+			// Attaching and resizing volumes looks them up in the
+			// caches rather than the API.
+			apiVolumeService.SetLookupServices(volumeService, serverService)
+		}
+		// Orphans are deleted without detaching them first, so they are
+		// never detached from a server they have just been attached to.
+		orphanVolumeService := volumeService
+		volumeService = volumes.NewIdempotentService(
+			log.With(logger, "component", "idempotent-volume-service"),
+			volumeService,
+		)
+		volumeCopyService := volumes.NewAttachCopyService(
+			log.With(logger, "component", "attach-copy-service"),
+			volumeService,
+			&csi.Server{
+				ID:       uint64(server.ID),
+				Location: server.Datacenter.Location.Name,
+			},
+		)
+		snapshotService := volumes.NewCopySnapshotService(
+			log.With(logger, "component", "copy-snapshot-service"),
+			volumeService,
+			volumeCopyService,
+			driver.SnapshotLabels,
+		)
+		controllerService = driver.NewControllerService(
+			log.With(logger, "component", "driver-controller-service"),
+			volumeService,
+			snapshotService,
+			serverService,
+			backupService,
+			volumeCopyService,
+			server.Datacenter.Location.Name,
+			clusterID,
+			clusterServerLabels,
+			os.Getenv("HCLOUD_CLUSTER_OWN_UNLABELED_VOLUMES") == "true",
+			os.Getenv("HCLOUD_VOLUME_FORCE_DELETE") == "true",
+		)
+
+		if orphanCollector := newOrphanCollector(orphanVolumeService, clusterID, metrics); orphanCollector != nil {
+			go orphanCollector.Run(context.Background())
+		}
+	}
+
 	listener, err := net.Listen("unix", endpoint)
 	if err != nil {
 		level.Error(logger).Log(
@@ -153,17 +215,6 @@ func main() {
 		os.Exit(1)
 	}
 
-	metricsEndpoint := os.Getenv("METRICS_ENDPOINT")
-	if metricsEndpoint == "" {
-		// Use a default endpoint
-		metricsEndpoint = ":9189"
-	}
-
-	metrics := metrics.New(
-		log.With(logger, "component", "metrics-service"),
-		metricsEndpoint,
-	)
-
 	grpcServer := grpc.NewServer(
 		grpc.UnaryInterceptor(
 			grpc_middleware.ChainUnaryServer(
@@ -173,7 +224,9 @@ func main() {
 		),
 	)
 
-	proto.RegisterControllerServer(grpcServer, controllerService)
+	if controllerService != nil {
+		proto.RegisterControllerServer(grpcServer, controllerService)
+	}
 	proto.RegisterIdentityServer(grpcServer, identityService)
 	proto.RegisterNodeServer(grpcServer, nodeService)
 
@@ -191,6 +244,220 @@ func main() {
 	}
 }
 
+func newHcloudClient(apiToken string, pollingInterval time.Duration, metrics *metrics.Metrics) *hcloud.Client {
+	opts := []hcloud.ClientOption{
+		hcloud.WithToken(apiToken),
+		hcloud.WithApplication("csi-driver", driver.PluginVersion),
+		hcloud.WithHTTPClient(&http.Client{
+			Transport: api.NewRetryTransport(
+				log.With(logger, "component", "api-retry-transport"),
+				http.DefaultTransport,
+				metrics.HcloudRateLimitRemaining(),
+			),
+		}),
+	}
+
+	enableDebug := os.Getenv("HCLOUD_DEBUG")
+	if enableDebug != "" {
+		opts = append(opts, hcloud.WithDebugWriter(os.Stdout))
+	}
+
+	opts = append(opts, hcloud.WithPollInterval(pollingInterval))
+
+	return hcloud.NewClient(opts...)
+}
+
+func getPollingInterval() time.Duration {
+	pollingInterval := 1
+	if customPollingInterval := os.Getenv("HCLOUD_POLLING_INTERVAL_SECONDS"); customPollingInterval != "" {
+		tmp, err := strconv.Atoi(customPollingInterval)
+		if err != nil || tmp < 1 {
+			level.Error(logger).Log(
+				"msg", "entered polling interval configuration is not a integer that is higher than 1",
+			)
+			os.Exit(2)
+		}
+		level.Info(logger).Log(
+			"msg", "got custom configuration for polling interval",
+			"interval", customPollingInterval,
+		)
+
+		pollingInterval = tmp
+	}
+	return time.Duration(pollingInterval) * time.Second
+}
+
+// getCacheTTL returns how long looked up volumes and servers are cached. A
+// TTL of zero disables the cache.
+func getCacheTTL() time.Duration {
+	cacheTTL := 5
+	if customCacheTTL := os.Getenv("HCLOUD_CACHE_TTL_SECONDS"); customCacheTTL != "" {
+		tmp, err := strconv.Atoi(customCacheTTL)
+		if err != nil || tmp < 0 {
+			level.Error(logger).Log(
+				"msg", "entered cache TTL configuration is not a non-negative integer",
+			)
+			os.Exit(2)
+		}
+		cacheTTL = tmp
+	}
+	return time.Duration(cacheTTL) * time.Second
+}
+
+// newOrphanCollector returns the collector of orphaned volumes configured by
+// the HCLOUD_ORPHAN_* env vars, or nil if it is not enabled.
+func newOrphanCollector(volumeService volumes.Service, clusterID string, metrics *metrics.Metrics) *volumes.OrphanCollector {
+	if os.Getenv("HCLOUD_ORPHAN_DETECTION") != "true" {
+		return nil
+	}
+	if clusterID == "" {
+		level.Error(logger).Log(
+			"msg", "detecting orphaned volumes requires a cluster id in the HCLOUD_CLUSTER_ID env var",
+		)
+		os.Exit(2)
+	}
+	knownVolumes, err := k8s.NewInClusterClient(driver.PluginName)
+	if err != nil {
+		level.Error(logger).Log(
+			"msg", "failed to create kubernetes client for detecting orphaned volumes",
+			"err", err,
+		)
+		os.Exit(2)
+	}
+
+	opts := volumes.OrphanCollectorOpts{
+		Labels:       map[string]string{driver.LabelCluster: clusterID},
+		IgnoreLabels: []string{driver.LabelSnapshotSource},
+		Interval:     getSecondsEnv("HCLOUD_ORPHAN_DETECTION_INTERVAL_SECONDS", 600),
+		GracePeriod:  getSecondsEnv("HCLOUD_ORPHAN_GRACE_PERIOD_SECONDS", 86400),
+	}
+	switch mode := os.Getenv("HCLOUD_ORPHAN_DELETE"); mode {
+	case "", "false":
+	case "true":
+		opts.Delete = true
+	case "dry-run":
+		opts.Delete = true
+		opts.DryRun = true
+	default:
+		level.Error(logger).Log(
+			"msg", "invalid value in HCLOUD_ORPHAN_DELETE env var, must be true, false or dry-run",
+			"value", mode,
+		)
+		os.Exit(2)
+	}
+	if opts.Interval <= 0 {
+		level.Error(logger).Log(
+			"msg", "orphan detection interval must be positive",
+		)
+		os.Exit(2)
+	}
+
+	level.Info(logger).Log(
+		"msg", "detecting orphaned volumes",
+		"interval", opts.Interval,
+		"delete", opts.Delete,
+		"dry-run", opts.DryRun,
+		"grace-period", opts.GracePeriod,
+	)
+	return volumes.NewOrphanCollector(
+		log.With(logger, "component", "orphan-collector"),
+		volumeService,
+		knownVolumes,
+		opts,
+		metrics.OrphanedVolumes(),
+		metrics.OrphanedVolumesDeleted(),
+	)
+}
+
+// getSecondsEnv returns the duration in seconds set in the env var, or the
+// default if it is not set.
+func getSecondsEnv(name string, defaultSeconds int) time.Duration {
+	seconds := defaultSeconds
+	if value := os.Getenv(name); value != "" {
+		tmp, err := strconv.Atoi(value)
+		if err != nil || tmp < 0 {
+			level.Error(logger).Log(
+				"msg", "invalid number of seconds in env var",
+				"env", name,
+				"value", value,
+			)
+			os.Exit(2)
+		}
+		seconds = tmp
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// getServer returns the server the driver runs on. Without an API client
+// only its ID and location are known, which is all the node service needs.
+func getServer(hcloudClient *hcloud.Client) *hcloud.Server {
+	hcloudServerID := getServerID(hcloudClient)
+
+	if hcloudClient == nil {
+		location := os.Getenv("HCLOUD_SERVER_LOCATION")
+		if location == "" {
+			level.Debug(logger).Log(
+				"msg", "getting location from metadata service",
+			)
+			var err error
+			location, err = getInstanceLocation()
+			if err != nil {
+				level.Error(logger).Log(
+					"msg", "failed to get location from metadata service",
+					"err", err,
+				)
+				os.Exit(1)
+			}
+		}
+		return &hcloud.Server{
+			ID: hcloudServerID,
+			Datacenter: &hcloud.Datacenter{
+				Location: &hcloud.Location{Name: location},
+			},
+		}
+	}
+
+	level.Debug(logger).Log("msg", "fetching server")
+	server, _, err := hcloudClient.Server.GetByID(context.Background(), hcloudServerID)
+	if err != nil {
+		level.Error(logger).Log(
+			"msg", "failed to fetch server",
+			"err", err,
+		)
+		os.Exit(1)
+	}
+	level.Info(logger).Log("msg", "fetched server", "server-name", server.Name)
+	return server
+}
+
+// newBackupService returns the service storing backups in the S3 bucket
+// configured by the BACKUP_S3_* env vars, or nil if no bucket is configured.
+func newBackupService() volumes.BackupService {
+	bucket := os.Getenv("BACKUP_S3_BUCKET")
+	if bucket == "" {
+		return nil
+	}
+	store, err := s3.NewClient(
+		os.Getenv("BACKUP_S3_ENDPOINT"),
+		os.Getenv("BACKUP_S3_REGION"),
+		bucket,
+		os.Getenv("BACKUP_S3_ACCESS_KEY"),
+		os.Getenv("BACKUP_S3_SECRET_KEY"),
+	)
+	if err != nil {
+		level.Error(logger).Log(
+			"msg", "invalid object storage configuration in BACKUP_S3_* env vars",
+			"err", err,
+		)
+		os.Exit(2)
+	}
+	return volumes.NewObjectStoreBackupService(
+		log.With(logger, "component", "object-store-backup-service"),
+		store,
+		volumes.DefaultBackupChunkSize,
+	)
+}
+
 func getServerID(hcloudClient *hcloud.Client) int {
 	if s := os.Getenv("HCLOUD_SERVER_ID"); s != "" {
 		id, err := strconv.Atoi(s)
@@ -208,7 +475,7 @@ func getServerID(hcloudClient *hcloud.Client) int {
 		return id
 	}
 
-	if s := os.Getenv("KUBE_NODE_NAME"); s != "" {
+	if s := os.Getenv("KUBE_NODE_NAME"); s != "" && hcloudClient != nil {
 		server, _, err := hcloudClient.Server.GetByName(context.Background(), s)
 		if err != nil {
 			level.Debug(logger).Log(
@@ -256,6 +523,26 @@ func getInstanceID() (int, error) {
 	return strconv.Atoi(string(body))
 }
 
+// getInstanceLocation returns the location of the server, which is the
+// availability zone reported by the metadata service without the data
+// center, e.g. fsn1 for fsn1-dc14.
+func getInstanceLocation() (string, error) {
+	resp, err := http.Get("http://169.254.169.254/hetzner/v1/metadata/availability-zone")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	zone := strings.TrimSpace(string(body))
+	if i := strings.Index(zone, "-"); i > 0 {
+		return zone[:i], nil
+	}
+	return zone, nil
+}
+
 func parseLogLevel(lvl string) level.Option {
 	switch lvl {
 	case "debug":
@@ -275,7 +562,7 @@ func requestLogger(logger log.Logger) grpc.UnaryServerInterceptor {
 	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
 		level.Debug(logger).Log(
 			"msg", "handling request",
-			"req", req,
+			"req", stripSecrets(req),
 		)
 		resp, err := handler(ctx, req)
 		if err != nil {
@@ -289,3 +576,26 @@ func requestLogger(logger log.Logger) grpc.UnaryServerInterceptor {
 		return resp, err
 	}
 }
+
+// stripSecrets returns a copy of req without the fields the CSI spec marks as
+// secret, like the encryption passphrase, so the request can be logged.
+func stripSecrets(req interface{}) interface{} {
+	msg, ok := req.(protov1.Message)
+	if !ok {
+		return req
+	}
+	stripped := protov2.Clone(protov1.MessageV2(msg))
+	clearSecrets(stripped.ProtoReflect())
+	return protov1.MessageV1(stripped)
+}
+
+func clearSecrets(msg protoreflect.Message) {
+	msg.Range(func(fd protoreflect.FieldDescriptor, value protoreflect.Value) bool {
+		if secret, ok := protov2.GetExtension(fd.Options(), proto.E_CsiSecret).(bool); ok && secret {
+			msg.Clear(fd)
+		} else if fd.Message() != nil && !fd.IsList() && !fd.IsMap() {
+			clearSecrets(value.Message())
+		}
+		return true
+	})
+}
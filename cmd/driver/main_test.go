@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	proto "github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+func TestStripSecrets(t *testing.T) {
+	req := &proto.NodeStageVolumeRequest{
+		VolumeId: "1",
+		Secrets:  map[string]string{"encryption-passphrase": "secret"},
+	}
+
+	stripped := fmt.Sprint(stripSecrets(req))
+	if strings.Contains(stripped, "secret") {
+		t.Errorf("secret logged: %s", stripped)
+	}
+	if !strings.Contains(stripped, `volume_id:"1"`) {
+		t.Errorf("volume ID not logged: %s", stripped)
+	}
+	if req.Secrets["encryption-passphrase"] != "secret" {
+		t.Error("secrets stripped from the request")
+	}
+}
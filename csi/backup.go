@@ -0,0 +1,24 @@
+package csi
+
+import "time"
+
+// Backup modes.
+const (
+	// BackupModeFilesystem backups contain the files of a mounted volume.
+	BackupModeFilesystem = "filesystem"
+	// BackupModeBlock backups contain the raw contents of a volume.
+	BackupModeBlock = "block"
+)
+
+// Backup represents a backup of a volume's contents stored in object storage.
+type Backup struct {
+	Name     string
+	VolumeID uint64
+	Mode     string
+	Size     int // GB, size of the volume at backup time
+	Created  time.Time
+}
+
+func (b Backup) SizeBytes() int64 {
+	return int64(b.Size) * 1024 * 1024 * 1024
+}
@@ -2,5 +2,8 @@ package csi
 
 // Server represents a server/node in the CSI driver domain.
 type Server struct {
-	ID uint64
+	ID       uint64
+	Name     string
+	Location string
+	Labels   map[string]string
 }
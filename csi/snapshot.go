@@ -0,0 +1,19 @@
+package csi
+
+import "time"
+
+// Snapshot represents a snapshot in the CSI driver domain. Snapshots are
+// stored as volumes holding a copy of their source volume.
+type Snapshot struct {
+	ID             uint64 // ID of the volume holding the snapshot
+	Name           string
+	SourceVolumeID uint64
+	Size           int // GB
+	Location       string
+	Created        time.Time
+	ReadyToUse     bool
+}
+
+func (s Snapshot) SizeBytes() int64 {
+	return int64(s.Size) * 1024 * 1024 * 1024
+}
@@ -1,5 +1,10 @@
 package csi
 
+import (
+	"fmt"
+	"time"
+)
+
 // Volume represents a volume in the CSI driver domain.
 type Volume struct {
 	ID          uint64
@@ -8,8 +13,22 @@ type Volume struct {
 	Location    string
 	LinuxDevice string
 	Server      *Server
+	Labels      map[string]string
+	Created     time.Time
+
+	// DeleteProtection is set if the volume is protected against deletion.
+	DeleteProtection bool
+
+	// Creating is set while the volume is still being created.
+	Creating bool
 }
 
 func (v Volume) SizeBytes() int64 {
 	return int64(v.Size) * 1024 * 1024 * 1024
 }
+
+// LinuxDevicePath returns the path of the device of a volume attached to
+// a server, as created by the udev rules of the Hetzner Cloud images.
+func LinuxDevicePath(volumeID uint64) string {
+	return fmt.Sprintf("/dev/disk/by-id/scsi-0HC_Volume_%d", volumeID)
+}
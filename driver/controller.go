@@ -4,7 +4,10 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	proto "github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/go-kit/kit/log"
@@ -17,24 +20,80 @@ import (
 )
 
 type ControllerService struct {
-	logger        log.Logger
-	volumeService volumes.Service
+	logger          log.Logger
+	volumeService   volumes.Service
+	snapshotService volumes.SnapshotService
+	serverService   volumes.ServerService
+
+	// backupService is nil if no object storage has been configured.
+	backupService volumes.BackupService
 	location      string
+	copyJobs      *volumes.CopyJobs
+
+	// clusterID identifies the volumes created by this cluster. If empty,
+	// volumes are neither labeled nor filtered by cluster.
+	clusterID string
+
+	// clusterServerLabels are the labels every server of the cluster
+	// carries. If empty, all servers are considered part of the cluster,
+	// but attached volumes are not deleted.
+	clusterServerLabels map[string]string
+
+	// ownUnlabeledVolumes makes volumes without cluster label count as owned
+	// by the cluster, like volumes created before they were labeled.
+	ownUnlabeledVolumes bool
+
+	// forceDelete makes DeleteVolume delete volumes no matter who owns them
+	// and which server they are attached to.
+	forceDelete bool
+
+	// operations serializes the operations per volume ID and name.
+	operations *operations
 }
 
 func NewControllerService(
 	logger log.Logger,
 	volumeService volumes.Service,
+	snapshotService volumes.SnapshotService,
+	serverService volumes.ServerService,
+	backupService volumes.BackupService,
+	copyService volumes.CopyService,
 	location string,
+	clusterID string,
+	clusterServerLabels map[string]string,
+	ownUnlabeledVolumes bool,
+	forceDelete bool,
 ) *ControllerService {
 	return &ControllerService{
-		logger:        logger,
-		volumeService: volumeService,
-		location:      location,
+		logger:              logger,
+		volumeService:       volumeService,
+		snapshotService:     snapshotService,
+		serverService:       serverService,
+		backupService:       backupService,
+		location:            location,
+		copyJobs:            volumes.NewCopyJobs(logger, volumeService, copyService),
+		clusterID:           clusterID,
+		clusterServerLabels: clusterServerLabels,
+		ownUnlabeledVolumes: ownUnlabeledVolumes,
+		forceDelete:         forceDelete,
+		operations:          newOperations(),
 	}
 }
 
 func (s *ControllerService) CreateVolume(ctx context.Context, req *proto.CreateVolumeRequest) (*proto.CreateVolumeResponse, error) {
+	if req.Name == "" {
+		return s.createVolume(ctx, req)
+	}
+	resp, err := s.operations.run(ctx, "volume name "+req.Name, "create "+req.String(), func() (interface{}, error) {
+		return s.createVolume(ctx, req)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*proto.CreateVolumeResponse), nil
+}
+
+func (s *ControllerService) createVolume(ctx context.Context, req *proto.CreateVolumeRequest) (*proto.CreateVolumeResponse, error) {
 	if req.Name == "" {
 		return nil, status.Error(codes.InvalidArgument, "missing name")
 	}
@@ -54,6 +113,27 @@ func (s *ControllerService) CreateVolume(ctx context.Context, req *proto.CreateV
 		}
 	}
 
+	params, err := parseVolumeParameters(req.Parameters)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid parameters: %s", err))
+	}
+	if params.Encrypted {
+		for _, cap := range req.VolumeCapabilities {
+			if cap.GetBlock() != nil {
+				return nil, status.Error(codes.InvalidArgument, "encryption is not supported for block volumes")
+			}
+		}
+	}
+	name, err := params.volumeName(volumeNameData{
+		Name:         req.Name,
+		PVCName:      params.PVCName,
+		PVCNamespace: params.PVCNamespace,
+		PVName:       params.PVName,
+	})
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid parameters: %s", err))
+	}
+
 	// Take the location where to create the volume from the request's
 	// accessibility requirements, falling back to the location where the
 	// controller pod has been scheduled if no requirements have been provided.
@@ -62,22 +142,69 @@ func (s *ControllerService) CreateVolume(ctx context.Context, req *proto.CreateV
 		location = *loc
 	}
 
+	labels := s.volumeLabels(params)
+
+	// Clones and restored snapshots are created next to their source and
+	// must be large enough to hold its contents. Backups are restored by the
+	// node when staging the volume.
+	var source *csi.Volume
+	var backup *csi.Backup
+	if backupName, ok := parseBackupID(req.GetVolumeContentSource().GetSnapshot().GetSnapshotId()); ok {
+		backup, err = s.getBackup(ctx, backupName)
+		if err != nil {
+			return nil, err
+		}
+		if backup.Mode == csi.BackupModeFilesystem {
+			for _, cap := range req.VolumeCapabilities {
+				if cap.GetBlock() != nil {
+					return nil, status.Error(codes.InvalidArgument, "filesystem backups cannot be restored to block volumes")
+				}
+			}
+		}
+		if maxSize > 0 && maxSize < backup.Size {
+			return nil, status.Error(codes.OutOfRange, "volume content source is larger than the limit")
+		}
+		if minSize < backup.Size {
+			minSize = backup.Size
+		}
+	} else if contentSource := req.GetVolumeContentSource(); contentSource != nil {
+		source, err = s.sourceVolume(ctx, contentSource)
+		if err != nil {
+			return nil, err
+		}
+		if maxSize > 0 && maxSize < source.Size {
+			return nil, status.Error(codes.OutOfRange, "volume content source is larger than the limit")
+		}
+		if minSize < source.Size {
+			minSize = source.Size
+		}
+		location = source.Location
+		labels[LabelCloneSource] = contentSourceID(contentSource)
+		labels[LabelCloneState] = cloneStateCopying
+	}
+
 	// Create the volume. The service handles idempotency as required by the CSI spec.
 	volume, err := s.volumeService.Create(ctx, volumes.CreateOpts{
-		Name:     req.Name,
-		MinSize:  minSize,
-		MaxSize:  maxSize,
-		Location: location,
+		Name:                   name,
+		MinSize:                minSize,
+		MaxSize:                maxSize,
+		Location:               location,
+		Labels:                 labels,
+		DeleteProtection:       params.DeleteProtection,
+		ProvisioningStateLabel: LabelProvisioningState,
+		RequestHashLabel:       LabelRequestHash,
 	})
 	if err != nil {
 		level.Error(s.logger).Log(
 			"msg", "failed to create volume",
 			"err", err,
 		)
-		code := codes.Internal
+		code := contextErrorCode(err, codes.Internal)
 		switch err {
 		case volumes.ErrVolumeAlreadyExists:
 			code = codes.AlreadyExists
+		case volumes.ErrVolumeCreating:
+			code = codes.Aborted
 		}
 		return nil, status.Error(code, fmt.Sprintf("failed to create volume: %s", err))
 	}
@@ -87,34 +214,247 @@ func (s *ControllerService) CreateVolume(ctx context.Context, req *proto.CreateV
 		"volume-name", volume.Name,
 	)
 
+	if source != nil {
+		if err := s.waitForClone(ctx, source, contentSourceID(req.VolumeContentSource), volume); err != nil {
+			return nil, err
+		}
+	}
+
 	resp := &proto.CreateVolumeResponse{
-		Volume: &proto.Volume{
-			VolumeId:      strconv.FormatUint(volume.ID, 10),
-			CapacityBytes: volume.SizeBytes(),
-			AccessibleTopology: []*proto.Topology{
-				{
-					Segments: map[string]string{
-						TopologySegmentLocation: volume.Location,
-					},
-				},
-			},
-		},
+		Volume: toProtoVolume(volume),
+	}
+	if source != nil || backup != nil {
+		resp.Volume.ContentSource = req.VolumeContentSource
+	}
+	if params.FSType != "" || params.Encrypted || backup != nil || params.Format != nil || params.FsckPolicy != "" {
+		resp.Volume.VolumeContext = make(map[string]string)
+	}
+	if backup != nil {
+		resp.Volume.VolumeContext[VolumeContextBackup] = backup.Name
+	}
+	if params.FSType != "" {
+		resp.Volume.VolumeContext[VolumeContextFSType] = params.FSType
+	}
+	if params.Encrypted {
+		resp.Volume.VolumeContext[VolumeContextEncrypted] = "true"
+	}
+	for key, value := range params.Format {
+		resp.Volume.VolumeContext[key] = value
+	}
+	if params.FsckPolicy != "" {
+		resp.Volume.VolumeContext[VolumeContextFsckPolicy] = params.FsckPolicy
 	}
 	return resp, nil
 }
 
+// sourceVolume returns the volume to copy the contents of a new volume from.
+// That is either the volume to clone, which must not be attached as its
+// contents may change while being copied, or the volume holding a snapshot.
+func (s *ControllerService) sourceVolume(ctx context.Context, contentSource *proto.VolumeContentSource) (*csi.Volume, error) {
+	if contentSource.GetSnapshot() != nil {
+		return s.snapshotSourceVolume(ctx, contentSource.GetSnapshot().SnapshotId)
+	}
+	if contentSource.GetVolume() == nil {
+		return nil, status.Error(codes.InvalidArgument, "unsupported volume content source")
+	}
+
+	sourceID, err := parseVolumeID(contentSource.GetVolume().VolumeId)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "source volume not found")
+	}
+	// The source must be checked to be detached right now.
+	source, err := s.volumeService.GetByID(volumes.WithoutCache(ctx), sourceID)
+	if err != nil {
+		code := codes.Internal
+		switch err {
+		case volumes.ErrVolumeNotFound:
+			code = codes.NotFound
+		}
+		return nil, status.Error(code, fmt.Sprintf("failed to get source volume: %s", err))
+	}
+	if !s.isClusterVolume(source) {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("source volume %d is not owned by this cluster", source.ID))
+	}
+	if source.Server != nil {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf(
+			"source volume %d is attached to server %d: it must be detached to be cloned, stop the pods using it first", source.ID, source.Server.ID))
+	}
+	return source, nil
+}
+
+func (s *ControllerService) snapshotSourceVolume(ctx context.Context, snapshotID string) (*csi.Volume, error) {
+	id, err := parseSnapshotID(snapshotID)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "source snapshot not found")
+	}
+	snapshot, err := s.snapshotService.GetByID(ctx, id)
+	if err != nil {
+		code := codes.Internal
+		switch err {
+		case volumes.ErrSnapshotNotFound:
+			code = codes.NotFound
+		}
+		return nil, status.Error(code, fmt.Sprintf("failed to get source snapshot: %s", err))
+	}
+	if !snapshot.ReadyToUse {
+		return nil, status.Error(codes.Unavailable, fmt.Sprintf("snapshot %s is not ready to use", snapshotID))
+	}
+	return &csi.Volume{
+		ID:       snapshot.ID,
+		Size:     snapshot.Size,
+		Location: snapshot.Location,
+	}, nil
+}
+
+func (s *ControllerService) getBackup(ctx context.Context, name string) (*csi.Backup, error) {
+	if s.backupService == nil {
+		return nil, status.Error(codes.FailedPrecondition, "backups are not configured")
+	}
+	backup, err := s.backupService.Get(ctx, name)
+	if err != nil {
+		code := codes.Internal
+		switch err {
+		case volumes.ErrBackupNotFound:
+			code = codes.NotFound
+		}
+		return nil, status.Error(code, fmt.Sprintf("failed to get backup: %s", err))
+	}
+	return backup, nil
+}
+
+// contentSourceID returns the ID of the volume or snapshot a volume is
+// created from.
+func contentSourceID(contentSource *proto.VolumeContentSource) string {
+	if snapshot := contentSource.GetSnapshot(); snapshot != nil {
+		return snapshot.SnapshotId
+	}
+	return contentSource.GetVolume().GetVolumeId()
+}
+
+// waitForClone copies the contents of source to volume unless that already
+// happened. If the copy does not finish before ctx is done, it continues in
+// the background and Aborted is returned, so that the CO retries.
+func (s *ControllerService) waitForClone(ctx context.Context, source *csi.Volume, sourceID string, volume *csi.Volume) error {
+	if volume.Labels[LabelCloneSource] != sourceID {
+		return status.Error(codes.AlreadyExists, fmt.Sprintf("volume %d is not created from %s", volume.ID, sourceID))
+	}
+	if _, ok := volume.Labels[LabelCloneState]; !ok {
+		return nil
+	}
+
+	job := s.copyJobs.Start(source, volume, LabelCloneState)
+	select {
+	case <-job.Done():
+		if err := job.Err(); err != nil {
+			code := codes.Internal
+			switch err {
+			case volumes.ErrAttached:
+				code = codes.FailedPrecondition
+			}
+			return status.Error(code, fmt.Sprintf("failed to clone volume: %s", err))
+		}
+		return nil
+	case <-ctx.Done():
+		return status.Error(codes.Aborted, fmt.Sprintf("volume %d is still being cloned", volume.ID))
+	}
+}
+
+// volumeLabels returns the labels of a new volume, which are the labels from
+// the parameters plus the labels marking the volume as owned by the cluster.
+// Values which are not valid label values, like overlong PVC names, are left out.
+func (s *ControllerService) volumeLabels(params *volumeParameters) map[string]string {
+	labels := make(map[string]string)
+	for key, value := range params.Labels {
+		labels[key] = value
+	}
+	for key, value := range s.clusterLabels() {
+		labels[key] = value
+	}
+	if params.DeleteProtectionPolicy != "" {
+		labels[LabelDeleteProtectionPolicy] = params.DeleteProtectionPolicy
+	}
+	for key, value := range map[string]string{
+		LabelPVCName:      params.PVCName,
+		LabelPVCNamespace: params.PVCNamespace,
+		LabelPVName:       params.PVName,
+	} {
+		if value == "" {
+			continue
+		}
+		if !IsValidLabelValue(value) {
+			level.Info(s.logger).Log(
+				"msg", "not adding label with invalid value",
+				"label", key,
+				"value", value,
+			)
+			continue
+		}
+		labels[key] = value
+	}
+	return labels
+}
+
+// clusterLabels returns the labels carried by all volumes owned by the cluster.
+func (s *ControllerService) clusterLabels() map[string]string {
+	if s.clusterID == "" {
+		return nil
+	}
+	return map[string]string{LabelCluster: s.clusterID}
+}
+
 func (s *ControllerService) DeleteVolume(ctx context.Context, req *proto.DeleteVolumeRequest) (*proto.DeleteVolumeResponse, error) {
+	if req.VolumeId == "" {
+		return s.deleteVolume(ctx, req)
+	}
+	resp, err := s.operations.run(ctx, "volume "+req.VolumeId, "delete", func() (interface{}, error) {
+		return s.deleteVolume(ctx, req)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*proto.DeleteVolumeResponse), nil
+}
+
+func (s *ControllerService) deleteVolume(ctx context.Context, req *proto.DeleteVolumeRequest) (*proto.DeleteVolumeResponse, error) {
 	if req.VolumeId == "" {
 		return nil, status.Error(codes.InvalidArgument, "invalid volume id")
 	}
 
 	if volumeID, err := parseVolumeID(req.VolumeId); err == nil {
-		volume := &csi.Volume{ID: volumeID}
+		volume, err := s.volumeService.GetByID(volumes.WithoutCache(ctx), volumeID)
+		if errors.Is(err, volumes.ErrVolumeNotFound) {
+			return &proto.DeleteVolumeResponse{}, nil
+		}
+		if err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("failed to get volume: %s", err))
+		}
+		if !s.forceDelete {
+			if err := s.checkDeletable(ctx, volume); err != nil {
+				return nil, err
+			}
+		}
+		lifted := false
+		if volume.DeleteProtection {
+			if volume.Labels[LabelDeleteProtectionPolicy] != DeleteProtectionPolicyLift {
+				return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("volume %d is protected against deletion", volume.ID))
+			}
+			level.Info(s.logger).Log(
+				"msg", "lifting delete protection of volume",
+				"volume-id", volume.ID,
+			)
+			if err := s.volumeService.SetDeleteProtection(ctx, volume, false); err != nil {
+				return nil, status.Error(contextErrorCode(err, codes.Internal), fmt.Sprintf("failed to lift delete protection: %s", err))
+			}
+			lifted = true
+		}
 		if err := s.volumeService.Delete(ctx, volume); err != nil {
 			if errors.Is(err, volumes.ErrVolumeNotFound) {
 				return &proto.DeleteVolumeResponse{}, nil
 			}
-			if errors.Is(err, volumes.ErrAttached) {
+			if lifted {
+				s.restoreDeleteProtection(volume)
+			}
+			if errors.Is(err, volumes.ErrAttached) || errors.Is(err, volumes.ErrDeleteProtected) {
 				return nil, status.Error(codes.FailedPrecondition, err.Error())
 			}
 			return nil, status.Error(codes.Internal, err.Error())
@@ -125,7 +465,80 @@ func (s *ControllerService) DeleteVolume(ctx context.Context, req *proto.DeleteV
 	return resp, nil
 }
 
+// restoreDeleteProtection protects a volume against deletion again after it
+// could not be deleted. It is done even if the request has been cancelled.
+func (s *ControllerService) restoreDeleteProtection(volume *csi.Volume) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	level.Info(s.logger).Log(
+		"msg", "restoring delete protection of volume which could not be deleted",
+		"volume-id", volume.ID,
+	)
+	if err := s.volumeService.SetDeleteProtection(ctx, volume, true); err != nil {
+		level.Error(s.logger).Log(
+			"msg", "failed to restore delete protection",
+			"volume-id", volume.ID,
+			"err", err,
+		)
+	}
+}
+
+// checkDeletable refuses to delete volumes which are not owned by the
+// cluster or which are attached to a server outside of the cluster. Without
+// cluster server labels the servers of the cluster are unknown, so attached
+// volumes are not deleted at all.
+func (s *ControllerService) checkDeletable(ctx context.Context, volume *csi.Volume) error {
+	if !s.isClusterVolume(volume) {
+		level.Info(s.logger).Log(
+			"msg", "refusing to delete volume not owned by the cluster",
+			"volume-id", volume.ID,
+		)
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("volume %d is not owned by this cluster", volume.ID))
+	}
+	if volume.Server == nil {
+		return nil
+	}
+	if len(s.clusterServerLabels) == 0 {
+		level.Info(s.logger).Log(
+			"msg", "refusing to delete attached volume without cluster server labels",
+			"volume-id", volume.ID,
+			"server-id", volume.Server.ID,
+		)
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf(
+			"volume %d is attached to server %d and no cluster server labels are configured to tell whether it is a node of this cluster",
+			volume.ID, volume.Server.ID))
+	}
+
+	server, err := s.serverService.GetByID(ctx, volume.Server.ID)
+	if err != nil && err != volumes.ErrServerNotFound {
+		return status.Error(codes.Internal, fmt.Sprintf("failed to get server: %s", err))
+	}
+	if server == nil || !s.isClusterServer(server) {
+		level.Info(s.logger).Log(
+			"msg", "refusing to delete volume attached to a server outside of the cluster",
+			"volume-id", volume.ID,
+			"server-id", volume.Server.ID,
+		)
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("volume %d is attached to server %d which is not a node of this cluster", volume.ID, volume.Server.ID))
+	}
+	return nil
+}
+
 func (s *ControllerService) ControllerPublishVolume(ctx context.Context, req *proto.ControllerPublishVolumeRequest) (*proto.ControllerPublishVolumeResponse, error) {
+	if req.VolumeId == "" {
+		return s.controllerPublishVolume(ctx, req)
+	}
+	resp, err := s.operations.run(ctx, "volume "+req.VolumeId, "publish "+req.String(), func() (interface{}, error) {
+		return s.controllerPublishVolume(ctx, req)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*proto.ControllerPublishVolumeResponse), nil
+}
+
+func (s *ControllerService) controllerPublishVolume(ctx context.Context, req *proto.ControllerPublishVolumeRequest) (*proto.ControllerPublishVolumeResponse, error) {
 	if req.VolumeId == "" {
 		return nil, status.Error(codes.InvalidArgument, "missing volume id")
 	}
@@ -157,7 +570,7 @@ func (s *ControllerService) ControllerPublishVolume(ctx context.Context, req *pr
 	server := &csi.Server{ID: serverID}
 
 	if err := s.volumeService.Attach(ctx, volume, server); err != nil {
-		code := codes.Internal
+		code := contextErrorCode(err, codes.Internal)
 		switch err {
 		case volumes.ErrVolumeNotFound:
 			code = codes.NotFound
@@ -173,11 +586,28 @@ func (s *ControllerService) ControllerPublishVolume(ctx context.Context, req *pr
 		return nil, status.Error(code, fmt.Sprintf("failed to publish volume: %s", err))
 	}
 
-	resp := &proto.ControllerPublishVolumeResponse{}
+	resp := &proto.ControllerPublishVolumeResponse{
+		PublishContext: map[string]string{
+			PublishContextDevicePath: csi.LinuxDevicePath(volume.ID),
+		},
+	}
 	return resp, nil
 }
 
 func (s *ControllerService) ControllerUnpublishVolume(ctx context.Context, req *proto.ControllerUnpublishVolumeRequest) (*proto.ControllerUnpublishVolumeResponse, error) {
+	if req.VolumeId == "" {
+		return s.controllerUnpublishVolume(ctx, req)
+	}
+	resp, err := s.operations.run(ctx, "volume "+req.VolumeId, "unpublish "+req.NodeId, func() (interface{}, error) {
+		return s.controllerUnpublishVolume(ctx, req)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*proto.ControllerUnpublishVolumeResponse), nil
+}
+
+func (s *ControllerService) controllerUnpublishVolume(ctx context.Context, req *proto.ControllerUnpublishVolumeRequest) (*proto.ControllerUnpublishVolumeResponse, error) {
 	if req.VolumeId == "" {
 		return nil, status.Error(codes.InvalidArgument, "invalid volume id")
 	}
@@ -198,7 +628,7 @@ func (s *ControllerService) ControllerUnpublishVolume(ctx context.Context, req *
 	}
 
 	if err := s.volumeService.Detach(ctx, volume, server); err != nil {
-		code := codes.Internal
+		code := contextErrorCode(err, codes.Internal)
 		switch err {
 		case volumes.ErrVolumeNotFound: // Based on the spec it is save to assume that the call was successful if the volume is not found
 			resp := &proto.ControllerUnpublishVolumeResponse{}
@@ -253,8 +683,81 @@ func (s *ControllerService) ValidateVolumeCapabilities(ctx context.Context, req
 	return resp, nil
 }
 
-func (s *ControllerService) ListVolumes(context.Context, *proto.ListVolumesRequest) (*proto.ListVolumesResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "listing volumes is not supported")
+func (s *ControllerService) ListVolumes(ctx context.Context, req *proto.ListVolumesRequest) (*proto.ListVolumesResponse, error) {
+	if req.MaxEntries < 0 {
+		return nil, status.Error(codes.InvalidArgument, "max entries must not be negative")
+	}
+
+	// The starting token is the ID of the first volume to return. As volume
+	// IDs are never reused, the token stays valid when volumes are created or
+	// deleted between two calls.
+	var startingID uint64
+	if req.StartingToken != "" {
+		id, err := parseVolumeID(req.StartingToken)
+		if err != nil {
+			return nil, status.Error(codes.Aborted, "invalid starting token")
+		}
+		startingID = id
+	}
+
+	allVolumes, err := s.volumeService.List(ctx, volumes.ListOpts{
+		Labels: s.clusterLabels(),
+	})
+	if err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to list volumes: %s", err))
+	}
+	sort.Slice(allVolumes, func(i, j int) bool {
+		return allVolumes[i].ID < allVolumes[j].ID
+	})
+
+	resp := &proto.ListVolumesResponse{}
+	var page []*csi.Volume
+	attached := false
+	for _, volume := range allVolumes {
+		if volume.ID < startingID {
+			continue
+		}
+		if _, ok := volume.Labels[LabelSnapshotSource]; ok {
+			continue
+		}
+		if req.MaxEntries > 0 && len(page) == int(req.MaxEntries) {
+			resp.NextToken = strconv.FormatUint(volume.ID, 10)
+			break
+		}
+		page = append(page, volume)
+		attached = attached || volume.Server != nil
+	}
+
+	// The servers are listed once per page instead of being looked up per
+	// attached volume.
+	servers := make(map[uint64]*csi.Server)
+	if attached {
+		allServers, err := s.serverService.List(ctx)
+		if err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("failed to list servers: %s", err))
+		}
+		for _, server := range allServers {
+			servers[server.ID] = server
+		}
+	}
+
+	for _, volume := range page {
+		var server *csi.Server
+		if volume.Server != nil {
+			server = servers[volume.Server.ID]
+		}
+		entry := &proto.ListVolumesResponse_Entry{
+			Volume: toProtoVolume(volume),
+			Status: &proto.ListVolumesResponse_VolumeStatus{
+				VolumeCondition: s.volumeCondition(volume, server),
+			},
+		}
+		if volume.Server != nil {
+			entry.Status.PublishedNodeIds = []string{strconv.FormatUint(volume.Server.ID, 10)}
+		}
+		resp.Entries = append(resp.Entries, entry)
+	}
+	return resp, nil
 }
 
 func (s *ControllerService) GetCapacity(context.Context, *proto.GetCapacityRequest) (*proto.GetCapacityResponse, error) {
@@ -285,24 +788,238 @@ func (s *ControllerService) ControllerGetCapabilities(context.Context, *proto.Co
 					},
 				},
 			},
+			{
+				Type: &proto.ControllerServiceCapability_Rpc{
+					Rpc: &proto.ControllerServiceCapability_RPC{
+						Type: proto.ControllerServiceCapability_RPC_LIST_VOLUMES,
+					},
+				},
+			},
+			{
+				Type: &proto.ControllerServiceCapability_Rpc{
+					Rpc: &proto.ControllerServiceCapability_RPC{
+						Type: proto.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES,
+					},
+				},
+			},
+			{
+				Type: &proto.ControllerServiceCapability_Rpc{
+					Rpc: &proto.ControllerServiceCapability_RPC{
+						Type: proto.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+					},
+				},
+			},
+			{
+				Type: &proto.ControllerServiceCapability_Rpc{
+					Rpc: &proto.ControllerServiceCapability_RPC{
+						Type: proto.ControllerServiceCapability_RPC_GET_VOLUME,
+					},
+				},
+			},
+			{
+				Type: &proto.ControllerServiceCapability_Rpc{
+					Rpc: &proto.ControllerServiceCapability_RPC{
+						Type: proto.ControllerServiceCapability_RPC_CLONE_VOLUME,
+					},
+				},
+			},
+			{
+				Type: &proto.ControllerServiceCapability_Rpc{
+					Rpc: &proto.ControllerServiceCapability_RPC{
+						Type: proto.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+					},
+				},
+			},
+			{
+				Type: &proto.ControllerServiceCapability_Rpc{
+					Rpc: &proto.ControllerServiceCapability_RPC{
+						Type: proto.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+					},
+				},
+			},
 		},
 	}
 	return resp, nil
 }
 
-func (s *ControllerService) CreateSnapshot(context.Context, *proto.CreateSnapshotRequest) (*proto.CreateSnapshotResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "creating snapshots is not supported")
+func (s *ControllerService) CreateSnapshot(ctx context.Context, req *proto.CreateSnapshotRequest) (*proto.CreateSnapshotResponse, error) {
+	if req.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing name")
+	}
+	if req.SourceVolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing source volume id")
+	}
+	for key := range req.Parameters {
+		if !strings.HasPrefix(key, reservedParameterPrefix) {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid parameters: unknown parameter %q", key))
+		}
+	}
+
+	sourceVolumeID, err := parseVolumeID(req.SourceVolumeId)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "source volume not found")
+	}
+	source, err := s.volumeService.GetByID(ctx, sourceVolumeID)
+	if err != nil {
+		code := codes.Internal
+		switch err {
+		case volumes.ErrVolumeNotFound:
+			code = codes.NotFound
+		}
+		return nil, status.Error(code, fmt.Sprintf("failed to get source volume: %s", err))
+	}
+	if !s.isClusterVolume(source) {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("source volume %d is not owned by this cluster", source.ID))
+	}
+
+	snapshot, err := s.snapshotService.Create(ctx, volumes.CreateSnapshotOpts{
+		Name:           req.Name,
+		SourceVolumeID: sourceVolumeID,
+		Labels:         s.clusterLabels(),
+	})
+	if err != nil {
+		level.Error(s.logger).Log(
+			"msg", "failed to create snapshot",
+			"err", err,
+		)
+		code := codes.Internal
+		switch err {
+		case volumes.ErrVolumeNotFound:
+			code = codes.NotFound
+		case volumes.ErrAttached:
+			return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf(
+				"source volume %d is attached: it must be detached to be snapshotted, stop the pods using it first", sourceVolumeID))
+		case volumes.ErrSnapshotAlreadyExists:
+			code = codes.AlreadyExists
+		}
+		return nil, status.Error(code, fmt.Sprintf("failed to create snapshot: %s", err))
+	}
+
+	resp := &proto.CreateSnapshotResponse{
+		Snapshot: toProtoSnapshot(snapshot),
+	}
+	return resp, nil
 }
 
-func (s *ControllerService) DeleteSnapshot(context.Context, *proto.DeleteSnapshotRequest) (*proto.DeleteSnapshotResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "deleting snapshots is not supported")
+func (s *ControllerService) DeleteSnapshot(ctx context.Context, req *proto.DeleteSnapshotRequest) (*proto.DeleteSnapshotResponse, error) {
+	if req.SnapshotId == "" {
+		return nil, status.Error(codes.InvalidArgument, "invalid snapshot id")
+	}
+
+	if backupName, ok := parseBackupID(req.SnapshotId); ok {
+		if s.backupService == nil {
+			return nil, status.Error(codes.FailedPrecondition, "backups are not configured")
+		}
+		if err := s.backupService.Delete(ctx, backupName); err != nil && err != volumes.ErrBackupNotFound {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	} else if snapshotID, err := parseSnapshotID(req.SnapshotId); err == nil {
+		snapshot := &csi.Snapshot{ID: snapshotID}
+		if err := s.snapshotService.Delete(ctx, snapshot); err != nil {
+			if errors.Is(err, volumes.ErrSnapshotNotFound) {
+				return &proto.DeleteSnapshotResponse{}, nil
+			}
+			if errors.Is(err, volumes.ErrAttached) {
+				return nil, status.Error(codes.FailedPrecondition, err.Error())
+			}
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	resp := &proto.DeleteSnapshotResponse{}
+	return resp, nil
 }
 
-func (s *ControllerService) ListSnapshots(context.Context, *proto.ListSnapshotsRequest) (*proto.ListSnapshotsResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "listing snapshots is not supported")
+func (s *ControllerService) ListSnapshots(ctx context.Context, req *proto.ListSnapshotsRequest) (*proto.ListSnapshotsResponse, error) {
+	if req.MaxEntries < 0 {
+		return nil, status.Error(codes.InvalidArgument, "max entries must not be negative")
+	}
+
+	// The starting token is the ID of the first snapshot to return, see
+	// ListVolumes.
+	var startingID uint64
+	if req.StartingToken != "" {
+		id, err := parseSnapshotID(req.StartingToken)
+		if err != nil {
+			return nil, status.Error(codes.Aborted, "invalid starting token")
+		}
+		startingID = id
+	}
+
+	// Backups are only listed when asked for by ID, which is what the CO does
+	// to import them as pre-provisioned snapshots.
+	if backupName, ok := parseBackupID(req.SnapshotId); ok {
+		return s.listBackup(ctx, backupName, req.SourceVolumeId)
+	}
+
+	var snapshots []*csi.Snapshot
+	if req.SnapshotId != "" {
+		snapshotID, err := parseSnapshotID(req.SnapshotId)
+		if err != nil {
+			return &proto.ListSnapshotsResponse{}, nil
+		}
+		snapshot, err := s.snapshotService.GetByID(ctx, snapshotID)
+		if err == volumes.ErrSnapshotNotFound {
+			return &proto.ListSnapshotsResponse{}, nil
+		}
+		if err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("failed to get snapshot: %s", err))
+		}
+		if req.SourceVolumeId != "" && strconv.FormatUint(snapshot.SourceVolumeID, 10) != req.SourceVolumeId {
+			return &proto.ListSnapshotsResponse{}, nil
+		}
+		snapshots = []*csi.Snapshot{snapshot}
+	} else {
+		opts := volumes.ListSnapshotsOpts{
+			Labels: s.clusterLabels(),
+		}
+		if req.SourceVolumeId != "" {
+			sourceVolumeID, err := parseVolumeID(req.SourceVolumeId)
+			if err != nil {
+				return &proto.ListSnapshotsResponse{}, nil
+			}
+			opts.SourceVolumeID = sourceVolumeID
+		}
+		var err error
+		snapshots, err = s.snapshotService.List(ctx, opts)
+		if err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("failed to list snapshots: %s", err))
+		}
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].ID < snapshots[j].ID
+	})
+
+	resp := &proto.ListSnapshotsResponse{}
+	for _, snapshot := range snapshots {
+		if snapshot.ID < startingID {
+			continue
+		}
+		if req.MaxEntries > 0 && len(resp.Entries) == int(req.MaxEntries) {
+			resp.NextToken = formatSnapshotID(snapshot.ID)
+			break
+		}
+		resp.Entries = append(resp.Entries, &proto.ListSnapshotsResponse_Entry{
+			Snapshot: toProtoSnapshot(snapshot),
+		})
+	}
+	return resp, nil
 }
 
 func (s *ControllerService) ControllerExpandVolume(ctx context.Context, req *proto.ControllerExpandVolumeRequest) (*proto.ControllerExpandVolumeResponse, error) {
+	if req.VolumeId == "" {
+		return s.controllerExpandVolume(ctx, req)
+	}
+	resp, err := s.operations.run(ctx, "volume "+req.VolumeId, "expand "+req.GetCapacityRange().String(), func() (interface{}, error) {
+		return s.controllerExpandVolume(ctx, req)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*proto.ControllerExpandVolumeResponse), nil
+}
+
+func (s *ControllerService) controllerExpandVolume(ctx context.Context, req *proto.ControllerExpandVolumeRequest) (*proto.ControllerExpandVolumeResponse, error) {
 	if req.VolumeId == "" {
 		return nil, status.Error(codes.InvalidArgument, "invalid volume id")
 	}
@@ -319,7 +1036,7 @@ func (s *ControllerService) ControllerExpandVolume(ctx context.Context, req *pro
 	}
 
 	if err := s.volumeService.Resize(ctx, volume, minSize); err != nil {
-		code := codes.Internal
+		code := contextErrorCode(err, codes.Internal)
 		switch err {
 		case volumes.ErrVolumeNotFound:
 			code = codes.NotFound
@@ -344,5 +1061,123 @@ func (s *ControllerService) ControllerExpandVolume(ctx context.Context, req *pro
 }
 
 func (s *ControllerService) ControllerGetVolume(ctx context.Context, req *proto.ControllerGetVolumeRequest) (*proto.ControllerGetVolumeResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method ControllerGetVolume not implemented")
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "invalid volume id")
+	}
+
+	volumeID, err := parseVolumeID(req.VolumeId)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "volume not found")
+	}
+
+	volume, err := s.volumeService.GetByID(ctx, volumeID)
+	if err != nil {
+		code := codes.Internal
+		switch err {
+		case volumes.ErrVolumeNotFound:
+			code = codes.NotFound
+		}
+		return nil, status.Error(code, fmt.Sprintf("failed to get volume: %s", err))
+	}
+
+	var server *csi.Server
+	if volume.Server != nil {
+		server, err = s.serverService.GetByID(ctx, volume.Server.ID)
+		if err != nil && err != volumes.ErrServerNotFound {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("failed to get server: %s", err))
+		}
+	}
+	condition := s.volumeCondition(volume, server)
+
+	protoVolume := toProtoVolume(volume)
+	protoVolume.VolumeContext = map[string]string{
+		VolumeContextDeleteProtection: strconv.FormatBool(volume.DeleteProtection),
+	}
+	resp := &proto.ControllerGetVolumeResponse{
+		Volume: protoVolume,
+		Status: &proto.ControllerGetVolumeResponse_VolumeStatus{
+			VolumeCondition: condition,
+		},
+	}
+	if volume.Server != nil {
+		resp.Status.PublishedNodeIds = []string{strconv.FormatUint(volume.Server.ID, 10)}
+	}
+	return resp, nil
+}
+
+// volumeCondition reports whether the volume is attached to a server that
+// vanished, that does not belong to the cluster or that is located somewhere
+// else than the volume. server is the server the volume is attached to, nil
+// if it does not exist.
+func (s *ControllerService) volumeCondition(volume *csi.Volume, server *csi.Server) *proto.VolumeCondition {
+	if volume.Server == nil {
+		return &proto.VolumeCondition{Message: "volume is not attached"}
+	}
+
+	switch {
+	case server == nil:
+		return &proto.VolumeCondition{
+			Abnormal: true,
+			Message:  fmt.Sprintf("volume is attached to server %d which does not exist", volume.Server.ID),
+		}
+	case !s.isClusterServer(server):
+		return &proto.VolumeCondition{
+			Abnormal: true,
+			Message:  fmt.Sprintf("volume is attached to server %d which is not part of the cluster", server.ID),
+		}
+	case server.Location != volume.Location:
+		return &proto.VolumeCondition{
+			Abnormal: true,
+			Message: fmt.Sprintf("volume in location %s is attached to server %d in location %s",
+				volume.Location, server.ID, server.Location),
+		}
+	}
+	return &proto.VolumeCondition{
+		Message: fmt.Sprintf("volume is attached to server %d", server.ID),
+	}
+}
+
+// isClusterVolume reports whether the volume is owned by the cluster.
+func (s *ControllerService) isClusterVolume(volume *csi.Volume) bool {
+	for key, value := range s.clusterLabels() {
+		actual, ok := volume.Labels[key]
+		if !ok && s.ownUnlabeledVolumes {
+			continue
+		}
+		if actual != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *ControllerService) isClusterServer(server *csi.Server) bool {
+	for key, value := range s.clusterServerLabels {
+		if server.Labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *ControllerService) listBackup(ctx context.Context, name string, sourceVolumeID string) (*proto.ListSnapshotsResponse, error) {
+	if s.backupService == nil {
+		return &proto.ListSnapshotsResponse{}, nil
+	}
+	backup, err := s.backupService.Get(ctx, name)
+	if err == volumes.ErrBackupNotFound {
+		return &proto.ListSnapshotsResponse{}, nil
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to get backup: %s", err))
+	}
+	if sourceVolumeID != "" && strconv.FormatUint(backup.VolumeID, 10) != sourceVolumeID {
+		return &proto.ListSnapshotsResponse{}, nil
+	}
+	resp := &proto.ListSnapshotsResponse{
+		Entries: []*proto.ListSnapshotsResponse_Entry{
+			{Snapshot: toProtoBackupSnapshot(backup)},
+		},
+	}
+	return resp, nil
 }
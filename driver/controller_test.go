@@ -3,7 +3,10 @@ package driver
 import (
 	"context"
 	"io"
+	"net/url"
+	"reflect"
 	"testing"
+	"time"
 
 	proto "github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/go-kit/kit/log"
@@ -18,23 +21,43 @@ import (
 var _ proto.ControllerServer = (*ControllerService)(nil)
 
 type controllerServiceTestEnv struct {
-	ctx           context.Context
-	service       *ControllerService
-	volumeService *mock.VolumeService
+	ctx             context.Context
+	service         *ControllerService
+	volumeService   *mock.VolumeService
+	snapshotService *mock.SnapshotService
+	serverService   *mock.ServerService
+	backupService   *mock.BackupService
+	copyService     *mock.VolumeCopyService
 }
 
 func newControllerServiceTestEnv() *controllerServiceTestEnv {
 	logger := log.NewNopLogger()
 	volumeService := &mock.VolumeService{}
+	snapshotService := &mock.SnapshotService{}
+	serverService := &mock.ServerService{}
+	backupService := &mock.BackupService{}
+	copyService := &mock.VolumeCopyService{}
 
 	return &controllerServiceTestEnv{
 		ctx: context.Background(),
 		service: NewControllerService(
 			logger,
 			volumeService,
+			snapshotService,
+			serverService,
+			backupService,
+			copyService,
 			"testloc",
+			"testcluster",
+			map[string]string{"cluster": "test"},
+			false,
+			false,
 		),
-		volumeService: volumeService,
+		volumeService:   volumeService,
+		snapshotService: snapshotService,
+		serverService:   serverService,
+		backupService:   backupService,
+		copyService:     copyService,
 	}
 }
 
@@ -154,6 +177,76 @@ func TestControllerServiceCreateVolumeWithLocation(t *testing.T) {
 	}
 }
 
+func TestControllerServiceCreateVolumeWithParameters(t *testing.T) {
+	env := newControllerServiceTestEnv()
+
+	env.volumeService.CreateFunc = func(ctx context.Context, opts volumes.CreateOpts) (*csi.Volume, error) {
+		if opts.Name != "k8s-default-data" {
+			t.Errorf("unexpected name passed to volume service: %s", opts.Name)
+		}
+		expectedLabels := map[string]string{
+			"env":             "prod",
+			LabelCluster:      "testcluster",
+			LabelPVCName:      "data",
+			LabelPVCNamespace: "default",
+			LabelPVName:       "testvol",
+		}
+		if !reflect.DeepEqual(opts.Labels, expectedLabels) {
+			t.Errorf("unexpected labels passed to volume service: %v", opts.Labels)
+		}
+		if !opts.DeleteProtection {
+			t.Errorf("expected delete protection to be passed to volume service")
+		}
+		return &csi.Volume{
+			ID:       1,
+			Name:     opts.Name,
+			Size:     opts.MinSize,
+			Location: opts.Location,
+		}, nil
+	}
+
+	resp, err := env.service.CreateVolume(env.ctx, &proto.CreateVolumeRequest{
+		Name: "testvol",
+		VolumeCapabilities: []*proto.VolumeCapability{
+			&proto.VolumeCapability{
+				AccessType: &proto.VolumeCapability_Mount{
+					Mount: &proto.VolumeCapability_MountVolume{},
+				},
+				AccessMode: &proto.VolumeCapability_AccessMode{
+					Mode: proto.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+			},
+		},
+		Parameters: map[string]string{
+			ParameterFSType:           "xfs",
+			ParameterLabels:           "env=prod",
+			ParameterDeleteProtection: "true",
+			ParameterNameTemplate:     "k8s-{{ .PVCNamespace }}-{{ .PVCName }}",
+			ParameterEncrypted:        "true",
+			ParameterXFSReflink:       "true",
+			ParameterFsckPolicy:       "never",
+			parameterPVCName:          "data",
+			parameterPVCNamespace:     "default",
+			parameterPVName:           "testvol",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fsType := resp.Volume.VolumeContext[VolumeContextFSType]; fsType != "xfs" {
+		t.Errorf("unexpected fs type in volume context: %s", fsType)
+	}
+	if encrypted := resp.Volume.VolumeContext[VolumeContextEncrypted]; encrypted != "true" {
+		t.Errorf("unexpected encrypted flag in volume context: %s", encrypted)
+	}
+	if reflink := resp.Volume.VolumeContext[ParameterXFSReflink]; reflink != "true" {
+		t.Errorf("unexpected reflink in volume context: %s", reflink)
+	}
+	if policy := resp.Volume.VolumeContext[VolumeContextFsckPolicy]; policy != "never" {
+		t.Errorf("unexpected fsck policy in volume context: %s", policy)
+	}
+}
+
 func TestControllerServiceCreateVolumeInputErrors(t *testing.T) {
 	env := newControllerServiceTestEnv()
 
@@ -214,6 +307,42 @@ func TestControllerServiceCreateVolumeInputErrors(t *testing.T) {
 			},
 			Code: codes.OutOfRange,
 		},
+		{
+			Name: "unknown parameter",
+			Req: &proto.CreateVolumeRequest{
+				Name: "test",
+				VolumeCapabilities: []*proto.VolumeCapability{
+					&proto.VolumeCapability{
+						AccessType: &proto.VolumeCapability_Mount{
+							Mount: &proto.VolumeCapability_MountVolume{},
+						},
+						AccessMode: &proto.VolumeCapability_AccessMode{
+							Mode: proto.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+						},
+					},
+				},
+				Parameters: map[string]string{"foo": "bar"},
+			},
+			Code: codes.InvalidArgument,
+		},
+		{
+			Name: "encrypted block volume",
+			Req: &proto.CreateVolumeRequest{
+				Name: "test",
+				VolumeCapabilities: []*proto.VolumeCapability{
+					&proto.VolumeCapability{
+						AccessType: &proto.VolumeCapability_Block{
+							Block: &proto.VolumeCapability_BlockVolume{},
+						},
+						AccessMode: &proto.VolumeCapability_AccessMode{
+							Mode: proto.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+						},
+					},
+				},
+				Parameters: map[string]string{ParameterEncrypted: "true"},
+			},
+			Code: codes.InvalidArgument,
+		},
 		{
 			Name: "unsupported capability",
 			Req: &proto.CreateVolumeRequest{
@@ -260,6 +389,11 @@ func TestControllerServiceCreateVolumeCreateErrors(t *testing.T) {
 			CreateError: volumes.ErrVolumeAlreadyExists,
 			Code:        codes.AlreadyExists,
 		},
+		{
+			Name:        "volume still being created",
+			CreateError: volumes.ErrVolumeCreating,
+			Code:        codes.Aborted,
+		},
 		{
 			Name:        "internal error",
 			CreateError: io.EOF,
@@ -297,9 +431,253 @@ func TestControllerServiceCreateVolumeCreateErrors(t *testing.T) {
 	}
 }
 
+func TestControllerServiceCreateVolumeClone(t *testing.T) {
+	env := newControllerServiceTestEnv()
+
+	env.volumeService.GetByIDFunc = func(ctx context.Context, id uint64) (*csi.Volume, error) {
+		if id != 1 {
+			t.Errorf("unexpected source volume id: %d", id)
+		}
+		return &csi.Volume{
+			ID:       1,
+			Size:     20,
+			Location: "srcloc",
+			Labels:   map[string]string{LabelCluster: "testcluster"},
+		}, nil
+	}
+	env.volumeService.CreateFunc = func(ctx context.Context, opts volumes.CreateOpts) (*csi.Volume, error) {
+		if opts.MinSize != 20 {
+			t.Errorf("unexpected min size passed to volume service: %d", opts.MinSize)
+		}
+		if opts.Location != "srcloc" {
+			t.Errorf("unexpected location passed to volume service: %s", opts.Location)
+		}
+		if opts.Labels[LabelCloneSource] != "1" || opts.Labels[LabelCloneState] != cloneStateCopying {
+			t.Errorf("unexpected labels passed to volume service: %v", opts.Labels)
+		}
+		return &csi.Volume{
+			ID:       2,
+			Name:     opts.Name,
+			Size:     opts.MinSize,
+			Location: opts.Location,
+			Labels:   opts.Labels,
+		}, nil
+	}
+	env.copyService.CopyFunc = func(ctx context.Context, src *csi.Volume, dst *csi.Volume) error {
+		if src.ID != 1 || dst.ID != 2 {
+			t.Errorf("unexpected volumes copied: %d to %d", src.ID, dst.ID)
+		}
+		return nil
+	}
+	env.volumeService.SetLabelsFunc = func(ctx context.Context, volume *csi.Volume, labels map[string]string) error {
+		if _, ok := labels[LabelCloneState]; ok {
+			t.Errorf("clone state label not removed: %v", labels)
+		}
+		if labels[LabelCloneSource] != "1" {
+			t.Errorf("clone source label removed: %v", labels)
+		}
+		return nil
+	}
+
+	req := &proto.CreateVolumeRequest{
+		Name: "testvol",
+		VolumeCapabilities: []*proto.VolumeCapability{
+			{
+				AccessType: &proto.VolumeCapability_Mount{
+					Mount: &proto.VolumeCapability_MountVolume{},
+				},
+				AccessMode: &proto.VolumeCapability_AccessMode{
+					Mode: proto.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+			},
+		},
+		VolumeContentSource: &proto.VolumeContentSource{
+			Type: &proto.VolumeContentSource_Volume{
+				Volume: &proto.VolumeContentSource_VolumeSource{
+					VolumeId: "1",
+				},
+			},
+		},
+	}
+
+	resp, err := env.service.CreateVolume(env.ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Volume.VolumeId != "2" {
+		t.Errorf("unexpected volume id: %s", resp.Volume.VolumeId)
+	}
+	if resp.Volume.CapacityBytes != 20*GB {
+		t.Errorf("unexpected capacity: %d", resp.Volume.CapacityBytes)
+	}
+	if resp.Volume.ContentSource.GetVolume().GetVolumeId() != "1" {
+		t.Errorf("unexpected content source: %v", resp.Volume.ContentSource)
+	}
+}
+
+func TestControllerServiceCreateVolumeCloneInProgress(t *testing.T) {
+	env := newControllerServiceTestEnv()
+
+	env.volumeService.GetByIDFunc = func(ctx context.Context, id uint64) (*csi.Volume, error) {
+		return &csi.Volume{ID: 1, Size: 10, Location: "testloc", Labels: map[string]string{LabelCluster: "testcluster"}}, nil
+	}
+	env.volumeService.CreateFunc = func(ctx context.Context, opts volumes.CreateOpts) (*csi.Volume, error) {
+		return &csi.Volume{ID: 2, Size: opts.MinSize, Location: opts.Location, Labels: opts.Labels}, nil
+	}
+	release := make(chan struct{})
+	copies := 0
+	env.copyService.CopyFunc = func(ctx context.Context, src *csi.Volume, dst *csi.Volume) error {
+		copies++
+		<-release
+		return nil
+	}
+	env.volumeService.SetLabelsFunc = func(ctx context.Context, volume *csi.Volume, labels map[string]string) error {
+		return nil
+	}
+
+	req := &proto.CreateVolumeRequest{
+		Name: "testvol",
+		VolumeCapabilities: []*proto.VolumeCapability{
+			{
+				AccessType: &proto.VolumeCapability_Mount{
+					Mount: &proto.VolumeCapability_MountVolume{},
+				},
+				AccessMode: &proto.VolumeCapability_AccessMode{
+					Mode: proto.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+			},
+		},
+		VolumeContentSource: &proto.VolumeContentSource{
+			Type: &proto.VolumeContentSource_Volume{
+				Volume: &proto.VolumeContentSource_VolumeSource{
+					VolumeId: "1",
+				},
+			},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(env.ctx)
+	cancel()
+	if _, err := env.service.CreateVolume(ctx, req); grpc.Code(err) != codes.Aborted {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	close(release)
+	if _, err := env.service.CreateVolume(env.ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	if copies != 1 {
+		t.Errorf("unexpected number of copies: %d", copies)
+	}
+}
+
+func TestControllerServiceCreateVolumeCloneErrors(t *testing.T) {
+	testCases := []struct {
+		Name        string
+		SourceID    string
+		Source      *csi.Volume
+		SourceError error
+		CopyError   error
+		LimitBytes  int64
+		Code        codes.Code
+	}{
+		{
+			Name:        "source not found",
+			SourceID:    "1",
+			SourceError: volumes.ErrVolumeNotFound,
+			Code:        codes.NotFound,
+		},
+		{
+			Name:     "invalid source id",
+			SourceID: "xxx",
+			Code:     codes.NotFound,
+		},
+		{
+			Name:     "source of other cluster",
+			SourceID: "1",
+			Source:   &csi.Volume{ID: 1, Size: 10, Labels: map[string]string{LabelCluster: "othercluster"}},
+			Code:     codes.FailedPrecondition,
+		},
+		{
+			Name:     "source attached",
+			SourceID: "1",
+			Source:   &csi.Volume{ID: 1, Size: 10, Server: &csi.Server{ID: 5}, Labels: map[string]string{LabelCluster: "testcluster"}},
+			Code:     codes.FailedPrecondition,
+		},
+		{
+			Name:       "source larger than limit",
+			SourceID:   "1",
+			Source:     &csi.Volume{ID: 1, Size: 50, Labels: map[string]string{LabelCluster: "testcluster"}},
+			LimitBytes: 20 * GB,
+			Code:       codes.OutOfRange,
+		},
+		{
+			Name:      "source attached while copying",
+			SourceID:  "1",
+			Source:    &csi.Volume{ID: 1, Size: 10, Labels: map[string]string{LabelCluster: "testcluster"}},
+			CopyError: volumes.ErrAttached,
+			Code:      codes.FailedPrecondition,
+		},
+		{
+			Name:      "copy error",
+			SourceID:  "1",
+			Source:    &csi.Volume{ID: 1, Size: 10, Labels: map[string]string{LabelCluster: "testcluster"}},
+			CopyError: io.EOF,
+			Code:      codes.Internal,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			env := newControllerServiceTestEnv()
+
+			env.volumeService.GetByIDFunc = func(ctx context.Context, id uint64) (*csi.Volume, error) {
+				return testCase.Source, testCase.SourceError
+			}
+			env.volumeService.CreateFunc = func(ctx context.Context, opts volumes.CreateOpts) (*csi.Volume, error) {
+				return &csi.Volume{ID: 2, Size: opts.MinSize, Labels: opts.Labels}, nil
+			}
+			env.copyService.CopyFunc = func(ctx context.Context, src *csi.Volume, dst *csi.Volume) error {
+				return testCase.CopyError
+			}
+
+			_, err := env.service.CreateVolume(env.ctx, &proto.CreateVolumeRequest{
+				Name: "testvol",
+				CapacityRange: &proto.CapacityRange{
+					LimitBytes: testCase.LimitBytes,
+				},
+				VolumeCapabilities: []*proto.VolumeCapability{
+					{
+						AccessType: &proto.VolumeCapability_Mount{
+							Mount: &proto.VolumeCapability_MountVolume{},
+						},
+						AccessMode: &proto.VolumeCapability_AccessMode{
+							Mode: proto.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+						},
+					},
+				},
+				VolumeContentSource: &proto.VolumeContentSource{
+					Type: &proto.VolumeContentSource_Volume{
+						Volume: &proto.VolumeContentSource_VolumeSource{
+							VolumeId: testCase.SourceID,
+						},
+					},
+				},
+			})
+			if grpc.Code(err) != testCase.Code {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
 func TestControllerServiceDeleteVolume(t *testing.T) {
 	env := newControllerServiceTestEnv()
 
+	env.volumeService.GetByIDFunc = func(ctx context.Context, id uint64) (*csi.Volume, error) {
+		return &csi.Volume{ID: id, Labels: map[string]string{LabelCluster: "testcluster"}}, nil
+	}
+
 	env.volumeService.DeleteFunc = func(ctx context.Context, volume *csi.Volume) error {
 		if volume.ID != 1 {
 			t.Errorf("unexpected volume id passed to volume service: %d", volume.ID)
@@ -346,6 +724,10 @@ func TestControllerServiceDeleteVolumeInputErrors(t *testing.T) {
 func TestControllerServiceDeleteVolumeAttached(t *testing.T) {
 	env := newControllerServiceTestEnv()
 
+	env.volumeService.GetByIDFunc = func(ctx context.Context, id uint64) (*csi.Volume, error) {
+		return &csi.Volume{ID: id, Labels: map[string]string{LabelCluster: "testcluster"}}, nil
+	}
+
 	env.volumeService.DeleteFunc = func(ctx context.Context, volume *csi.Volume) error {
 		return volumes.ErrAttached
 	}
@@ -376,6 +758,10 @@ func TestControllerServiceDeleteVolumeInvalidID(t *testing.T) {
 func TestControllerServiceDeleteVolumeInternalError(t *testing.T) {
 	env := newControllerServiceTestEnv()
 
+	env.volumeService.GetByIDFunc = func(ctx context.Context, id uint64) (*csi.Volume, error) {
+		return &csi.Volume{ID: id, Labels: map[string]string{LabelCluster: "testcluster"}}, nil
+	}
+
 	env.volumeService.DeleteFunc = func(ctx context.Context, volume *csi.Volume) error {
 		return io.EOF
 	}
@@ -388,48 +774,241 @@ func TestControllerServiceDeleteVolumeInternalError(t *testing.T) {
 	}
 }
 
-func TestControllerServicePublishVolume(t *testing.T) {
-	env := newControllerServiceTestEnv()
-
-	env.volumeService.AttachFunc = func(ctx context.Context, volume *csi.Volume, server *csi.Server) error {
-		if volume.ID != 1 {
-			t.Errorf("unexpected volume id passed to volume service: %d", volume.ID)
-		}
-		if server.ID != 2 {
-			t.Errorf("unexpected server id passed to volume service: %d", server.ID)
-		}
-		return nil
-	}
-
-	req := &proto.ControllerPublishVolumeRequest{
-		VolumeId: "1",
-		NodeId:   "2",
-		VolumeCapability: &proto.VolumeCapability{
-			AccessMode: &proto.VolumeCapability_AccessMode{
-				Mode: proto.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
-			},
-		},
-	}
-	_, err := env.service.ControllerPublishVolume(env.ctx, req)
-	if err != nil {
-		t.Fatal(err)
-	}
-}
-
-func TestControllerServicePublishVolumeInputErrors(t *testing.T) {
-	env := newControllerServiceTestEnv()
-
-	env.volumeService.AttachFunc = func(ctx context.Context, volume *csi.Volume, server *csi.Server) error {
-		return nil
-	}
+func TestControllerServiceDeleteVolumePolicy(t *testing.T) {
+	owned := map[string]string{LabelCluster: "testcluster"}
 
 	testCases := []struct {
-		Name string
-		Req  *proto.ControllerPublishVolumeRequest
-		Code codes.Code
+		Name                string
+		Volume              *csi.Volume
+		VolumeError         error
+		Server              *csi.Server
+		ServerError         error
+		ForceDelete         bool
+		NoServerLabels      bool
+		OwnUnlabeledVolumes bool
+		DeleteError         error
+		Code                codes.Code
+		Lifted              bool
+		Restored            bool
+		Deleted             bool
 	}{
 		{
-			Name: "readonly",
+			Name:    "detached",
+			Volume:  &csi.Volume{ID: 1, Labels: owned},
+			Code:    codes.OK,
+			Deleted: true,
+		},
+		{
+			Name:    "attached to cluster node",
+			Volume:  &csi.Volume{ID: 1, Labels: owned, Server: &csi.Server{ID: 2}},
+			Server:  &csi.Server{ID: 2, Labels: map[string]string{"cluster": "test"}},
+			Code:    codes.OK,
+			Deleted: true,
+		},
+		{
+			Name:        "not found",
+			VolumeError: volumes.ErrVolumeNotFound,
+			Code:        codes.OK,
+		},
+		{
+			Name:        "lookup failed",
+			VolumeError: io.EOF,
+			Code:        codes.Internal,
+		},
+		{
+			Name:   "not owned",
+			Volume: &csi.Volume{ID: 1},
+			Code:   codes.FailedPrecondition,
+		},
+		{
+			Name:                "unlabeled with unlabeled volumes owned",
+			Volume:              &csi.Volume{ID: 1},
+			OwnUnlabeledVolumes: true,
+			Code:                codes.OK,
+			Deleted:             true,
+		},
+		{
+			Name:   "owned by other cluster",
+			Volume: &csi.Volume{ID: 1, Labels: map[string]string{LabelCluster: "othercluster"}},
+			Code:   codes.FailedPrecondition,
+		},
+		{
+			Name:                "owned by other cluster with unlabeled volumes owned",
+			Volume:              &csi.Volume{ID: 1, Labels: map[string]string{LabelCluster: "othercluster"}},
+			OwnUnlabeledVolumes: true,
+			Code:                codes.FailedPrecondition,
+		},
+		{
+			Name:           "attached without cluster server labels",
+			Volume:         &csi.Volume{ID: 1, Labels: owned, Server: &csi.Server{ID: 2}},
+			Server:         &csi.Server{ID: 2},
+			NoServerLabels: true,
+			Code:           codes.FailedPrecondition,
+		},
+		{
+			Name:           "detached without cluster server labels",
+			Volume:         &csi.Volume{ID: 1, Labels: owned},
+			NoServerLabels: true,
+			Code:           codes.OK,
+			Deleted:        true,
+		},
+		{
+			Name:   "attached to foreign server",
+			Volume: &csi.Volume{ID: 1, Labels: owned, Server: &csi.Server{ID: 2}},
+			Server: &csi.Server{ID: 2},
+			Code:   codes.FailedPrecondition,
+		},
+		{
+			Name:        "attached to unknown server",
+			Volume:      &csi.Volume{ID: 1, Labels: owned, Server: &csi.Server{ID: 2}},
+			ServerError: volumes.ErrServerNotFound,
+			Code:        codes.FailedPrecondition,
+		},
+		{
+			Name:        "server lookup failed",
+			Volume:      &csi.Volume{ID: 1, Labels: owned, Server: &csi.Server{ID: 2}},
+			ServerError: io.EOF,
+			Code:        codes.Internal,
+		},
+		{
+			Name:   "protected",
+			Volume: &csi.Volume{ID: 1, Labels: owned, DeleteProtection: true},
+			Code:   codes.FailedPrecondition,
+		},
+		{
+			Name: "protected with refuse policy",
+			Volume: &csi.Volume{ID: 1, DeleteProtection: true, Labels: map[string]string{
+				LabelCluster:                "testcluster",
+				LabelDeleteProtectionPolicy: DeleteProtectionPolicyRefuse,
+			}},
+			Code: codes.FailedPrecondition,
+		},
+		{
+			Name: "protected with lift policy",
+			Volume: &csi.Volume{ID: 1, DeleteProtection: true, Labels: map[string]string{
+				LabelCluster:                "testcluster",
+				LabelDeleteProtectionPolicy: DeleteProtectionPolicyLift,
+			}},
+			Code:    codes.OK,
+			Lifted:  true,
+			Deleted: true,
+		},
+		{
+			Name: "protected with lift policy delete failed",
+			Volume: &csi.Volume{ID: 1, DeleteProtection: true, Labels: map[string]string{
+				LabelCluster:                "testcluster",
+				LabelDeleteProtectionPolicy: DeleteProtectionPolicyLift,
+			}},
+			DeleteError: io.EOF,
+			Code:        codes.Internal,
+			Lifted:      true,
+			Restored:    true,
+		},
+		{
+			Name:        "forced",
+			Volume:      &csi.Volume{ID: 1, Server: &csi.Server{ID: 2}},
+			ServerError: volumes.ErrServerNotFound,
+			ForceDelete: true,
+			Code:        codes.OK,
+			Deleted:     true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			env := newControllerServiceTestEnv()
+			env.service.forceDelete = testCase.ForceDelete
+			env.service.ownUnlabeledVolumes = testCase.OwnUnlabeledVolumes
+			if testCase.NoServerLabels {
+				env.service.clusterServerLabels = nil
+			}
+
+			env.volumeService.GetByIDFunc = func(ctx context.Context, id uint64) (*csi.Volume, error) {
+				return testCase.Volume, testCase.VolumeError
+			}
+			env.serverService.GetByIDFunc = func(ctx context.Context, id uint64) (*csi.Server, error) {
+				return testCase.Server, testCase.ServerError
+			}
+			lifted, restored := false, false
+			env.volumeService.SetDeleteProtectionFunc = func(ctx context.Context, volume *csi.Volume, enabled bool) error {
+				if enabled {
+					restored = true
+				} else {
+					lifted = true
+				}
+				return nil
+			}
+			deleted := false
+			env.volumeService.DeleteFunc = func(ctx context.Context, volume *csi.Volume) error {
+				if testCase.DeleteError != nil {
+					return testCase.DeleteError
+				}
+				deleted = true
+				return nil
+			}
+
+			_, err := env.service.DeleteVolume(env.ctx, &proto.DeleteVolumeRequest{VolumeId: "1"})
+			if grpc.Code(err) != testCase.Code {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if lifted != testCase.Lifted {
+				t.Errorf("expected lifted to be %t", testCase.Lifted)
+			}
+			if restored != testCase.Restored {
+				t.Errorf("expected restored to be %t", testCase.Restored)
+			}
+			if deleted != testCase.Deleted {
+				t.Errorf("expected deleted to be %t", testCase.Deleted)
+			}
+		})
+	}
+}
+
+func TestControllerServicePublishVolume(t *testing.T) {
+	env := newControllerServiceTestEnv()
+
+	env.volumeService.AttachFunc = func(ctx context.Context, volume *csi.Volume, server *csi.Server) error {
+		if volume.ID != 1 {
+			t.Errorf("unexpected volume id passed to volume service: %d", volume.ID)
+		}
+		if server.ID != 2 {
+			t.Errorf("unexpected server id passed to volume service: %d", server.ID)
+		}
+		return nil
+	}
+
+	req := &proto.ControllerPublishVolumeRequest{
+		VolumeId: "1",
+		NodeId:   "2",
+		VolumeCapability: &proto.VolumeCapability{
+			AccessMode: &proto.VolumeCapability_AccessMode{
+				Mode: proto.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		},
+	}
+	resp, err := env.service.ControllerPublishVolume(env.ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if devicePath := resp.PublishContext[PublishContextDevicePath]; devicePath != "/dev/disk/by-id/scsi-0HC_Volume_1" {
+		t.Errorf("unexpected device path in publish context: %s", devicePath)
+	}
+}
+
+func TestControllerServicePublishVolumeInputErrors(t *testing.T) {
+	env := newControllerServiceTestEnv()
+
+	env.volumeService.AttachFunc = func(ctx context.Context, volume *csi.Volume, server *csi.Server) error {
+		return nil
+	}
+
+	testCases := []struct {
+		Name string
+		Req  *proto.ControllerPublishVolumeRequest
+		Code codes.Code
+	}{
+		{
+			Name: "readonly",
 			Req: &proto.ControllerPublishVolumeRequest{
 				VolumeId: "1",
 				NodeId:   "2",
@@ -560,6 +1139,16 @@ func TestControllerServicePublishVolumeAttachErrors(t *testing.T) {
 			AttachError: volumes.ErrLockedServer,
 			Code:        codes.Unavailable,
 		},
+		{
+			Name:        "deadline exceeded",
+			AttachError: context.DeadlineExceeded,
+			Code:        codes.DeadlineExceeded,
+		},
+		{
+			Name:        "cancelled",
+			AttachError: &url.Error{Op: "Get", URL: "https://api.hetzner.cloud/v1/volumes/1", Err: context.Canceled},
+			Code:        codes.Aborted,
+		},
 	}
 
 	for _, testCase := range testCases {
@@ -692,6 +1281,11 @@ func TestControllerServiceUnpublishVolumeDetachErrors(t *testing.T) {
 			DetachError: volumes.ErrLockedServer,
 			Code:        codes.Unavailable,
 		},
+		{
+			Name:        "deadline exceeded",
+			DetachError: context.DeadlineExceeded,
+			Code:        codes.DeadlineExceeded,
+		},
 	}
 
 	for _, testCase := range testCases {
@@ -710,96 +1304,226 @@ func TestControllerServiceUnpublishVolumeDetachErrors(t *testing.T) {
 	}
 }
 
-func TestControllerServiceControllerGetCapabilities(t *testing.T) {
+func TestControllerServiceConcurrentOperations(t *testing.T) {
 	env := newControllerServiceTestEnv()
 
-	resp, err := env.service.ControllerGetCapabilities(env.ctx, &proto.ControllerGetCapabilitiesRequest{})
+	attaching := make(chan struct{})
+	release := make(chan struct{})
+	env.volumeService.AttachFunc = func(ctx context.Context, volume *csi.Volume, server *csi.Server) error {
+		close(attaching)
+		<-release
+		return nil
+	}
+	env.volumeService.DetachFunc = func(ctx context.Context, volume *csi.Volume, server *csi.Server) error {
+		if volume.ID == 1 {
+			t.Error("unexpected detach while volume is being attached")
+		}
+		return nil
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := env.service.ControllerPublishVolume(env.ctx, &proto.ControllerPublishVolumeRequest{
+			VolumeId: "1",
+			NodeId:   "2",
+			VolumeCapability: &proto.VolumeCapability{
+				AccessMode: &proto.VolumeCapability_AccessMode{
+					Mode: proto.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+			},
+		})
+		errs <- err
+	}()
+	<-attaching
+
+	_, err := env.service.ControllerUnpublishVolume(env.ctx, &proto.ControllerUnpublishVolumeRequest{
+		VolumeId: "1",
+		NodeId:   "2",
+	})
+	if grpc.Code(err) != codes.Aborted {
+		t.Errorf("unexpected unpublish error: %v", err)
+	}
+	_, err = env.service.DeleteVolume(env.ctx, &proto.DeleteVolumeRequest{VolumeId: "1"})
+	if grpc.Code(err) != codes.Aborted {
+		t.Errorf("unexpected delete error: %v", err)
+	}
+
+	// Operations on other volumes are not blocked.
+	_, err = env.service.ControllerUnpublishVolume(env.ctx, &proto.ControllerUnpublishVolumeRequest{
+		VolumeId: "3",
+		NodeId:   "2",
+	})
+	if err != nil {
+		t.Errorf("unexpected error for other volume: %v", err)
+	}
+
+	close(release)
+	if err := <-errs; err != nil {
+		t.Errorf("unexpected publish error: %v", err)
+	}
+
+	// The volume is unlocked once the operation has completed.
+	env.volumeService.DetachFunc = func(ctx context.Context, volume *csi.Volume, server *csi.Server) error {
+		return nil
+	}
+	_, err = env.service.ControllerUnpublishVolume(env.ctx, &proto.ControllerUnpublishVolumeRequest{
+		VolumeId: "1",
+		NodeId:   "2",
+	})
+	if err != nil {
+		t.Errorf("unexpected unpublish error: %v", err)
+	}
+}
+
+func TestControllerServiceListVolumes(t *testing.T) {
+	env := newControllerServiceTestEnv()
+
+	serverLists := 0
+	env.serverService.ListFunc = func(ctx context.Context) ([]*csi.Server, error) {
+		serverLists++
+		return []*csi.Server{
+			{ID: 5, Location: "testloc", Labels: map[string]string{"cluster": "test"}},
+			{ID: 6, Location: "testloc", Labels: map[string]string{"cluster": "other"}},
+		}, nil
+	}
+	env.volumeService.ListFunc = func(ctx context.Context, opts volumes.ListOpts) ([]*csi.Volume, error) {
+		if len(opts.Labels) != 1 || opts.Labels[LabelCluster] != "testcluster" {
+			t.Errorf("unexpected labels passed to volume service: %v", opts.Labels)
+		}
+		return []*csi.Volume{
+			{ID: 3, Size: 10, Location: "testloc", Server: &csi.Server{ID: 5}},
+			{ID: 1, Size: 10, Location: "testloc", Server: &csi.Server{ID: 5}},
+			{ID: 2, Size: 20, Location: "testloc"},
+		}, nil
+	}
+
+	resp, err := env.service.ListVolumes(env.ctx, &proto.ListVolumesRequest{})
 	if err != nil {
 		t.Fatal(err)
 	}
+	if serverLists != 1 {
+		t.Errorf("expected servers to be listed once, got %d", serverLists)
+	}
+	if len(resp.Entries) != 3 {
+		t.Fatalf("unexpected number of entries: %d", len(resp.Entries))
+	}
+	if resp.NextToken != "" {
+		t.Errorf("unexpected next token: %s", resp.NextToken)
+	}
+	for i, id := range []string{"1", "2", "3"} {
+		if resp.Entries[i].Volume.VolumeId != id {
+			t.Errorf("unexpected volume id at index %d: %s", i, resp.Entries[i].Volume.VolumeId)
+		}
+	}
+	if nodeIDs := resp.Entries[0].Status.PublishedNodeIds; len(nodeIDs) != 1 || nodeIDs[0] != "5" {
+		t.Errorf("unexpected published node ids: %v", nodeIDs)
+	}
+	if nodeIDs := resp.Entries[1].Status.PublishedNodeIds; len(nodeIDs) != 0 {
+		t.Errorf("unexpected published node ids: %v", nodeIDs)
+	}
+	for _, entry := range resp.Entries {
+		if entry.Status.VolumeCondition == nil || entry.Status.VolumeCondition.Abnormal {
+			t.Errorf("unexpected volume condition: %v", entry.Status.VolumeCondition)
+		}
+	}
+}
 
-	if len(resp.Capabilities) != 3 {
-		t.Fatalf("unexpected number of capabilities: %d", len(resp.Capabilities))
+func TestControllerServiceListVolumesAbnormal(t *testing.T) {
+	env := newControllerServiceTestEnv()
+
+	env.serverService.ListFunc = func(ctx context.Context) ([]*csi.Server, error) {
+		return []*csi.Server{
+			{ID: 5, Location: "testloc", Labels: map[string]string{"cluster": "other"}},
+		}, nil
+	}
+	env.volumeService.ListFunc = func(ctx context.Context, opts volumes.ListOpts) ([]*csi.Volume, error) {
+		return []*csi.Volume{
+			{ID: 1, Size: 10, Location: "testloc", Server: &csi.Server{ID: 4}},
+			{ID: 2, Size: 10, Location: "testloc", Server: &csi.Server{ID: 5}},
+		}, nil
+	}
+
+	resp, err := env.service.ListVolumes(env.ctx, &proto.ListVolumesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range resp.Entries {
+		if !entry.Status.VolumeCondition.Abnormal {
+			t.Errorf("expected abnormal volume condition for volume %s", entry.Volume.VolumeId)
+		}
 	}
 }
 
-func TestControllerServiceValidateVolumeCapabilities(t *testing.T) {
+func TestControllerServiceListVolumesPagination(t *testing.T) {
 	env := newControllerServiceTestEnv()
 
-	env.volumeService.GetByIDFunc = func(ctx context.Context, id uint64) (*csi.Volume, error) {
-		return &csi.Volume{ID: id}, nil
+	env.volumeService.ListFunc = func(ctx context.Context, opts volumes.ListOpts) ([]*csi.Volume, error) {
+		return []*csi.Volume{
+			{ID: 1, Size: 10, Location: "testloc"},
+			{ID: 4, Size: 10, Location: "testloc"},
+			{ID: 7, Size: 10, Location: "testloc"},
+		}, nil
 	}
 
-	req := &proto.ValidateVolumeCapabilitiesRequest{
-		VolumeId: "1",
-		VolumeCapabilities: []*proto.VolumeCapability{
-			&proto.VolumeCapability{
-				AccessMode: &proto.VolumeCapability_AccessMode{
-					Mode: proto.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
-				},
-			},
-		},
+	resp, err := env.service.ListVolumes(env.ctx, &proto.ListVolumesRequest{
+		MaxEntries: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
 	}
-	resp, err := env.service.ValidateVolumeCapabilities(env.ctx, req)
+	if len(resp.Entries) != 2 {
+		t.Fatalf("unexpected number of entries: %d", len(resp.Entries))
+	}
+	if resp.NextToken != "7" {
+		t.Fatalf("unexpected next token: %s", resp.NextToken)
+	}
+
+	resp, err = env.service.ListVolumes(env.ctx, &proto.ListVolumesRequest{
+		MaxEntries:    2,
+		StartingToken: resp.NextToken,
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
-	if resp.Confirmed == nil {
-		t.Fatal("expected confirmation")
+	if len(resp.Entries) != 1 || resp.Entries[0].Volume.VolumeId != "7" {
+		t.Fatalf("unexpected entries: %v", resp.Entries)
 	}
-	if len(resp.Confirmed.VolumeCapabilities) != 1 {
-		t.Errorf("unexpected confirmed capabilities: %v", resp.Confirmed.VolumeCapabilities)
+	if resp.NextToken != "" {
+		t.Errorf("unexpected next token: %s", resp.NextToken)
 	}
 }
 
-func TestControllerServiceValidateVolumeCapabilitiesInputErrors(t *testing.T) {
+func TestControllerServiceListVolumesInputErrors(t *testing.T) {
 	env := newControllerServiceTestEnv()
 
+	env.volumeService.ListFunc = func(ctx context.Context, opts volumes.ListOpts) ([]*csi.Volume, error) {
+		return nil, nil
+	}
+
 	testCases := []struct {
 		Name string
-		Req  *proto.ValidateVolumeCapabilitiesRequest
+		Req  *proto.ListVolumesRequest
 		Code codes.Code
 	}{
 		{
-			Name: "empty volume id",
-			Req: &proto.ValidateVolumeCapabilitiesRequest{
-				VolumeId: "",
-				VolumeCapabilities: []*proto.VolumeCapability{
-					&proto.VolumeCapability{
-						AccessMode: &proto.VolumeCapability_AccessMode{
-							Mode: proto.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
-						},
-					},
-				},
-			},
-			Code: codes.InvalidArgument,
-		},
-		{
-			Name: "empty capabilities",
-			Req: &proto.ValidateVolumeCapabilitiesRequest{
-				VolumeId: "1",
+			Name: "negative max entries",
+			Req: &proto.ListVolumesRequest{
+				MaxEntries: -1,
 			},
 			Code: codes.InvalidArgument,
 		},
 		{
-			Name: "invalid volume id",
-			Req: &proto.ValidateVolumeCapabilitiesRequest{
-				VolumeId: "xxx",
-				VolumeCapabilities: []*proto.VolumeCapability{
-					&proto.VolumeCapability{
-						AccessMode: &proto.VolumeCapability_AccessMode{
-							Mode: proto.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
-						},
-					},
-				},
+			Name: "invalid starting token",
+			Req: &proto.ListVolumesRequest{
+				StartingToken: "xxx",
 			},
-			Code: codes.NotFound,
+			Code: codes.Aborted,
 		},
 	}
 
 	for _, testCase := range testCases {
 		t.Run(testCase.Name, func(t *testing.T) {
-			_, err := env.service.ValidateVolumeCapabilities(env.ctx, testCase.Req)
+			_, err := env.service.ListVolumes(env.ctx, testCase.Req)
 			if grpc.Code(err) != testCase.Code {
 				t.Fatalf("unexpected error: %v", err)
 			}
@@ -807,34 +1531,278 @@ func TestControllerServiceValidateVolumeCapabilitiesInputErrors(t *testing.T) {
 	}
 }
 
-func TestControllerServiceValidateVolumeCapabilitiesVolumeNotFound(t *testing.T) {
+func TestControllerServiceListVolumesInternalError(t *testing.T) {
 	env := newControllerServiceTestEnv()
 
-	env.volumeService.GetByIDFunc = func(ctx context.Context, id uint64) (*csi.Volume, error) {
-		return nil, nil
+	env.volumeService.ListFunc = func(ctx context.Context, opts volumes.ListOpts) ([]*csi.Volume, error) {
+		return nil, io.EOF
 	}
 
-	req := &proto.ValidateVolumeCapabilitiesRequest{
-		VolumeId: "1",
-		VolumeCapabilities: []*proto.VolumeCapability{
-			&proto.VolumeCapability{
-				AccessMode: &proto.VolumeCapability_AccessMode{
-					Mode: proto.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
-				},
-			},
-		},
-	}
-	_, err := env.service.ValidateVolumeCapabilities(env.ctx, req)
-	if grpc.Code(err) != codes.NotFound {
+	_, err := env.service.ListVolumes(env.ctx, &proto.ListVolumesRequest{})
+	if grpc.Code(err) != codes.Internal {
 		t.Fatalf("unexpected error: %v", err)
 	}
 }
 
-func TestControllerServiceValidateVolumeCapabilitiesInternalError(t *testing.T) {
+func TestControllerServiceControllerGetVolume(t *testing.T) {
 	env := newControllerServiceTestEnv()
 
 	env.volumeService.GetByIDFunc = func(ctx context.Context, id uint64) (*csi.Volume, error) {
-		return nil, io.EOF
+		if id != 1 {
+			t.Errorf("unexpected volume id passed to volume service: %d", id)
+		}
+		return &csi.Volume{ID: 1, Size: 10, Location: "testloc", Server: &csi.Server{ID: 2}, DeleteProtection: true}, nil
+	}
+	env.serverService.GetByIDFunc = func(ctx context.Context, id uint64) (*csi.Server, error) {
+		if id != 2 {
+			t.Errorf("unexpected server id passed to server service: %d", id)
+		}
+		return &csi.Server{ID: 2, Location: "testloc", Labels: map[string]string{"cluster": "test"}}, nil
+	}
+
+	resp, err := env.service.ControllerGetVolume(env.ctx, &proto.ControllerGetVolumeRequest{
+		VolumeId: "1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Volume.VolumeId != "1" {
+		t.Errorf("unexpected value for VolumeId: %s", resp.Volume.VolumeId)
+	}
+	if resp.Volume.CapacityBytes != 10*GB {
+		t.Errorf("unexpected value for CapacityBytes: %d", resp.Volume.CapacityBytes)
+	}
+	if loc := resp.Volume.AccessibleTopology[0].Segments[TopologySegmentLocation]; loc != "testloc" {
+		t.Errorf("unexpected location segment in topology: %s", loc)
+	}
+	if nodeIDs := resp.Status.PublishedNodeIds; len(nodeIDs) != 1 || nodeIDs[0] != "2" {
+		t.Errorf("unexpected published node ids: %v", nodeIDs)
+	}
+	if resp.Status.VolumeCondition.Abnormal {
+		t.Errorf("unexpected abnormal volume condition: %s", resp.Status.VolumeCondition.Message)
+	}
+	if protection := resp.Volume.VolumeContext[VolumeContextDeleteProtection]; protection != "true" {
+		t.Errorf("unexpected delete protection in volume context: %s", protection)
+	}
+}
+
+func TestControllerServiceControllerGetVolumeAbnormal(t *testing.T) {
+	env := newControllerServiceTestEnv()
+
+	testCases := []struct {
+		Name        string
+		Server      *csi.Server
+		ServerError error
+	}{
+		{
+			Name:        "server not found",
+			ServerError: volumes.ErrServerNotFound,
+		},
+		{
+			Name:   "foreign server",
+			Server: &csi.Server{ID: 2, Location: "testloc", Labels: map[string]string{"cluster": "other"}},
+		},
+		{
+			Name:   "location mismatch",
+			Server: &csi.Server{ID: 2, Location: "otherloc", Labels: map[string]string{"cluster": "test"}},
+		},
+	}
+
+	env.volumeService.GetByIDFunc = func(ctx context.Context, id uint64) (*csi.Volume, error) {
+		return &csi.Volume{ID: 1, Size: 10, Location: "testloc", Server: &csi.Server{ID: 2}}, nil
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			env.serverService.GetByIDFunc = func(ctx context.Context, id uint64) (*csi.Server, error) {
+				return testCase.Server, testCase.ServerError
+			}
+			resp, err := env.service.ControllerGetVolume(env.ctx, &proto.ControllerGetVolumeRequest{
+				VolumeId: "1",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !resp.Status.VolumeCondition.Abnormal {
+				t.Errorf("expected abnormal volume condition")
+			}
+		})
+	}
+}
+
+func TestControllerServiceControllerGetVolumeErrors(t *testing.T) {
+	env := newControllerServiceTestEnv()
+
+	testCases := []struct {
+		Name     string
+		VolumeID string
+		GetError error
+		Code     codes.Code
+	}{
+		{
+			Name:     "empty volume id",
+			VolumeID: "",
+			Code:     codes.InvalidArgument,
+		},
+		{
+			Name:     "invalid volume id",
+			VolumeID: "xxx",
+			Code:     codes.NotFound,
+		},
+		{
+			Name:     "volume not found",
+			VolumeID: "1",
+			GetError: volumes.ErrVolumeNotFound,
+			Code:     codes.NotFound,
+		},
+		{
+			Name:     "internal error",
+			VolumeID: "1",
+			GetError: io.EOF,
+			Code:     codes.Internal,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			env.volumeService.GetByIDFunc = func(ctx context.Context, id uint64) (*csi.Volume, error) {
+				return nil, testCase.GetError
+			}
+			_, err := env.service.ControllerGetVolume(env.ctx, &proto.ControllerGetVolumeRequest{
+				VolumeId: testCase.VolumeID,
+			})
+			if grpc.Code(err) != testCase.Code {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestControllerServiceControllerGetCapabilities(t *testing.T) {
+	env := newControllerServiceTestEnv()
+
+	resp, err := env.service.ControllerGetCapabilities(env.ctx, &proto.ControllerGetCapabilitiesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.Capabilities) != 10 {
+		t.Fatalf("unexpected number of capabilities: %d", len(resp.Capabilities))
+	}
+}
+
+func TestControllerServiceValidateVolumeCapabilities(t *testing.T) {
+	env := newControllerServiceTestEnv()
+
+	env.volumeService.GetByIDFunc = func(ctx context.Context, id uint64) (*csi.Volume, error) {
+		return &csi.Volume{ID: id}, nil
+	}
+
+	req := &proto.ValidateVolumeCapabilitiesRequest{
+		VolumeId: "1",
+		VolumeCapabilities: []*proto.VolumeCapability{
+			&proto.VolumeCapability{
+				AccessMode: &proto.VolumeCapability_AccessMode{
+					Mode: proto.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+			},
+		},
+	}
+	resp, err := env.service.ValidateVolumeCapabilities(env.ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Confirmed == nil {
+		t.Fatal("expected confirmation")
+	}
+	if len(resp.Confirmed.VolumeCapabilities) != 1 {
+		t.Errorf("unexpected confirmed capabilities: %v", resp.Confirmed.VolumeCapabilities)
+	}
+}
+
+func TestControllerServiceValidateVolumeCapabilitiesInputErrors(t *testing.T) {
+	env := newControllerServiceTestEnv()
+
+	testCases := []struct {
+		Name string
+		Req  *proto.ValidateVolumeCapabilitiesRequest
+		Code codes.Code
+	}{
+		{
+			Name: "empty volume id",
+			Req: &proto.ValidateVolumeCapabilitiesRequest{
+				VolumeId: "",
+				VolumeCapabilities: []*proto.VolumeCapability{
+					&proto.VolumeCapability{
+						AccessMode: &proto.VolumeCapability_AccessMode{
+							Mode: proto.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+						},
+					},
+				},
+			},
+			Code: codes.InvalidArgument,
+		},
+		{
+			Name: "empty capabilities",
+			Req: &proto.ValidateVolumeCapabilitiesRequest{
+				VolumeId: "1",
+			},
+			Code: codes.InvalidArgument,
+		},
+		{
+			Name: "invalid volume id",
+			Req: &proto.ValidateVolumeCapabilitiesRequest{
+				VolumeId: "xxx",
+				VolumeCapabilities: []*proto.VolumeCapability{
+					&proto.VolumeCapability{
+						AccessMode: &proto.VolumeCapability_AccessMode{
+							Mode: proto.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+						},
+					},
+				},
+			},
+			Code: codes.NotFound,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			_, err := env.service.ValidateVolumeCapabilities(env.ctx, testCase.Req)
+			if grpc.Code(err) != testCase.Code {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestControllerServiceValidateVolumeCapabilitiesVolumeNotFound(t *testing.T) {
+	env := newControllerServiceTestEnv()
+
+	env.volumeService.GetByIDFunc = func(ctx context.Context, id uint64) (*csi.Volume, error) {
+		return nil, nil
+	}
+
+	req := &proto.ValidateVolumeCapabilitiesRequest{
+		VolumeId: "1",
+		VolumeCapabilities: []*proto.VolumeCapability{
+			&proto.VolumeCapability{
+				AccessMode: &proto.VolumeCapability_AccessMode{
+					Mode: proto.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+			},
+		},
+	}
+	_, err := env.service.ValidateVolumeCapabilities(env.ctx, req)
+	if grpc.Code(err) != codes.NotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestControllerServiceValidateVolumeCapabilitiesInternalError(t *testing.T) {
+	env := newControllerServiceTestEnv()
+
+	env.volumeService.GetByIDFunc = func(ctx context.Context, id uint64) (*csi.Volume, error) {
+		return nil, io.EOF
 	}
 
 	req := &proto.ValidateVolumeCapabilitiesRequest{
@@ -878,3 +1846,506 @@ func TestControllerServiceValidateVolumeCapabilitiesUnsupportedCapability(t *tes
 		t.Errorf("unexpected confirmation: %v", resp.Confirmed)
 	}
 }
+
+func TestControllerServiceCreateSnapshot(t *testing.T) {
+	env := newControllerServiceTestEnv()
+
+	created := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	env.volumeService.GetByIDFunc = func(ctx context.Context, id uint64) (*csi.Volume, error) {
+		return &csi.Volume{ID: id, Labels: map[string]string{LabelCluster: "testcluster"}}, nil
+	}
+	env.snapshotService.CreateFunc = func(ctx context.Context, opts volumes.CreateSnapshotOpts) (*csi.Snapshot, error) {
+		if opts.Name != "testsnap" {
+			t.Errorf("unexpected name passed to snapshot service: %s", opts.Name)
+		}
+		if opts.SourceVolumeID != 1 {
+			t.Errorf("unexpected source volume id passed to snapshot service: %d", opts.SourceVolumeID)
+		}
+		if !reflect.DeepEqual(opts.Labels, map[string]string{LabelCluster: "testcluster"}) {
+			t.Errorf("unexpected labels passed to snapshot service: %v", opts.Labels)
+		}
+		return &csi.Snapshot{
+			ID:             2,
+			Name:           opts.Name,
+			SourceVolumeID: opts.SourceVolumeID,
+			Size:           10,
+			Created:        created,
+		}, nil
+	}
+
+	resp, err := env.service.CreateSnapshot(env.ctx, &proto.CreateSnapshotRequest{
+		Name:           "testsnap",
+		SourceVolumeId: "1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Snapshot.SnapshotId != "snap-2" {
+		t.Errorf("unexpected snapshot id: %s", resp.Snapshot.SnapshotId)
+	}
+	if resp.Snapshot.SourceVolumeId != "1" {
+		t.Errorf("unexpected source volume id: %s", resp.Snapshot.SourceVolumeId)
+	}
+	if resp.Snapshot.SizeBytes != 10*GB {
+		t.Errorf("unexpected size: %d", resp.Snapshot.SizeBytes)
+	}
+	if resp.Snapshot.CreationTime.GetSeconds() != created.Unix() {
+		t.Errorf("unexpected creation time: %v", resp.Snapshot.CreationTime)
+	}
+	if resp.Snapshot.ReadyToUse {
+		t.Error("unexpected ready to use")
+	}
+}
+
+func TestControllerServiceCreateSnapshotErrors(t *testing.T) {
+	testCases := []struct {
+		Name        string
+		Req         *proto.CreateSnapshotRequest
+		Source      *csi.Volume
+		SourceError error
+		CreateError error
+		Code        codes.Code
+	}{
+		{
+			Name: "empty name",
+			Req:  &proto.CreateSnapshotRequest{SourceVolumeId: "1"},
+			Code: codes.InvalidArgument,
+		},
+		{
+			Name: "empty source volume id",
+			Req:  &proto.CreateSnapshotRequest{Name: "testsnap"},
+			Code: codes.InvalidArgument,
+		},
+		{
+			Name: "unknown parameter",
+			Req: &proto.CreateSnapshotRequest{
+				Name:           "testsnap",
+				SourceVolumeId: "1",
+				Parameters:     map[string]string{"foo": "bar"},
+			},
+			Code: codes.InvalidArgument,
+		},
+		{
+			Name: "invalid source volume id",
+			Req:  &proto.CreateSnapshotRequest{Name: "testsnap", SourceVolumeId: "xxx"},
+			Code: codes.NotFound,
+		},
+		{
+			Name:        "source volume not found",
+			Req:         &proto.CreateSnapshotRequest{Name: "testsnap", SourceVolumeId: "1"},
+			SourceError: volumes.ErrVolumeNotFound,
+			Code:        codes.NotFound,
+		},
+		{
+			Name:   "source volume of other cluster",
+			Req:    &proto.CreateSnapshotRequest{Name: "testsnap", SourceVolumeId: "1"},
+			Source: &csi.Volume{ID: 1, Labels: map[string]string{LabelCluster: "othercluster"}},
+			Code:   codes.FailedPrecondition,
+		},
+		{
+			Name:        "source volume attached",
+			Req:         &proto.CreateSnapshotRequest{Name: "testsnap", SourceVolumeId: "1"},
+			CreateError: volumes.ErrAttached,
+			Code:        codes.FailedPrecondition,
+		},
+		{
+			Name:        "snapshot already exists",
+			Req:         &proto.CreateSnapshotRequest{Name: "testsnap", SourceVolumeId: "1"},
+			CreateError: volumes.ErrSnapshotAlreadyExists,
+			Code:        codes.AlreadyExists,
+		},
+		{
+			Name:        "internal error",
+			Req:         &proto.CreateSnapshotRequest{Name: "testsnap", SourceVolumeId: "1"},
+			CreateError: io.EOF,
+			Code:        codes.Internal,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			env := newControllerServiceTestEnv()
+			env.volumeService.GetByIDFunc = func(ctx context.Context, id uint64) (*csi.Volume, error) {
+				if testCase.SourceError != nil {
+					return nil, testCase.SourceError
+				}
+				if testCase.Source != nil {
+					return testCase.Source, nil
+				}
+				return &csi.Volume{ID: id, Labels: map[string]string{LabelCluster: "testcluster"}}, nil
+			}
+			env.snapshotService.CreateFunc = func(ctx context.Context, opts volumes.CreateSnapshotOpts) (*csi.Snapshot, error) {
+				return nil, testCase.CreateError
+			}
+
+			_, err := env.service.CreateSnapshot(env.ctx, testCase.Req)
+			if grpc.Code(err) != testCase.Code {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestControllerServiceDeleteSnapshot(t *testing.T) {
+	testCases := []struct {
+		Name        string
+		SnapshotID  string
+		DeleteError error
+		Code        codes.Code
+	}{
+		{
+			Name:       "success",
+			SnapshotID: "snap-2",
+			Code:       codes.OK,
+		},
+		{
+			Name:        "not found",
+			SnapshotID:  "snap-2",
+			DeleteError: volumes.ErrSnapshotNotFound,
+			Code:        codes.OK,
+		},
+		{
+			Name:       "volume id",
+			SnapshotID: "2",
+			Code:       codes.OK,
+		},
+		{
+			Name: "empty id",
+			Code: codes.InvalidArgument,
+		},
+		{
+			Name:        "in use",
+			SnapshotID:  "snap-2",
+			DeleteError: volumes.ErrAttached,
+			Code:        codes.FailedPrecondition,
+		},
+		{
+			Name:        "internal error",
+			SnapshotID:  "snap-2",
+			DeleteError: io.EOF,
+			Code:        codes.Internal,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			env := newControllerServiceTestEnv()
+			env.snapshotService.DeleteFunc = func(ctx context.Context, snapshot *csi.Snapshot) error {
+				if snapshot.ID != 2 {
+					t.Errorf("unexpected snapshot id passed to snapshot service: %d", snapshot.ID)
+				}
+				return testCase.DeleteError
+			}
+
+			_, err := env.service.DeleteSnapshot(env.ctx, &proto.DeleteSnapshotRequest{
+				SnapshotId: testCase.SnapshotID,
+			})
+			if grpc.Code(err) != testCase.Code {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestControllerServiceListSnapshots(t *testing.T) {
+	env := newControllerServiceTestEnv()
+
+	env.snapshotService.ListFunc = func(ctx context.Context, opts volumes.ListSnapshotsOpts) ([]*csi.Snapshot, error) {
+		if opts.SourceVolumeID != 1 {
+			t.Errorf("unexpected source volume id passed to snapshot service: %d", opts.SourceVolumeID)
+		}
+		return []*csi.Snapshot{
+			{ID: 4, SourceVolumeID: 1, Size: 10, ReadyToUse: true},
+			{ID: 2, SourceVolumeID: 1, Size: 10, ReadyToUse: true},
+			{ID: 3, SourceVolumeID: 1, Size: 10},
+		}, nil
+	}
+
+	resp, err := env.service.ListSnapshots(env.ctx, &proto.ListSnapshotsRequest{
+		SourceVolumeId: "1",
+		MaxEntries:     2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Entries) != 2 {
+		t.Fatalf("unexpected number of entries: %d", len(resp.Entries))
+	}
+	if resp.Entries[0].Snapshot.SnapshotId != "snap-2" || resp.Entries[1].Snapshot.SnapshotId != "snap-3" {
+		t.Errorf("unexpected entries: %v", resp.Entries)
+	}
+	if resp.NextToken != "snap-4" {
+		t.Errorf("unexpected next token: %s", resp.NextToken)
+	}
+
+	resp, err = env.service.ListSnapshots(env.ctx, &proto.ListSnapshotsRequest{
+		SourceVolumeId: "1",
+		StartingToken:  resp.NextToken,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Entries) != 1 || resp.Entries[0].Snapshot.SnapshotId != "snap-4" {
+		t.Errorf("unexpected entries: %v", resp.Entries)
+	}
+	if resp.NextToken != "" {
+		t.Errorf("unexpected next token: %s", resp.NextToken)
+	}
+}
+
+func TestControllerServiceListSnapshotsByID(t *testing.T) {
+	testCases := []struct {
+		Name         string
+		Req          *proto.ListSnapshotsRequest
+		GetByIDError error
+		Entries      int
+		Code         codes.Code
+	}{
+		{
+			Name:    "found",
+			Req:     &proto.ListSnapshotsRequest{SnapshotId: "snap-2"},
+			Entries: 1,
+		},
+		{
+			Name:         "not found",
+			Req:          &proto.ListSnapshotsRequest{SnapshotId: "snap-2"},
+			GetByIDError: volumes.ErrSnapshotNotFound,
+		},
+		{
+			Name: "invalid id",
+			Req:  &proto.ListSnapshotsRequest{SnapshotId: "2"},
+		},
+		{
+			Name: "other source volume",
+			Req:  &proto.ListSnapshotsRequest{SnapshotId: "snap-2", SourceVolumeId: "5"},
+		},
+		{
+			Name:         "internal error",
+			Req:          &proto.ListSnapshotsRequest{SnapshotId: "snap-2"},
+			GetByIDError: io.EOF,
+			Code:         codes.Internal,
+		},
+		{
+			Name: "invalid starting token",
+			Req:  &proto.ListSnapshotsRequest{StartingToken: "xxx"},
+			Code: codes.Aborted,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			env := newControllerServiceTestEnv()
+			env.snapshotService.GetByIDFunc = func(ctx context.Context, id uint64) (*csi.Snapshot, error) {
+				if testCase.GetByIDError != nil {
+					return nil, testCase.GetByIDError
+				}
+				return &csi.Snapshot{ID: id, SourceVolumeID: 1, Size: 10}, nil
+			}
+
+			resp, err := env.service.ListSnapshots(env.ctx, testCase.Req)
+			if grpc.Code(err) != testCase.Code {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err == nil && len(resp.Entries) != testCase.Entries {
+				t.Errorf("unexpected number of entries: %d", len(resp.Entries))
+			}
+		})
+	}
+}
+
+func TestControllerServiceCreateVolumeFromSnapshot(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Snapshot *csi.Snapshot
+		Code     codes.Code
+	}{
+		{
+			Name:     "ready",
+			Snapshot: &csi.Snapshot{ID: 2, SourceVolumeID: 1, Size: 20, Location: "srcloc", ReadyToUse: true},
+			Code:     codes.OK,
+		},
+		{
+			Name:     "not ready",
+			Snapshot: &csi.Snapshot{ID: 2, SourceVolumeID: 1, Size: 20, Location: "srcloc"},
+			Code:     codes.Unavailable,
+		},
+		{
+			Name: "not found",
+			Code: codes.NotFound,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			env := newControllerServiceTestEnv()
+			env.snapshotService.GetByIDFunc = func(ctx context.Context, id uint64) (*csi.Snapshot, error) {
+				if testCase.Snapshot == nil {
+					return nil, volumes.ErrSnapshotNotFound
+				}
+				return testCase.Snapshot, nil
+			}
+			env.volumeService.CreateFunc = func(ctx context.Context, opts volumes.CreateOpts) (*csi.Volume, error) {
+				if opts.MinSize != 20 || opts.Location != "srcloc" {
+					t.Errorf("unexpected options passed to volume service: %v", opts)
+				}
+				if opts.Labels[LabelCloneSource] != "snap-2" {
+					t.Errorf("unexpected labels passed to volume service: %v", opts.Labels)
+				}
+				return &csi.Volume{ID: 3, Size: opts.MinSize, Location: opts.Location, Labels: opts.Labels}, nil
+			}
+			env.copyService.CopyFunc = func(ctx context.Context, src *csi.Volume, dst *csi.Volume) error {
+				if src.ID != 2 || dst.ID != 3 {
+					t.Errorf("unexpected volumes copied: %d to %d", src.ID, dst.ID)
+				}
+				return nil
+			}
+			env.volumeService.SetLabelsFunc = func(ctx context.Context, volume *csi.Volume, labels map[string]string) error {
+				return nil
+			}
+
+			resp, err := env.service.CreateVolume(env.ctx, &proto.CreateVolumeRequest{
+				Name: "testvol",
+				VolumeCapabilities: []*proto.VolumeCapability{
+					{
+						AccessType: &proto.VolumeCapability_Mount{
+							Mount: &proto.VolumeCapability_MountVolume{},
+						},
+						AccessMode: &proto.VolumeCapability_AccessMode{
+							Mode: proto.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+						},
+					},
+				},
+				VolumeContentSource: &proto.VolumeContentSource{
+					Type: &proto.VolumeContentSource_Snapshot{
+						Snapshot: &proto.VolumeContentSource_SnapshotSource{
+							SnapshotId: "snap-2",
+						},
+					},
+				},
+			})
+			if grpc.Code(err) != testCase.Code {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err == nil && resp.Volume.ContentSource.GetSnapshot().GetSnapshotId() != "snap-2" {
+				t.Errorf("unexpected content source: %v", resp.Volume.ContentSource)
+			}
+		})
+	}
+}
+
+func TestControllerServiceCreateVolumeFromBackup(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Backup *csi.Backup
+		Block  bool
+		Code   codes.Code
+	}{
+		{
+			Name:   "filesystem",
+			Backup: &csi.Backup{Name: "test", VolumeID: 1, Mode: csi.BackupModeFilesystem, Size: 20},
+			Code:   codes.OK,
+		},
+		{
+			Name:   "block",
+			Backup: &csi.Backup{Name: "test", VolumeID: 1, Mode: csi.BackupModeBlock, Size: 20},
+			Block:  true,
+			Code:   codes.OK,
+		},
+		{
+			Name:   "filesystem to block volume",
+			Backup: &csi.Backup{Name: "test", VolumeID: 1, Mode: csi.BackupModeFilesystem, Size: 20},
+			Block:  true,
+			Code:   codes.InvalidArgument,
+		},
+		{
+			Name: "not found",
+			Code: codes.NotFound,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			env := newControllerServiceTestEnv()
+			env.backupService.GetFunc = func(ctx context.Context, name string) (*csi.Backup, error) {
+				if name != "test" {
+					t.Errorf("unexpected backup name: %s", name)
+				}
+				if testCase.Backup == nil {
+					return nil, volumes.ErrBackupNotFound
+				}
+				return testCase.Backup, nil
+			}
+			env.volumeService.CreateFunc = func(ctx context.Context, opts volumes.CreateOpts) (*csi.Volume, error) {
+				if opts.MinSize != 20 {
+					t.Errorf("unexpected options passed to volume service: %v", opts)
+				}
+				return &csi.Volume{ID: 2, Size: opts.MinSize, Location: "testloc"}, nil
+			}
+
+			capability := &proto.VolumeCapability{
+				AccessType: &proto.VolumeCapability_Mount{
+					Mount: &proto.VolumeCapability_MountVolume{},
+				},
+				AccessMode: &proto.VolumeCapability_AccessMode{
+					Mode: proto.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+			}
+			if testCase.Block {
+				capability.AccessType = &proto.VolumeCapability_Block{Block: &proto.VolumeCapability_BlockVolume{}}
+			}
+			resp, err := env.service.CreateVolume(env.ctx, &proto.CreateVolumeRequest{
+				Name:               "testvol",
+				VolumeCapabilities: []*proto.VolumeCapability{capability},
+				VolumeContentSource: &proto.VolumeContentSource{
+					Type: &proto.VolumeContentSource_Snapshot{
+						Snapshot: &proto.VolumeContentSource_SnapshotSource{
+							SnapshotId: "backup-test",
+						},
+					},
+				},
+			})
+			if grpc.Code(err) != testCase.Code {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err != nil {
+				return
+			}
+			if resp.Volume.VolumeContext[VolumeContextBackup] != "test" {
+				t.Errorf("unexpected volume context: %v", resp.Volume.VolumeContext)
+			}
+			if resp.Volume.ContentSource.GetSnapshot().GetSnapshotId() != "backup-test" {
+				t.Errorf("unexpected content source: %v", resp.Volume.ContentSource)
+			}
+		})
+	}
+}
+
+func TestControllerServiceListSnapshotsBackup(t *testing.T) {
+	env := newControllerServiceTestEnv()
+	env.backupService.GetFunc = func(ctx context.Context, name string) (*csi.Backup, error) {
+		if name != "test" {
+			return nil, volumes.ErrBackupNotFound
+		}
+		return &csi.Backup{Name: "test", VolumeID: 1, Mode: csi.BackupModeBlock, Size: 20}, nil
+	}
+
+	resp, err := env.service.ListSnapshots(env.ctx, &proto.ListSnapshotsRequest{SnapshotId: "backup-test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Entries) != 1 {
+		t.Fatalf("unexpected number of entries: %d", len(resp.Entries))
+	}
+	snapshot := resp.Entries[0].Snapshot
+	if snapshot.SnapshotId != "backup-test" || snapshot.SourceVolumeId != "1" || !snapshot.ReadyToUse {
+		t.Errorf("unexpected snapshot: %v", snapshot)
+	}
+
+	resp, err = env.service.ListSnapshots(env.ctx, &proto.ListSnapshotsRequest{SnapshotId: "backup-missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Entries) != 0 {
+		t.Errorf("unexpected entries: %v", resp.Entries)
+	}
+}
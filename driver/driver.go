@@ -1,5 +1,7 @@
 package driver
 
+import "github.com/hetznercloud/csi-driver/volumes"
+
 const (
 	PluginName    = "csi.hetzner.cloud"
 	PluginVersion = "1.5.2"
@@ -9,4 +11,40 @@ const (
 	DefaultVolumeSize = MinVolumeSize
 
 	TopologySegmentLocation = PluginName + "/location"
+
+	// Labels added to every volume created by the driver.
+	LabelCluster      = PluginName + "/cluster"
+	LabelPVCName      = PluginName + "/pvc-name"
+	LabelPVCNamespace = PluginName + "/pvc-namespace"
+	LabelPVName       = PluginName + "/pv-name"
+
+	// Labels added to volumes cloned from another volume. The clone state
+	// label is removed once the contents have been copied.
+	LabelCloneSource = PluginName + "/clone-source"
+	LabelCloneState  = PluginName + "/clone-state"
+
+	// Labels of the volumes holding snapshots. The snapshot state label is
+	// removed once the contents have been copied.
+	LabelSnapshotSource = PluginName + "/snapshot-source"
+	LabelSnapshotState  = PluginName + "/snapshot-state"
+
+	// LabelDeleteProtectionPolicy stores what DeleteVolume does with a
+	// volume protected against deletion.
+	LabelDeleteProtectionPolicy = PluginName + "/delete-protection-policy"
+
+	// Labels journaling the creation of a volume. The provisioning state
+	// label is removed once the volume is ready, the request hash tells
+	// whether a retried CreateVolume call is identical to the original one.
+	LabelProvisioningState = PluginName + "/provisioning-state"
+	LabelRequestHash       = PluginName + "/request-hash"
+
+	// cloneStateCopying is the value of LabelCloneState while the contents
+	// of the source volume are copied.
+	cloneStateCopying = "copying"
 )
+
+// SnapshotLabels are the labels of the volumes holding snapshots.
+var SnapshotLabels = volumes.SnapshotLabels{
+	Source: LabelSnapshotSource,
+	State:  LabelSnapshotState,
+}
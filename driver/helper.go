@@ -1,15 +1,67 @@
 package driver
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"math"
 	"strconv"
+	"strings"
 
 	proto "github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"google.golang.org/grpc/codes"
+
+	"github.com/hetznercloud/csi-driver/csi"
 )
 
 func parseVolumeID(id string) (uint64, error) { return strconv.ParseUint(id, 10, 64) }
 func parseNodeID(id string) (uint64, error)   { return strconv.ParseUint(id, 10, 64) }
 
+// snapshotIDPrefix tells snapshot IDs apart from the IDs of the volumes
+// holding the snapshots.
+const snapshotIDPrefix = "snap-"
+
+func parseSnapshotID(id string) (uint64, error) {
+	if !strings.HasPrefix(id, snapshotIDPrefix) {
+		return 0, fmt.Errorf("invalid snapshot id %q", id)
+	}
+	return strconv.ParseUint(strings.TrimPrefix(id, snapshotIDPrefix), 10, 64)
+}
+
+func formatSnapshotID(id uint64) string {
+	return snapshotIDPrefix + strconv.FormatUint(id, 10)
+}
+
+// backupIDPrefix marks snapshot IDs referring to backups in object storage.
+// The prefix is followed by the name of the backup.
+const backupIDPrefix = "backup-"
+
+func parseBackupID(id string) (string, bool) {
+	if !strings.HasPrefix(id, backupIDPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(id, backupIDPrefix), true
+}
+
+// ParseLabels parses a comma separated list of key=value pairs.
+func ParseLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		key := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || key == "" {
+			return nil, fmt.Errorf("invalid label %q, expected key=value", pair)
+		}
+		labels[key] = strings.TrimSpace(kv[1])
+	}
+	return labels, nil
+}
+
 func volumeSizeFromCapacityRange(cr *proto.CapacityRange) (int, int, bool) {
 	if cr == nil {
 		return DefaultVolumeSize, 0, true
@@ -73,3 +125,56 @@ func locationFromTopologyRequirement(tr *proto.TopologyRequirement) *string {
 	}
 	return nil
 }
+
+func toProtoVolume(volume *csi.Volume) *proto.Volume {
+	return &proto.Volume{
+		VolumeId:      strconv.FormatUint(volume.ID, 10),
+		CapacityBytes: volume.SizeBytes(),
+		AccessibleTopology: []*proto.Topology{
+			{
+				Segments: map[string]string{
+					TopologySegmentLocation: volume.Location,
+				},
+			},
+		},
+	}
+}
+
+func toProtoSnapshot(snapshot *csi.Snapshot) *proto.Snapshot {
+	return &proto.Snapshot{
+		SnapshotId:     formatSnapshotID(snapshot.ID),
+		SourceVolumeId: strconv.FormatUint(snapshot.SourceVolumeID, 10),
+		SizeBytes:      snapshot.SizeBytes(),
+		CreationTime: &timestamp.Timestamp{
+			Seconds: snapshot.Created.Unix(),
+			Nanos:   int32(snapshot.Created.Nanosecond()),
+		},
+		ReadyToUse: snapshot.ReadyToUse,
+	}
+}
+
+func toProtoBackupSnapshot(backup *csi.Backup) *proto.Snapshot {
+	return &proto.Snapshot{
+		SnapshotId:     backupIDPrefix + backup.Name,
+		SourceVolumeId: strconv.FormatUint(backup.VolumeID, 10),
+		SizeBytes:      backup.SizeBytes(),
+		CreationTime: &timestamp.Timestamp{
+			Seconds: backup.Created.Unix(),
+			Nanos:   int32(backup.Created.Nanosecond()),
+		},
+		ReadyToUse: true,
+	}
+}
+
+// contextErrorCode returns the code for errors caused by the deadline of
+// the request being exceeded or the request being cancelled, and fallback
+// for all other errors.
+func contextErrorCode(err error, fallback codes.Code) codes.Code {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return codes.DeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		return codes.Aborted
+	}
+	return fallback
+}
@@ -1,6 +1,7 @@
 package driver
 
 import (
+	"reflect"
 	"testing"
 
 	proto "github.com/container-storage-interface/spec/lib/go/csi"
@@ -118,3 +119,47 @@ func TestVolumeSizeFromCapacityRange(t *testing.T) {
 		})
 	}
 }
+
+func TestParseLabels(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Input  string
+		Labels map[string]string
+		OK     bool
+	}{
+		{
+			Name:   "empty",
+			Input:  "",
+			Labels: map[string]string{},
+			OK:     true,
+		},
+		{
+			Name:   "multiple labels",
+			Input:  "a=b, c=d,e=",
+			Labels: map[string]string{"a": "b", "c": "d", "e": ""},
+			OK:     true,
+		},
+		{
+			Name:  "missing value",
+			Input: "a=b,c",
+			OK:    false,
+		},
+		{
+			Name:  "missing key",
+			Input: "=b",
+			OK:    false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			labels, err := ParseLabels(testCase.Input)
+			if (err == nil) != testCase.OK {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(labels, testCase.Labels) && testCase.OK {
+				t.Fatalf("unexpected labels: %v", labels)
+			}
+		})
+	}
+}
@@ -2,8 +2,11 @@ package driver
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"path/filepath"
 	"strconv"
+	"strings"
 
 	proto "github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/go-kit/kit/log"
@@ -11,33 +14,44 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
+	"github.com/hetznercloud/csi-driver/csi"
 	"github.com/hetznercloud/csi-driver/volumes"
 )
 
 type NodeService struct {
 	logger              log.Logger
 	server              *hcloud.Server
-	volumeService       volumes.Service
 	volumeMountService  volumes.MountService
 	volumeResizeService volumes.ResizeService
 	volumeStatsService  volumes.StatsService
+
+	// backupService is nil if no object storage has been configured.
+	backupService volumes.BackupService
+
+	// inFlight rejects overlapping operations on the same volume or path.
+	inFlight *inFlight
+	// restores runs the restores of backups to volumes, which may take
+	// longer than a single request.
+	restores *restores
 }
 
 func NewNodeService(
 	logger log.Logger,
 	server *hcloud.Server,
-	volumeService volumes.Service,
 	volumeMountService volumes.MountService,
 	volumeResizeService volumes.ResizeService,
 	volumeStatsService volumes.StatsService,
+	backupService volumes.BackupService,
 ) *NodeService {
 	return &NodeService{
 		logger:              logger,
 		server:              server,
-		volumeService:       volumeService,
 		volumeMountService:  volumeMountService,
 		volumeResizeService: volumeResizeService,
 		volumeStatsService:  volumeStatsService,
+		backupService:       backupService,
+		inFlight:            newInFlight(),
+		restores:            newRestores(),
 	}
 }
 
@@ -57,18 +71,53 @@ func (s *NodeService) NodeStageVolume(ctx context.Context, req *proto.NodeStageV
 		return nil, status.Error(codes.NotFound, "volume not found")
 	}
 
-	volume, err := s.volumeService.GetByID(ctx, volumeID)
+	volume, err := nodeVolume(volumeID, req.PublishContext)
 	if err != nil {
-		switch err {
-		case volumes.ErrVolumeNotFound:
-			return nil, status.Error(codes.NotFound, "volume not found")
-		default:
-			return nil, status.Error(codes.Internal, fmt.Sprintf("failed to get volume: %s", err))
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("stage volume: %s", err))
+	}
+
+	unlock, err := s.inFlight.lock("volume "+req.VolumeId, "path "+req.StagingTargetPath)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	encrypted := req.VolumeContext[VolumeContextEncrypted] == "true"
+
+	// Block backups are written to the device before it is staged,
+	// filesystem backups are extracted once the volume has been staged.
+	var backup *csi.Backup
+	if backupName := req.VolumeContext[VolumeContextBackup]; backupName != "" {
+		if s.backupService == nil {
+			return nil, status.Error(codes.FailedPrecondition, "stage volume: backups are not configured")
+		}
+		backup, err = s.backupService.Get(ctx, backupName)
+		if err != nil {
+			code := codes.Internal
+			switch err {
+			case volumes.ErrBackupNotFound:
+				code = codes.FailedPrecondition
+			}
+			return nil, status.Error(code, fmt.Sprintf("stage volume: failed to get backup: %s", err))
+		}
+		if backup.Mode == csi.BackupModeBlock {
+			if err := s.volumeMountService.VerifyDevice(ctx, volume); err != nil {
+				return nil, status.Error(deviceErrorCode(err), fmt.Sprintf("stage volume: %s", err))
+			}
+			if err := s.restore(ctx, req.VolumeId, backup.Name, volumes.RestoreOpts{Device: volume.LinuxDevice}); err != nil {
+				return nil, err
+			}
 		}
 	}
 
 	switch {
 	case req.VolumeCapability.GetBlock() != nil:
+		if encrypted {
+			return nil, status.Error(codes.InvalidArgument, "stage volume: encryption is not supported for block volumes")
+		}
+		if backup != nil && backup.Mode == csi.BackupModeFilesystem {
+			return nil, status.Error(codes.InvalidArgument, "stage volume: filesystem backups cannot be restored to block volumes")
+		}
 		return &proto.NodeStageVolumeResponse{}, nil
 	case req.VolumeCapability.GetMount() != nil:
 		mount := req.VolumeCapability.GetMount()
@@ -76,8 +125,45 @@ func (s *NodeService) NodeStageVolume(ctx context.Context, req *proto.NodeStageV
 			FSType:     mount.FsType,
 			Additional: mount.MountFlags,
 		}
-		if err := s.volumeMountService.Stage(volume, req.StagingTargetPath, opts); err != nil {
-			return nil, status.Error(codes.Internal, fmt.Sprintf("failed to stage volume: %s", err))
+		if opts.FSType == "" {
+			opts.FSType = req.VolumeContext[VolumeContextFSType]
+		}
+		if err := volumes.ValidateMountFlags(opts.FSType, opts.Additional); err != nil {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("stage volume: %s", err))
+		}
+		if opts.Format, err = parseFormatOpts(req.VolumeContext); err != nil {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("stage volume: %s", err))
+		}
+		fsType := opts.FSType
+		if fsType == "" {
+			fsType = volumes.DefaultFSType
+		}
+		if err := opts.Format.Validate(fsType); err != nil {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("stage volume: %s", err))
+		}
+		if policy, ok := req.VolumeContext[VolumeContextFsckPolicy]; ok {
+			if err := validateFsckPolicy(policy); err != nil {
+				return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("stage volume: invalid %s: %s", VolumeContextFsckPolicy, err))
+			}
+			opts.FsckPolicy = policy
+		}
+		if encrypted {
+			opts.EncryptionPassphrase = req.Secrets[SecretEncryptionPassphrase]
+			if opts.EncryptionPassphrase == "" {
+				return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("stage volume: missing secret %s for encrypted volume", SecretEncryptionPassphrase))
+			}
+		}
+		if err := s.volumeMountService.Stage(ctx, volume, req.StagingTargetPath, opts); err != nil {
+			code := deviceErrorCode(err)
+			if errors.Is(err, volumes.ErrFilesystemMismatch) || errors.Is(err, volumes.ErrFilesystemErrors) {
+				code = codes.FailedPrecondition
+			}
+			return nil, status.Error(code, fmt.Sprintf("failed to stage volume: %s", err))
+		}
+		if backup != nil && backup.Mode == csi.BackupModeFilesystem {
+			if err := s.restore(ctx, req.VolumeId, backup.Name, volumes.RestoreOpts{Path: req.StagingTargetPath}); err != nil {
+				return nil, err
+			}
 		}
 		return &proto.NodeStageVolumeResponse{}, nil
 	default:
@@ -93,21 +179,24 @@ func (s *NodeService) NodeUnstageVolume(ctx context.Context, req *proto.NodeUnst
 		return nil, status.Error(codes.InvalidArgument, "missing staging target path")
 	}
 
+	// The mounts are cleaned up no matter whether the volume still exists.
 	volumeID, err := parseVolumeID(req.VolumeId)
 	if err != nil {
 		return nil, status.Error(codes.NotFound, "volume not found")
 	}
+	volume := &csi.Volume{ID: volumeID, LinuxDevice: csi.LinuxDevicePath(volumeID)}
 
-	volume, err := s.volumeService.GetByID(ctx, volumeID)
+	unlock, err := s.inFlight.lock("volume "+req.VolumeId, "path "+req.StagingTargetPath)
 	if err != nil {
-		switch err {
-		case volumes.ErrVolumeNotFound:
-			return &proto.NodeUnstageVolumeResponse{}, nil
-		default:
-			return nil, status.Error(codes.Internal, fmt.Sprintf("failed to get volume: %s", err))
-		}
+		return nil, err
 	}
+	defer unlock()
 
+	// A filesystem backup must not be extracted to the staging target path
+	// once the volume has been unmounted from it.
+	if err := s.restores.forget("volume " + req.VolumeId); err != nil {
+		return nil, err
+	}
 	if err := s.volumeMountService.Unstage(volume, req.StagingTargetPath); err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to unstage volume: %s", err))
 	}
@@ -132,18 +221,22 @@ func (s *NodeService) NodePublishVolume(ctx context.Context, req *proto.NodePubl
 		return nil, status.Error(codes.NotFound, "volume not found")
 	}
 
-	volume, err := s.volumeService.GetByID(ctx, volumeID)
+	volume, err := nodeVolume(volumeID, req.PublishContext)
 	if err != nil {
-		switch err {
-		case volumes.ErrVolumeNotFound:
-			return nil, status.Error(codes.NotFound, "volume not found")
-		default:
-			return nil, status.Error(codes.Internal, fmt.Sprintf("failed to get volume: %s", err))
-		}
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("publish volume: %s", err))
+	}
+
+	unlock, err := s.inFlight.lock("volume "+req.VolumeId, "path "+req.TargetPath)
+	if err != nil {
+		return nil, err
 	}
+	defer unlock()
 
 	switch {
 	case req.VolumeCapability.GetBlock() != nil:
+		if err := s.volumeMountService.VerifyDevice(ctx, volume); err != nil {
+			return nil, status.Error(deviceErrorCode(err), fmt.Sprintf("publish volume: %s", err))
+		}
 		opts := volumes.MountOpts{BlockVolume: true}
 		if err := s.volumeMountService.Publish(volume, req.TargetPath, volume.LinuxDevice, opts); err != nil {
 			return nil, status.Error(codes.Internal, fmt.Sprintf("failed to publish block volume: %s", err))
@@ -156,6 +249,12 @@ func (s *NodeService) NodePublishVolume(ctx context.Context, req *proto.NodePubl
 			Readonly:   req.Readonly,
 			Additional: mount.MountFlags,
 		}
+		if opts.FSType == "" {
+			opts.FSType = req.VolumeContext[VolumeContextFSType]
+		}
+		if err := volumes.ValidateMountFlags(opts.FSType, opts.Additional); err != nil {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("publish volume: %s", err))
+		}
 		if err := s.volumeMountService.Publish(volume, req.TargetPath, req.StagingTargetPath, opts); err != nil {
 			return nil, status.Error(codes.Internal, fmt.Sprintf("failed to publish volume: %s", err))
 		}
@@ -173,22 +272,18 @@ func (s *NodeService) NodeUnpublishVolume(ctx context.Context, req *proto.NodeUn
 		return nil, status.Error(codes.InvalidArgument, "missing target path")
 	}
 
-	volumeID, err := parseVolumeID(req.VolumeId)
-	if err != nil {
+	// The mounts are cleaned up no matter whether the volume still exists.
+	if _, err := parseVolumeID(req.VolumeId); err != nil {
 		return nil, status.Error(codes.NotFound, "volume not found")
 	}
 
-	volume, err := s.volumeService.GetByID(ctx, volumeID)
+	unlock, err := s.inFlight.lock("volume "+req.VolumeId, "path "+req.TargetPath)
 	if err != nil {
-		switch err {
-		case volumes.ErrVolumeNotFound:
-			return &proto.NodeUnpublishVolumeResponse{}, nil
-		default:
-			return nil, status.Error(codes.Internal, fmt.Sprintf("failed to get volume: %s", err))
-		}
+		return nil, err
 	}
+	defer unlock()
 
-	if err := s.volumeMountService.Unpublish(volume, req.TargetPath); err != nil {
+	if err := s.volumeMountService.Unpublish(req.TargetPath); err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to unpublish volume: %s", err))
 	}
 
@@ -222,7 +317,7 @@ func (s *NodeService) NodeGetVolumeStats(ctx context.Context, req *proto.NodeGet
 		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to get volume inode stats: %s", err))
 	}
 
-	return &proto.NodeGetVolumeStatsResponse{
+	resp := &proto.NodeGetVolumeStatsResponse{
 		Usage: []*proto.VolumeUsage{
 			{
 				Unit:      proto.VolumeUsage_BYTES,
@@ -230,14 +325,18 @@ func (s *NodeService) NodeGetVolumeStats(ctx context.Context, req *proto.NodeGet
 				Total:     totalBytes,
 				Used:      usedBytes,
 			},
-			{
-				Unit:      proto.VolumeUsage_INODES,
-				Available: freeINodes,
-				Total:     totalINodes,
-				Used:      usedINodes,
-			},
 		},
-	}, nil
+	}
+	// Filesystems allocating inodes dynamically, like btrfs, report none.
+	if totalINodes > 0 {
+		resp.Usage = append(resp.Usage, &proto.VolumeUsage{
+			Unit:      proto.VolumeUsage_INODES,
+			Available: freeINodes,
+			Total:     totalINodes,
+			Used:      usedINodes,
+		})
+	}
+	return resp, nil
 }
 
 func (s *NodeService) NodeGetCapabilities(ctx context.Context, req *proto.NodeGetCapabilitiesRequest) (*proto.NodeGetCapabilitiesResponse, error) {
@@ -300,15 +399,13 @@ func (s *NodeService) NodeExpandVolume(ctx context.Context, req *proto.NodeExpan
 		return nil, status.Error(codes.NotFound, "volume not found")
 	}
 
-	volume, err := s.volumeService.GetByID(ctx, volumeID)
+	volume := &csi.Volume{ID: volumeID, LinuxDevice: csi.LinuxDevicePath(volumeID)}
+
+	unlock, err := s.inFlight.lock("volume "+req.VolumeId, "path "+req.VolumePath)
 	if err != nil {
-		switch err {
-		case volumes.ErrVolumeNotFound:
-			return nil, status.Error(codes.NotFound, "volume not found")
-		default:
-			return nil, status.Error(codes.Internal, fmt.Sprintf("failed to get volume: %s", err))
-		}
+		return nil, err
 	}
+	defer unlock()
 
 	volumeExists, err := s.volumeMountService.PathExists(volume.LinuxDevice)
 	if err != nil {
@@ -318,11 +415,55 @@ func (s *NodeService) NodeExpandVolume(ctx context.Context, req *proto.NodeExpan
 		return nil, status.Error(codes.Unavailable, fmt.Sprintf("volume %s is not available on this node %v", volume.LinuxDevice, s.server.ID))
 	}
 
-	if err := s.volumeResizeService.Resize(volume, req.VolumePath); err != nil {
+	size, err := s.volumeResizeService.Resize(volume, req.VolumePath)
+	if err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to resize volume: %s", err))
 	}
 	resp := &proto.NodeExpandVolumeResponse{
-		CapacityBytes: volume.SizeBytes(),
+		CapacityBytes: size,
 	}
 	return resp, nil
 }
+
+// restore restores the backup to the volume in the background. It fails with
+// Aborted while the restore is still running when ctx is done, so the CO
+// retries staging until the restore has finished.
+func (s *NodeService) restore(ctx context.Context, volumeID string, backupName string, opts volumes.RestoreOpts) error {
+	err := s.restores.run(ctx, "volume "+volumeID, func(ctx context.Context) error {
+		return s.backupService.Restore(ctx, backupName, opts)
+	})
+	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			return err
+		}
+		return status.Error(codes.Internal, fmt.Sprintf("stage volume: %s", err))
+	}
+	return nil
+}
+
+// nodeVolume returns the volume as far as the node needs to know it without
+// asking the API. The device path is taken from the publish context if the
+// controller passed one and derived from the volume ID otherwise.
+func nodeVolume(volumeID uint64, publishContext map[string]string) (*csi.Volume, error) {
+	device := csi.LinuxDevicePath(volumeID)
+	if path, ok := publishContext[PublishContextDevicePath]; ok {
+		device = filepath.Clean(path)
+		if !strings.HasPrefix(device, "/dev/") {
+			return nil, fmt.Errorf("invalid device path %q in publish context", path)
+		}
+	}
+	return &csi.Volume{ID: volumeID, LinuxDevice: device}, nil
+}
+
+// deviceErrorCode returns the code of an error verifying the device of a
+// volume. A missing device is retried by the CO, a device belonging to another
+// volume is not.
+func deviceErrorCode(err error) codes.Code {
+	switch {
+	case errors.Is(err, volumes.ErrDeviceNotFound):
+		return codes.Unavailable
+	case errors.Is(err, volumes.ErrDeviceMismatch):
+		return codes.FailedPrecondition
+	}
+	return codes.Internal
+}
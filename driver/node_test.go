@@ -2,6 +2,7 @@ package driver
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"testing"
 
@@ -22,9 +23,10 @@ type nodeServiceTestEnv struct {
 	ctx                 context.Context
 	service             *NodeService
 	server              *hcloud.Server
-	volumeService       *mock.VolumeService
 	volumeMountService  *mock.VolumeMountService
 	volumeResizeService *mock.VolumeResizeService
+	volumeStatsService  *mock.VolumeStatsService
+	backupService       *mock.BackupService
 }
 
 func newNodeServerTestEnv() nodeServiceTestEnv {
@@ -37,42 +39,34 @@ func newNodeServerTestEnv() nodeServiceTestEnv {
 				},
 			},
 		}
-		volumeService       = &mock.VolumeService{}
 		volumeMountService  = &mock.VolumeMountService{}
 		volumeResizeService = &mock.VolumeResizeService{}
 		volumeStatsService  = &mock.VolumeStatsService{}
+		backupService       = &mock.BackupService{}
 	)
 	return nodeServiceTestEnv{
 		ctx: context.Background(),
 		service: NewNodeService(
 			log.NewNopLogger(),
 			server,
-			volumeService,
 			volumeMountService,
 			volumeResizeService,
 			volumeStatsService,
+			backupService,
 		),
 		server:              server,
-		volumeService:       volumeService,
 		volumeMountService:  volumeMountService,
 		volumeResizeService: volumeResizeService,
+		volumeStatsService:  volumeStatsService,
+		backupService:       backupService,
 	}
 }
 
 func TestNodeServiceNodeStageVolume(t *testing.T) {
 	env := newNodeServerTestEnv()
 
-	existingVolume := &csi.Volume{}
-
-	env.volumeService.GetByIDFunc = func(ctx context.Context, id uint64) (*csi.Volume, error) {
-		if id != 1 {
-			t.Errorf("unexpected volume id passed to volume service: %d", id)
-		}
-		return existingVolume, nil
-	}
-
-	env.volumeMountService.StageFunc = func(volume *csi.Volume, stagingTargetPath string, opts volumes.MountOpts) error {
-		if volume != existingVolume {
+	env.volumeMountService.StageFunc = func(ctx context.Context, volume *csi.Volume, stagingTargetPath string, opts volumes.MountOpts) error {
+		if volume.ID != 1 || volume.LinuxDevice != "/dev/sdb" {
 			t.Errorf("unexpected volume passed to volume mount service: %v", volume)
 		}
 		if stagingTargetPath != "staging" {
@@ -81,15 +75,25 @@ func TestNodeServiceNodeStageVolume(t *testing.T) {
 		if opts.FSType != "ext4" {
 			t.Errorf("unexpected fs type in mount options: %s", opts.FSType)
 		}
-		if len(opts.Additional) != 2 || opts.Additional[0] != "flag1" || opts.Additional[1] != "flag2" {
+		if len(opts.Additional) != 2 || opts.Additional[0] != "noatime" || opts.Additional[1] != "discard" {
 			t.Errorf("unexpected additional options in mount options: %v", opts.Additional)
 		}
+		if opts.Format.Label != "data" || opts.Format.InodeRatio != 65536 {
+			t.Errorf("unexpected format options in mount options: %v", opts.Format)
+		}
 		return nil
 	}
 
 	_, err := env.service.NodeStageVolume(env.ctx, &proto.NodeStageVolumeRequest{
 		VolumeId:          "1",
 		StagingTargetPath: "staging",
+		PublishContext: map[string]string{
+			PublishContextDevicePath: "/dev/sdb",
+		},
+		VolumeContext: map[string]string{
+			ParameterFSLabel:        "data",
+			ParameterExt4InodeRatio: "65536",
+		},
 		VolumeCapability: &proto.VolumeCapability{
 			AccessMode: &proto.VolumeCapability_AccessMode{
 				Mode: proto.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
@@ -97,7 +101,7 @@ func TestNodeServiceNodeStageVolume(t *testing.T) {
 			AccessType: &proto.VolumeCapability_Mount{
 				Mount: &proto.VolumeCapability_MountVolume{
 					FsType:     "ext4",
-					MountFlags: []string{"flag1", "flag2"},
+					MountFlags: []string{"noatime", "discard"},
 				},
 			},
 		},
@@ -110,12 +114,32 @@ func TestNodeServiceNodeStageVolume(t *testing.T) {
 func TestNodeServiceNodeStageBlockVolume(t *testing.T) {
 	env := newNodeServerTestEnv()
 
-	existingVolume := &csi.Volume{ID: 1}
-	env.volumeService.GetByIDFunc = func(_ context.Context, id uint64) (*csi.Volume, error) {
-		if id != existingVolume.ID {
-			t.Errorf("unexpected volume id: %d", id)
+	_, err := env.service.NodeStageVolume(env.ctx, &proto.NodeStageVolumeRequest{
+		VolumeId:          "1",
+		StagingTargetPath: "staging",
+		VolumeCapability: &proto.VolumeCapability{
+			AccessMode: &proto.VolumeCapability_AccessMode{
+				Mode: proto.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+			AccessType: &proto.VolumeCapability_Block{Block: &proto.VolumeCapability_BlockVolume{}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNodeServiceNodeStageEncryptedVolume(t *testing.T) {
+	env := newNodeServerTestEnv()
+
+	env.volumeMountService.StageFunc = func(ctx context.Context, volume *csi.Volume, stagingTargetPath string, opts volumes.MountOpts) error {
+		if opts.EncryptionPassphrase != "secret" {
+			t.Errorf("unexpected encryption passphrase in mount options: %s", opts.EncryptionPassphrase)
 		}
-		return existingVolume, nil
+		if opts.FSType != "xfs" {
+			t.Errorf("unexpected fs type in mount options: %s", opts.FSType)
+		}
+		return nil
 	}
 
 	_, err := env.service.NodeStageVolume(env.ctx, &proto.NodeStageVolumeRequest{
@@ -125,7 +149,16 @@ func TestNodeServiceNodeStageBlockVolume(t *testing.T) {
 			AccessMode: &proto.VolumeCapability_AccessMode{
 				Mode: proto.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
 			},
-			AccessType: &proto.VolumeCapability_Block{Block: &proto.VolumeCapability_BlockVolume{}},
+			AccessType: &proto.VolumeCapability_Mount{
+				Mount: &proto.VolumeCapability_MountVolume{},
+			},
+		},
+		VolumeContext: map[string]string{
+			VolumeContextFSType:    "xfs",
+			VolumeContextEncrypted: "true",
+		},
+		Secrets: map[string]string{
+			SecretEncryptionPassphrase: "secret",
 		},
 	})
 	if err != nil {
@@ -133,16 +166,262 @@ func TestNodeServiceNodeStageBlockVolume(t *testing.T) {
 	}
 }
 
-func TestNodeServiceNodeStageVolumeNotFound(t *testing.T) {
+func TestNodeServiceNodeStageEncryptedVolumeInputErrors(t *testing.T) {
+	env := newNodeServerTestEnv()
+
+	testCases := []struct {
+		Name       string
+		Capability *proto.VolumeCapability
+		Secrets    map[string]string
+	}{
+		{
+			Name: "missing passphrase",
+			Capability: &proto.VolumeCapability{
+				AccessMode: &proto.VolumeCapability_AccessMode{
+					Mode: proto.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+				AccessType: &proto.VolumeCapability_Mount{
+					Mount: &proto.VolumeCapability_MountVolume{},
+				},
+			},
+		},
+		{
+			Name: "block volume",
+			Capability: &proto.VolumeCapability{
+				AccessMode: &proto.VolumeCapability_AccessMode{
+					Mode: proto.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+				AccessType: &proto.VolumeCapability_Block{Block: &proto.VolumeCapability_BlockVolume{}},
+			},
+			Secrets: map[string]string{
+				SecretEncryptionPassphrase: "secret",
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			_, err := env.service.NodeStageVolume(env.ctx, &proto.NodeStageVolumeRequest{
+				VolumeId:          "1",
+				StagingTargetPath: "staging",
+				VolumeCapability:  testCase.Capability,
+				VolumeContext: map[string]string{
+					VolumeContextEncrypted: "true",
+				},
+				Secrets: testCase.Secrets,
+			})
+			if grpc.Code(err) != codes.InvalidArgument {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestNodeServiceNodeStageVolumeFromBackup(t *testing.T) {
+	testCases := []struct {
+		Name       string
+		Mode       string
+		Block      bool
+		VerifyErr  error
+		RestoreErr error
+		Code       codes.Code
+	}{
+		{Name: "filesystem", Mode: csi.BackupModeFilesystem, Code: codes.OK},
+		{Name: "block", Mode: csi.BackupModeBlock, Code: codes.OK},
+		{Name: "block to other device", Mode: csi.BackupModeBlock, VerifyErr: volumes.ErrDeviceMismatch, Code: codes.FailedPrecondition},
+		{Name: "block to missing device", Mode: csi.BackupModeBlock, VerifyErr: volumes.ErrDeviceNotFound, Code: codes.Unavailable},
+		{Name: "block to block volume", Mode: csi.BackupModeBlock, Block: true, Code: codes.OK},
+		{Name: "filesystem to block volume", Mode: csi.BackupModeFilesystem, Block: true, Code: codes.InvalidArgument},
+		{Name: "restore error", Mode: csi.BackupModeFilesystem, RestoreErr: io.ErrUnexpectedEOF, Code: codes.Internal},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			env := newNodeServerTestEnv()
+
+			verified := false
+			env.volumeMountService.VerifyDeviceFunc = func(ctx context.Context, volume *csi.Volume) error {
+				verified = true
+				return testCase.VerifyErr
+			}
+			staged := false
+			env.volumeMountService.StageFunc = func(ctx context.Context, volume *csi.Volume, stagingTargetPath string, opts volumes.MountOpts) error {
+				staged = true
+				return nil
+			}
+			env.backupService.GetFunc = func(ctx context.Context, name string) (*csi.Backup, error) {
+				if name != "test" {
+					t.Errorf("unexpected backup name: %s", name)
+				}
+				return &csi.Backup{Name: name, VolumeID: 2, Mode: testCase.Mode, Size: 10}, nil
+			}
+			restored := false
+			env.backupService.RestoreFunc = func(ctx context.Context, name string, opts volumes.RestoreOpts) error {
+				restored = true
+				switch testCase.Mode {
+				case csi.BackupModeBlock:
+					if staged {
+						t.Error("block backup restored after staging")
+					}
+					if !verified || testCase.VerifyErr != nil {
+						t.Error("block backup restored to unverified device")
+					}
+					if opts.Device != "/dev/disk/by-id/scsi-0HC_Volume_1" {
+						t.Errorf("unexpected device: %s", opts.Device)
+					}
+				case csi.BackupModeFilesystem:
+					if !staged {
+						t.Error("filesystem backup restored before staging")
+					}
+					if opts.Path != "staging" {
+						t.Errorf("unexpected path: %s", opts.Path)
+					}
+				}
+				return testCase.RestoreErr
+			}
+
+			capability := &proto.VolumeCapability{
+				AccessMode: &proto.VolumeCapability_AccessMode{
+					Mode: proto.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+				AccessType: &proto.VolumeCapability_Mount{
+					Mount: &proto.VolumeCapability_MountVolume{},
+				},
+			}
+			if testCase.Block {
+				capability.AccessType = &proto.VolumeCapability_Block{Block: &proto.VolumeCapability_BlockVolume{}}
+			}
+			_, err := env.service.NodeStageVolume(env.ctx, &proto.NodeStageVolumeRequest{
+				VolumeId:          "1",
+				StagingTargetPath: "staging",
+				VolumeCapability:  capability,
+				VolumeContext:     map[string]string{VolumeContextBackup: "test"},
+			})
+			if grpc.Code(err) != testCase.Code {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if testCase.Code == codes.OK && !restored {
+				t.Error("backup not restored")
+			}
+		})
+	}
+}
+
+func TestNodeServiceNodeStageVolumeFromBackupInterrupted(t *testing.T) {
 	env := newNodeServerTestEnv()
 
-	env.volumeService.GetByIDFunc = func(ctx context.Context, id uint64) (*csi.Volume, error) {
-		return nil, volumes.ErrVolumeNotFound
+	env.volumeMountService.StageFunc = func(ctx context.Context, volume *csi.Volume, stagingTargetPath string, opts volumes.MountOpts) error {
+		return nil
+	}
+	env.volumeMountService.UnstageFunc = func(volume *csi.Volume, stagingTargetPath string) error {
+		return nil
+	}
+	env.backupService.GetFunc = func(ctx context.Context, name string) (*csi.Backup, error) {
+		return &csi.Backup{Name: name, VolumeID: 2, Mode: csi.BackupModeFilesystem, Size: 10}, nil
+	}
+	restores := 0
+	started := make(chan struct{})
+	release := make(chan struct{})
+	restored := make(chan error, 1)
+	env.backupService.RestoreFunc = func(ctx context.Context, name string, opts volumes.RestoreOpts) error {
+		restores++
+		close(started)
+		<-release
+		// The restore must not be canceled with the request which
+		// started it.
+		restored <- ctx.Err()
+		return ctx.Err()
+	}
+
+	req := &proto.NodeStageVolumeRequest{
+		VolumeId:          "1",
+		StagingTargetPath: "staging",
+		VolumeCapability: &proto.VolumeCapability{
+			AccessMode: &proto.VolumeCapability_AccessMode{
+				Mode: proto.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+			AccessType: &proto.VolumeCapability_Mount{
+				Mount: &proto.VolumeCapability_MountVolume{},
+			},
+		},
+		VolumeContext: map[string]string{VolumeContextBackup: "test"},
+	}
+	unstageReq := &proto.NodeUnstageVolumeRequest{VolumeId: "1", StagingTargetPath: "staging"}
+
+	ctx, cancel := context.WithCancel(env.ctx)
+	go func() {
+		<-started
+		cancel()
+	}()
+	if _, err := env.service.NodeStageVolume(ctx, req); grpc.Code(err) != codes.Aborted {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := env.service.NodeUnstageVolume(env.ctx, unstageReq); grpc.Code(err) != codes.Aborted {
+		t.Fatalf("unexpected error unstaging volume during restore: %v", err)
+	}
+
+	close(release)
+	if err := <-restored; err != nil {
+		t.Fatalf("restore canceled: %v", err)
+	}
+	if _, err := env.service.NodeStageVolume(env.ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	if restores != 1 {
+		t.Errorf("expected the restore to continue, got %d restores", restores)
+	}
+	if _, err := env.service.NodeUnstageVolume(env.ctx, unstageReq); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNodeServiceNodeStageVolumeFromBackupErrors(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		GetErr error
+		Code   codes.Code
+	}{
+		{Name: "backup not found", GetErr: volumes.ErrBackupNotFound, Code: codes.FailedPrecondition},
+		{Name: "object storage error", GetErr: io.ErrUnexpectedEOF, Code: codes.Internal},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			env := newNodeServerTestEnv()
+
+			env.backupService.GetFunc = func(ctx context.Context, name string) (*csi.Backup, error) {
+				return nil, testCase.GetErr
+			}
+
+			_, err := env.service.NodeStageVolume(env.ctx, &proto.NodeStageVolumeRequest{
+				VolumeId:          "1",
+				StagingTargetPath: "staging",
+				VolumeCapability: &proto.VolumeCapability{
+					AccessMode: &proto.VolumeCapability_AccessMode{
+						Mode: proto.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+					},
+					AccessType: &proto.VolumeCapability_Mount{
+						Mount: &proto.VolumeCapability_MountVolume{},
+					},
+				},
+				VolumeContext: map[string]string{VolumeContextBackup: "test"},
+			})
+			if grpc.Code(err) != testCase.Code {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
 	}
+}
+
+func TestNodeServiceNodeStageVolumeInvalidDevicePath(t *testing.T) {
+	env := newNodeServerTestEnv()
 
 	_, err := env.service.NodeStageVolume(env.ctx, &proto.NodeStageVolumeRequest{
 		VolumeId:          "1",
 		StagingTargetPath: "staging",
+		PublishContext: map[string]string{
+			PublishContextDevicePath: "/dev/../etc/passwd",
+		},
 		VolumeCapability: &proto.VolumeCapability{
 			AccessMode: &proto.VolumeCapability_AccessMode{
 				Mode: proto.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
@@ -150,12 +429,12 @@ func TestNodeServiceNodeStageVolumeNotFound(t *testing.T) {
 			AccessType: &proto.VolumeCapability_Mount{
 				Mount: &proto.VolumeCapability_MountVolume{
 					FsType:     "ext4",
-					MountFlags: []string{"flag1", "flag2"},
+					MountFlags: []string{"noatime", "discard"},
 				},
 			},
 		},
 	})
-	if grpc.Code(err) != codes.NotFound {
+	if grpc.Code(err) != codes.InvalidArgument {
 		t.Fatalf("unexpected error: %v", err)
 	}
 }
@@ -163,11 +442,7 @@ func TestNodeServiceNodeStageVolumeNotFound(t *testing.T) {
 func TestNodeServiceNodeStageVolumeStageError(t *testing.T) {
 	env := newNodeServerTestEnv()
 
-	env.volumeService.GetByIDFunc = func(ctx context.Context, id uint64) (*csi.Volume, error) {
-		return &csi.Volume{}, nil
-	}
-
-	env.volumeMountService.StageFunc = func(volume *csi.Volume, stagingTargetPath string, opts volumes.MountOpts) error {
+	env.volumeMountService.StageFunc = func(ctx context.Context, volume *csi.Volume, stagingTargetPath string, opts volumes.MountOpts) error {
 		return io.EOF
 	}
 
@@ -181,7 +456,7 @@ func TestNodeServiceNodeStageVolumeStageError(t *testing.T) {
 			AccessType: &proto.VolumeCapability_Mount{
 				Mount: &proto.VolumeCapability_MountVolume{
 					FsType:     "ext4",
-					MountFlags: []string{"flag1", "flag2"},
+					MountFlags: []string{"noatime", "discard"},
 				},
 			},
 		},
@@ -191,12 +466,75 @@ func TestNodeServiceNodeStageVolumeStageError(t *testing.T) {
 	}
 }
 
-func TestNodeServiceNodeStageVolumeInputErrors(t *testing.T) {
-	env := newNodeServerTestEnv()
+func TestNodeServiceNodeStageVolumeStageErrors(t *testing.T) {
+	testCases := []struct {
+		Name       string
+		StageError error
+		Code       codes.Code
+	}{
+		{
+			Name:       "device not found",
+			StageError: fmt.Errorf("%w: /dev/sdb did not appear within 30s", volumes.ErrDeviceNotFound),
+			Code:       codes.Unavailable,
+		},
+		{
+			Name:       "device mismatch",
+			StageError: fmt.Errorf("%w: /dev/sdb resolves to /dev/sdc with serial \"2\", expected volume 1", volumes.ErrDeviceMismatch),
+			Code:       codes.FailedPrecondition,
+		},
+		{
+			Name:       "filesystem mismatch",
+			StageError: fmt.Errorf("%w: device /dev/sdb holds ext4, requested xfs", volumes.ErrFilesystemMismatch),
+			Code:       codes.FailedPrecondition,
+		},
+		{
+			Name:       "filesystem errors",
+			StageError: fmt.Errorf("%w on device /dev/sdb", volumes.ErrFilesystemErrors),
+			Code:       codes.FailedPrecondition,
+		},
+		{
+			Name:       "other error",
+			StageError: fmt.Errorf("mount failed"),
+			Code:       codes.Internal,
+		},
+	}
 
-	env.volumeService.GetByIDFunc = func(ctx context.Context, id uint64) (*csi.Volume, error) {
-		return &csi.Volume{}, nil
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			env := newNodeServerTestEnv()
+			env.volumeMountService.StageFunc = func(ctx context.Context, volume *csi.Volume, stagingTargetPath string, opts volumes.MountOpts) error {
+				if opts.FsckPolicy != volumes.FsckPolicyCheck {
+					t.Errorf("unexpected fsck policy in mount options: %s", opts.FsckPolicy)
+				}
+				return testCase.StageError
+			}
+
+			_, err := env.service.NodeStageVolume(env.ctx, &proto.NodeStageVolumeRequest{
+				VolumeId:          "1",
+				StagingTargetPath: "staging",
+				VolumeContext: map[string]string{
+					VolumeContextFsckPolicy: volumes.FsckPolicyCheck,
+				},
+				VolumeCapability: &proto.VolumeCapability{
+					AccessMode: &proto.VolumeCapability_AccessMode{
+						Mode: proto.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+					},
+					AccessType: &proto.VolumeCapability_Mount{
+						Mount: &proto.VolumeCapability_MountVolume{
+							FsType: "xfs",
+						},
+					},
+				},
+			})
+			if grpc.Code(err) != testCase.Code {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
 	}
+}
+
+func TestNodeServiceNodeStageVolumeInputErrors(t *testing.T) {
+	env := newNodeServerTestEnv()
 
 	testCases := []struct {
 		Name string
@@ -214,7 +552,7 @@ func TestNodeServiceNodeStageVolumeInputErrors(t *testing.T) {
 					AccessType: &proto.VolumeCapability_Mount{
 						Mount: &proto.VolumeCapability_MountVolume{
 							FsType:     "ext4",
-							MountFlags: []string{"flag1", "flag2"},
+							MountFlags: []string{"noatime", "discard"},
 						},
 					},
 				},
@@ -232,7 +570,7 @@ func TestNodeServiceNodeStageVolumeInputErrors(t *testing.T) {
 					AccessType: &proto.VolumeCapability_Mount{
 						Mount: &proto.VolumeCapability_MountVolume{
 							FsType:     "ext4",
-							MountFlags: []string{"flag1", "flag2"},
+							MountFlags: []string{"noatime", "discard"},
 						},
 					},
 				},
@@ -272,13 +610,127 @@ func TestNodeServiceNodeStageVolumeInputErrors(t *testing.T) {
 					AccessType: &proto.VolumeCapability_Mount{
 						Mount: &proto.VolumeCapability_MountVolume{
 							FsType:     "ext4",
-							MountFlags: []string{"flag1", "flag2"},
+							MountFlags: []string{"noatime", "discard"},
 						},
 					},
 				},
 			},
 			Code: codes.NotFound,
 		},
+		{
+			Name: "dangerous mount flag",
+			Req: &proto.NodeStageVolumeRequest{
+				VolumeId:          "1",
+				StagingTargetPath: "staging",
+				PublishContext: map[string]string{
+					PublishContextDevicePath: "/dev/sdb",
+				},
+				VolumeCapability: &proto.VolumeCapability{
+					AccessMode: &proto.VolumeCapability_AccessMode{
+						Mode: proto.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+					},
+					AccessType: &proto.VolumeCapability_Mount{
+						Mount: &proto.VolumeCapability_MountVolume{
+							FsType:     "ext4",
+							MountFlags: []string{"noatime", "bind"},
+						},
+					},
+				},
+			},
+			Code: codes.InvalidArgument,
+		},
+		{
+			Name: "mount flag with disallowed value",
+			Req: &proto.NodeStageVolumeRequest{
+				VolumeId:          "1",
+				StagingTargetPath: "staging",
+				PublishContext: map[string]string{
+					PublishContextDevicePath: "/dev/sdb",
+				},
+				VolumeCapability: &proto.VolumeCapability{
+					AccessMode: &proto.VolumeCapability_AccessMode{
+						Mode: proto.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+					},
+					AccessType: &proto.VolumeCapability_Mount{
+						Mount: &proto.VolumeCapability_MountVolume{
+							FsType:     "ext4",
+							MountFlags: []string{"errors=panic"},
+						},
+					},
+				},
+			},
+			Code: codes.InvalidArgument,
+		},
+		{
+			Name: "invalid fsck policy",
+			Req: &proto.NodeStageVolumeRequest{
+				VolumeId:          "1",
+				StagingTargetPath: "staging",
+				PublishContext: map[string]string{
+					PublishContextDevicePath: "/dev/sdb",
+				},
+				VolumeContext: map[string]string{
+					VolumeContextFsckPolicy: "sometimes",
+				},
+				VolumeCapability: &proto.VolumeCapability{
+					AccessMode: &proto.VolumeCapability_AccessMode{
+						Mode: proto.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+					},
+					AccessType: &proto.VolumeCapability_Mount{
+						Mount: &proto.VolumeCapability_MountVolume{
+							FsType: "ext4",
+						},
+					},
+				},
+			},
+			Code: codes.InvalidArgument,
+		},
+		{
+			Name: "format option of other filesystem",
+			Req: &proto.NodeStageVolumeRequest{
+				VolumeId:          "1",
+				StagingTargetPath: "staging",
+				PublishContext: map[string]string{
+					PublishContextDevicePath: "/dev/sdb",
+				},
+				VolumeContext: map[string]string{
+					ParameterXFSCRC: "true",
+				},
+				VolumeCapability: &proto.VolumeCapability{
+					AccessMode: &proto.VolumeCapability_AccessMode{
+						Mode: proto.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+					},
+					AccessType: &proto.VolumeCapability_Mount{
+						Mount: &proto.VolumeCapability_MountVolume{
+							FsType: "ext4",
+						},
+					},
+				},
+			},
+			Code: codes.InvalidArgument,
+		},
+		{
+			Name: "mount flag of other filesystem",
+			Req: &proto.NodeStageVolumeRequest{
+				VolumeId:          "1",
+				StagingTargetPath: "staging",
+				PublishContext: map[string]string{
+					PublishContextDevicePath: "/dev/sdb",
+				},
+				VolumeCapability: &proto.VolumeCapability{
+					AccessMode: &proto.VolumeCapability_AccessMode{
+						Mode: proto.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+					},
+					AccessType: &proto.VolumeCapability_Mount{
+						Mount: &proto.VolumeCapability_MountVolume{
+							FsType:     "ext4",
+							MountFlags: []string{"nouuid"},
+						},
+					},
+				},
+			},
+			Code: codes.InvalidArgument,
+		},
 	}
 
 	for _, testCase := range testCases {
@@ -291,42 +743,90 @@ func TestNodeServiceNodeStageVolumeInputErrors(t *testing.T) {
 	}
 }
 
-func TestNodeServiceNodeUnstageVolume(t *testing.T) {
+func TestNodeServiceNodeStageVolumeInProgress(t *testing.T) {
 	env := newNodeServerTestEnv()
 
-	existingVolume := &csi.Volume{}
-
-	env.volumeService.GetByIDFunc = func(ctx context.Context, id uint64) (*csi.Volume, error) {
-		if id != 1 {
-			t.Errorf("unexpected volume id passed to volume service: %d", id)
-		}
-		return existingVolume, nil
+	staging := make(chan struct{})
+	release := make(chan struct{})
+	env.volumeMountService.StageFunc = func(ctx context.Context, volume *csi.Volume, stagingTargetPath string, opts volumes.MountOpts) error {
+		close(staging)
+		<-release
+		return nil
 	}
-
 	env.volumeMountService.UnstageFunc = func(volume *csi.Volume, stagingTargetPath string) error {
-		if volume != existingVolume {
-			t.Errorf("unexpected volume passed to volume mount service: %v", volume)
-		}
-		if stagingTargetPath != "staging" {
-			t.Errorf("unexpected staging target path passed to volume mount service: %s", stagingTargetPath)
-		}
+		return nil
+	}
+	env.volumeMountService.PublishFunc = func(volume *csi.Volume, targetPath string, stagingTargetPath string, opts volumes.MountOpts) error {
 		return nil
 	}
 
-	_, err := env.service.NodeUnstageVolume(env.ctx, &proto.NodeUnstageVolumeRequest{
+	stageReq := &proto.NodeStageVolumeRequest{
 		VolumeId:          "1",
 		StagingTargetPath: "staging",
-	})
-	if err != nil {
+		VolumeCapability: &proto.VolumeCapability{
+			AccessMode: &proto.VolumeCapability_AccessMode{
+				Mode: proto.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+			AccessType: &proto.VolumeCapability_Mount{
+				Mount: &proto.VolumeCapability_MountVolume{},
+			},
+		},
+	}
+	errs := make(chan error, 1)
+	go func() {
+		_, err := env.service.NodeStageVolume(env.ctx, stageReq)
+		errs <- err
+	}()
+	<-staging
+
+	if _, err := env.service.NodeStageVolume(env.ctx, stageReq); grpc.Code(err) != codes.Aborted {
+		t.Errorf("unexpected stage error: %v", err)
+	}
+	if _, err := env.service.NodeUnstageVolume(env.ctx, &proto.NodeUnstageVolumeRequest{
+		VolumeId:          "1",
+		StagingTargetPath: "staging",
+	}); grpc.Code(err) != codes.Aborted {
+		t.Errorf("unexpected unstage error: %v", err)
+	}
+	if _, err := env.service.NodeUnstageVolume(env.ctx, &proto.NodeUnstageVolumeRequest{
+		VolumeId:          "2",
+		StagingTargetPath: "staging",
+	}); grpc.Code(err) != codes.Aborted {
+		t.Errorf("unexpected unstage error for same path: %v", err)
+	}
+	if _, err := env.service.NodeUnstageVolume(env.ctx, &proto.NodeUnstageVolumeRequest{
+		VolumeId:          "2",
+		StagingTargetPath: "other",
+	}); err != nil {
+		t.Errorf("unexpected unstage error for other volume: %v", err)
+	}
+
+	close(release)
+	if err := <-errs; err != nil {
 		t.Fatal(err)
 	}
+
+	if _, err := env.service.NodePublishVolume(env.ctx, &proto.NodePublishVolumeRequest{
+		VolumeId:          "1",
+		StagingTargetPath: "staging",
+		TargetPath:        "target",
+		VolumeCapability:  stageReq.VolumeCapability,
+	}); err != nil {
+		t.Errorf("unexpected publish error after stage completed: %v", err)
+	}
 }
 
-func TestNodeServiceNodeUnstageVolumeNotFound(t *testing.T) {
+func TestNodeServiceNodeUnstageVolume(t *testing.T) {
 	env := newNodeServerTestEnv()
 
-	env.volumeService.GetByIDFunc = func(ctx context.Context, id uint64) (*csi.Volume, error) {
-		return nil, volumes.ErrVolumeNotFound
+	env.volumeMountService.UnstageFunc = func(volume *csi.Volume, stagingTargetPath string) error {
+		if volume.ID != 1 {
+			t.Errorf("unexpected volume passed to volume mount service: %v", volume)
+		}
+		if stagingTargetPath != "staging" {
+			t.Errorf("unexpected staging target path passed to volume mount service: %s", stagingTargetPath)
+		}
+		return nil
 	}
 
 	_, err := env.service.NodeUnstageVolume(env.ctx, &proto.NodeUnstageVolumeRequest{
@@ -334,17 +834,13 @@ func TestNodeServiceNodeUnstageVolumeNotFound(t *testing.T) {
 		StagingTargetPath: "staging",
 	})
 	if err != nil {
-		t.Fatalf("unexpected error: %v", err)
+		t.Fatal(err)
 	}
 }
 
 func TestNodeServiceNodeUnstageVolumeUnstageError(t *testing.T) {
 	env := newNodeServerTestEnv()
 
-	env.volumeService.GetByIDFunc = func(ctx context.Context, id uint64) (*csi.Volume, error) {
-		return &csi.Volume{}, nil
-	}
-
 	env.volumeMountService.UnstageFunc = func(volume *csi.Volume, stagingTargetPath string) error {
 		return io.EOF
 	}
@@ -403,17 +899,8 @@ func TestNodeServiceNodeUnstageVolumeInputErrors(t *testing.T) {
 func TestNodeServiceNodePublishVolume(t *testing.T) {
 	env := newNodeServerTestEnv()
 
-	existingVolume := &csi.Volume{}
-
-	env.volumeService.GetByIDFunc = func(ctx context.Context, id uint64) (*csi.Volume, error) {
-		if id != 1 {
-			t.Errorf("unexpected volume id passed to volume service: %d", id)
-		}
-		return existingVolume, nil
-	}
-
 	env.volumeMountService.PublishFunc = func(volume *csi.Volume, targetPath string, stagingTargetPath string, opts volumes.MountOpts) error {
-		if volume != existingVolume {
+		if volume.ID != 1 {
 			t.Errorf("unexpected volume passed to volume mount service: %v", volume)
 		}
 		if targetPath != "target" {
@@ -436,7 +923,7 @@ func TestNodeServiceNodePublishVolume(t *testing.T) {
 			AccessType: &proto.VolumeCapability_Mount{
 				Mount: &proto.VolumeCapability_MountVolume{
 					FsType:     "ext4",
-					MountFlags: []string{"flag1", "flag2"},
+					MountFlags: []string{"noatime", "discard"},
 				},
 			},
 		},
@@ -447,61 +934,79 @@ func TestNodeServiceNodePublishVolume(t *testing.T) {
 }
 
 func TestNodeServiceNodePublishBlockVolume(t *testing.T) {
-	env := newNodeServerTestEnv()
-
-	existingVolume := &csi.Volume{ID: 1, LinuxDevice: "linuxDevicePath"}
-	env.volumeService.GetByIDFunc = func(_ context.Context, id uint64) (*csi.Volume, error) {
-		if id != existingVolume.ID {
-			t.Errorf("unexpected volume id passed to volume service: %d", id)
-		}
-		return existingVolume, nil
+	testCases := []struct {
+		Name      string
+		VerifyErr error
+		Code      codes.Code
+	}{
+		{Name: "verified device", Code: codes.OK},
+		{Name: "other device", VerifyErr: volumes.ErrDeviceMismatch, Code: codes.FailedPrecondition},
+		{Name: "missing device", VerifyErr: volumes.ErrDeviceNotFound, Code: codes.Unavailable},
 	}
 
-	env.volumeMountService.PublishFunc = func(
-		volume *csi.Volume, targetPath, stagingTargetPath string, opts volumes.MountOpts,
-	) error {
-		if volume != existingVolume {
-			t.Errorf("unexpected volume: %v", volume)
-		}
-		if targetPath != "target" {
-			t.Errorf("unexpected target path: %s", targetPath)
-		}
-		if stagingTargetPath != volume.LinuxDevice {
-			t.Errorf("unexpected staging target path: %s", stagingTargetPath)
-		}
-		return nil
-	}
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			env := newNodeServerTestEnv()
 
-	_, err := env.service.NodePublishVolume(env.ctx, &proto.NodePublishVolumeRequest{
-		VolumeId:          "1",
-		StagingTargetPath: "staging",
-		TargetPath:        "target",
-		VolumeCapability: &proto.VolumeCapability{
-			AccessMode: &proto.VolumeCapability_AccessMode{
-				Mode: proto.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
-			},
-			AccessType: &proto.VolumeCapability_Block{
-				Block: &proto.VolumeCapability_BlockVolume{},
-			},
-		},
-	})
+			env.volumeMountService.VerifyDeviceFunc = func(ctx context.Context, volume *csi.Volume) error {
+				if volume.LinuxDevice != "/dev/sdb" {
+					t.Errorf("unexpected device: %s", volume.LinuxDevice)
+				}
+				return testCase.VerifyErr
+			}
+			published := false
+			env.volumeMountService.PublishFunc = func(
+				volume *csi.Volume, targetPath, stagingTargetPath string, opts volumes.MountOpts,
+			) error {
+				published = true
+				if volume.ID != 1 {
+					t.Errorf("unexpected volume: %v", volume)
+				}
+				if targetPath != "target" {
+					t.Errorf("unexpected target path: %s", targetPath)
+				}
+				if stagingTargetPath != "/dev/sdb" {
+					t.Errorf("unexpected staging target path: %s", stagingTargetPath)
+				}
+				return nil
+			}
 
-	if err != nil {
-		t.Fatal(err)
+			_, err := env.service.NodePublishVolume(env.ctx, &proto.NodePublishVolumeRequest{
+				VolumeId:          "1",
+				StagingTargetPath: "staging",
+				TargetPath:        "target",
+				PublishContext: map[string]string{
+					PublishContextDevicePath: "/dev/sdb",
+				},
+				VolumeCapability: &proto.VolumeCapability{
+					AccessMode: &proto.VolumeCapability_AccessMode{
+						Mode: proto.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+					},
+					AccessType: &proto.VolumeCapability_Block{
+						Block: &proto.VolumeCapability_BlockVolume{},
+					},
+				},
+			})
+			if grpc.Code(err) != testCase.Code {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if published != (testCase.VerifyErr == nil) {
+				t.Errorf("unexpected publish: %v", published)
+			}
+		})
 	}
 }
 
-func TestNodeServiceNodePublishVolumeNotFound(t *testing.T) {
+func TestNodeServiceNodePublishVolumeInvalidDevicePath(t *testing.T) {
 	env := newNodeServerTestEnv()
 
-	env.volumeService.GetByIDFunc = func(ctx context.Context, id uint64) (*csi.Volume, error) {
-		return nil, volumes.ErrVolumeNotFound
-	}
-
 	_, err := env.service.NodePublishVolume(env.ctx, &proto.NodePublishVolumeRequest{
 		VolumeId:          "1",
 		TargetPath:        "target",
 		StagingTargetPath: "staging",
+		PublishContext: map[string]string{
+			PublishContextDevicePath: "sdb",
+		},
 		VolumeCapability: &proto.VolumeCapability{
 			AccessMode: &proto.VolumeCapability_AccessMode{
 				Mode: proto.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
@@ -509,12 +1014,12 @@ func TestNodeServiceNodePublishVolumeNotFound(t *testing.T) {
 			AccessType: &proto.VolumeCapability_Mount{
 				Mount: &proto.VolumeCapability_MountVolume{
 					FsType:     "ext4",
-					MountFlags: []string{"flag1", "flag2"},
+					MountFlags: []string{"noatime", "discard"},
 				},
 			},
 		},
 	})
-	if grpc.Code(err) != codes.NotFound {
+	if grpc.Code(err) != codes.InvalidArgument {
 		t.Fatalf("unexpected error: %v", err)
 	}
 }
@@ -522,10 +1027,6 @@ func TestNodeServiceNodePublishVolumeNotFound(t *testing.T) {
 func TestNodeServiceNodePublishPublishError(t *testing.T) {
 	env := newNodeServerTestEnv()
 
-	env.volumeService.GetByIDFunc = func(ctx context.Context, id uint64) (*csi.Volume, error) {
-		return &csi.Volume{}, nil
-	}
-
 	env.volumeMountService.PublishFunc = func(volume *csi.Volume, targetPath string, stagingTargetPath string, opts volumes.MountOpts) error {
 		return io.EOF
 	}
@@ -541,7 +1042,7 @@ func TestNodeServiceNodePublishPublishError(t *testing.T) {
 			AccessType: &proto.VolumeCapability_Mount{
 				Mount: &proto.VolumeCapability_MountVolume{
 					FsType:     "ext4",
-					MountFlags: []string{"flag1", "flag2"},
+					MountFlags: []string{"noatime", "discard"},
 				},
 			},
 		},
@@ -554,10 +1055,6 @@ func TestNodeServiceNodePublishPublishError(t *testing.T) {
 func TestNodeServiceNodePublishVolumeInputErrors(t *testing.T) {
 	env := newNodeServerTestEnv()
 
-	env.volumeService.GetByIDFunc = func(ctx context.Context, id uint64) (*csi.Volume, error) {
-		return &csi.Volume{}, nil
-	}
-
 	testCases := []struct {
 		Name string
 		Req  *proto.NodePublishVolumeRequest
@@ -575,7 +1072,7 @@ func TestNodeServiceNodePublishVolumeInputErrors(t *testing.T) {
 					AccessType: &proto.VolumeCapability_Mount{
 						Mount: &proto.VolumeCapability_MountVolume{
 							FsType:     "ext4",
-							MountFlags: []string{"flag1", "flag2"},
+							MountFlags: []string{"noatime", "discard"},
 						},
 					},
 				},
@@ -594,7 +1091,7 @@ func TestNodeServiceNodePublishVolumeInputErrors(t *testing.T) {
 					AccessType: &proto.VolumeCapability_Mount{
 						Mount: &proto.VolumeCapability_MountVolume{
 							FsType:     "ext4",
-							MountFlags: []string{"flag1", "flag2"},
+							MountFlags: []string{"noatime", "discard"},
 						},
 					},
 				},
@@ -613,7 +1110,7 @@ func TestNodeServiceNodePublishVolumeInputErrors(t *testing.T) {
 					AccessType: &proto.VolumeCapability_Mount{
 						Mount: &proto.VolumeCapability_MountVolume{
 							FsType:     "ext4",
-							MountFlags: []string{"flag1", "flag2"},
+							MountFlags: []string{"noatime", "discard"},
 						},
 					},
 				},
@@ -633,7 +1130,7 @@ func TestNodeServiceNodePublishVolumeInputErrors(t *testing.T) {
 					AccessType: &proto.VolumeCapability_Mount{
 						Mount: &proto.VolumeCapability_MountVolume{
 							FsType:     "ext4",
-							MountFlags: []string{"flag1", "flag2"},
+							MountFlags: []string{"noatime", "discard"},
 						},
 					},
 				},
@@ -654,6 +1151,29 @@ func TestNodeServiceNodePublishVolumeInputErrors(t *testing.T) {
 			},
 			Code: codes.InvalidArgument,
 		},
+		{
+			Name: "dangerous mount flag",
+			Req: &proto.NodePublishVolumeRequest{
+				VolumeId:          "1",
+				TargetPath:        "target",
+				StagingTargetPath: "staging",
+				PublishContext: map[string]string{
+					PublishContextDevicePath: "/dev/sdb",
+				},
+				VolumeCapability: &proto.VolumeCapability{
+					AccessMode: &proto.VolumeCapability_AccessMode{
+						Mode: proto.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+					},
+					AccessType: &proto.VolumeCapability_Mount{
+						Mount: &proto.VolumeCapability_MountVolume{
+							FsType:     "ext4",
+							MountFlags: []string{"noatime,suid"},
+						},
+					},
+				},
+			},
+			Code: codes.InvalidArgument,
+		},
 	}
 
 	for _, testCase := range testCases {
@@ -669,19 +1189,7 @@ func TestNodeServiceNodePublishVolumeInputErrors(t *testing.T) {
 func TestNodeServiceNodeUnpublishVolume(t *testing.T) {
 	env := newNodeServerTestEnv()
 
-	existingVolume := &csi.Volume{}
-
-	env.volumeService.GetByIDFunc = func(ctx context.Context, id uint64) (*csi.Volume, error) {
-		if id != 1 {
-			t.Errorf("unexpected volume id passed to volume service: %d", id)
-		}
-		return existingVolume, nil
-	}
-
-	env.volumeMountService.UnpublishFunc = func(volume *csi.Volume, targetPath string) error {
-		if volume != existingVolume {
-			t.Errorf("unexpected volume passed to volume mount service: %v", volume)
-		}
+	env.volumeMountService.UnpublishFunc = func(targetPath string) error {
 		if targetPath != "target" {
 			t.Errorf("unexpected target path passed to volume service: %s", targetPath)
 		}
@@ -697,30 +1205,10 @@ func TestNodeServiceNodeUnpublishVolume(t *testing.T) {
 	}
 }
 
-func TestNodeServiceNodeUnpublishVolumeNotFound(t *testing.T) {
-	env := newNodeServerTestEnv()
-
-	env.volumeService.GetByIDFunc = func(ctx context.Context, id uint64) (*csi.Volume, error) {
-		return nil, volumes.ErrVolumeNotFound
-	}
-
-	_, err := env.service.NodeUnpublishVolume(env.ctx, &proto.NodeUnpublishVolumeRequest{
-		VolumeId:   "1",
-		TargetPath: "target",
-	})
-	if err != nil {
-		t.Fatalf("unexpected error: %v", err)
-	}
-}
-
 func TestNodeServiceNodeUnpublishUnpublishError(t *testing.T) {
 	env := newNodeServerTestEnv()
 
-	env.volumeService.GetByIDFunc = func(ctx context.Context, id uint64) (*csi.Volume, error) {
-		return &csi.Volume{}, nil
-	}
-
-	env.volumeMountService.UnpublishFunc = func(volume *csi.Volume, targetPath string) error {
+	env.volumeMountService.UnpublishFunc = func(targetPath string) error {
 		return io.EOF
 	}
 
@@ -828,56 +1316,89 @@ func TestNodeServiceNodeGetInfo(t *testing.T) {
 	}
 }
 
-func TestNodeServiceNodeExpandVolume(t *testing.T) {
-	env := newNodeServerTestEnv()
-
-	existingVolume := &csi.Volume{
-		LinuxDevice: "LinuxDevicePath",
+func TestNodeServiceNodeGetVolumeStats(t *testing.T) {
+	testCases := []struct {
+		Name        string
+		TotalINodes int64
+		Usages      int
+	}{
+		{Name: "with inodes", TotalINodes: 100, Usages: 2},
+		{Name: "dynamic inodes", TotalINodes: 0, Usages: 1},
 	}
 
-	env.volumeService.GetByIDFunc = func(ctx context.Context, id uint64) (*csi.Volume, error) {
-		if id != 1 {
-			t.Errorf("unexpected volume id passed to volume service: %d", id)
-		}
-		return existingVolume, nil
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			env := newNodeServerTestEnv()
+			env.volumeMountService.PathExistsFunc = func(path string) (bool, error) {
+				return true, nil
+			}
+			env.volumeStatsService.ByteFilesystemStatsFunc = func(volumePath string) (int64, int64, int64, error) {
+				return 10, 6, 4, nil
+			}
+			env.volumeStatsService.INodeFilesystemStatsFunc = func(volumePath string) (int64, int64, int64, error) {
+				return testCase.TotalINodes, 0, testCase.TotalINodes, nil
+			}
+
+			resp, err := env.service.NodeGetVolumeStats(env.ctx, &proto.NodeGetVolumeStatsRequest{
+				VolumeId:   "1",
+				VolumePath: "volumePath",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(resp.Usage) != testCase.Usages {
+				t.Fatalf("unexpected usage: %v", resp.Usage)
+			}
+			if bytes := resp.Usage[0]; bytes.Unit != proto.VolumeUsage_BYTES || bytes.Total != 10 || bytes.Used != 4 {
+				t.Errorf("unexpected byte usage: %v", bytes)
+			}
+		})
 	}
+}
+
+func TestNodeServiceNodeExpandVolume(t *testing.T) {
+	env := newNodeServerTestEnv()
+
 	env.volumeMountService.PathExistsFunc = func(path string) (bool, error) {
-		if path != "LinuxDevicePath" {
+		if path != "/dev/disk/by-id/scsi-0HC_Volume_1" {
 			t.Errorf("unexpected volume path passed to volume mount service: %s", path)
 		}
 		return true, nil
 	}
-	env.volumeResizeService.ResizeFunc = func(volume *csi.Volume, volumePath string) error {
-		if volume != existingVolume {
+	env.volumeResizeService.ResizeFunc = func(volume *csi.Volume, volumePath string) (int64, error) {
+		if volume.ID != 1 {
 			t.Errorf("unexpected volume passed to volume mount service: %v", volume)
 		}
 		if volumePath != "volumePath" {
 			t.Errorf("unexpected volume path passed to volume service: %s", volumePath)
 		}
-		return nil
+		return 20 * GB, nil
 	}
 
-	_, err := env.service.NodeExpandVolume(env.ctx, &proto.NodeExpandVolumeRequest{
+	resp, err := env.service.NodeExpandVolume(env.ctx, &proto.NodeExpandVolumeRequest{
 		VolumeId:   "1",
 		VolumePath: "volumePath",
 	})
 	if err != nil {
 		t.Fatal(err)
 	}
+	if resp.CapacityBytes != 20*GB {
+		t.Errorf("unexpected capacity: %d", resp.CapacityBytes)
+	}
 }
 
-func TestNodeServiceNodeNodeExpandVolumeNotFound(t *testing.T) {
+func TestNodeServiceNodeExpandVolumeNotAttached(t *testing.T) {
 	env := newNodeServerTestEnv()
 
-	env.volumeService.GetByIDFunc = func(ctx context.Context, id uint64) (*csi.Volume, error) {
-		return nil, volumes.ErrVolumeNotFound
+	env.volumeMountService.PathExistsFunc = func(path string) (bool, error) {
+		return false, nil
 	}
 
 	_, err := env.service.NodeExpandVolume(env.ctx, &proto.NodeExpandVolumeRequest{
 		VolumeId:   "1",
 		VolumePath: "volumePath",
 	})
-	if grpc.Code(err) != codes.NotFound {
+	if grpc.Code(err) != codes.Unavailable {
 		t.Fatalf("unexpected error: %v", err)
 	}
 }
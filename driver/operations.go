@@ -0,0 +1,174 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// operations tracks the operations in flight per key, like a volume ID or
+// name. As required by the CSI spec, an operation conflicting with one in
+// flight for the same key is rejected with Aborted. Identical operations are
+// coalesced: they wait for the operation in flight and share its result.
+type operations struct {
+	mu       sync.Mutex
+	inFlight map[string]*operation
+}
+
+type operation struct {
+	op   string
+	done chan struct{}
+	resp interface{}
+	err  error
+	// canceled is set if the operation failed after the context of the
+	// request running it was done.
+	canceled bool
+}
+
+func newOperations() *operations {
+	return &operations{inFlight: make(map[string]*operation)}
+}
+
+// run runs fn as operation op on key, or waits for the result of the
+// identical operation in flight. A panic in fn fails the operation with
+// Internal. Callers waiting for an operation which failed because the context
+// of the request running it was done get Aborted, so they retry it.
+func (o *operations) run(ctx context.Context, key string, op string, fn func() (interface{}, error)) (resp interface{}, err error) {
+	o.mu.Lock()
+	if current, ok := o.inFlight[key]; ok {
+		o.mu.Unlock()
+		if current.op != op {
+			return nil, status.Error(codes.Aborted, fmt.Sprintf("another operation is in progress for %s", key))
+		}
+		select {
+		case <-current.done:
+			if current.canceled {
+				return nil, status.Error(codes.Aborted, fmt.Sprintf("the operation in progress for %s was canceled", key))
+			}
+			return current.resp, current.err
+		case <-ctx.Done():
+			return nil, status.Error(contextErrorCode(ctx.Err(), codes.Aborted), ctx.Err().Error())
+		}
+	}
+	current := &operation{op: op, done: make(chan struct{})}
+	o.inFlight[key] = current
+	o.mu.Unlock()
+
+	defer func() {
+		if r := recover(); r != nil {
+			resp, err = nil, status.Error(codes.Internal, fmt.Sprintf("operation on %s failed: %v", key, r))
+		}
+		current.resp, current.err = resp, err
+		current.canceled = err != nil && ctx.Err() != nil
+		o.mu.Lock()
+		delete(o.inFlight, key)
+		o.mu.Unlock()
+		close(current.done)
+	}()
+	return fn()
+}
+
+// inFlight tracks the keys of the operations in flight. Unlike operations,
+// it rejects every overlapping operation, identical or not.
+type inFlight struct {
+	mu   sync.Mutex
+	keys map[string]struct{}
+}
+
+func newInFlight() *inFlight {
+	return &inFlight{keys: make(map[string]struct{})}
+}
+
+// lock claims all keys. It fails with Aborted if an operation holding any of
+// the keys is in flight. The returned function releases the keys.
+func (f *inFlight) lock(keys ...string) (func(), error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, key := range keys {
+		if _, ok := f.keys[key]; ok {
+			return nil, status.Error(codes.Aborted, fmt.Sprintf("another operation is in progress for %s", key))
+		}
+	}
+	for _, key := range keys {
+		f.keys[key] = struct{}{}
+	}
+	return func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		for _, key := range keys {
+			delete(f.keys, key)
+		}
+	}, nil
+}
+
+// restores runs the restores of backups in the background, so that restoring
+// a large backup is not bound to the deadline of a single request. A restore
+// keeps running when the request which started it ends and is joined by the
+// request retrying it.
+type restores struct {
+	mu      sync.Mutex
+	running map[string]*restore
+}
+
+type restore struct {
+	done chan struct{}
+	err  error
+}
+
+func newRestores() *restores {
+	return &restores{running: make(map[string]*restore)}
+}
+
+// run starts fn in the background for key, unless a restore for key has been
+// started already, and waits for it to finish. It fails with Aborted if ctx is
+// done first, the restore keeps running then. The result of a restore is
+// returned to the first call waiting for it to finish only, later calls start
+// a new restore.
+func (r *restores) run(ctx context.Context, key string, fn func(ctx context.Context) error) error {
+	r.mu.Lock()
+	current, ok := r.running[key]
+	if !ok {
+		current = &restore{done: make(chan struct{})}
+		r.running[key] = current
+		go func() {
+			defer close(current.done)
+			current.err = fn(context.Background())
+		}()
+	}
+	r.mu.Unlock()
+
+	select {
+	case <-current.done:
+	case <-ctx.Done():
+		return status.Error(codes.Aborted, fmt.Sprintf("restore for %s is still in progress", key))
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.running[key] == current {
+		delete(r.running, key)
+	}
+	return current.err
+}
+
+// forget forgets the result of the restore for key. It fails with Aborted if
+// the restore is still running.
+func (r *restores) forget(key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	current, ok := r.running[key]
+	if !ok {
+		return nil
+	}
+	select {
+	case <-current.done:
+		delete(r.running, key)
+		return nil
+	default:
+		return status.Error(codes.Aborted, fmt.Sprintf("restore for %s is still in progress", key))
+	}
+}
@@ -0,0 +1,194 @@
+package driver
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestOperationsConflict(t *testing.T) {
+	ops := newOperations()
+	ctx := context.Background()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		_, err := ops.run(ctx, "volume 1", "publish", func() (interface{}, error) {
+			close(started)
+			<-release
+			return nil, nil
+		})
+		done <- err
+	}()
+	<-started
+
+	if _, err := ops.run(ctx, "volume 1", "unpublish", func() (interface{}, error) {
+		t.Error("conflicting operation was run")
+		return nil, nil
+	}); grpc.Code(err) != codes.Aborted {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := ops.run(ctx, "volume 2", "unpublish", func() (interface{}, error) {
+		return nil, nil
+	}); err != nil {
+		t.Errorf("unexpected error for other key: %v", err)
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ops.run(ctx, "volume 1", "unpublish", func() (interface{}, error) {
+		return nil, nil
+	}); err != nil {
+		t.Errorf("unexpected error after operation completed: %v", err)
+	}
+}
+
+func TestOperationsCoalesce(t *testing.T) {
+	ops := newOperations()
+	ctx := context.Background()
+
+	var calls int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	fn := func() (interface{}, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(started)
+		}
+		<-release
+		return "result", nil
+	}
+
+	results := make(chan interface{}, 2)
+	go func() {
+		resp, _ := ops.run(ctx, "volume 1", "publish", fn)
+		results <- resp
+	}()
+	<-started
+	go func() {
+		resp, _ := ops.run(ctx, "volume 1", "publish", fn)
+		results <- resp
+	}()
+
+	// Give the second caller time to join the operation in flight.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	for i := 0; i < 2; i++ {
+		if resp := <-results; resp != "result" {
+			t.Errorf("unexpected result: %v", resp)
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("expected operation to run once, ran %d times", n)
+	}
+}
+
+func TestOperationsCoalesceContextCanceled(t *testing.T) {
+	ops := newOperations()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	go ops.run(context.Background(), "volume 1", "publish", func() (interface{}, error) {
+		close(started)
+		<-release
+		return nil, nil
+	})
+	<-started
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ops.run(ctx, "volume 1", "publish", func() (interface{}, error) {
+		t.Error("coalesced operation was run")
+		return nil, nil
+	}); grpc.Code(err) != codes.Aborted {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestOperationsCoalescePanic(t *testing.T) {
+	ops := newOperations()
+	ctx := context.Background()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	leader := make(chan error, 1)
+	go func() {
+		_, err := ops.run(ctx, "volume 1", "publish", func() (interface{}, error) {
+			close(started)
+			<-release
+			panic("test")
+		})
+		leader <- err
+	}()
+	<-started
+
+	waiter := make(chan error, 1)
+	go func() {
+		_, err := ops.run(ctx, "volume 1", "publish", func() (interface{}, error) {
+			t.Error("coalesced operation was run")
+			return nil, nil
+		})
+		waiter <- err
+	}()
+	// Give the second caller time to join the operation in flight.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	if err := <-leader; grpc.Code(err) != codes.Internal {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := <-waiter; grpc.Code(err) != codes.Internal {
+		t.Errorf("unexpected error of coalesced operation: %v", err)
+	}
+	if _, err := ops.run(ctx, "volume 1", "unpublish", func() (interface{}, error) {
+		return nil, nil
+	}); err != nil {
+		t.Errorf("unexpected error after operation panicked: %v", err)
+	}
+}
+
+func TestOperationsCoalesceLeaderContextCanceled(t *testing.T) {
+	ops := newOperations()
+
+	leaderCtx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	leader := make(chan error, 1)
+	go func() {
+		_, err := ops.run(leaderCtx, "volume 1", "publish", func() (interface{}, error) {
+			close(started)
+			<-leaderCtx.Done()
+			return nil, status.Error(codes.DeadlineExceeded, leaderCtx.Err().Error())
+		})
+		leader <- err
+	}()
+	<-started
+
+	waiter := make(chan error, 1)
+	go func() {
+		_, err := ops.run(context.Background(), "volume 1", "publish", func() (interface{}, error) {
+			t.Error("coalesced operation was run")
+			return nil, nil
+		})
+		waiter <- err
+	}()
+	// Give the second caller time to join the operation in flight.
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	if err := <-leader; grpc.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := <-waiter; grpc.Code(err) != codes.Aborted {
+		t.Errorf("unexpected error of coalesced operation: %v", err)
+	}
+}
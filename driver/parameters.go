@@ -0,0 +1,338 @@
+package driver
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/hetznercloud/csi-driver/volumes"
+)
+
+// Keys of the StorageClass parameters understood by the driver.
+const (
+	ParameterFSType                 = "fsType"
+	ParameterLabels                 = "labels"
+	ParameterDeleteProtection       = "deleteProtection"
+	ParameterDeleteProtectionPolicy = "deleteProtectionPolicy"
+	ParameterNameTemplate           = "nameTemplate"
+	ParameterEncrypted              = "encrypted"
+
+	// Parameters controlling how the filesystem is created. They are passed
+	// to the node in the volume context under the same keys.
+	ParameterFSLabel                      = "fsLabel"
+	ParameterExt4InodeRatio               = "ext4InodeRatio"
+	ParameterExt4ReservedBlocksPercentage = "ext4ReservedBlocksPercentage"
+	ParameterExt4LazyInit                 = "ext4LazyInit"
+	ParameterXFSReflink                   = "xfsReflink"
+	ParameterXFSCRC                       = "xfsCRC"
+
+	// ParameterFsckPolicy controls whether the filesystem is checked or
+	// repaired before it is mounted.
+	ParameterFsckPolicy = "fsckPolicy"
+
+	// Parameters with this prefix are reserved for the CO and its sidecars.
+	reservedParameterPrefix = "csi.storage.k8s.io/"
+
+	// Parameters passed by the external-provisioner when running with
+	// --extra-create-metadata.
+	parameterPVCName      = reservedParameterPrefix + "pvc/name"
+	parameterPVCNamespace = reservedParameterPrefix + "pvc/namespace"
+	parameterPVName       = reservedParameterPrefix + "pv/name"
+
+	// Labels with this prefix are managed by the driver.
+	reservedLabelPrefix = PluginName + "/"
+)
+
+// Policies for deleting volumes protected against deletion.
+const (
+	// DeleteProtectionPolicyRefuse makes DeleteVolume fail until the
+	// protection has been lifted manually.
+	DeleteProtectionPolicyRefuse = "refuse"
+
+	// DeleteProtectionPolicyLift makes DeleteVolume lift the protection,
+	// as the CO only deletes volumes if the reclaim policy allows it.
+	DeleteProtectionPolicyLift = "lift"
+)
+
+// Keys of the volume context passed from the controller to the node.
+const (
+	VolumeContextFSType     = "fsType"
+	VolumeContextEncrypted  = "encrypted"
+	VolumeContextBackup     = "backup"
+	VolumeContextFsckPolicy = "fsckPolicy"
+
+	// VolumeContextDeleteProtection reports the delete protection of a
+	// volume in ControllerGetVolume.
+	VolumeContextDeleteProtection = "deleteProtection"
+)
+
+// Keys of the publish context passed from the controller to the node.
+const (
+	PublishContextDevicePath = "devicePath"
+)
+
+// Keys of the secrets passed to the node.
+const (
+	SecretEncryptionPassphrase = "encryption-passphrase"
+)
+
+// formatParameters are the parameters controlling how the filesystem is
+// created.
+var formatParameters = []string{
+	ParameterFSLabel,
+	ParameterExt4InodeRatio,
+	ParameterExt4ReservedBlocksPercentage,
+	ParameterExt4LazyInit,
+	ParameterXFSReflink,
+	ParameterXFSCRC,
+}
+
+var supportedFSTypes = map[string]bool{
+	"ext3":  true,
+	"ext4":  true,
+	"xfs":   true,
+	"btrfs": true,
+}
+
+var (
+	labelKeyNameRegexp   = regexp.MustCompile(`^[a-zA-Z0-9]([-_.a-zA-Z0-9]*[a-zA-Z0-9])?$`)
+	labelKeyPrefixRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+	labelValueRegexp     = regexp.MustCompile(`^([a-zA-Z0-9]([-_.a-zA-Z0-9]*[a-zA-Z0-9])?)?$`)
+	volumeNameRegexp     = regexp.MustCompile(`^[a-zA-Z0-9]([-_.a-zA-Z0-9]*[a-zA-Z0-9])?$`)
+)
+
+// maxVolumeNameLength is the maximum length of the name of a volume.
+const maxVolumeNameLength = 64
+
+// sampleVolumeName is used to check name templates before the name of the
+// volume is known.
+const sampleVolumeName = "pvc-00000000-0000-0000-0000-000000000000"
+
+// volumeParameters are the validated parameters of a CreateVolume request.
+type volumeParameters struct {
+	FSType           string
+	Labels           map[string]string
+	DeleteProtection bool
+	// DeleteProtectionPolicy is empty if not set.
+	DeleteProtectionPolicy string
+	NameTemplate           *template.Template
+	Encrypted              bool
+
+	// Format holds the format parameters as passed to the node.
+	Format map[string]string
+	// FsckPolicy is empty if not set.
+	FsckPolicy string
+
+	// Only available if the external-provisioner passes them.
+	PVCName      string
+	PVCNamespace string
+	PVName       string
+}
+
+// volumeNameData is passed to the name template.
+type volumeNameData struct {
+	// Name is the name of the volume as requested by the CO.
+	Name         string
+	PVCName      string
+	PVCNamespace string
+	PVName       string
+}
+
+func parseVolumeParameters(params map[string]string) (*volumeParameters, error) {
+	p := &volumeParameters{}
+	for key, value := range params {
+		switch key {
+		case ParameterFSType:
+			if !supportedFSTypes[value] {
+				return nil, fmt.Errorf("unsupported %s %q", key, value)
+			}
+			p.FSType = value
+		case ParameterLabels:
+			labels, err := ParseLabels(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %s", key, err)
+			}
+			if err := validateLabels(labels); err != nil {
+				return nil, fmt.Errorf("invalid %s: %s", key, err)
+			}
+			for labelKey := range labels {
+				if strings.HasPrefix(labelKey, reservedLabelPrefix) {
+					return nil, fmt.Errorf("invalid %s: label %q uses reserved prefix %s", key, labelKey, reservedLabelPrefix)
+				}
+			}
+			p.Labels = labels
+		case ParameterDeleteProtection:
+			deleteProtection, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q: must be true or false", key, value)
+			}
+			p.DeleteProtection = deleteProtection
+		case ParameterDeleteProtectionPolicy:
+			switch value {
+			case DeleteProtectionPolicyRefuse, DeleteProtectionPolicyLift:
+			default:
+				return nil, fmt.Errorf("invalid %s %q: must be %s or %s", key, value, DeleteProtectionPolicyRefuse, DeleteProtectionPolicyLift)
+			}
+			p.DeleteProtectionPolicy = value
+		case ParameterNameTemplate:
+			tmpl, err := template.New(key).Option("missingkey=error").Parse(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %s", key, err)
+			}
+			p.NameTemplate = tmpl
+		case ParameterEncrypted:
+			encrypted, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q: must be true or false", key, value)
+			}
+			p.Encrypted = encrypted
+		case ParameterFSLabel, ParameterExt4InodeRatio, ParameterExt4ReservedBlocksPercentage,
+			ParameterExt4LazyInit, ParameterXFSReflink, ParameterXFSCRC:
+			if p.Format == nil {
+				p.Format = make(map[string]string)
+			}
+			p.Format[key] = value
+		case ParameterFsckPolicy:
+			if err := validateFsckPolicy(value); err != nil {
+				return nil, fmt.Errorf("invalid %s: %s", key, err)
+			}
+			p.FsckPolicy = value
+		case parameterPVCName:
+			p.PVCName = value
+		case parameterPVCNamespace:
+			p.PVCNamespace = value
+		case parameterPVName:
+			p.PVName = value
+		default:
+			if strings.HasPrefix(key, reservedParameterPrefix) {
+				continue
+			}
+			return nil, fmt.Errorf("unknown parameter %q", key)
+		}
+	}
+	if p.NameTemplate != nil {
+		// Reject templates which cannot result in a valid name before
+		// anything is created.
+		if _, err := p.volumeName(volumeNameData{
+			Name:         sampleVolumeName,
+			PVCName:      p.PVCName,
+			PVCNamespace: p.PVCNamespace,
+			PVName:       p.PVName,
+		}); err != nil {
+			return nil, err
+		}
+	}
+	if p.Format != nil {
+		formatOpts, err := parseFormatOpts(p.Format)
+		if err != nil {
+			return nil, err
+		}
+		// Without fsType, the filesystem is only known to the node.
+		if err := formatOpts.Validate(p.FSType); err != nil {
+			return nil, fmt.Errorf("invalid format parameters: %s", err)
+		}
+	}
+	return p, nil
+}
+
+// parseFormatOpts returns the format options set by the format parameters in
+// values, which are either StorageClass parameters or the volume context.
+func parseFormatOpts(values map[string]string) (volumes.FormatOpts, error) {
+	var opts volumes.FormatOpts
+	for _, key := range formatParameters {
+		value, ok := values[key]
+		if !ok {
+			continue
+		}
+		var err error
+		switch key {
+		case ParameterFSLabel:
+			opts.Label = value
+		case ParameterExt4InodeRatio:
+			opts.InodeRatio, err = strconv.Atoi(value)
+		case ParameterExt4ReservedBlocksPercentage:
+			opts.ReservedBlocksPercentage, err = strconv.Atoi(value)
+		case ParameterExt4LazyInit:
+			var lazyInit bool
+			lazyInit, err = strconv.ParseBool(value)
+			opts.DisableLazyInit = !lazyInit
+		case ParameterXFSReflink:
+			opts.Reflink, err = parseBoolPtr(value)
+		case ParameterXFSCRC:
+			opts.CRC, err = parseBoolPtr(value)
+		}
+		if err != nil {
+			return volumes.FormatOpts{}, fmt.Errorf("invalid %s %q", key, value)
+		}
+	}
+	if err := opts.Validate(""); err != nil {
+		return volumes.FormatOpts{}, fmt.Errorf("invalid format parameters: %s", err)
+	}
+	return opts, nil
+}
+
+func validateFsckPolicy(policy string) error {
+	switch policy {
+	case volumes.FsckPolicyNever, volumes.FsckPolicyCheck, volumes.FsckPolicyRepair:
+		return nil
+	}
+	return fmt.Errorf("%q must be %s, %s or %s", policy, volumes.FsckPolicyNever, volumes.FsckPolicyCheck, volumes.FsckPolicyRepair)
+}
+
+func parseBoolPtr(value string) (*bool, error) {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// volumeName returns the name of the volume to create, which is either the
+// name requested by the CO or the result of the name template.
+func (p *volumeParameters) volumeName(data volumeNameData) (string, error) {
+	if p.NameTemplate == nil {
+		return data.Name, nil
+	}
+	var buf bytes.Buffer
+	if err := p.NameTemplate.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to execute %s: %s", ParameterNameTemplate, err)
+	}
+	name := strings.TrimSpace(buf.String())
+	if name == "" {
+		return "", fmt.Errorf("%s resulted in an empty name", ParameterNameTemplate)
+	}
+	if len(name) > maxVolumeNameLength || !volumeNameRegexp.MatchString(name) {
+		return "", fmt.Errorf("%s resulted in invalid volume name %q: must be at most %d letters, digits, '-', '_' or '.' and start and end with a letter or digit",
+			ParameterNameTemplate, name, maxVolumeNameLength)
+	}
+	return name, nil
+}
+
+// IsValidLabelValue reports whether value can be used as value of a label.
+func IsValidLabelValue(value string) bool {
+	return len(value) <= 63 && labelValueRegexp.MatchString(value)
+}
+
+// validateLabels checks that labels are accepted by the Hetzner Cloud API.
+func validateLabels(labels map[string]string) error {
+	for key, value := range labels {
+		name := key
+		if i := strings.LastIndex(key, "/"); i >= 0 {
+			prefix := key[:i]
+			name = key[i+1:]
+			if len(prefix) > 253 || !labelKeyPrefixRegexp.MatchString(prefix) {
+				return fmt.Errorf("invalid label key %q", key)
+			}
+		}
+		if len(name) > 63 || !labelKeyNameRegexp.MatchString(name) {
+			return fmt.Errorf("invalid label key %q", key)
+		}
+		if !IsValidLabelValue(value) {
+			return fmt.Errorf("invalid value %q for label %q", value, key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+package driver
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseVolumeParameters(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Params map[string]string
+		FSType string
+		Labels map[string]string
+		DP     bool
+		OK     bool
+	}{
+		{
+			Name:   "no parameters",
+			Params: nil,
+			OK:     true,
+		},
+		{
+			Name: "all parameters",
+			Params: map[string]string{
+				ParameterFSType:           "xfs",
+				ParameterLabels:           "env=prod,example.com/team=storage",
+				ParameterDeleteProtection: "true",
+				ParameterNameTemplate:     "vol-{{ .Name }}",
+			},
+			FSType: "xfs",
+			Labels: map[string]string{"env": "prod", "example.com/team": "storage"},
+			DP:     true,
+			OK:     true,
+		},
+		{
+			Name: "reserved parameters are ignored",
+			Params: map[string]string{
+				"csi.storage.k8s.io/pvc/name": "data",
+			},
+			OK: true,
+		},
+		{
+			Name:   "unknown parameter",
+			Params: map[string]string{"foo": "bar"},
+			OK:     false,
+		},
+		{
+			Name:   "unsupported fs type",
+			Params: map[string]string{ParameterFSType: "ntfs"},
+			OK:     false,
+		},
+		{
+			Name:   "invalid label key",
+			Params: map[string]string{ParameterLabels: "-env=prod"},
+			OK:     false,
+		},
+		{
+			Name:   "invalid label value",
+			Params: map[string]string{ParameterLabels: "env=prod!"},
+			OK:     false,
+		},
+		{
+			Name:   "reserved label prefix",
+			Params: map[string]string{ParameterLabels: LabelCluster + "=other"},
+			OK:     false,
+		},
+		{
+			Name:   "invalid delete protection",
+			Params: map[string]string{ParameterDeleteProtection: "maybe"},
+			OK:     false,
+		},
+		{
+			Name:   "delete protection policy",
+			Params: map[string]string{ParameterDeleteProtectionPolicy: DeleteProtectionPolicyLift},
+			OK:     true,
+		},
+		{
+			Name:   "invalid delete protection policy",
+			Params: map[string]string{ParameterDeleteProtectionPolicy: "ignore"},
+			OK:     false,
+		},
+		{
+			Name:   "invalid name template",
+			Params: map[string]string{ParameterNameTemplate: "{{ .Name"},
+			OK:     false,
+		},
+		{
+			Name: "ext4 format parameters",
+			Params: map[string]string{
+				ParameterFSType:                       "ext4",
+				ParameterFSLabel:                      "data",
+				ParameterExt4InodeRatio:               "65536",
+				ParameterExt4ReservedBlocksPercentage: "5",
+				ParameterExt4LazyInit:                 "false",
+			},
+			FSType: "ext4",
+			OK:     true,
+		},
+		{
+			Name: "xfs format parameters",
+			Params: map[string]string{
+				ParameterFSType:     "xfs",
+				ParameterXFSReflink: "true",
+				ParameterXFSCRC:     "true",
+			},
+			FSType: "xfs",
+			OK:     true,
+		},
+		{
+			Name:   "format parameters without fs type",
+			Params: map[string]string{ParameterXFSReflink: "false"},
+			OK:     true,
+		},
+		{
+			Name: "format parameter of other fs type",
+			Params: map[string]string{
+				ParameterFSType:         "xfs",
+				ParameterExt4InodeRatio: "65536",
+			},
+			OK: false,
+		},
+		{
+			Name:   "invalid inode ratio",
+			Params: map[string]string{ParameterExt4InodeRatio: "1"},
+			OK:     false,
+		},
+		{
+			Name:   "invalid reserved blocks percentage",
+			Params: map[string]string{ParameterExt4ReservedBlocksPercentage: "many"},
+			OK:     false,
+		},
+		{
+			Name:   "invalid fs label",
+			Params: map[string]string{ParameterFSLabel: "my data"},
+			OK:     false,
+		},
+		{
+			Name: "fs label too long",
+			Params: map[string]string{
+				ParameterFSType:  "xfs",
+				ParameterFSLabel: "longer-than-twelve",
+			},
+			OK: false,
+		},
+		{
+			Name:   "fsck policy",
+			Params: map[string]string{ParameterFsckPolicy: "check"},
+			OK:     true,
+		},
+		{
+			Name:   "invalid fsck policy",
+			Params: map[string]string{ParameterFsckPolicy: "sometimes"},
+			OK:     false,
+		},
+		{
+			Name: "reflink without crc",
+			Params: map[string]string{
+				ParameterXFSReflink: "true",
+				ParameterXFSCRC:     "false",
+			},
+			OK: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			params, err := parseVolumeParameters(testCase.Params)
+			if (err == nil) != testCase.OK {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !testCase.OK {
+				return
+			}
+			if params.FSType != testCase.FSType {
+				t.Errorf("unexpected fs type: %s", params.FSType)
+			}
+			if len(params.Labels) != 0 || len(testCase.Labels) != 0 {
+				if !reflect.DeepEqual(params.Labels, testCase.Labels) {
+					t.Errorf("unexpected labels: %v", params.Labels)
+				}
+			}
+			if params.DeleteProtection != testCase.DP {
+				t.Errorf("unexpected delete protection: %v", params.DeleteProtection)
+			}
+		})
+	}
+}
+
+func TestVolumeParametersVolumeName(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Template string
+		Result   string
+		OK       bool
+	}{
+		{
+			Name:   "without template",
+			Result: "pvc-123",
+			OK:     true,
+		},
+		{
+			Name:     "with template",
+			Template: "vol-{{ .Name }}",
+			Result:   "vol-pvc-123",
+			OK:       true,
+		},
+		{
+			Name:     "unknown field",
+			Template: "{{ .Unknown }}",
+			OK:       false,
+		},
+		{
+			Name:     "empty result",
+			Template: " ",
+			OK:       false,
+		},
+		{
+			Name:     "invalid characters",
+			Template: "vol {{ .Name }}",
+			OK:       false,
+		},
+		{
+			Name:     "too long",
+			Template: "{{ .Name }}-{{ .Name }}",
+			OK:       false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			params := map[string]string{}
+			if testCase.Template != "" {
+				params[ParameterNameTemplate] = testCase.Template
+			}
+			// Broken templates are rejected by either.
+			var name string
+			p, err := parseVolumeParameters(params)
+			if err == nil {
+				name, err = p.volumeName(volumeNameData{Name: "pvc-123"})
+			}
+			if (err == nil) != testCase.OK {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if name != testCase.Result {
+				t.Errorf("unexpected name: %s", name)
+			}
+		})
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"os"
 	"sync"
 	"testing"
+	"time"
 
 	proto "github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/go-kit/kit/log"
@@ -42,10 +43,24 @@ func TestSanity(t *testing.T) {
 	volumeMountService := &sanityMountService{}
 	volumeResizeService := &sanityResizeService{}
 	volumeStatsService := &sanityStatsService{}
+	snapshotService := volumes.NewCopySnapshotService(
+		log.With(logger, "component", "copy-snapshot-service"),
+		volumeService,
+		&sanityCopyService{},
+		SnapshotLabels,
+	)
 	controllerService := NewControllerService(
 		log.With(logger, "component", "driver-controller-service"),
 		volumeService,
+		snapshotService,
+		&sanityServerService{},
+		nil,
+		&sanityCopyService{},
 		"testloc",
+		"",
+		nil,
+		false,
+		false,
 	)
 	identityService := NewIdentityService(
 		log.With(logger, "component", "driver-identity-service"),
@@ -60,14 +75,14 @@ func TestSanity(t *testing.T) {
 				},
 			},
 		},
-		volumeService,
 		volumeMountService,
 		volumeResizeService,
 		volumeStatsService,
+		nil,
 	)
 
 	grpcServer := grpc.NewServer()
-	proto.RegisterControllerServer(grpcServer, controllerService)
+	proto.RegisterControllerServer(grpcServer, &sanityControllerService{controllerService})
 	proto.RegisterIdentityServer(grpcServer, identityService)
 	proto.RegisterNodeServer(grpcServer, nodeService)
 
@@ -90,9 +105,35 @@ func TestSanity(t *testing.T) {
 	sanity.Test(t, testConfig)
 }
 
+// sanityControllerService hides the controller capabilities added in CSI 1.3
+// from csi-test, which predates them and fails on capabilities it does not
+// know.
+type sanityControllerService struct {
+	*ControllerService
+}
+
+func (s *sanityControllerService) ControllerGetCapabilities(ctx context.Context, req *proto.ControllerGetCapabilitiesRequest) (*proto.ControllerGetCapabilitiesResponse, error) {
+	resp, err := s.ControllerService.ControllerGetCapabilities(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	var capabilities []*proto.ControllerServiceCapability
+	for _, capability := range resp.Capabilities {
+		switch capability.GetRpc().GetType() {
+		case proto.ControllerServiceCapability_RPC_GET_VOLUME,
+			proto.ControllerServiceCapability_RPC_VOLUME_CONDITION:
+			continue
+		}
+		capabilities = append(capabilities, capability)
+	}
+	resp.Capabilities = capabilities
+	return resp, nil
+}
+
 type sanityVolumeService struct {
 	mu      sync.Mutex
 	volumes list.List
+	lastID  uint64
 }
 
 func (s *sanityVolumeService) Create(ctx context.Context, opts volumes.CreateOpts) (*csi.Volume, error) {
@@ -106,16 +147,22 @@ func (s *sanityVolumeService) Create(ctx context.Context, opts volumes.CreateOpt
 		}
 	}
 
+	s.lastID++
 	volume := &csi.Volume{
-		ID:          uint64(s.volumes.Len() + 1),
+		ID:          s.lastID,
 		Name:        opts.Name,
 		Size:        opts.MinSize,
 		Location:    opts.Location,
-		LinuxDevice: fmt.Sprintf("/dev/disk/by-id/scsi-0HC_Volume_%d", s.volumes.Len()+1),
+		LinuxDevice: fmt.Sprintf("/dev/disk/by-id/scsi-0HC_Volume_%d", s.lastID),
+		Created:     time.Now(),
 	}
 
+	volume.Labels = make(map[string]string, len(opts.Labels))
+	for key, value := range opts.Labels {
+		volume.Labels[key] = value
+	}
 	s.volumes.PushBack(volume)
-	return volume, nil
+	return copyVolume(volume), nil
 }
 
 func (s *sanityVolumeService) GetByID(ctx context.Context, id uint64) (*csi.Volume, error) {
@@ -125,7 +172,7 @@ func (s *sanityVolumeService) GetByID(ctx context.Context, id uint64) (*csi.Volu
 	for e := s.volumes.Front(); e != nil; e = e.Next() {
 		v := e.Value.(*csi.Volume)
 		if v.ID == id {
-			return v, nil
+			return copyVolume(v), nil
 		}
 	}
 
@@ -139,13 +186,33 @@ func (s *sanityVolumeService) GetByName(ctx context.Context, name string) (*csi.
 	for e := s.volumes.Front(); e != nil; e = e.Next() {
 		v := e.Value.(*csi.Volume)
 		if v.Name == name {
-			return v, nil
+			return copyVolume(v), nil
 		}
 	}
 
 	return nil, volumes.ErrVolumeNotFound
 }
 
+func (s *sanityVolumeService) List(ctx context.Context, opts volumes.ListOpts) ([]*csi.Volume, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var result []*csi.Volume
+	for e := s.volumes.Front(); e != nil; e = e.Next() {
+		v := e.Value.(*csi.Volume)
+		matches := true
+		for key, value := range opts.Labels {
+			if v.Labels[key] != value {
+				matches = false
+			}
+		}
+		if matches {
+			result = append(result, copyVolume(v))
+		}
+	}
+	return result, nil
+}
+
 func (s *sanityVolumeService) Delete(ctx context.Context, volume *csi.Volume) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -176,6 +243,39 @@ func (s *sanityVolumeService) Resize(ctx context.Context, volume *csi.Volume, si
 	return volumes.ErrVolumeNotFound
 }
 
+func (s *sanityVolumeService) SetLabels(ctx context.Context, volume *csi.Volume, labels map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for e := s.volumes.Front(); e != nil; e = e.Next() {
+		v := e.Value.(*csi.Volume)
+		if v.ID == volume.ID {
+			v.Labels = make(map[string]string, len(labels))
+			for key, value := range labels {
+				v.Labels[key] = value
+			}
+			return nil
+		}
+	}
+
+	return volumes.ErrVolumeNotFound
+}
+
+func (s *sanityVolumeService) SetDeleteProtection(ctx context.Context, volume *csi.Volume, enabled bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for e := s.volumes.Front(); e != nil; e = e.Next() {
+		v := e.Value.(*csi.Volume)
+		if v.ID == volume.ID {
+			v.DeleteProtection = enabled
+			return nil
+		}
+	}
+
+	return volumes.ErrVolumeNotFound
+}
+
 func (s *sanityVolumeService) Attach(ctx context.Context, volume *csi.Volume, server *csi.Server) error {
 	return nil
 }
@@ -184,9 +284,40 @@ func (s *sanityVolumeService) Detach(ctx context.Context, volume *csi.Volume, se
 	return nil
 }
 
+// copyVolume returns a copy of a volume of the sanity volume service, so
+// callers never share its state like volumes returned by the API.
+func copyVolume(volume *csi.Volume) *csi.Volume {
+	v := *volume
+	v.Labels = make(map[string]string, len(volume.Labels))
+	for key, value := range volume.Labels {
+		v.Labels[key] = value
+	}
+	return &v
+}
+
+type sanityServerService struct{}
+
+func (s *sanityServerService) GetByID(ctx context.Context, id uint64) (*csi.Server, error) {
+	return &csi.Server{ID: id, Location: "testloc"}, nil
+}
+
+func (s *sanityServerService) List(ctx context.Context) ([]*csi.Server, error) {
+	return nil, nil
+}
+
+type sanityCopyService struct{}
+
+func (s *sanityCopyService) Copy(ctx context.Context, src *csi.Volume, dst *csi.Volume) error {
+	return nil
+}
+
 type sanityMountService struct{}
 
-func (s *sanityMountService) Stage(volume *csi.Volume, stagingTargetPath string, opts volumes.MountOpts) error {
+func (s *sanityMountService) VerifyDevice(ctx context.Context, volume *csi.Volume) error {
+	return nil
+}
+
+func (s *sanityMountService) Stage(ctx context.Context, volume *csi.Volume, stagingTargetPath string, opts volumes.MountOpts) error {
 	return nil
 }
 
@@ -198,7 +329,7 @@ func (s *sanityMountService) Publish(volume *csi.Volume, targetPath string, stag
 	return nil
 }
 
-func (s *sanityMountService) Unpublish(volume *csi.Volume, targetPath string) error {
+func (s *sanityMountService) Unpublish(targetPath string) error {
 	return nil
 }
 
@@ -211,8 +342,8 @@ func (s *sanityMountService) PathExists(path string) (bool, error) {
 
 type sanityResizeService struct{}
 
-func (s *sanityResizeService) Resize(volume *csi.Volume, volumePath string) error {
-	return nil
+func (s *sanityResizeService) Resize(volume *csi.Volume, volumePath string) (int64, error) {
+	return 0, nil
 }
 
 type sanityStatsService struct{}
@@ -0,0 +1,151 @@
+// Package k8s implements the subset of the Kubernetes API needed to find the
+// volumes backing the persistent volumes of the cluster.
+package k8s
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+	// listPageSize is the number of persistent volumes listed at once.
+	listPageSize = 500
+)
+
+// Client lists the persistent volumes of a cluster.
+type Client struct {
+	endpoint   *url.URL
+	token      string
+	driver     string
+	httpClient *http.Client
+}
+
+func NewClient(endpoint string, token string, driver string, httpClient *http.Client) (*Client, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint: %s", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid endpoint %q: scheme must be http or https", endpoint)
+	}
+	if httpClient == nil {
+		httpClient = &http.Client{}
+	}
+	return &Client{
+		endpoint:   u,
+		token:      token,
+		driver:     driver,
+		httpClient: httpClient,
+	}, nil
+}
+
+// NewInClusterClient returns a client authenticating with the service account
+// of the pod it runs in.
+func NewInClusterClient(driver string) (*Client, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a cluster: KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set")
+	}
+	token, err := ioutil.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account token: %s", err)
+	}
+	ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account CA: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("invalid service account CA")
+	}
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		},
+	}
+	return NewClient("https://"+net.JoinHostPort(host, port), strings.TrimSpace(string(token)), driver, httpClient)
+}
+
+type persistentVolumeList struct {
+	Metadata struct {
+		Continue string `json:"continue"`
+	} `json:"metadata"`
+	Items []struct {
+		Spec struct {
+			CSI *struct {
+				Driver       string `json:"driver"`
+				VolumeHandle string `json:"volumeHandle"`
+			} `json:"csi"`
+		} `json:"spec"`
+	} `json:"items"`
+}
+
+// KnownVolumeIDs returns the IDs of the volumes backing persistent volumes
+// provisioned by the driver.
+func (c *Client) KnownVolumeIDs(ctx context.Context) (map[uint64]bool, error) {
+	ids := make(map[uint64]bool)
+	continueToken := ""
+	for {
+		query := url.Values{"limit": {strconv.Itoa(listPageSize)}}
+		if continueToken != "" {
+			query.Set("continue", continueToken)
+		}
+		var list persistentVolumeList
+		if err := c.get(ctx, "/api/v1/persistentvolumes", query, &list); err != nil {
+			return nil, err
+		}
+		for _, pv := range list.Items {
+			if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != c.driver {
+				continue
+			}
+			id, err := strconv.ParseUint(pv.Spec.CSI.VolumeHandle, 10, 64)
+			if err != nil {
+				continue
+			}
+			ids[id] = true
+		}
+		if list.Metadata.Continue == "" {
+			return ids, nil
+		}
+		continueToken = list.Metadata.Continue
+	}
+}
+
+func (c *Client) get(ctx context.Context, path string, query url.Values, v interface{}) error {
+	u := *c.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected response %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
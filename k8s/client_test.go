@@ -0,0 +1,70 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/hetznercloud/csi-driver/volumes"
+)
+
+var _ volumes.KnownVolumeLister = (*Client)(nil)
+
+func TestClientKnownVolumeIDs(t *testing.T) {
+	pages := []string{
+		`{"metadata":{"continue":"page2"},"items":[
+			{"spec":{"csi":{"driver":"csi.hetzner.cloud","volumeHandle":"1"}}},
+			{"spec":{"csi":{"driver":"other.csi.example.com","volumeHandle":"2"}}},
+			{"spec":{"hostPath":{"path":"/tmp"}}}
+		]}`,
+		`{"metadata":{},"items":[
+			{"spec":{"csi":{"driver":"csi.hetzner.cloud","volumeHandle":"3"}}},
+			{"spec":{"csi":{"driver":"csi.hetzner.cloud","volumeHandle":"invalid"}}}
+		]}`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/api/v1/persistentvolumes" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch r.URL.Query().Get("continue") {
+		case "":
+			fmt.Fprint(w, pages[0])
+		case "page2":
+			fmt.Fprint(w, pages[1])
+		default:
+			w.WriteHeader(http.StatusGone)
+		}
+	}))
+	defer server.Close()
+
+	client, err := NewClient(server.URL, "token", "csi.hetzner.cloud", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := client.KnownVolumeIDs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, map[uint64]bool{1: true, 3: true}) {
+		t.Errorf("unexpected volume ids: %v", ids)
+	}
+
+	client.token = "wrong"
+	if _, err := client.KnownVolumeIDs(context.Background()); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestNewClientInvalidEndpoint(t *testing.T) {
+	if _, err := NewClient("ftp://example.com", "", "csi.hetzner.cloud", nil); err == nil {
+		t.Error("expected error")
+	}
+}
@@ -13,13 +13,21 @@ import (
 
 // Metrics wraps the prometheus metrics gathering and serving.
 //
-// It exposes gRPC and Go Runtime metrics.
+// It exposes gRPC, Go Runtime, hcloud API, cache, orphaned volume and
+// filesystem check metrics.
 type Metrics struct {
 	logger      log.Logger
 	addr        string
 	reg         *prometheus.Registry
 	grpcMetrics *grpc_prometheus.ServerMetrics
 	goMetrics   prometheus.Collector
+
+	hcloudRateLimitRemaining prometheus.Gauge
+	cacheRequests            *prometheus.CounterVec
+	orphanedVolumes          prometheus.Gauge
+	orphanedVolumesDeleted   prometheus.Counter
+	filesystemChecks         *prometheus.CounterVec
+	filesystemErrors         *prometheus.GaugeVec
 }
 
 func New(logger log.Logger, addr string) *Metrics {
@@ -29,6 +37,31 @@ func New(logger log.Logger, addr string) *Metrics {
 		reg:         prometheus.NewRegistry(),
 		grpcMetrics: grpc_prometheus.NewServerMetrics(),
 		goMetrics:   prometheus.NewGoCollector(),
+
+		hcloudRateLimitRemaining: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "hcloud_api_rate_limit_remaining",
+			Help: "Remaining requests of the hcloud API rate limit as last reported by the API.",
+		}),
+		cacheRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "hcloud_cache_requests_total",
+			Help: "Lookups of hcloud API objects in the cache by cache and result (hit or miss).",
+		}, []string{"cache", "result"}),
+		orphanedVolumes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "hcloud_orphaned_volumes",
+			Help: "Volumes of the cluster which do not back a persistent volume.",
+		}),
+		orphanedVolumesDeleted: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "hcloud_orphaned_volumes_deleted_total",
+			Help: "Orphaned volumes deleted by the driver.",
+		}),
+		filesystemChecks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "hcloud_volume_fsck_total",
+			Help: "Filesystem checks before mounting by volume and result (clean, repaired, errors, skipped or failed).",
+		}, []string{"volume_id", "result"}),
+		filesystemErrors: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "hcloud_volume_filesystem_errors",
+			Help: "Whether the last filesystem check of a volume left errors (1) or not (0).",
+		}, []string{"volume_id"}),
 	}
 
 	level.Debug(metrics.logger).Log(
@@ -38,6 +71,12 @@ func New(logger log.Logger, addr string) *Metrics {
 	metrics.grpcMetrics.EnableHandlingTimeHistogram()
 	metrics.reg.MustRegister(metrics.goMetrics)
 	metrics.reg.MustRegister(metrics.grpcMetrics)
+	metrics.reg.MustRegister(metrics.hcloudRateLimitRemaining)
+	metrics.reg.MustRegister(metrics.cacheRequests)
+	metrics.reg.MustRegister(metrics.orphanedVolumes)
+	metrics.reg.MustRegister(metrics.orphanedVolumesDeleted)
+	metrics.reg.MustRegister(metrics.filesystemChecks)
+	metrics.reg.MustRegister(metrics.filesystemErrors)
 
 	level.Debug(metrics.logger).Log(
 		"msg", "registered metrics",
@@ -59,6 +98,56 @@ func (s *Metrics) InitializeMetrics(server *grpc.Server) {
 	s.grpcMetrics.InitializeMetrics(server)
 }
 
+// HcloudRateLimitRemaining returns the gauge of the remaining hcloud API
+// rate limit.
+func (s *Metrics) HcloudRateLimitRemaining() prometheus.Gauge {
+	return s.hcloudRateLimitRemaining
+}
+
+// CacheHits returns the counter of the lookups served by the cache.
+func (s *Metrics) CacheHits(cache string) prometheus.Counter {
+	return s.cacheRequests.WithLabelValues(cache, "hit")
+}
+
+// CacheMisses returns the counter of the lookups not served by the cache.
+func (s *Metrics) CacheMisses(cache string) prometheus.Counter {
+	return s.cacheRequests.WithLabelValues(cache, "miss")
+}
+
+// OrphanedVolumes returns the gauge of the orphaned volumes.
+func (s *Metrics) OrphanedVolumes() prometheus.Gauge {
+	return s.orphanedVolumes
+}
+
+// OrphanedVolumesDeleted returns the counter of the deleted orphaned volumes.
+func (s *Metrics) OrphanedVolumesDeleted() prometheus.Counter {
+	return s.orphanedVolumesDeleted
+}
+
+// FilesystemChecks returns the counter of the filesystem checks of a volume
+// with the given result.
+func (s *Metrics) FilesystemChecks(volumeID string, result string) prometheus.Counter {
+	return s.filesystemChecks.WithLabelValues(volumeID, result)
+}
+
+// FilesystemErrors returns the gauge of whether the filesystem of a volume
+// has errors left.
+func (s *Metrics) FilesystemErrors(volumeID string) prometheus.Gauge {
+	return s.filesystemErrors.WithLabelValues(volumeID)
+}
+
+// DeleteFilesystemChecks deletes the counter of the filesystem checks of a
+// volume with the given result.
+func (s *Metrics) DeleteFilesystemChecks(volumeID string, result string) {
+	s.filesystemChecks.DeleteLabelValues(volumeID, result)
+}
+
+// DeleteFilesystemErrors deletes the gauge of whether the filesystem of a
+// volume has errors left.
+func (s *Metrics) DeleteFilesystemErrors(volumeID string) {
+	s.filesystemErrors.DeleteLabelValues(volumeID)
+}
+
 func (s *Metrics) Serve() {
 	httpServer := &http.Server{Handler: promhttp.HandlerFor(s.reg, promhttp.HandlerOpts{}), Addr: s.addr}
 
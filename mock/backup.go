@@ -0,0 +1,43 @@
+package mock
+
+import (
+	"context"
+
+	"github.com/hetznercloud/csi-driver/csi"
+	"github.com/hetznercloud/csi-driver/volumes"
+)
+
+type BackupService struct {
+	BackupFunc  func(ctx context.Context, opts volumes.BackupOpts) (*csi.Backup, error)
+	RestoreFunc func(ctx context.Context, name string, opts volumes.RestoreOpts) error
+	GetFunc     func(ctx context.Context, name string) (*csi.Backup, error)
+	DeleteFunc  func(ctx context.Context, name string) error
+}
+
+func (s *BackupService) Backup(ctx context.Context, opts volumes.BackupOpts) (*csi.Backup, error) {
+	if s.BackupFunc == nil {
+		panic("not implemented")
+	}
+	return s.BackupFunc(ctx, opts)
+}
+
+func (s *BackupService) Restore(ctx context.Context, name string, opts volumes.RestoreOpts) error {
+	if s.RestoreFunc == nil {
+		panic("not implemented")
+	}
+	return s.RestoreFunc(ctx, name, opts)
+}
+
+func (s *BackupService) Get(ctx context.Context, name string) (*csi.Backup, error) {
+	if s.GetFunc == nil {
+		panic("not implemented")
+	}
+	return s.GetFunc(ctx, name)
+}
+
+func (s *BackupService) Delete(ctx context.Context, name string) error {
+	if s.DeleteFunc == nil {
+		panic("not implemented")
+	}
+	return s.DeleteFunc(ctx, name)
+}
@@ -0,0 +1,26 @@
+package mock
+
+import (
+	"context"
+
+	"github.com/hetznercloud/csi-driver/csi"
+)
+
+type ServerService struct {
+	GetByIDFunc func(ctx context.Context, id uint64) (*csi.Server, error)
+	ListFunc    func(ctx context.Context) ([]*csi.Server, error)
+}
+
+func (s *ServerService) GetByID(ctx context.Context, id uint64) (*csi.Server, error) {
+	if s.GetByIDFunc == nil {
+		panic("not implemented")
+	}
+	return s.GetByIDFunc(ctx, id)
+}
+
+func (s *ServerService) List(ctx context.Context) ([]*csi.Server, error) {
+	if s.ListFunc == nil {
+		panic("not implemented")
+	}
+	return s.ListFunc(ctx)
+}
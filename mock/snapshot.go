@@ -0,0 +1,43 @@
+package mock
+
+import (
+	"context"
+
+	"github.com/hetznercloud/csi-driver/csi"
+	"github.com/hetznercloud/csi-driver/volumes"
+)
+
+type SnapshotService struct {
+	CreateFunc  func(ctx context.Context, opts volumes.CreateSnapshotOpts) (*csi.Snapshot, error)
+	GetByIDFunc func(ctx context.Context, id uint64) (*csi.Snapshot, error)
+	ListFunc    func(ctx context.Context, opts volumes.ListSnapshotsOpts) ([]*csi.Snapshot, error)
+	DeleteFunc  func(ctx context.Context, snapshot *csi.Snapshot) error
+}
+
+func (s *SnapshotService) Create(ctx context.Context, opts volumes.CreateSnapshotOpts) (*csi.Snapshot, error) {
+	if s.CreateFunc == nil {
+		panic("not implemented")
+	}
+	return s.CreateFunc(ctx, opts)
+}
+
+func (s *SnapshotService) GetByID(ctx context.Context, id uint64) (*csi.Snapshot, error) {
+	if s.GetByIDFunc == nil {
+		panic("not implemented")
+	}
+	return s.GetByIDFunc(ctx, id)
+}
+
+func (s *SnapshotService) List(ctx context.Context, opts volumes.ListSnapshotsOpts) ([]*csi.Snapshot, error) {
+	if s.ListFunc == nil {
+		panic("not implemented")
+	}
+	return s.ListFunc(ctx, opts)
+}
+
+func (s *SnapshotService) Delete(ctx context.Context, snapshot *csi.Snapshot) error {
+	if s.DeleteFunc == nil {
+		panic("not implemented")
+	}
+	return s.DeleteFunc(ctx, snapshot)
+}
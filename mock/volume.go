@@ -11,10 +11,14 @@ type VolumeService struct {
 	CreateFunc    func(ctx context.Context, opts volumes.CreateOpts) (*csi.Volume, error)
 	GetByIDFunc   func(ctx context.Context, id uint64) (*csi.Volume, error)
 	GetByNameFunc func(ctx context.Context, name string) (*csi.Volume, error)
+	ListFunc      func(ctx context.Context, opts volumes.ListOpts) ([]*csi.Volume, error)
 	DeleteFunc    func(ctx context.Context, volume *csi.Volume) error
 	AttachFunc    func(ctx context.Context, volume *csi.Volume, server *csi.Server) error
 	DetachFunc    func(ctx context.Context, volume *csi.Volume, server *csi.Server) error
 	ResizeFunc    func(ctx context.Context, volume *csi.Volume, size int) error
+	SetLabelsFunc func(ctx context.Context, volume *csi.Volume, labels map[string]string) error
+
+	SetDeleteProtectionFunc func(ctx context.Context, volume *csi.Volume, enabled bool) error
 }
 
 func (s *VolumeService) Create(ctx context.Context, opts volumes.CreateOpts) (*csi.Volume, error) {
@@ -38,6 +42,13 @@ func (s *VolumeService) GetByName(ctx context.Context, name string) (*csi.Volume
 	return s.GetByNameFunc(ctx, name)
 }
 
+func (s *VolumeService) List(ctx context.Context, opts volumes.ListOpts) ([]*csi.Volume, error) {
+	if s.ListFunc == nil {
+		panic("not implemented")
+	}
+	return s.ListFunc(ctx, opts)
+}
+
 func (s *VolumeService) Delete(ctx context.Context, volume *csi.Volume) error {
 	if s.DeleteFunc == nil {
 		panic("not implemented")
@@ -66,19 +77,52 @@ func (s *VolumeService) Resize(ctx context.Context, volume *csi.Volume, size int
 	return s.ResizeFunc(ctx, volume, size)
 }
 
+func (s *VolumeService) SetLabels(ctx context.Context, volume *csi.Volume, labels map[string]string) error {
+	if s.SetLabelsFunc == nil {
+		panic("not implemented")
+	}
+	return s.SetLabelsFunc(ctx, volume, labels)
+}
+
+func (s *VolumeService) SetDeleteProtection(ctx context.Context, volume *csi.Volume, enabled bool) error {
+	if s.SetDeleteProtectionFunc == nil {
+		panic("not implemented")
+	}
+	return s.SetDeleteProtectionFunc(ctx, volume, enabled)
+}
+
+type VolumeCopyService struct {
+	CopyFunc func(ctx context.Context, src *csi.Volume, dst *csi.Volume) error
+}
+
+func (s *VolumeCopyService) Copy(ctx context.Context, src *csi.Volume, dst *csi.Volume) error {
+	if s.CopyFunc == nil {
+		panic("not implemented")
+	}
+	return s.CopyFunc(ctx, src, dst)
+}
+
 type VolumeMountService struct {
-	StageFunc      func(volume *csi.Volume, stagingTargetPath string, opts volumes.MountOpts) error
-	UnstageFunc    func(volume *csi.Volume, stagingTargetPath string) error
-	PublishFunc    func(volume *csi.Volume, targetPath string, stagingTargetPath string, opts volumes.MountOpts) error
-	UnpublishFunc  func(volume *csi.Volume, targetPath string) error
-	PathExistsFunc func(path string) (bool, error)
+	VerifyDeviceFunc func(ctx context.Context, volume *csi.Volume) error
+	StageFunc        func(ctx context.Context, volume *csi.Volume, stagingTargetPath string, opts volumes.MountOpts) error
+	UnstageFunc      func(volume *csi.Volume, stagingTargetPath string) error
+	PublishFunc      func(volume *csi.Volume, targetPath string, stagingTargetPath string, opts volumes.MountOpts) error
+	UnpublishFunc    func(targetPath string) error
+	PathExistsFunc   func(path string) (bool, error)
+}
+
+func (s *VolumeMountService) VerifyDevice(ctx context.Context, volume *csi.Volume) error {
+	if s.VerifyDeviceFunc == nil {
+		panic("not implemented")
+	}
+	return s.VerifyDeviceFunc(ctx, volume)
 }
 
-func (s *VolumeMountService) Stage(volume *csi.Volume, stagingTargetPath string, opts volumes.MountOpts) error {
+func (s *VolumeMountService) Stage(ctx context.Context, volume *csi.Volume, stagingTargetPath string, opts volumes.MountOpts) error {
 	if s.StageFunc == nil {
 		panic("not implemented")
 	}
-	return s.StageFunc(volume, stagingTargetPath, opts)
+	return s.StageFunc(ctx, volume, stagingTargetPath, opts)
 }
 
 func (s *VolumeMountService) Unstage(volume *csi.Volume, stagingTargetPath string) error {
@@ -102,18 +146,18 @@ func (s *VolumeMountService) PathExists(path string) (bool, error) {
 	return s.PathExistsFunc(path)
 }
 
-func (s *VolumeMountService) Unpublish(volume *csi.Volume, targetPath string) error {
+func (s *VolumeMountService) Unpublish(targetPath string) error {
 	if s.UnpublishFunc == nil {
 		panic("not implemented")
 	}
-	return s.UnpublishFunc(volume, targetPath)
+	return s.UnpublishFunc(targetPath)
 }
 
 type VolumeResizeService struct {
-	ResizeFunc func(volume *csi.Volume, volumePath string) error
+	ResizeFunc func(volume *csi.Volume, volumePath string) (int64, error)
 }
 
-func (s *VolumeResizeService) Resize(volume *csi.Volume, volumePath string) error {
+func (s *VolumeResizeService) Resize(volume *csi.Volume, volumePath string) (int64, error) {
 	if s.ResizeFunc == nil {
 		panic("not implemented")
 	}
@@ -0,0 +1,157 @@
+package s3
+
+import (
+	"context"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hetznercloud/csi-driver/volumes"
+)
+
+var _ volumes.ObjectStore = (*Client)(nil)
+
+// fakeServer is a minimal stand-in for MinIO storing objects of a single
+// bucket in memory.
+type fakeServer struct {
+	t       *testing.T
+	bucket  string
+	pageLen int
+
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (s *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=access/") || !strings.Contains(auth, "Signature=") {
+		s.t.Errorf("unexpected authorization header: %s", auth)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if r.Header.Get("X-Amz-Date") == "" || r.Header.Get("X-Amz-Content-Sha256") == "" {
+		s.t.Error("missing signed headers")
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if path != s.bucket && !strings.HasPrefix(path, s.bucket+"/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(path, s.bucket), "/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodPut:
+		data, _ := ioutil.ReadAll(r.Body)
+		s.objects[key] = data
+	case r.Method == http.MethodGet && key == "":
+		s.list(w, r)
+	case r.Method == http.MethodGet:
+		data, ok := s.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`))
+			return
+		}
+		w.Write(data)
+	case r.Method == http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *fakeServer) list(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	var keys []string
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) && key > r.URL.Query().Get("continuation-token") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	type object struct{ Key string }
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Contents              []object
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+	}{}
+	for i, key := range keys {
+		if i == s.pageLen {
+			result.IsTruncated = true
+			result.NextContinuationToken = keys[i-1]
+			break
+		}
+		result.Contents = append(result.Contents, object{Key: key})
+	}
+	xml.NewEncoder(w).Encode(result)
+}
+
+func newTestClient(t *testing.T) *Client {
+	fake := &fakeServer{t: t, bucket: "backups", pageLen: 2, objects: make(map[string][]byte)}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	client, err := NewClient(server.URL, "", "backups", "access", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestClient(t *testing.T) {
+	client := newTestClient(t)
+	ctx := context.Background()
+
+	for _, key := range []string{"a/1", "a/2", "a/3", "b/1"} {
+		if err := client.Put(ctx, key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := client.Get(ctx, "a/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(data) != "a/2" {
+		t.Errorf("unexpected object contents: %s", data)
+	}
+
+	keys, err := client.List(ctx, "a/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{"a/1", "a/2", "a/3"}) {
+		t.Errorf("unexpected keys: %v", keys)
+	}
+
+	if err := client.Delete(ctx, "a/2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Get(ctx, "a/2"); err != volumes.ErrObjectNotFound {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestNewClientInvalidEndpoint(t *testing.T) {
+	if _, err := NewClient("ftp://example.com", "", "bucket", "", ""); err == nil {
+		t.Error("expected error")
+	}
+	if _, err := NewClient("https://example.com", "", "", "", ""); err == nil {
+		t.Error("expected error")
+	}
+}
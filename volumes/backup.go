@@ -0,0 +1,661 @@
+package volumes
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/hetznercloud/csi-driver/csi"
+)
+
+const (
+	// DefaultBackupChunkSize is the default size of the compressed chunks
+	// backups are split into.
+	DefaultBackupChunkSize = 64 * 1024 * 1024
+
+	backupKeyPrefix       = "backups/"
+	backupManifestVersion = 1
+
+	// restoreMarker is created in the root of a filesystem while a backup is
+	// extracted to it, so that interrupted restores are started over.
+	restoreMarker = ".hcloud-csi-restore-in-progress"
+
+	// restoredMarker replaces restoreMarker once the backup has been
+	// extracted, so that the backup is never restored again, even if all
+	// files are deleted later on.
+	restoredMarker = ".hcloud-csi-restored"
+)
+
+// deviceRestoreMagic is written to the start of a device before a block
+// backup is restored to it and overwritten by the header of the backup last,
+// so that an interrupted restore can be told apart from a finished one.
+var deviceRestoreMagic = []byte("HCLOUD-CSI-RESTORE-IN-PROGRESS")
+
+var backupNameRegexp = regexp.MustCompile(`^[a-z0-9]([-.a-z0-9]*[a-z0-9])?$`)
+
+// IsValidBackupName reports whether name can be used as name of a backup.
+func IsValidBackupName(name string) bool {
+	return len(name) <= 128 && backupNameRegexp.MatchString(name)
+}
+
+// backupManifest describes a backup. It is stored after all chunks have been
+// uploaded, so only complete backups have a manifest.
+type backupManifest struct {
+	Version  int       `json:"version"`
+	VolumeID uint64    `json:"volume_id"`
+	Mode     string    `json:"mode"`
+	Size     int       `json:"size"`
+	Created  time.Time `json:"created"`
+	Chunks   int       `json:"chunks"`
+}
+
+// ObjectStoreBackupService stores backups as gzip compressed archives split
+// into chunks in object storage. Filesystem backups are tar archives, block
+// backups the raw contents of the device.
+type ObjectStoreBackupService struct {
+	logger    log.Logger
+	store     ObjectStore
+	chunkSize int
+}
+
+func NewObjectStoreBackupService(logger log.Logger, store ObjectStore, chunkSize int) *ObjectStoreBackupService {
+	return &ObjectStoreBackupService{
+		logger:    logger,
+		store:     store,
+		chunkSize: chunkSize,
+	}
+}
+
+func (s *ObjectStoreBackupService) Backup(ctx context.Context, opts BackupOpts) (*csi.Backup, error) {
+	if !IsValidBackupName(opts.Name) {
+		return nil, fmt.Errorf("invalid backup name %q", opts.Name)
+	}
+	if opts.Mode != csi.BackupModeFilesystem && opts.Mode != csi.BackupModeBlock {
+		return nil, fmt.Errorf("invalid backup mode %q", opts.Mode)
+	}
+
+	level.Info(s.logger).Log(
+		"msg", "backing up volume",
+		"backup-name", opts.Name,
+		"volume-id", opts.Volume.ID,
+		"mode", opts.Mode,
+		"path", opts.Path,
+	)
+
+	if _, err := s.Get(ctx, opts.Name); err == nil {
+		return nil, ErrBackupAlreadyExists
+	} else if err != ErrBackupNotFound {
+		return nil, err
+	}
+	// Remove the chunks of an earlier attempt.
+	if err := s.deleteObjects(ctx, opts.Name); err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		gz := gzip.NewWriter(pw)
+		var err error
+		switch opts.Mode {
+		case csi.BackupModeFilesystem:
+			err = writeTar(ctx, gz, opts.Path)
+		case csi.BackupModeBlock:
+			err = writeDevice(ctx, gz, opts.Path)
+		}
+		if err == nil {
+			err = gz.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	defer pr.Close()
+
+	chunks := 0
+	buf := make([]byte, s.chunkSize)
+	for {
+		n, err := io.ReadFull(pr, buf)
+		if n > 0 {
+			if err := s.store.Put(ctx, chunkKey(opts.Name, chunks), buf[:n]); err != nil {
+				return nil, fmt.Errorf("failed to upload chunk %d: %s", chunks, err)
+			}
+			chunks++
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	manifest := backupManifest{
+		Version:  backupManifestVersion,
+		VolumeID: opts.Volume.ID,
+		Mode:     opts.Mode,
+		Size:     opts.Volume.Size,
+		Created:  time.Now().UTC(),
+		Chunks:   chunks,
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.store.Put(ctx, manifestKey(opts.Name), data); err != nil {
+		return nil, fmt.Errorf("failed to upload manifest: %s", err)
+	}
+
+	level.Info(s.logger).Log(
+		"msg", "volume backed up",
+		"backup-name", opts.Name,
+		"volume-id", opts.Volume.ID,
+		"chunks", chunks,
+	)
+	return toBackup(opts.Name, &manifest), nil
+}
+
+// Restore restores a backup. A backup is only restored once: filesystems
+// keep a marker once the backup has been extracted and devices are only
+// written to while they are still blank or hold an interrupted restore, so
+// calling Restore again does not overwrite changes made since.
+func (s *ObjectStoreBackupService) Restore(ctx context.Context, name string, opts RestoreOpts) error {
+	manifest, err := s.manifest(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	level.Info(s.logger).Log(
+		"msg", "restoring backup",
+		"backup-name", name,
+		"mode", manifest.Mode,
+		"device", opts.Device,
+		"path", opts.Path,
+	)
+
+	switch manifest.Mode {
+	case csi.BackupModeBlock:
+		if opts.Device == "" {
+			return fmt.Errorf("block backup %s can only be restored to a device", name)
+		}
+		restore, err := prepareRestoreDevice(ctx, opts.Device)
+		if err != nil {
+			return err
+		}
+		if !restore {
+			level.Info(s.logger).Log(
+				"msg", "device is not blank, not restoring backup",
+				"backup-name", name,
+				"device", opts.Device,
+			)
+			return nil
+		}
+	case csi.BackupModeFilesystem:
+		if opts.Path == "" {
+			return fmt.Errorf("filesystem backup %s can only be restored to a path", name)
+		}
+		restore, err := prepareRestorePath(opts.Path)
+		if err != nil {
+			return err
+		}
+		if !restore {
+			level.Info(s.logger).Log(
+				"msg", "backup already restored to filesystem, not restoring it again",
+				"backup-name", name,
+				"path", opts.Path,
+			)
+			return nil
+		}
+	default:
+		return fmt.Errorf("backup %s has unsupported mode %q", name, manifest.Mode)
+	}
+
+	chunks := &chunkReader{ctx: ctx, store: s.store, name: name, chunks: manifest.Chunks}
+	defer chunks.Close()
+	gz, err := gzip.NewReader(chunks)
+	if err != nil {
+		return fmt.Errorf("failed to read backup %s: %s", name, err)
+	}
+
+	switch manifest.Mode {
+	case csi.BackupModeBlock:
+		err = readDevice(ctx, gz, opts.Device)
+	case csi.BackupModeFilesystem:
+		if err = readTar(ctx, gz, opts.Path); err == nil {
+			err = os.Rename(filepath.Join(opts.Path, restoreMarker), filepath.Join(opts.Path, restoredMarker))
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to restore backup %s: %s", name, err)
+	}
+
+	level.Info(s.logger).Log(
+		"msg", "backup restored",
+		"backup-name", name,
+	)
+	return nil
+}
+
+func (s *ObjectStoreBackupService) Get(ctx context.Context, name string) (*csi.Backup, error) {
+	manifest, err := s.manifest(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return toBackup(name, manifest), nil
+}
+
+func (s *ObjectStoreBackupService) Delete(ctx context.Context, name string) error {
+	level.Info(s.logger).Log(
+		"msg", "deleting backup",
+		"backup-name", name,
+	)
+
+	if _, err := s.manifest(ctx, name); err != nil {
+		return err
+	}
+	// Delete the manifest first so that a partially deleted backup is not
+	// mistaken for a complete one.
+	if err := s.store.Delete(ctx, manifestKey(name)); err != nil {
+		return err
+	}
+	return s.deleteObjects(ctx, name)
+}
+
+func (s *ObjectStoreBackupService) manifest(ctx context.Context, name string) (*backupManifest, error) {
+	if !IsValidBackupName(name) {
+		return nil, ErrBackupNotFound
+	}
+	r, err := s.store.Get(ctx, manifestKey(name))
+	if err == ErrObjectNotFound {
+		return nil, ErrBackupNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var manifest backupManifest
+	if err := json.NewDecoder(r).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest of backup %s: %s", name, err)
+	}
+	if manifest.Version != backupManifestVersion {
+		return nil, fmt.Errorf("backup %s has unsupported version %d", name, manifest.Version)
+	}
+	return &manifest, nil
+}
+
+func (s *ObjectStoreBackupService) deleteObjects(ctx context.Context, name string) error {
+	keys, err := s.store.List(ctx, backupKeyPrefix+name+"/")
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := s.store.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func toBackup(name string, manifest *backupManifest) *csi.Backup {
+	return &csi.Backup{
+		Name:     name,
+		VolumeID: manifest.VolumeID,
+		Mode:     manifest.Mode,
+		Size:     manifest.Size,
+		Created:  manifest.Created,
+	}
+}
+
+func manifestKey(name string) string {
+	return backupKeyPrefix + name + "/manifest.json"
+}
+
+func chunkKey(name string, i int) string {
+	return fmt.Sprintf("%s%s/chunk-%06d", backupKeyPrefix, name, i)
+}
+
+// chunkReader reads the chunks of a backup one after another.
+type chunkReader struct {
+	ctx     context.Context
+	store   ObjectStore
+	name    string
+	chunks  int
+	next    int
+	current io.ReadCloser
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if r.next == r.chunks {
+				return 0, io.EOF
+			}
+			chunk, err := r.store.Get(r.ctx, chunkKey(r.name, r.next))
+			if err != nil {
+				return 0, fmt.Errorf("failed to download chunk %d: %s", r.next, err)
+			}
+			r.current = chunk
+			r.next++
+		}
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (r *chunkReader) Close() error {
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
+}
+
+// writeTar writes the contents of the filesystem mounted at root to w.
+func writeTar(ctx context.Context, w io.Writer, root string) error {
+	tw := tar.NewWriter(w)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		name, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			return nil
+		}
+		if name == "lost+found" || name == restoreMarker || name == restoredMarker {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		var link string
+		switch mode := info.Mode(); {
+		case mode.IsRegular(), mode.IsDir():
+		case mode&os.ModeSymlink != 0:
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		default:
+			// Sockets, pipes and devices are not backed up.
+			return nil
+		}
+
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(name)
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// readTar extracts the tar archive read from r to root.
+func readTar(ctx context.Context, r io.Reader, root string) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		path := filepath.Join(root, filepath.FromSlash(header.Name))
+		if !strings.HasPrefix(path, filepath.Clean(root)+string(filepath.Separator)) {
+			return fmt.Errorf("invalid path %q in backup", header.Name)
+		}
+		// Symlinks extracted earlier must not redirect later entries
+		// outside of root.
+		if err := checkNoSymlinks(root, path); err != nil {
+			return fmt.Errorf("invalid path %q in backup: %s", header.Name, err)
+		}
+		mode := os.FileMode(header.Mode).Perm()
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, mode); err != nil {
+				return err
+			}
+			if err := os.Chmod(path, mode); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|syscall.O_NOFOLLOW, mode)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return err
+			}
+			if err := os.Chtimes(path, header.ModTime, header.ModTime); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(header.Linkname, path); err != nil {
+				return err
+			}
+		default:
+			continue
+		}
+		if err := os.Lchown(path, header.Uid, header.Gid); err != nil {
+			return err
+		}
+	}
+}
+
+// checkNoSymlinks returns an error if path or any of its parents below root
+// is a symlink.
+func checkNoSymlinks(root string, path string) error {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return err
+	}
+	current := root
+	for _, component := range strings.Split(rel, string(filepath.Separator)) {
+		current = filepath.Join(current, component)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%s is a symlink", current)
+		}
+	}
+	return nil
+}
+
+// prepareRestorePath reports whether a backup has to be extracted to path,
+// which is the case for empty filesystems and filesystems with an
+// interrupted restore. The contents of the latter are removed. Filesystems
+// which already have contents but no marker, like those restored before
+// markers were kept, are marked as restored.
+func prepareRestorePath(path string) (bool, error) {
+	restored, err := deviceExists(filepath.Join(path, restoredMarker))
+	if err != nil || restored {
+		return false, err
+	}
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return false, err
+	}
+	marker := filepath.Join(path, restoreMarker)
+	interrupted, err := deviceExists(marker)
+	if err != nil {
+		return false, err
+	}
+	for _, entry := range entries {
+		if entry.Name() == "lost+found" || entry.Name() == restoreMarker {
+			continue
+		}
+		if !interrupted {
+			return false, ioutil.WriteFile(filepath.Join(path, restoredMarker), nil, 0600)
+		}
+		if err := os.RemoveAll(filepath.Join(path, entry.Name())); err != nil {
+			return false, err
+		}
+	}
+	if err := ioutil.WriteFile(marker, nil, 0600); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// writeDevice writes the contents of device to w.
+func writeDevice(ctx context.Context, w io.Writer, device string) error {
+	f, err := os.Open(device)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return copyWithContext(ctx, w, f)
+}
+
+// prepareRestoreDevice reports whether a block backup has to be restored to
+// device, which is the case for blank devices and devices with an
+// interrupted restore. A device is blank if it holds only zeros, like a new
+// volume, so it is read in full before a backup is first restored to it.
+func prepareRestoreDevice(ctx context.Context, device string) (bool, error) {
+	f, err := os.Open(device)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, copyBufferSize)
+	for chunk := 0; ; chunk++ {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		n, err := io.ReadFull(f, buf)
+		if chunk == 0 && bytes.HasPrefix(buf[:n], deviceRestoreMagic) {
+			return true, nil
+		}
+		for _, b := range buf[:n] {
+			if b != 0 {
+				return false, nil
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+// readDevice writes the contents read from r to device. The start of the
+// device is marked with deviceRestoreMagic while the rest is written and the
+// header is written last, so that an interrupted restore is started over.
+func readDevice(ctx context.Context, r io.Reader, device string) error {
+	f, err := os.OpenFile(device, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.WriteAt(deviceRestoreMagic, 0); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	// The header is padded so that it always overwrites the magic.
+	header := make([]byte, copyHeaderSize)
+	n, err := io.ReadFull(r, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	if n > len(deviceRestoreMagic) {
+		header = header[:n]
+	} else {
+		header = header[:len(deviceRestoreMagic)]
+	}
+	if _, err := f.Seek(int64(n), io.SeekStart); err != nil {
+		return err
+	}
+	if err := copyWithContext(ctx, f, r); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(header, 0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func copyWithContext(ctx context.Context, dst io.Writer, src io.Reader) error {
+	buf := make([]byte, copyBufferSize)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,415 @@
+package volumes
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/hetznercloud/csi-driver/csi"
+)
+
+var _ BackupService = (*ObjectStoreBackupService)(nil)
+
+// memoryObjectStore keeps objects in memory.
+type memoryObjectStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (s *memoryObjectStore) Put(ctx context.Context, key string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = append([]byte(nil), data...)
+	return nil
+}
+
+func (s *memoryObjectStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[key]
+	if !ok {
+		return nil, ErrObjectNotFound
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *memoryObjectStore) List(ctx context.Context, prefix string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *memoryObjectStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, key)
+	return nil
+}
+
+func newTestBackupService() (*ObjectStoreBackupService, *memoryObjectStore) {
+	store := &memoryObjectStore{objects: make(map[string][]byte)}
+	service := &ObjectStoreBackupService{
+		logger:    log.NewNopLogger(),
+		store:     store,
+		chunkSize: 128,
+	}
+	return service, store
+}
+
+func TestObjectStoreBackupServiceFilesystem(t *testing.T) {
+	service, store := newTestBackupService()
+	ctx := context.Background()
+
+	src := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "dir", "lost+found"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(src, "lost+found"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	content := bytes.Repeat([]byte("hello world "), 100)
+	if err := ioutil.WriteFile(filepath.Join(src, "dir", "file"), content, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("dir/file", filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	backup, err := service.Backup(ctx, BackupOpts{
+		Name:   "test",
+		Volume: &csi.Volume{ID: 1, Size: 10},
+		Mode:   csi.BackupModeFilesystem,
+		Path:   src,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backup.VolumeID != 1 || backup.Size != 10 || backup.Mode != csi.BackupModeFilesystem {
+		t.Errorf("unexpected backup: %v", backup)
+	}
+	if keys, _ := store.List(ctx, "backups/test/chunk-"); len(keys) < 2 {
+		t.Errorf("expected backup to be split into chunks, got %d", len(keys))
+	}
+
+	if _, err := service.Backup(ctx, BackupOpts{
+		Name:   "test",
+		Volume: &csi.Volume{ID: 1, Size: 10},
+		Mode:   csi.BackupModeFilesystem,
+		Path:   src,
+	}); err != ErrBackupAlreadyExists {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	dst := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dst, "lost+found"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := service.Restore(ctx, "test", RestoreOpts{Path: dst}); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := ioutil.ReadFile(filepath.Join(dst, "dir", "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(restored, content) {
+		t.Error("unexpected contents of restored file")
+	}
+	if info, err := os.Stat(filepath.Join(dst, "dir", "file")); err != nil || info.Mode().Perm() != 0640 {
+		t.Errorf("unexpected mode of restored file: %v %v", info, err)
+	}
+	if link, err := os.Readlink(filepath.Join(dst, "link")); err != nil || link != "dir/file" {
+		t.Errorf("unexpected symlink: %s %v", link, err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "dir", "lost+found")); err != nil {
+		t.Errorf("nested lost+found not restored: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, restoreMarker)); !os.IsNotExist(err) {
+		t.Errorf("restore marker not removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, restoredMarker)); err != nil {
+		t.Errorf("restored marker not created: %v", err)
+	}
+
+	// Restoring again must not overwrite changes.
+	if err := ioutil.WriteFile(filepath.Join(dst, "dir", "file"), []byte("changed"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := service.Restore(ctx, "test", RestoreOpts{Path: dst}); err != nil {
+		t.Fatal(err)
+	}
+	if restored, _ := ioutil.ReadFile(filepath.Join(dst, "dir", "file")); string(restored) != "changed" {
+		t.Error("restore overwrote existing contents")
+	}
+
+	// Nor may it restore the backup once all files have been deleted.
+	for _, name := range []string{"dir", "link"} {
+		if err := os.RemoveAll(filepath.Join(dst, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := service.Restore(ctx, "test", RestoreOpts{Path: dst}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "dir")); !os.IsNotExist(err) {
+		t.Errorf("backup restored again: %v", err)
+	}
+
+	if err := service.Delete(ctx, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := store.List(ctx, "backups/test/"); len(keys) != 0 {
+		t.Errorf("objects left after deleting backup: %v", keys)
+	}
+	if _, err := service.Get(ctx, "test"); err != ErrBackupNotFound {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestObjectStoreBackupServiceRestoreInterrupted(t *testing.T) {
+	service, _ := newTestBackupService()
+	ctx := context.Background()
+
+	src := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(src, "file"), []byte("backup"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.Backup(ctx, BackupOpts{
+		Name:   "test",
+		Volume: &csi.Volume{ID: 1, Size: 10},
+		Mode:   csi.BackupModeFilesystem,
+		Path:   src,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := t.TempDir()
+	for _, name := range []string{restoreMarker, "partial"} {
+		if err := ioutil.WriteFile(filepath.Join(dst, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := service.Restore(ctx, "test", RestoreOpts{Path: dst}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "partial")); !os.IsNotExist(err) {
+		t.Errorf("leftovers of interrupted restore not removed: %v", err)
+	}
+	if restored, _ := ioutil.ReadFile(filepath.Join(dst, "file")); string(restored) != "backup" {
+		t.Error("backup not restored")
+	}
+}
+
+func TestObjectStoreBackupServiceBlock(t *testing.T) {
+	service, _ := newTestBackupService()
+	ctx := context.Background()
+
+	content := make([]byte, copyHeaderSize+1000)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	src := filepath.Join(t.TempDir(), "src")
+	if err := ioutil.WriteFile(src, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := service.Backup(ctx, BackupOpts{
+		Name:   "test",
+		Volume: &csi.Volume{ID: 1, Size: 10},
+		Mode:   csi.BackupModeBlock,
+		Path:   src,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(t.TempDir(), "dst")
+	if err := ioutil.WriteFile(dst, make([]byte, len(content)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := service.Restore(ctx, "test", RestoreOpts{Path: "/unused"}); err == nil {
+		t.Error("expected error restoring block backup to path")
+	}
+	if err := service.Restore(ctx, "test", RestoreOpts{Device: dst}); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(restored, content) {
+		t.Error("unexpected contents of restored device")
+	}
+
+	// Restoring again must not overwrite changes, even if the device does
+	// not look formatted.
+	changed := make([]byte, len(content))
+	changed[len(changed)-1] = 1
+	if err := ioutil.WriteFile(dst, changed, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := service.Restore(ctx, "test", RestoreOpts{Device: dst}); err != nil {
+		t.Fatal(err)
+	}
+	if restored, _ := ioutil.ReadFile(dst); !bytes.Equal(restored, changed) {
+		t.Error("restore overwrote existing device contents")
+	}
+}
+
+func TestObjectStoreBackupServiceBlockInterrupted(t *testing.T) {
+	service, _ := newTestBackupService()
+	ctx := context.Background()
+
+	src := filepath.Join(t.TempDir(), "src")
+	if err := ioutil.WriteFile(src, []byte("backup"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.Backup(ctx, BackupOpts{
+		Name:   "test",
+		Volume: &csi.Volume{ID: 1, Size: 10},
+		Mode:   csi.BackupModeBlock,
+		Path:   src,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(t.TempDir(), "dst")
+	partial := append(append([]byte(nil), deviceRestoreMagic...), make([]byte, 100)...)
+	partial[len(partial)-1] = 1
+	if err := ioutil.WriteFile(dst, partial, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := service.Restore(ctx, "test", RestoreOpts{Device: dst}); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(restored, []byte("backup")) || bytes.Contains(restored, deviceRestoreMagic) {
+		t.Errorf("interrupted restore not started over: %q", restored[:len(deviceRestoreMagic)])
+	}
+}
+
+func TestObjectStoreBackupServiceBlockNotEmpty(t *testing.T) {
+	service, _ := newTestBackupService()
+	ctx := context.Background()
+
+	src := filepath.Join(t.TempDir(), "src")
+	if err := ioutil.WriteFile(src, []byte("backup"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.Backup(ctx, BackupOpts{
+		Name:   "test",
+		Volume: &csi.Volume{ID: 1, Size: 10},
+		Mode:   csi.BackupModeBlock,
+		Path:   src,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(t.TempDir(), "dst")
+	if err := ioutil.WriteFile(dst, []byte("existing"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := service.Restore(ctx, "test", RestoreOpts{Device: dst}); err != nil {
+		t.Fatal(err)
+	}
+	if restored, _ := ioutil.ReadFile(dst); string(restored) != "existing" {
+		t.Error("restore overwrote existing device contents")
+	}
+}
+
+func TestObjectStoreBackupServiceInvalidName(t *testing.T) {
+	service, _ := newTestBackupService()
+
+	if _, err := service.Backup(context.Background(), BackupOpts{
+		Name:   "../test",
+		Volume: &csi.Volume{ID: 1, Size: 10},
+		Mode:   csi.BackupModeBlock,
+		Path:   "/dev/null",
+	}); err == nil {
+		t.Error("expected error")
+	}
+	if _, err := service.Get(context.Background(), "../test"); err != ErrBackupNotFound {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestReadTarSymlinkEscape(t *testing.T) {
+	testCases := []struct {
+		Name    string
+		Entries []*tar.Header
+	}{
+		{
+			Name: "file below symlinked directory",
+			Entries: []*tar.Header{
+				{Name: "dir", Typeflag: tar.TypeSymlink, Linkname: "OUTSIDE"},
+				{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0644},
+			},
+		},
+		{
+			Name: "directory below symlinked directory",
+			Entries: []*tar.Header{
+				{Name: "dir", Typeflag: tar.TypeSymlink, Linkname: "OUTSIDE"},
+				{Name: "dir/sub", Typeflag: tar.TypeDir, Mode: 0755},
+			},
+		},
+		{
+			Name: "file replacing symlink",
+			Entries: []*tar.Header{
+				{Name: "file", Typeflag: tar.TypeSymlink, Linkname: "OUTSIDE/file"},
+				{Name: "file", Typeflag: tar.TypeReg, Mode: 0644},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			root := t.TempDir()
+			outside := t.TempDir()
+
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			for _, header := range testCase.Entries {
+				header := *header
+				header.Linkname = strings.Replace(header.Linkname, "OUTSIDE", outside, 1)
+				header.Uid = os.Getuid()
+				header.Gid = os.Getgid()
+				if err := tw.WriteHeader(&header); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := tw.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := readTar(context.Background(), &buf, root); err == nil {
+				t.Error("expected error")
+			}
+			entries, err := ioutil.ReadDir(outside)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 0 {
+				t.Errorf("archive escaped root: %s", entries[0].Name())
+			}
+		})
+	}
+}
@@ -0,0 +1,253 @@
+package volumes
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/hetznercloud/csi-driver/csi"
+)
+
+type cacheBypassKey struct{}
+
+// WithoutCache returns a context making lookups skip caches. It is meant for
+// reads whose result must be current, e.g. to check whether a volume is
+// attached right before acting on it.
+func WithoutCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, cacheBypassKey{}, true)
+}
+
+func cacheBypassed(ctx context.Context) bool {
+	bypass, _ := ctx.Value(cacheBypassKey{}).(bool)
+	return bypass
+}
+
+// ttlCache caches objects by ID for a fixed time.
+type ttlCache struct {
+	ttl    time.Duration
+	now    func() time.Time
+	hits   prometheus.Counter
+	misses prometheus.Counter
+
+	mu      sync.Mutex
+	entries map[uint64]cacheEntry
+
+	// generation is incremented on every invalidation, so lookups which
+	// started before do not cache what they fetched.
+	generation uint64
+}
+
+type cacheEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+func newTTLCache(ttl time.Duration, hits prometheus.Counter, misses prometheus.Counter) *ttlCache {
+	return &ttlCache{
+		ttl:     ttl,
+		now:     time.Now,
+		hits:    hits,
+		misses:  misses,
+		entries: make(map[uint64]cacheEntry),
+	}
+}
+
+// get returns the cached object and true, or the current generation and
+// false if the object is not cached.
+func (c *ttlCache) get(id uint64) (interface{}, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[id]
+	if ok && c.now().Before(entry.expires) {
+		if c.hits != nil {
+			c.hits.Inc()
+		}
+		return entry.value, c.generation, true
+	}
+	if ok {
+		delete(c.entries, id)
+	}
+	if c.misses != nil {
+		c.misses.Inc()
+	}
+	return nil, c.generation, false
+}
+
+// set caches the object unless the cache has been invalidated since the
+// lookup of generation.
+func (c *ttlCache) set(id uint64, value interface{}, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+	c.entries[id] = cacheEntry{value: value, expires: c.now().Add(c.ttl)}
+}
+
+func (c *ttlCache) invalidate(id uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	delete(c.entries, id)
+}
+
+// CachingService wraps a volume service and caches the volumes looked up by
+// ID for a short time. The cached volume is invalidated by every call which
+// modifies it, successful or not.
+type CachingService struct {
+	logger        log.Logger
+	volumeService Service
+	cache         *ttlCache
+}
+
+func NewCachingService(logger log.Logger, volumeService Service, ttl time.Duration, hits prometheus.Counter, misses prometheus.Counter) *CachingService {
+	return &CachingService{
+		logger:        logger,
+		volumeService: volumeService,
+		cache:         newTTLCache(ttl, hits, misses),
+	}
+}
+
+func (s *CachingService) Create(ctx context.Context, opts CreateOpts) (*csi.Volume, error) {
+	return s.volumeService.Create(ctx, opts)
+}
+
+func (s *CachingService) GetByID(ctx context.Context, id uint64) (*csi.Volume, error) {
+	if cacheBypassed(ctx) {
+		s.cache.invalidate(id)
+		return s.volumeService.GetByID(ctx, id)
+	}
+
+	cached, generation, ok := s.cache.get(id)
+	if ok {
+		level.Debug(s.logger).Log(
+			"msg", "volume found in cache",
+			"volume-id", id,
+		)
+		return copyVolume(cached.(*csi.Volume)), nil
+	}
+
+	volume, err := s.volumeService.GetByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	s.cache.set(id, copyVolume(volume), generation)
+	return volume, nil
+}
+
+func (s *CachingService) GetByName(ctx context.Context, name string) (*csi.Volume, error) {
+	return s.volumeService.GetByName(ctx, name)
+}
+
+func (s *CachingService) List(ctx context.Context, opts ListOpts) ([]*csi.Volume, error) {
+	return s.volumeService.List(ctx, opts)
+}
+
+func (s *CachingService) Delete(ctx context.Context, volume *csi.Volume) error {
+	defer s.cache.invalidate(volume.ID)
+	return s.volumeService.Delete(ctx, volume)
+}
+
+func (s *CachingService) Attach(ctx context.Context, volume *csi.Volume, server *csi.Server) error {
+	defer s.cache.invalidate(volume.ID)
+	return s.volumeService.Attach(ctx, volume, server)
+}
+
+func (s *CachingService) Detach(ctx context.Context, volume *csi.Volume, server *csi.Server) error {
+	defer s.cache.invalidate(volume.ID)
+	return s.volumeService.Detach(ctx, volume, server)
+}
+
+func (s *CachingService) Resize(ctx context.Context, volume *csi.Volume, size int) error {
+	defer s.cache.invalidate(volume.ID)
+	return s.volumeService.Resize(ctx, volume, size)
+}
+
+func (s *CachingService) SetLabels(ctx context.Context, volume *csi.Volume, labels map[string]string) error {
+	defer s.cache.invalidate(volume.ID)
+	return s.volumeService.SetLabels(ctx, volume, labels)
+}
+
+func (s *CachingService) SetDeleteProtection(ctx context.Context, volume *csi.Volume, enabled bool) error {
+	defer s.cache.invalidate(volume.ID)
+	return s.volumeService.SetDeleteProtection(ctx, volume, enabled)
+}
+
+// CachingServerService wraps a server service and caches the servers looked
+// up by ID for a short time.
+type CachingServerService struct {
+	logger        log.Logger
+	serverService ServerService
+	cache         *ttlCache
+}
+
+func NewCachingServerService(logger log.Logger, serverService ServerService, ttl time.Duration, hits prometheus.Counter, misses prometheus.Counter) *CachingServerService {
+	return &CachingServerService{
+		logger:        logger,
+		serverService: serverService,
+		cache:         newTTLCache(ttl, hits, misses),
+	}
+}
+
+func (s *CachingServerService) GetByID(ctx context.Context, id uint64) (*csi.Server, error) {
+	if cacheBypassed(ctx) {
+		s.cache.invalidate(id)
+		return s.serverService.GetByID(ctx, id)
+	}
+
+	cached, generation, ok := s.cache.get(id)
+	if ok {
+		level.Debug(s.logger).Log(
+			"msg", "server found in cache",
+			"server-id", id,
+		)
+		return copyServer(cached.(*csi.Server)), nil
+	}
+
+	server, err := s.serverService.GetByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	s.cache.set(id, copyServer(server), generation)
+	return server, nil
+}
+
+func (s *CachingServerService) List(ctx context.Context) ([]*csi.Server, error) {
+	return s.serverService.List(ctx)
+}
+
+// copyVolume returns a deep copy of volume, so that callers cannot modify
+// cached volumes.
+func copyVolume(volume *csi.Volume) *csi.Volume {
+	c := *volume
+	c.Labels = copyLabels(volume.Labels)
+	if volume.Server != nil {
+		c.Server = copyServer(volume.Server)
+	}
+	return &c
+}
+
+// copyServer returns a deep copy of server.
+func copyServer(server *csi.Server) *csi.Server {
+	c := *server
+	c.Labels = copyLabels(server.Labels)
+	return &c
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	if labels == nil {
+		return nil
+	}
+	c := make(map[string]string, len(labels))
+	for key, value := range labels {
+		c[key] = value
+	}
+	return c
+}
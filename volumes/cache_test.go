@@ -0,0 +1,169 @@
+package volumes_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/hetznercloud/csi-driver/csi"
+	"github.com/hetznercloud/csi-driver/mock"
+	"github.com/hetznercloud/csi-driver/volumes"
+)
+
+var (
+	_ volumes.Service       = (*volumes.CachingService)(nil)
+	_ volumes.ServerService = (*volumes.CachingServerService)(nil)
+)
+
+func newTestCounters() (prometheus.Counter, prometheus.Counter) {
+	return prometheus.NewCounter(prometheus.CounterOpts{Name: "hits"}),
+		prometheus.NewCounter(prometheus.CounterOpts{Name: "misses"})
+}
+
+func TestCachingServiceGetByID(t *testing.T) {
+	calls := 0
+	volumeService := &mock.VolumeService{
+		GetByIDFunc: func(ctx context.Context, id uint64) (*csi.Volume, error) {
+			calls++
+			return &csi.Volume{
+				ID:     id,
+				Size:   10,
+				Labels: map[string]string{"key": "value"},
+				Server: &csi.Server{ID: 1, Labels: map[string]string{"key": "value"}},
+			}, nil
+		},
+		AttachFunc: func(ctx context.Context, volume *csi.Volume, server *csi.Server) error {
+			return volumes.ErrAttachLimitReached
+		},
+	}
+	hits, misses := newTestCounters()
+	service := volumes.NewCachingService(log.NewNopLogger(), volumeService, time.Minute, hits, misses)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		volume, err := service.GetByID(ctx, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if volume.ID != 1 || volume.Size != 10 || volume.Labels["key"] != "value" || volume.Server.Labels["key"] != "value" {
+			t.Errorf("unexpected volume: %v", volume)
+		}
+		// Modifying the returned volume must not affect the cache.
+		volume.Size = 20
+		volume.Labels["key"] = "changed"
+		volume.Server.Labels["key"] = "changed"
+	}
+	if calls != 1 {
+		t.Errorf("expected 1 lookup, got %d", calls)
+	}
+	if n := testutil.ToFloat64(hits); n != 2 {
+		t.Errorf("unexpected hits: %v", n)
+	}
+	if n := testutil.ToFloat64(misses); n != 1 {
+		t.Errorf("unexpected misses: %v", n)
+	}
+
+	if _, err := service.GetByID(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("expected other volume to be looked up, got %d lookups", calls)
+	}
+
+	// Mutating calls invalidate the volume even if they fail.
+	if err := service.Attach(ctx, &csi.Volume{ID: 1}, &csi.Server{ID: 1}); err != volumes.ErrAttachLimitReached {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := service.GetByID(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 {
+		t.Errorf("expected volume to be looked up after attach, got %d lookups", calls)
+	}
+
+	if _, err := service.GetByID(volumes.WithoutCache(ctx), 1); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 4 {
+		t.Errorf("expected cache to be bypassed, got %d lookups", calls)
+	}
+}
+
+func TestCachingServiceGetByIDExpired(t *testing.T) {
+	calls := 0
+	volumeService := &mock.VolumeService{
+		GetByIDFunc: func(ctx context.Context, id uint64) (*csi.Volume, error) {
+			calls++
+			return &csi.Volume{ID: id}, nil
+		},
+	}
+	service := volumes.NewCachingService(log.NewNopLogger(), volumeService, 10*time.Millisecond, nil, nil)
+
+	if _, err := service.GetByID(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, err := service.GetByID(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("expected expired volume to be looked up again, got %d lookups", calls)
+	}
+}
+
+func TestCachingServiceGetByIDError(t *testing.T) {
+	calls := 0
+	volumeService := &mock.VolumeService{
+		GetByIDFunc: func(ctx context.Context, id uint64) (*csi.Volume, error) {
+			calls++
+			return nil, volumes.ErrVolumeNotFound
+		},
+	}
+	service := volumes.NewCachingService(log.NewNopLogger(), volumeService, time.Minute, nil, nil)
+
+	for i := 0; i < 2; i++ {
+		if _, err := service.GetByID(context.Background(), 1); err != volumes.ErrVolumeNotFound {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("expected errors not to be cached, got %d lookups", calls)
+	}
+}
+
+func TestCachingServerServiceGetByID(t *testing.T) {
+	calls := 0
+	serverService := &mock.ServerService{
+		GetByIDFunc: func(ctx context.Context, id uint64) (*csi.Server, error) {
+			calls++
+			return &csi.Server{ID: id, Location: "loc", Labels: map[string]string{"key": "value"}}, nil
+		},
+	}
+	hits, misses := newTestCounters()
+	service := volumes.NewCachingServerService(log.NewNopLogger(), serverService, time.Minute, hits, misses)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		server, err := service.GetByID(ctx, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if server.ID != 1 || server.Location != "loc" || server.Labels["key"] != "value" {
+			t.Errorf("unexpected server: %v", server)
+		}
+		server.Labels["key"] = "changed"
+	}
+	if _, err := service.GetByID(volumes.WithoutCache(ctx), 1); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("expected 2 lookups, got %d", calls)
+	}
+	if n := testutil.ToFloat64(hits); n != 1 {
+		t.Errorf("unexpected hits: %v", n)
+	}
+}
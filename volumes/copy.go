@@ -0,0 +1,280 @@
+package volumes
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/hetznercloud/csi-driver/csi"
+)
+
+const (
+	// copyBufferSize is the size of the blocks copied at once.
+	copyBufferSize = 4 * 1024 * 1024
+
+	// copyHeaderSize is the size of the region at the start of a device that
+	// is copied last. It holds the signatures of filesystems and LUKS
+	// headers, so an interrupted copy never looks like a valid device.
+	copyHeaderSize = 1024 * 1024
+
+	devicePollInterval = time.Second
+)
+
+// AttachCopyService copies volumes by attaching them to the local server and
+// copying the block devices.
+type AttachCopyService struct {
+	logger        log.Logger
+	volumeService Service
+	server        *csi.Server
+
+	// mu serializes copies, so that one copy does not detach a volume
+	// still used by another.
+	mu sync.Mutex
+}
+
+func NewAttachCopyService(logger log.Logger, volumeService Service, server *csi.Server) *AttachCopyService {
+	return &AttachCopyService{
+		logger:        logger,
+		volumeService: volumeService,
+		server:        server,
+	}
+}
+
+// Copy copies src to dst. Both volumes must not be in use, dst must be at
+// least as large as src.
+func (s *AttachCopyService) Copy(ctx context.Context, src *csi.Volume, dst *csi.Volume) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	level.Info(s.logger).Log(
+		"msg", "copying volume",
+		"src-volume-id", src.ID,
+		"dst-volume-id", dst.ID,
+		"server-id", s.server.ID,
+	)
+
+	srcDevice, err := s.attach(ctx, src)
+	if err != nil {
+		return err
+	}
+	defer s.detach(src)
+
+	dstDevice, err := s.attach(ctx, dst)
+	if err != nil {
+		return err
+	}
+	defer s.detach(dst)
+
+	if err := copyDevice(ctx, srcDevice, dstDevice); err != nil {
+		level.Info(s.logger).Log(
+			"msg", "failed to copy volume",
+			"src-volume-id", src.ID,
+			"dst-volume-id", dst.ID,
+			"err", err,
+		)
+		return err
+	}
+
+	level.Info(s.logger).Log(
+		"msg", "volume copied",
+		"src-volume-id", src.ID,
+		"dst-volume-id", dst.ID,
+	)
+	return nil
+}
+
+// attach attaches a detached volume to the local server and returns its
+// device once it has appeared.
+func (s *AttachCopyService) attach(ctx context.Context, volume *csi.Volume) (string, error) {
+	volume, err := s.volumeService.GetByID(WithoutCache(ctx), volume.ID)
+	if err != nil {
+		return "", err
+	}
+	if volume.Server != nil && volume.Server.ID != s.server.ID {
+		return "", ErrAttached
+	}
+	if volume.Location != s.server.Location {
+		return "", fmt.Errorf("volume %d is in location %s, but can only be copied in location %s",
+			volume.ID, volume.Location, s.server.Location)
+	}
+	if err := s.volumeService.Attach(ctx, volume, s.server); err != nil {
+		return "", err
+	}
+
+	ticker := time.NewTicker(devicePollInterval)
+	defer ticker.Stop()
+	for {
+		exists, err := deviceExists(volume.LinuxDevice)
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			return volume.LinuxDevice, nil
+		}
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("device %s did not appear: %w", volume.LinuxDevice, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *AttachCopyService) detach(volume *csi.Volume) {
+	// Detach even if the copy was cancelled.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if err := s.volumeService.Detach(ctx, volume, s.server); err != nil {
+		level.Error(s.logger).Log(
+			"msg", "failed to detach volume after copying",
+			"volume-id", volume.ID,
+			"err", err,
+		)
+	}
+}
+
+// copyDevice copies the contents of the src device to the dst device. The
+// header is copied after the rest of the device has been written and synced.
+func copyDevice(ctx context.Context, srcDevice string, dstDevice string) error {
+	src, err := os.Open(srcDevice)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(dstDevice, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	size, err := src.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, copyBufferSize)
+	header := int64(copyHeaderSize)
+	if header > size {
+		header = size
+	}
+	if err := copyRange(ctx, src, dst, buf, header, size); err != nil {
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		return err
+	}
+	if err := copyRange(ctx, src, dst, buf, 0, header); err != nil {
+		return err
+	}
+	return dst.Sync()
+}
+
+func copyRange(ctx context.Context, src io.ReaderAt, dst io.WriterAt, buf []byte, from int64, to int64) error {
+	for offset := from; offset < to; {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		chunk := buf
+		if remaining := to - offset; remaining < int64(len(chunk)) {
+			chunk = chunk[:remaining]
+		}
+		n, err := src.ReadAt(chunk, offset)
+		if err != nil && !(err == io.EOF && n == len(chunk)) {
+			return err
+		}
+		if _, err := dst.WriteAt(chunk[:n], offset); err != nil {
+			return err
+		}
+		offset += int64(n)
+	}
+	return nil
+}
+
+// CopyJob is a copy running in the background.
+type CopyJob struct {
+	done chan struct{}
+	err  error
+}
+
+// Done is closed when the copy finished.
+func (j *CopyJob) Done() <-chan struct{} {
+	return j.done
+}
+
+// Err returns the error of a finished copy.
+func (j *CopyJob) Err() error {
+	return j.err
+}
+
+// CopyJobs runs copies in the background. Copying a volume takes longer than
+// a CO waits for a response, so copies run detached from the request and
+// later requests for the same volume wait for the running copy. Once the copy
+// finished, the state label is removed from the destination volume.
+type CopyJobs struct {
+	logger        log.Logger
+	volumeService Service
+	copyService   CopyService
+
+	mu   sync.Mutex
+	jobs map[uint64]*CopyJob
+}
+
+func NewCopyJobs(logger log.Logger, volumeService Service, copyService CopyService) *CopyJobs {
+	return &CopyJobs{
+		logger:        logger,
+		volumeService: volumeService,
+		copyService:   copyService,
+		jobs:          make(map[uint64]*CopyJob),
+	}
+}
+
+// Start starts copying src to dst unless dst is already being copied to.
+func (c *CopyJobs) Start(src *csi.Volume, dst *csi.Volume, stateLabel string) *CopyJob {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if job, ok := c.jobs[dst.ID]; ok {
+		return job
+	}
+	job := &CopyJob{done: make(chan struct{})}
+	c.jobs[dst.ID] = job
+
+	go func() {
+		job.err = c.run(context.Background(), src, dst, stateLabel)
+
+		c.mu.Lock()
+		delete(c.jobs, dst.ID)
+		c.mu.Unlock()
+		close(job.done)
+	}()
+	return job
+}
+
+func (c *CopyJobs) run(ctx context.Context, src *csi.Volume, dst *csi.Volume, stateLabel string) error {
+	if err := c.copyService.Copy(ctx, src, dst); err != nil {
+		return err
+	}
+
+	labels := make(map[string]string)
+	for key, value := range dst.Labels {
+		if key != stateLabel {
+			labels[key] = value
+		}
+	}
+	if err := c.volumeService.SetLabels(ctx, dst, labels); err != nil {
+		level.Error(c.logger).Log(
+			"msg", "failed to mark volume as copied",
+			"volume-id", dst.ID,
+			"err", err,
+		)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,3 @@
+package volumes
+
+var _ CopyService = (*AttachCopyService)(nil)
@@ -0,0 +1,95 @@
+package volumes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrDeviceNotFound is returned if the device of a volume has not
+	// appeared on the node.
+	ErrDeviceNotFound = errors.New("device not found")
+
+	// ErrDeviceMismatch is returned if the device of a volume cannot be
+	// verified to belong to the volume.
+	ErrDeviceMismatch = errors.New("device does not belong to the volume")
+)
+
+const (
+	// deviceWaitTimeout is how long staging waits for udev to create the
+	// device of a volume after it has been attached.
+	deviceWaitTimeout = 30 * time.Second
+
+	sysfsPath = "/sys"
+)
+
+// waitForDevice waits for at most timeout until device exists. It returns the
+// error of ctx if ctx is done before.
+func waitForDevice(ctx context.Context, device string, timeout time.Duration) error {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(devicePollInterval)
+	defer ticker.Stop()
+	for {
+		exists, err := deviceExists(device)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for device %s: %w", device, ctx.Err())
+		case <-deadline.C:
+			return fmt.Errorf("%w: %s did not appear within %s", ErrDeviceNotFound, device, timeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+// verifyDevice checks that device resolves to a SCSI disk whose serial is the
+// ID of the volume, as reported in the unit serial number VPD page in sysfs.
+// It returns the path device resolves to.
+func verifyDevice(sysfs string, device string, volumeID uint64) (string, error) {
+	resolved, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("%w: %s", ErrDeviceNotFound, device)
+		}
+		return "", err
+	}
+	serial, err := scsiSerial(sysfs, filepath.Base(resolved))
+	if err != nil {
+		return "", fmt.Errorf("%w: cannot read serial of %s: %s", ErrDeviceMismatch, resolved, err)
+	}
+	if serial != strconv.FormatUint(volumeID, 10) {
+		return "", fmt.Errorf("%w: %s resolves to %s with serial %q, expected volume %d", ErrDeviceMismatch, device, resolved, serial, volumeID)
+	}
+	return resolved, nil
+}
+
+// scsiSerial returns the serial of the SCSI disk with the given kernel name.
+func scsiSerial(sysfs string, name string) (string, error) {
+	page, err := ioutil.ReadFile(filepath.Join(sysfs, "class", "block", name, "device", "vpd_pg80"))
+	if err != nil {
+		return "", err
+	}
+	// The page starts with a four byte header, the last two bytes of
+	// which hold the length of the serial following it.
+	if len(page) < 4 || page[1] != 0x80 {
+		return "", fmt.Errorf("invalid unit serial number page")
+	}
+	length := int(page[2])<<8 | int(page[3])
+	if len(page) < 4+length {
+		return "", fmt.Errorf("truncated unit serial number page")
+	}
+	return strings.Trim(string(page[4:4+length]), " \x00"), nil
+}
@@ -0,0 +1,123 @@
+package volumes
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestDevice creates the device sdb with the given unit serial number page
+// and a by-id symlink to it below dir. It returns the path of the symlink.
+func newTestDevice(t *testing.T, dir string, vpdPage []byte) string {
+	devDir := filepath.Join(dir, "dev")
+	byIDDir := filepath.Join(devDir, "disk", "by-id")
+	sysDir := filepath.Join(dir, "sys", "class", "block", "sdb", "device")
+	for _, path := range []string{byIDDir, sysDir} {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(devDir, "sdb"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if vpdPage != nil {
+		if err := ioutil.WriteFile(filepath.Join(sysDir, "vpd_pg80"), vpdPage, 0444); err != nil {
+			t.Fatal(err)
+		}
+	}
+	link := filepath.Join(byIDDir, "scsi-0HC_Volume_1")
+	if err := os.Symlink("../../sdb", link); err != nil {
+		t.Fatal(err)
+	}
+	return link
+}
+
+func vpdPage(serial string) []byte {
+	return append([]byte{0x00, 0x80, 0x00, byte(len(serial))}, serial...)
+}
+
+func TestVerifyDevice(t *testing.T) {
+	testCases := []struct {
+		Name    string
+		VPDPage []byte
+		Error   error
+	}{
+		{
+			Name:    "matching serial",
+			VPDPage: vpdPage("1"),
+		},
+		{
+			Name:    "padded serial",
+			VPDPage: vpdPage("1   "),
+		},
+		{
+			Name:    "serial of other volume",
+			VPDPage: vpdPage("12"),
+			Error:   ErrDeviceMismatch,
+		},
+		{
+			Name:  "no scsi device",
+			Error: ErrDeviceMismatch,
+		},
+		{
+			Name:    "truncated page",
+			VPDPage: []byte{0x00, 0x80, 0x00, 0x08, '1'},
+			Error:   ErrDeviceMismatch,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "csi-device")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			device := newTestDevice(t, dir, testCase.VPDPage)
+
+			resolved, err := verifyDevice(filepath.Join(dir, "sys"), device, 1)
+			if testCase.Error != nil {
+				if !errors.Is(err, testCase.Error) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resolved != filepath.Join(dir, "dev", "sdb") {
+				t.Errorf("unexpected resolved device: %s", resolved)
+			}
+		})
+	}
+}
+
+func TestWaitForDevice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csi-device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	device := filepath.Join(dir, "sdb")
+
+	if err := waitForDevice(context.Background(), device, 10*time.Millisecond); !errors.Is(err, ErrDeviceNotFound) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := ioutil.WriteFile(device, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitForDevice(context.Background(), device, 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := waitForDevice(ctx, filepath.Join(dir, "sdc"), time.Minute); !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,205 @@
+package volumes
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/utils/exec"
+)
+
+var (
+	// ErrFilesystemMismatch is returned if a volume holds a filesystem
+	// other than the requested one.
+	ErrFilesystemMismatch = errors.New("filesystem does not match the requested filesystem")
+
+	// ErrFilesystemErrors is returned if the filesystem of a volume has
+	// errors which have not been repaired.
+	ErrFilesystemErrors = errors.New("filesystem has errors")
+)
+
+// Policies for checking the filesystem of a volume before it is mounted.
+const (
+	FsckPolicyNever  = "never"
+	FsckPolicyCheck  = "check"
+	FsckPolicyRepair = "repair"
+
+	// DefaultFsckPolicy is used if no policy is set.
+	DefaultFsckPolicy = FsckPolicyRepair
+)
+
+// FsckMetrics records the results of filesystem checks per volume.
+type FsckMetrics interface {
+	// FilesystemChecks returns the counter of the checks of a volume
+	// with the given result.
+	FilesystemChecks(volumeID string, result string) prometheus.Counter
+	// FilesystemErrors returns the gauge which is 1 while the filesystem
+	// of a volume has errors left and 0 otherwise.
+	FilesystemErrors(volumeID string) prometheus.Gauge
+	// DeleteFilesystemChecks deletes the counter of the checks of a
+	// volume with the given result.
+	DeleteFilesystemChecks(volumeID string, result string)
+	// DeleteFilesystemErrors deletes the error gauge of a volume.
+	DeleteFilesystemErrors(volumeID string)
+}
+
+// fsckResult is the outcome of checking a filesystem.
+type fsckResult int
+
+const (
+	fsckClean fsckResult = iota
+	fsckRepaired
+	// fsckErrors means errors were found and not repaired, either because
+	// only a check was requested or because they could not be repaired.
+	fsckErrors
+	// fsckSkipped means the filesystem could not be checked without
+	// modifying it, e.g. because its journal needs to be replayed.
+	fsckSkipped
+)
+
+// fsckResultFailed is recorded for checks which failed to run.
+const fsckResultFailed = "failed"
+
+// fsckResults are all results recorded for the checks of a volume.
+var fsckResults = []string{
+	fsckClean.String(),
+	fsckRepaired.String(),
+	fsckErrors.String(),
+	fsckSkipped.String(),
+	fsckResultFailed,
+}
+
+func (r fsckResult) String() string {
+	switch r {
+	case fsckClean:
+		return "clean"
+	case fsckRepaired:
+		return "repaired"
+	case fsckSkipped:
+		return "skipped"
+	default:
+		return "errors"
+	}
+}
+
+// fsckCommand returns the command checking the filesystem of type fsType on
+// device, which repairs it if repair is set. The filesystem must not be
+// mounted.
+func fsckCommand(fsType string, device string, repair bool) (string, []string, error) {
+	switch fsType {
+	case "ext3", "ext4":
+		if repair {
+			// Only repair what can be repaired safely without a human.
+			return "e2fsck", []string{"-p", device}, nil
+		}
+		return "e2fsck", []string{"-n", device}, nil
+	case "xfs":
+		if repair {
+			return "xfs_repair", []string{device}, nil
+		}
+		return "xfs_repair", []string{"-n", device}, nil
+	case "btrfs":
+		// btrfs check --repair is not considered safe, btrfs repairs
+		// what it can while mounted instead.
+		return "btrfs", []string{"check", "--readonly", device}, nil
+	}
+	return "", nil, fmt.Errorf("checking %s filesystems is not supported", fsType)
+}
+
+// fsckResultFromExitStatus interprets the exit status of the command returned
+// by fsckCommand. It returns false if the check itself failed.
+func fsckResultFromExitStatus(fsType string, status int, repair bool) (fsckResult, bool) {
+	switch fsType {
+	case "ext3", "ext4":
+		// The exit status is a bit mask: 1 and 2 mean errors have been
+		// corrected, 4 that errors are left, anything above that the
+		// check failed.
+		switch {
+		case status == 0:
+			return fsckClean, true
+		case status&^7 != 0:
+			return fsckErrors, false
+		case status&4 != 0 || !repair:
+			return fsckErrors, true
+		default:
+			return fsckRepaired, true
+		}
+	case "xfs":
+		switch status {
+		case 0:
+			return fsckClean, true
+		case 1:
+			return fsckErrors, true
+		case 2:
+			// The log is dirty and is replayed when mounting.
+			return fsckClean, true
+		}
+	case "btrfs":
+		switch status {
+		case 0:
+			return fsckClean, true
+		case 1:
+			return fsckErrors, true
+		}
+	}
+	return fsckErrors, false
+}
+
+// checkFilesystem checks the filesystem of type fsType on device and repairs
+// it if repair is set. The output of the check is returned along with the
+// result.
+func checkFilesystem(executor exec.Interface, fsType string, device string, repair bool) (fsckResult, string, error) {
+	if !repair && (fsType == "ext3" || fsType == "ext4") {
+		// e2fsck -n cannot replay the journal and reports errors for
+		// every filesystem which was not unmounted cleanly. The journal
+		// is replayed when mounting instead.
+		recovery, err := ext4NeedsRecovery(executor, device)
+		if err != nil {
+			return fsckErrors, "", err
+		}
+		if recovery {
+			return fsckSkipped, "journal needs recovery", nil
+		}
+	}
+
+	cmd, args, err := fsckCommand(fsType, device, repair)
+	if err != nil {
+		return fsckErrors, "", err
+	}
+	output, err := executor.Command(cmd, args...).CombinedOutput()
+	out := strings.TrimSpace(string(output))
+	if err == nil {
+		return fsckClean, out, nil
+	}
+	exitErr, ok := err.(exec.ExitError)
+	if !ok {
+		return fsckErrors, out, fmt.Errorf("failed to run %s: %w", cmd, err)
+	}
+	result, ok := fsckResultFromExitStatus(fsType, exitErr.ExitStatus(), repair)
+	if !ok {
+		return fsckErrors, out, fmt.Errorf("%s failed with exit status %d: %s", cmd, exitErr.ExitStatus(), out)
+	}
+	return result, out, nil
+}
+
+// ext4NeedsRecovery returns whether the journal of the ext3 or ext4 filesystem
+// on device needs to be replayed.
+func ext4NeedsRecovery(executor exec.Interface, device string) (bool, error) {
+	output, err := executor.Command("dumpe2fs", "-h", device).CombinedOutput()
+	if err != nil {
+		return false, fmt.Errorf("failed to run dumpe2fs: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		features := strings.TrimPrefix(line, "Filesystem features:")
+		if features == line {
+			continue
+		}
+		for _, feature := range strings.Fields(features) {
+			if feature == "needs_recovery" {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
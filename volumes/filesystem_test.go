@@ -0,0 +1,411 @@
+package volumes
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/mount-utils"
+	"k8s.io/utils/exec"
+	testingexec "k8s.io/utils/exec/testing"
+
+	"github.com/hetznercloud/csi-driver/csi"
+)
+
+// fakeCommand is a command expected by newFakeExec, which returns output and
+// exits with exitStatus.
+type fakeCommand struct {
+	argv       string
+	output     string
+	exitStatus int
+}
+
+// newFakeExec returns an executor expecting the commands in order. The
+// returned function returns the commands actually run.
+func newFakeExec(t *testing.T, commands ...fakeCommand) (*testingexec.FakeExec, func() []string) {
+	fakeExec := &testingexec.FakeExec{}
+	var run []string
+	for _, command := range commands {
+		command := command
+		fakeExec.CommandScript = append(fakeExec.CommandScript, func(cmd string, args ...string) exec.Cmd {
+			argv := strings.Join(append([]string{cmd}, args...), " ")
+			run = append(run, argv)
+			if argv != command.argv {
+				t.Errorf("unexpected command %q, expected %q", argv, command.argv)
+			}
+			fakeCmd := &testingexec.FakeCmd{
+				CombinedOutputScript: []testingexec.FakeAction{
+					func() ([]byte, []byte, error) {
+						if command.exitStatus != 0 {
+							return []byte(command.output), nil, testingexec.FakeExitError{Status: command.exitStatus}
+						}
+						return []byte(command.output), nil, nil
+					},
+				},
+			}
+			return testingexec.InitFakeCmd(fakeCmd, cmd, args...)
+		})
+	}
+	return fakeExec, func() []string { return run }
+}
+
+// dumpe2fsOutput returns the output of dumpe2fs -h for an ext4 filesystem
+// whose journal needs recovery if recovery is set.
+func dumpe2fsOutput(recovery bool) string {
+	features := "has_journal ext_attr resize_inode dir_index filetype extent 64bit flex_bg sparse_super large_file huge_file dir_nlink extra_isize metadata_csum"
+	if recovery {
+		features = "has_journal ext_attr resize_inode dir_index filetype needs_recovery extent 64bit flex_bg sparse_super large_file huge_file dir_nlink extra_isize metadata_csum"
+	}
+	return "Filesystem volume name:   <none>\nFilesystem magic number:  0xEF53\nFilesystem features:      " + features + "\nFilesystem state:         clean\n"
+}
+
+func TestCheckFilesystem(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		FSType   string
+		Repair   bool
+		Recovery bool
+		Command  fakeCommand
+		Expected fsckResult
+		Error    bool
+	}{
+		{
+			Name:     "ext4 clean",
+			FSType:   "ext4",
+			Command:  fakeCommand{argv: "e2fsck -n /dev/sdb"},
+			Expected: fsckClean,
+		},
+		{
+			Name:     "ext4 errors",
+			FSType:   "ext4",
+			Command:  fakeCommand{argv: "e2fsck -n /dev/sdb", exitStatus: 4},
+			Expected: fsckErrors,
+		},
+		{
+			Name:     "ext4 repaired",
+			FSType:   "ext4",
+			Repair:   true,
+			Command:  fakeCommand{argv: "e2fsck -p /dev/sdb", exitStatus: 1},
+			Expected: fsckRepaired,
+		},
+		{
+			Name:     "ext4 not repaired",
+			FSType:   "ext4",
+			Repair:   true,
+			Command:  fakeCommand{argv: "e2fsck -p /dev/sdb", exitStatus: 4},
+			Expected: fsckErrors,
+		},
+		{
+			Name:    "ext4 check failed",
+			FSType:  "ext4",
+			Command: fakeCommand{argv: "e2fsck -n /dev/sdb", exitStatus: 8},
+			Error:   true,
+		},
+		{
+			Name:     "ext4 journal needs recovery",
+			FSType:   "ext4",
+			Recovery: true,
+			Expected: fsckSkipped,
+		},
+		{
+			Name:     "xfs errors",
+			FSType:   "xfs",
+			Command:  fakeCommand{argv: "xfs_repair -n /dev/sdb", exitStatus: 1},
+			Expected: fsckErrors,
+		},
+		{
+			Name:     "xfs dirty log",
+			FSType:   "xfs",
+			Repair:   true,
+			Command:  fakeCommand{argv: "xfs_repair /dev/sdb", exitStatus: 2},
+			Expected: fsckClean,
+		},
+		{
+			Name:     "btrfs clean",
+			FSType:   "btrfs",
+			Repair:   true,
+			Command:  fakeCommand{argv: "btrfs check --readonly /dev/sdb"},
+			Expected: fsckClean,
+		},
+		{
+			Name:     "btrfs errors",
+			FSType:   "btrfs",
+			Command:  fakeCommand{argv: "btrfs check --readonly /dev/sdb", exitStatus: 1},
+			Expected: fsckErrors,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			commands := []fakeCommand{testCase.Command}
+			if !testCase.Repair && strings.HasPrefix(testCase.FSType, "ext") {
+				// Checks of ext filesystems first look at the journal.
+				dumpe2fs := fakeCommand{argv: "dumpe2fs -h /dev/sdb", output: dumpe2fsOutput(testCase.Recovery)}
+				commands = []fakeCommand{dumpe2fs, testCase.Command}
+				if testCase.Recovery {
+					commands = commands[:1]
+				}
+			}
+			fakeExec, run := newFakeExec(t, commands...)
+			result, _, err := checkFilesystem(fakeExec, testCase.FSType, "/dev/sdb", testCase.Repair)
+			if testCase.Error {
+				if err == nil {
+					t.Fatal("expected check to fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result != testCase.Expected {
+				t.Errorf("unexpected result: %s", result)
+			}
+			if len(run()) != len(commands) {
+				t.Errorf("unexpected commands: %v", run())
+			}
+		})
+	}
+}
+
+// testFsckMetrics records the filesystem check metrics of volume 1.
+type testFsckMetrics struct {
+	checks        *prometheus.CounterVec
+	errors        prometheus.Gauge
+	errorsDeleted bool
+}
+
+func newTestFsckMetrics() *testFsckMetrics {
+	return &testFsckMetrics{
+		checks: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "checks"}, []string{"result"}),
+		errors: prometheus.NewGauge(prometheus.GaugeOpts{Name: "errors"}),
+	}
+}
+
+func (m *testFsckMetrics) FilesystemChecks(volumeID string, result string) prometheus.Counter {
+	return m.checks.WithLabelValues(result)
+}
+
+func (m *testFsckMetrics) FilesystemErrors(volumeID string) prometheus.Gauge {
+	return m.errors
+}
+
+func (m *testFsckMetrics) DeleteFilesystemChecks(volumeID string, result string) {
+	m.checks.DeleteLabelValues(result)
+}
+
+func (m *testFsckMetrics) DeleteFilesystemErrors(volumeID string) {
+	m.errorsDeleted = true
+}
+
+func TestLinuxMountServiceFormatAndMount(t *testing.T) {
+	testCases := []struct {
+		Name       string
+		FSType     string
+		FsckPolicy string
+		Options    []string
+		Commands   []fakeCommand
+		Mounted    bool
+		Error      error
+		FsckResult string
+		FsckErrors float64
+	}{
+		{
+			Name:   "empty device",
+			FSType: "xfs",
+			Commands: []fakeCommand{
+				{argv: "blkid -p -s TYPE -s PTTYPE -o export /dev/sdb", exitStatus: 2},
+				{argv: "mkfs.xfs /dev/sdb"},
+			},
+			Mounted: true,
+		},
+		{
+			Name:       "existing filesystem",
+			FSType:     "btrfs",
+			FsckPolicy: FsckPolicyRepair,
+			Commands: []fakeCommand{
+				{argv: "blkid -p -s TYPE -s PTTYPE -o export /dev/sdb", output: "DEVNAME=/dev/sdb\nTYPE=btrfs\n"},
+				{argv: "btrfs check --readonly /dev/sdb"},
+			},
+			Mounted:    true,
+			FsckResult: "clean",
+		},
+		{
+			Name:       "repaired",
+			FSType:     "ext4",
+			FsckPolicy: FsckPolicyRepair,
+			Commands: []fakeCommand{
+				{argv: "blkid -p -s TYPE -s PTTYPE -o export /dev/sdb", output: "DEVNAME=/dev/sdb\nTYPE=ext4\n"},
+				{argv: "e2fsck -p /dev/sdb", exitStatus: 1},
+			},
+			Mounted:    true,
+			FsckResult: "repaired",
+		},
+		{
+			Name:       "check policy",
+			FSType:     "xfs",
+			FsckPolicy: FsckPolicyCheck,
+			Commands: []fakeCommand{
+				{argv: "blkid -p -s TYPE -s PTTYPE -o export /dev/sdb", output: "DEVNAME=/dev/sdb\nTYPE=xfs\n"},
+				{argv: "xfs_repair -n /dev/sdb", exitStatus: 1},
+			},
+			Error:      ErrFilesystemErrors,
+			FsckResult: "errors",
+			FsckErrors: 1,
+		},
+		{
+			Name:       "check policy with journal needing recovery",
+			FSType:     "ext4",
+			FsckPolicy: FsckPolicyCheck,
+			Commands: []fakeCommand{
+				{argv: "blkid -p -s TYPE -s PTTYPE -o export /dev/sdb", output: "DEVNAME=/dev/sdb\nTYPE=ext4\n"},
+				{argv: "dumpe2fs -h /dev/sdb", output: dumpe2fsOutput(true)},
+			},
+			Mounted:    true,
+			FsckResult: "skipped",
+		},
+		{
+			Name:       "read-only mount is only checked",
+			FSType:     "xfs",
+			FsckPolicy: FsckPolicyRepair,
+			Options:    []string{"ro"},
+			Commands: []fakeCommand{
+				{argv: "blkid -p -s TYPE -s PTTYPE -o export /dev/sdb", output: "DEVNAME=/dev/sdb\nTYPE=xfs\n"},
+				{argv: "xfs_repair -n /dev/sdb"},
+			},
+			Mounted:    true,
+			FsckResult: "clean",
+		},
+		{
+			Name:       "never policy",
+			FSType:     "ext4",
+			FsckPolicy: FsckPolicyNever,
+			Commands: []fakeCommand{
+				{argv: "blkid -p -s TYPE -s PTTYPE -o export /dev/sdb", output: "DEVNAME=/dev/sdb\nTYPE=ext4\n"},
+			},
+			Mounted: true,
+		},
+		{
+			Name:   "default policy repairs",
+			FSType: "ext4",
+			Commands: []fakeCommand{
+				{argv: "blkid -p -s TYPE -s PTTYPE -o export /dev/sdb", output: "DEVNAME=/dev/sdb\nTYPE=ext4\n"},
+				{argv: "e2fsck -p /dev/sdb", exitStatus: 1},
+			},
+			Mounted:    true,
+			FsckResult: "repaired",
+		},
+		{
+			Name:       "check failed",
+			FSType:     "ext4",
+			FsckPolicy: FsckPolicyRepair,
+			Commands: []fakeCommand{
+				{argv: "blkid -p -s TYPE -s PTTYPE -o export /dev/sdb", output: "DEVNAME=/dev/sdb\nTYPE=ext4\n"},
+				{argv: "e2fsck -p /dev/sdb", exitStatus: 8},
+			},
+			FsckResult: "failed",
+		},
+		{
+			Name:   "filesystem mismatch",
+			FSType: "xfs",
+			Commands: []fakeCommand{
+				{argv: "blkid -p -s TYPE -s PTTYPE -o export /dev/sdb", output: "DEVNAME=/dev/sdb\nTYPE=ext4\n"},
+			},
+			Error: ErrFilesystemMismatch,
+		},
+		{
+			Name:   "partition table",
+			FSType: "ext4",
+			Commands: []fakeCommand{
+				{argv: "blkid -p -s TYPE -s PTTYPE -o export /dev/sdb", output: "DEVNAME=/dev/sdb\nPTTYPE=dos\n"},
+			},
+			Error: ErrFilesystemMismatch,
+		},
+		{
+			Name:       "unrepairable errors",
+			FSType:     "ext4",
+			FsckPolicy: FsckPolicyRepair,
+			Commands: []fakeCommand{
+				{argv: "blkid -p -s TYPE -s PTTYPE -o export /dev/sdb", output: "DEVNAME=/dev/sdb\nTYPE=ext4\n"},
+				{argv: "e2fsck -p /dev/sdb", exitStatus: 4},
+			},
+			Error:      ErrFilesystemErrors,
+			FsckResult: "errors",
+			FsckErrors: 1,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			fakeExec, run := newFakeExec(t, testCase.Commands...)
+			fakeMounter := mount.NewFakeMounter(nil)
+			fsckMetrics := newTestFsckMetrics()
+			service := &LinuxMountService{
+				logger:      log.NewNopLogger(),
+				mounter:     &mount.SafeFormatAndMount{Interface: fakeMounter, Exec: fakeExec},
+				fsckMetrics: fsckMetrics,
+			}
+
+			opts := MountOpts{FSType: testCase.FSType, FsckPolicy: testCase.FsckPolicy}
+			err := service.formatAndMount(&csi.Volume{ID: 1}, "/dev/sdb", "/staging", opts, testCase.Options)
+			if testCase.Mounted && err != nil {
+				t.Fatal(err)
+			}
+			if !testCase.Mounted && err == nil {
+				t.Fatal("expected mount to fail")
+			}
+			if testCase.Error != nil && !errors.Is(err, testCase.Error) {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if len(run()) != len(testCase.Commands) {
+				t.Errorf("unexpected commands: %v", run())
+			}
+
+			var expectedLog []mount.FakeAction
+			if testCase.Mounted {
+				expectedLog = []mount.FakeAction{
+					{Action: mount.FakeActionMount, Source: "/dev/sdb", Target: "/staging", FSType: testCase.FSType},
+				}
+			}
+			if log := fakeMounter.GetLog(); !reflect.DeepEqual(log, expectedLog) {
+				t.Errorf("unexpected mounts: %v", log)
+			}
+
+			if n := testutil.CollectAndCount(fsckMetrics.checks); testCase.FsckResult == "" && n != 0 {
+				t.Errorf("expected no filesystem check to be recorded, got %d", n)
+			}
+			if testCase.FsckResult != "" {
+				if n := testutil.ToFloat64(fsckMetrics.checks.WithLabelValues(testCase.FsckResult)); n != 1 {
+					t.Errorf("expected filesystem check result %s to be recorded", testCase.FsckResult)
+				}
+			}
+			if n := testutil.ToFloat64(fsckMetrics.errors); n != testCase.FsckErrors {
+				t.Errorf("unexpected filesystem errors: %v", n)
+			}
+		})
+	}
+}
+
+func TestLinuxMountServiceUnstageDeletesFsckMetrics(t *testing.T) {
+	fsckMetrics := newTestFsckMetrics()
+	service := &LinuxMountService{
+		logger:      log.NewNopLogger(),
+		mounter:     &mount.SafeFormatAndMount{Interface: mount.NewFakeMounter(nil)},
+		fsckMetrics: fsckMetrics,
+	}
+	fsckMetrics.checks.WithLabelValues("clean").Inc()
+	fsckMetrics.checks.WithLabelValues("skipped").Inc()
+
+	if err := service.Unstage(&csi.Volume{ID: 1}, "/nonexistent/staging"); err != nil {
+		t.Fatal(err)
+	}
+	if n := testutil.CollectAndCount(fsckMetrics.checks); n != 0 {
+		t.Errorf("expected filesystem checks to be deleted, got %d", n)
+	}
+	if !fsckMetrics.errorsDeleted {
+		t.Error("expected filesystem errors to be deleted")
+	}
+}
@@ -0,0 +1,264 @@
+package volumes
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-kit/kit/log/level"
+	"k8s.io/utils/exec"
+
+	"github.com/hetznercloud/csi-driver/csi"
+)
+
+// FormatOpts specifies how the filesystem of a volume is created. The zero
+// value creates it with the defaults of the driver.
+type FormatOpts struct {
+	// Label of the filesystem.
+	Label string
+
+	// Options of ext3 and ext4 filesystems. InodeRatio is the number of
+	// bytes per inode, the mkfs default is used if it is zero.
+	InodeRatio               int
+	ReservedBlocksPercentage int
+	DisableLazyInit          bool
+
+	// Options of XFS filesystems, the mkfs defaults are used if nil.
+	Reflink *bool
+	CRC     *bool
+}
+
+// Limits of the format options.
+const (
+	MinInodeRatio               = 1024
+	MaxInodeRatio               = 64 * 1024 * 1024
+	MaxReservedBlocksPercentage = 50
+)
+
+// maxFSLabelLength is the maximum length of the label per filesystem.
+var maxFSLabelLength = map[string]int{
+	"ext3":  16,
+	"ext4":  16,
+	"xfs":   12,
+	"btrfs": 255,
+}
+
+var fsLabelRegexp = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9_.-]*$`)
+
+// Validate checks that the options can be used to create a filesystem of
+// type fsType. If fsType is empty, only the values of the options are
+// checked.
+func (o FormatOpts) Validate(fsType string) error {
+	if o.Label != "" && !fsLabelRegexp.MatchString(o.Label) {
+		return fmt.Errorf("invalid filesystem label %q", o.Label)
+	}
+	if o.InodeRatio != 0 && (o.InodeRatio < MinInodeRatio || o.InodeRatio > MaxInodeRatio) {
+		return fmt.Errorf("inode ratio %d must be between %d and %d", o.InodeRatio, MinInodeRatio, MaxInodeRatio)
+	}
+	if o.ReservedBlocksPercentage < 0 || o.ReservedBlocksPercentage > MaxReservedBlocksPercentage {
+		return fmt.Errorf("reserved blocks percentage %d must be between 0 and %d", o.ReservedBlocksPercentage, MaxReservedBlocksPercentage)
+	}
+	if o.Reflink != nil && *o.Reflink && o.CRC != nil && !*o.CRC {
+		return fmt.Errorf("reflink requires crc")
+	}
+	if fsType == "" {
+		return nil
+	}
+
+	if max, ok := maxFSLabelLength[fsType]; ok && len(o.Label) > max {
+		return fmt.Errorf("filesystem label %q exceeds %d characters allowed for %s", o.Label, max, fsType)
+	}
+	isExt := fsType == "ext3" || fsType == "ext4"
+	if !isExt && (o.InodeRatio != 0 || o.ReservedBlocksPercentage != 0 || o.DisableLazyInit) {
+		return fmt.Errorf("inode ratio, reserved blocks and lazy init can only be set for ext3 and ext4, not %s", fsType)
+	}
+	if fsType != "xfs" && (o.Reflink != nil || o.CRC != nil) {
+		return fmt.Errorf("reflink and crc can only be set for xfs, not %s", fsType)
+	}
+	return nil
+}
+
+// mkfsArgs returns the arguments of mkfs.<fsType> to format device.
+func (o FormatOpts) mkfsArgs(fsType string, device string) []string {
+	var args []string
+	switch fsType {
+	case "ext3", "ext4":
+		args = append(args, "-F", "-m", strconv.Itoa(o.ReservedBlocksPercentage))
+		if o.InodeRatio != 0 {
+			args = append(args, "-i", strconv.Itoa(o.InodeRatio))
+		}
+		if o.DisableLazyInit {
+			args = append(args, "-E", "lazy_itable_init=0,lazy_journal_init=0")
+		}
+	case "xfs":
+		var metadata []string
+		if o.CRC != nil {
+			metadata = append(metadata, "crc="+boolToDigit(*o.CRC))
+		}
+		if o.Reflink != nil {
+			metadata = append(metadata, "reflink="+boolToDigit(*o.Reflink))
+		}
+		if len(metadata) > 0 {
+			args = append(args, "-m", strings.Join(metadata, ","))
+		}
+	}
+	if o.Label != "" {
+		args = append(args, "-L", o.Label)
+	}
+	return append(args, device)
+}
+
+func boolToDigit(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+// formatAndMount creates the filesystem on device if the device is empty and
+// mounts it at target. Devices with any data on them, a filesystem or just a
+// partition table, are never formatted. Existing filesystems must match the
+// requested one and are checked according to the fsck policy before they are
+// mounted. Without a policy they are repaired before read-write mounts, as
+// they were when volumes were mounted with mount-utils' SafeFormatAndMount.
+func (s *LinuxMountService) formatAndMount(volume *csi.Volume, device string, target string, opts MountOpts, options []string) error {
+	readOnly := false
+	for _, option := range options {
+		if option == "ro" {
+			readOnly = true
+		}
+	}
+
+	existingFormat, err := s.mounter.GetDiskFormat(device)
+	if err != nil {
+		return fmt.Errorf("failed to get format of device %s: %s", device, err)
+	}
+	switch {
+	case existingFormat == "":
+		if readOnly {
+			return fmt.Errorf("cannot format device %s mounted read-only", device)
+		}
+		args := opts.Format.mkfsArgs(opts.FSType, device)
+		level.Info(s.logger).Log(
+			"msg", "formatting device",
+			"device", device,
+			"fs-type", opts.FSType,
+			"mkfs-args", strings.Join(args, " "),
+		)
+		output, err := s.mounter.Exec.Command("mkfs."+opts.FSType, args...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("failed to format device %s: %s: %s", device, err, strings.TrimSpace(string(output)))
+		}
+	case existingFormat != opts.FSType:
+		return fmt.Errorf("%w: device %s holds %s, requested %s", ErrFilesystemMismatch, device, existingFormat, opts.FSType)
+	default:
+		policy := opts.FsckPolicy
+		if policy == "" {
+			policy = DefaultFsckPolicy
+		}
+		// Read-only mounts must not modify the filesystem.
+		if readOnly && policy == FsckPolicyRepair {
+			policy = FsckPolicyCheck
+		}
+		if policy != FsckPolicyNever {
+			if err := s.fsck(volume, device, opts.FSType, policy == FsckPolicyRepair); err != nil {
+				return err
+			}
+		}
+	}
+
+	return s.mounter.Mount(device, target, opts.FSType, options)
+}
+
+// fsck checks the filesystem on device and repairs it if repair is set. It
+// fails with ErrFilesystemErrors if errors are left.
+func (s *LinuxMountService) fsck(volume *csi.Volume, device string, fsType string, repair bool) error {
+	level.Debug(s.logger).Log(
+		"msg", "checking filesystem",
+		"volume-name", volume.Name,
+		"device", device,
+		"fs-type", fsType,
+		"repair", repair,
+	)
+	result, output, err := checkFilesystem(s.mounter.Exec, fsType, device, repair)
+	if errors.Is(err, exec.ErrExecutableNotFound) {
+		level.Warn(s.logger).Log(
+			"msg", "filesystem check not available, mounting without check",
+			"device", device,
+			"fs-type", fsType,
+		)
+		return nil
+	}
+	s.recordFsck(volume, result, err)
+	if err != nil {
+		return err
+	}
+
+	switch result {
+	case fsckSkipped:
+		level.Info(s.logger).Log(
+			"msg", "skipped filesystem check",
+			"volume-name", volume.Name,
+			"device", device,
+			"fs-type", fsType,
+			"reason", output,
+		)
+	case fsckRepaired:
+		level.Info(s.logger).Log(
+			"msg", "repaired filesystem",
+			"volume-name", volume.Name,
+			"device", device,
+			"fs-type", fsType,
+			"output", output,
+		)
+	case fsckErrors:
+		level.Error(s.logger).Log(
+			"msg", "filesystem has errors",
+			"volume-name", volume.Name,
+			"device", device,
+			"fs-type", fsType,
+			"repair", repair,
+			"output", output,
+		)
+		if repair {
+			return fmt.Errorf("%w which could not be repaired on device %s: %s", ErrFilesystemErrors, device, output)
+		}
+		return fmt.Errorf("%w on device %s, repair them manually or with fsck policy %s: %s", ErrFilesystemErrors, device, FsckPolicyRepair, output)
+	}
+	return nil
+}
+
+// recordFsck records the result of checking the filesystem of volume. Checks
+// which failed to run leave the error gauge as is.
+func (s *LinuxMountService) recordFsck(volume *csi.Volume, result fsckResult, err error) {
+	if s.fsckMetrics == nil {
+		return
+	}
+	volumeID := strconv.FormatUint(volume.ID, 10)
+	if err != nil {
+		s.fsckMetrics.FilesystemChecks(volumeID, fsckResultFailed).Inc()
+		return
+	}
+	s.fsckMetrics.FilesystemChecks(volumeID, result.String()).Inc()
+	switch result {
+	case fsckErrors:
+		s.fsckMetrics.FilesystemErrors(volumeID).Set(1)
+	case fsckClean, fsckRepaired:
+		s.fsckMetrics.FilesystemErrors(volumeID).Set(0)
+	}
+}
+
+// deleteFsckMetrics deletes the filesystem check metrics of volume, so that
+// they are not exported for volumes which are not staged on this node.
+func (s *LinuxMountService) deleteFsckMetrics(volume *csi.Volume) {
+	if s.fsckMetrics == nil {
+		return
+	}
+	volumeID := strconv.FormatUint(volume.ID, 10)
+	for _, result := range fsckResults {
+		s.fsckMetrics.DeleteFilesystemChecks(volumeID, result)
+	}
+	s.fsckMetrics.DeleteFilesystemErrors(volumeID)
+}
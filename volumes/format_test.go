@@ -0,0 +1,95 @@
+package volumes
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFormatOptsMkfsArgs(t *testing.T) {
+	yes, no := true, false
+
+	testCases := []struct {
+		Name     string
+		FSType   string
+		Opts     FormatOpts
+		Expected []string
+	}{
+		{
+			Name:     "ext4 defaults",
+			FSType:   "ext4",
+			Expected: []string{"-F", "-m", "0", "/dev/sdb"},
+		},
+		{
+			Name:   "ext4",
+			FSType: "ext4",
+			Opts: FormatOpts{
+				Label:                    "data",
+				InodeRatio:               65536,
+				ReservedBlocksPercentage: 5,
+				DisableLazyInit:          true,
+			},
+			Expected: []string{"-F", "-m", "5", "-i", "65536", "-E", "lazy_itable_init=0,lazy_journal_init=0", "-L", "data", "/dev/sdb"},
+		},
+		{
+			Name:     "xfs defaults",
+			FSType:   "xfs",
+			Expected: []string{"/dev/sdb"},
+		},
+		{
+			Name:     "xfs",
+			FSType:   "xfs",
+			Opts:     FormatOpts{Label: "data", Reflink: &no, CRC: &yes},
+			Expected: []string{"-m", "crc=1,reflink=0", "-L", "data", "/dev/sdb"},
+		},
+		{
+			Name:     "btrfs",
+			FSType:   "btrfs",
+			Opts:     FormatOpts{Label: "data"},
+			Expected: []string{"-L", "data", "/dev/sdb"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			args := testCase.Opts.mkfsArgs(testCase.FSType, "/dev/sdb")
+			if !reflect.DeepEqual(args, testCase.Expected) {
+				t.Errorf("unexpected args: %v", args)
+			}
+		})
+	}
+}
+
+func TestFormatOptsValidate(t *testing.T) {
+	yes, no := true, false
+
+	testCases := []struct {
+		Name   string
+		FSType string
+		Opts   FormatOpts
+		Valid  bool
+	}{
+		{Name: "defaults", FSType: "ext4", Valid: true},
+		{Name: "ext4", FSType: "ext4", Opts: FormatOpts{Label: "data", InodeRatio: 4096, ReservedBlocksPercentage: 1}, Valid: true},
+		{Name: "xfs", FSType: "xfs", Opts: FormatOpts{Reflink: &yes, CRC: &yes}, Valid: true},
+		{Name: "unknown fs type", Opts: FormatOpts{InodeRatio: 4096, Reflink: &yes}, Valid: true},
+		{Name: "ext4 option for xfs", FSType: "xfs", Opts: FormatOpts{DisableLazyInit: true}},
+		{Name: "xfs option for ext4", FSType: "ext4", Opts: FormatOpts{CRC: &yes}},
+		{Name: "reflink without crc", Opts: FormatOpts{Reflink: &yes, CRC: &no}},
+		{Name: "inode ratio too small", Opts: FormatOpts{InodeRatio: 512}},
+		{Name: "reserved blocks too large", Opts: FormatOpts{ReservedBlocksPercentage: 60}},
+		{Name: "invalid label", Opts: FormatOpts{Label: "-L x"}},
+		{Name: "label too long", FSType: "ext4", Opts: FormatOpts{Label: "longer-than-sixteen"}},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			err := testCase.Opts.Validate(testCase.FSType)
+			if testCase.Valid && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !testCase.Valid && err == nil {
+				t.Fatal("expected options to be rejected")
+			}
+		})
+	}
+}
@@ -62,6 +62,15 @@ func (s *IdempotentService) Create(ctx context.Context, opts CreateOpts) (*csi.V
 			)
 			return nil, ErrVolumeAlreadyExists
 		}
+		if opts.RequestHashLabel != "" {
+			if hash, ok := existingVolume.Labels[opts.RequestHashLabel]; ok && hash != opts.RequestHash() {
+				level.Info(s.logger).Log(
+					"msg", "existing volume was created by a different request",
+					"name", opts.Name,
+				)
+				return nil, ErrVolumeAlreadyExists
+			}
+		}
 		if existingVolume.Size < opts.MinSize {
 			level.Info(s.logger).Log(
 				"msg", "existing volume is too small",
@@ -89,12 +98,59 @@ func (s *IdempotentService) Create(ctx context.Context, opts CreateOpts) (*csi.V
 			)
 			return nil, ErrVolumeAlreadyExists
 		}
+		if opts.ProvisioningStateLabel != "" {
+			return s.resumeCreate(ctx, existingVolume, opts)
+		}
 		return existingVolume, nil
 	}
 
 	return nil, err
 }
 
+// resumeCreate returns an existing volume created by an identical request
+// once it is ready. The creation is finished if it has been interrupted and
+// restarted if it failed.
+func (s *IdempotentService) resumeCreate(ctx context.Context, volume *csi.Volume, opts CreateOpts) (*csi.Volume, error) {
+	switch volume.Labels[opts.ProvisioningStateLabel] {
+	case "":
+		return volume, nil
+	case ProvisioningStateFailed:
+		level.Info(s.logger).Log(
+			"msg", "creating existing volume failed, recreating it",
+			"volume-id", volume.ID,
+		)
+		if err := s.volumeService.Delete(ctx, volume); err != nil && err != ErrVolumeNotFound {
+			return nil, err
+		}
+		return s.volumeService.Create(ctx, opts)
+	}
+
+	if volume.Creating {
+		level.Info(s.logger).Log(
+			"msg", "existing volume is still being created",
+			"volume-id", volume.ID,
+		)
+		return nil, ErrVolumeCreating
+	}
+
+	level.Info(s.logger).Log(
+		"msg", "finishing interrupted creation of existing volume",
+		"volume-id", volume.ID,
+	)
+	if opts.DeleteProtection && !volume.DeleteProtection {
+		if err := s.volumeService.SetDeleteProtection(ctx, volume, true); err != nil {
+			return nil, err
+		}
+		volume.DeleteProtection = true
+	}
+	labels := opts.JournalLabels("")
+	if err := s.volumeService.SetLabels(ctx, volume, labels); err != nil {
+		return nil, err
+	}
+	volume.Labels = labels
+	return volume, nil
+}
+
 func (s *IdempotentService) GetByID(ctx context.Context, id uint64) (*csi.Volume, error) {
 	return s.volumeService.GetByID(ctx, id)
 }
@@ -103,6 +159,10 @@ func (s *IdempotentService) GetByName(ctx context.Context, name string) (*csi.Vo
 	return s.volumeService.GetByName(ctx, name)
 }
 
+func (s *IdempotentService) List(ctx context.Context, opts ListOpts) ([]*csi.Volume, error) {
+	return s.volumeService.List(ctx, opts)
+}
+
 func (s *IdempotentService) Delete(ctx context.Context, volume *csi.Volume) error {
 	switch err := s.volumeService.Detach(ctx, volume, nil); err {
 	case ErrVolumeNotFound, ErrNotAttached, nil:
@@ -127,7 +187,7 @@ func (s *IdempotentService) Attach(ctx context.Context, volume *csi.Volume, serv
 		return nil
 	}
 
-	vol, err := s.volumeService.GetByID(ctx, volume.ID)
+	vol, err := s.volumeService.GetByID(WithoutCache(ctx), volume.ID)
 	if err != nil {
 		return err
 	}
@@ -154,3 +214,11 @@ func (s *IdempotentService) Detach(ctx context.Context, volume *csi.Volume, serv
 func (s *IdempotentService) Resize(ctx context.Context, volume *csi.Volume, size int) error {
 	return s.volumeService.Resize(ctx, volume, size)
 }
+
+func (s *IdempotentService) SetDeleteProtection(ctx context.Context, volume *csi.Volume, enabled bool) error {
+	return s.volumeService.SetDeleteProtection(ctx, volume, enabled)
+}
+
+func (s *IdempotentService) SetLabels(ctx context.Context, volume *csi.Volume, labels map[string]string) error {
+	return s.volumeService.SetLabels(ctx, volume, labels)
+}
@@ -3,6 +3,7 @@ package volumes_test
 import (
 	"context"
 	"io"
+	"reflect"
 	"testing"
 
 	"github.com/go-kit/kit/log"
@@ -30,7 +31,7 @@ func TestIdempotentServiceCreateNew(t *testing.T) {
 
 	volumeService := &mock.VolumeService{
 		CreateFunc: func(ctx context.Context, opts volumes.CreateOpts) (*csi.Volume, error) {
-			if opts != creatingOpts {
+			if !reflect.DeepEqual(opts, creatingOpts) {
 				t.Errorf("unexpected options: %v", opts)
 			}
 			return creatingVolume, nil
@@ -165,6 +166,158 @@ func TestIdempotentServiceCreateExistingNotFitting(t *testing.T) {
 	}
 }
 
+func TestCreateOptsRequestHash(t *testing.T) {
+	opts := volumes.CreateOpts{
+		Name:                   "test",
+		MinSize:                10,
+		Location:               "loc",
+		Labels:                 map[string]string{"a": "1", "b": "2"},
+		ProvisioningStateLabel: "state",
+		RequestHashLabel:       "hash",
+	}
+	hash := opts.RequestHash()
+
+	journaled := opts
+	journaled.Labels = opts.JournalLabels(volumes.ProvisioningStateCreating)
+	if h := journaled.RequestHash(); h != hash {
+		t.Errorf("expected journal labels not to change the hash, got %s and %s", h, hash)
+	}
+
+	other := opts
+	other.MinSize = 20
+	if h := other.RequestHash(); h == hash {
+		t.Error("expected different options to change the hash")
+	}
+}
+
+func TestIdempotentServiceCreateJournal(t *testing.T) {
+	opts := volumes.CreateOpts{
+		Name:                   "test",
+		MinSize:                10,
+		Location:               "loc",
+		Labels:                 map[string]string{"a": "1"},
+		DeleteProtection:       true,
+		ProvisioningStateLabel: "state",
+		RequestHashLabel:       "hash",
+	}
+	hash := opts.RequestHash()
+
+	testCases := []struct {
+		Name               string
+		ExistingVolume     *csi.Volume
+		ExpectedError      error
+		ExpectedVolumeID   uint64
+		ExpectedCalls      []string
+		ExpectedLabels     map[string]string
+		ExpectedProtection bool
+	}{
+		{
+			Name: "ready",
+			ExistingVolume: &csi.Volume{
+				ID: 1, Size: 10, Location: "loc", DeleteProtection: true,
+				Labels: map[string]string{"a": "1", "hash": hash},
+			},
+			ExpectedVolumeID:   1,
+			ExpectedLabels:     map[string]string{"a": "1", "hash": hash},
+			ExpectedProtection: true,
+		},
+		{
+			Name: "different request",
+			ExistingVolume: &csi.Volume{
+				ID: 1, Size: 10, Location: "loc",
+				Labels: map[string]string{"a": "1", "hash": "other"},
+			},
+			ExpectedError: volumes.ErrVolumeAlreadyExists,
+		},
+		{
+			Name: "still creating",
+			ExistingVolume: &csi.Volume{
+				ID: 1, Size: 10, Location: "loc", Creating: true,
+				Labels: map[string]string{"a": "1", "hash": hash, "state": volumes.ProvisioningStateCreating},
+			},
+			ExpectedError: volumes.ErrVolumeCreating,
+		},
+		{
+			Name: "creation interrupted",
+			ExistingVolume: &csi.Volume{
+				ID: 1, Size: 10, Location: "loc",
+				Labels: map[string]string{"a": "1", "hash": hash, "state": volumes.ProvisioningStateCreating},
+			},
+			ExpectedVolumeID:   1,
+			ExpectedCalls:      []string{"protect", "labels"},
+			ExpectedLabels:     map[string]string{"a": "1", "hash": hash},
+			ExpectedProtection: true,
+		},
+		{
+			Name: "creation failed",
+			ExistingVolume: &csi.Volume{
+				ID: 1, Size: 10, Location: "loc",
+				Labels: map[string]string{"a": "1", "hash": hash, "state": volumes.ProvisioningStateFailed},
+			},
+			ExpectedVolumeID: 2,
+			ExpectedCalls:    []string{"delete", "create"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			var calls []string
+			creates := 0
+			volumeService := &mock.VolumeService{
+				CreateFunc: func(ctx context.Context, opts volumes.CreateOpts) (*csi.Volume, error) {
+					creates++
+					if creates == 1 {
+						return nil, volumes.ErrVolumeAlreadyExists
+					}
+					calls = append(calls, "create")
+					return &csi.Volume{ID: 2}, nil
+				},
+				GetByNameFunc: func(ctx context.Context, name string) (*csi.Volume, error) {
+					return testCase.ExistingVolume, nil
+				},
+				DeleteFunc: func(ctx context.Context, volume *csi.Volume) error {
+					calls = append(calls, "delete")
+					return nil
+				},
+				SetDeleteProtectionFunc: func(ctx context.Context, volume *csi.Volume, enabled bool) error {
+					calls = append(calls, "protect")
+					return nil
+				},
+				SetLabelsFunc: func(ctx context.Context, volume *csi.Volume, labels map[string]string) error {
+					calls = append(calls, "labels")
+					if !reflect.DeepEqual(labels, testCase.ExpectedLabels) {
+						t.Errorf("unexpected labels: %v", labels)
+					}
+					return nil
+				},
+			}
+			service := volumes.NewIdempotentService(log.NewNopLogger(), volumeService)
+
+			volume, err := service.Create(context.Background(), opts)
+			if err != testCase.ExpectedError {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(calls, testCase.ExpectedCalls) {
+				t.Errorf("unexpected calls: %v", calls)
+			}
+			if err != nil {
+				return
+			}
+			if volume.ID != testCase.ExpectedVolumeID {
+				t.Errorf("unexpected volume: %v", volume)
+			}
+			if testCase.ExpectedLabels != nil {
+				if !reflect.DeepEqual(volume.Labels, testCase.ExpectedLabels) {
+					t.Errorf("unexpected labels: %v", volume.Labels)
+				}
+				if volume.DeleteProtection != testCase.ExpectedProtection {
+					t.Errorf("unexpected delete protection: %v", volume.DeleteProtection)
+				}
+			}
+		})
+	}
+}
+
 func TestIdempotentServiceDelete(t *testing.T) {
 	volumeService := &mock.VolumeService{}
 	service := volumes.NewIdempotentService(log.NewNopLogger(), volumeService)
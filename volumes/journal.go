@@ -0,0 +1,59 @@
+package volumes
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Provisioning states recorded in the provisioning state label of a volume.
+// The label is removed once the volume is ready.
+const (
+	ProvisioningStateCreating = "creating"
+	ProvisioningStateFailed   = "failed"
+)
+
+// RequestHash returns a hash of the options, which is the same for identical
+// create requests.
+func (o CreateOpts) RequestHash() string {
+	keys := make([]string, 0, len(o.Labels))
+	for key := range o.Labels {
+		if key == o.ProvisioningStateLabel || key == o.RequestHashLabel {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "name=%s\nmin-size=%d\nmax-size=%d\nlocation=%s\ndelete-protection=%t\n",
+		o.Name, o.MinSize, o.MaxSize, o.Location, o.DeleteProtection)
+	for _, key := range keys {
+		fmt.Fprintf(&b, "label=%s=%s\n", key, o.Labels[key])
+	}
+	sum := sha256.Sum256([]byte(b.String()))
+	// Label values are limited to 63 characters.
+	return hex.EncodeToString(sum[:16])
+}
+
+// JournalLabels returns the labels of a volume created with the options
+// while it is in the provisioning state, or once it is ready if state is
+// empty.
+func (o CreateOpts) JournalLabels(state string) map[string]string {
+	labels := make(map[string]string, len(o.Labels)+2)
+	for key, value := range o.Labels {
+		labels[key] = value
+	}
+	if o.RequestHashLabel != "" {
+		labels[o.RequestHashLabel] = o.RequestHash()
+	}
+	if o.ProvisioningStateLabel != "" {
+		delete(labels, o.ProvisioningStateLabel)
+		if state != "" {
+			labels[o.ProvisioningStateLabel] = state
+		}
+	}
+	return labels
+}
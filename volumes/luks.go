@@ -0,0 +1,86 @@
+package volumes
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"k8s.io/utils/exec"
+)
+
+// luksMapperPrefix is the prefix of the device mapper names of all volumes
+// opened by the driver.
+const luksMapperPrefix = "hcloud-csi-"
+
+func luksMapperName(volumeID uint64) string {
+	return fmt.Sprintf("%s%d", luksMapperPrefix, volumeID)
+}
+
+func luksMapperDevice(volumeID uint64) string {
+	return "/dev/mapper/" + luksMapperName(volumeID)
+}
+
+// cryptSetup runs cryptsetup to manage LUKS encrypted devices.
+type cryptSetup struct {
+	exec exec.Interface
+}
+
+// IsLuks reports whether device contains a LUKS header.
+func (c cryptSetup) IsLuks(device string) (bool, error) {
+	output, err := c.exec.Command("cryptsetup", "isLuks", device).CombinedOutput()
+	if err == nil {
+		return true, nil
+	}
+	if exitErr, ok := err.(exec.ExitError); ok && exitErr.ExitStatus() == 1 {
+		return false, nil
+	}
+	return false, fmt.Errorf("cryptsetup isLuks %s: %s: %s", device, err, output)
+}
+
+// Format initializes device as LUKS device protected by passphrase.
+func (c cryptSetup) Format(device string, passphrase string) error {
+	return c.runWithPassphrase(passphrase, "luksFormat", "--type", "luks2", "--batch-mode", "--key-file", "-", device)
+}
+
+// Open opens the LUKS device under /dev/mapper/name. The volume key is not
+// put into the kernel keyring so that the device can be resized without
+// passphrase later on.
+func (c cryptSetup) Open(device string, name string, passphrase string) error {
+	return c.runWithPassphrase(passphrase, "luksOpen", "--disable-keyring", "--key-file", "-", device, name)
+}
+
+// Close closes the LUKS device /dev/mapper/name.
+func (c cryptSetup) Close(name string) error {
+	if output, err := c.exec.Command("cryptsetup", "luksClose", name).CombinedOutput(); err != nil {
+		return fmt.Errorf("cryptsetup luksClose %s: %s: %s", name, err, output)
+	}
+	return nil
+}
+
+// Resize grows the LUKS device /dev/mapper/name to the size of the underlying device.
+func (c cryptSetup) Resize(name string) error {
+	if output, err := c.exec.Command("cryptsetup", "resize", name).CombinedOutput(); err != nil {
+		return fmt.Errorf("cryptsetup resize %s: %s: %s", name, err, output)
+	}
+	return nil
+}
+
+func (c cryptSetup) runWithPassphrase(passphrase string, args ...string) error {
+	cmd := c.exec.Command("cryptsetup", args...)
+	cmd.SetStdin(strings.NewReader(passphrase))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("cryptsetup %s: %s: %s", args[0], err, output)
+	}
+	return nil
+}
+
+func deviceExists(device string) (bool, error) {
+	_, err := os.Stat(device)
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
@@ -1,9 +1,12 @@
 package volumes
 
 import (
+	"context"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
@@ -21,34 +24,63 @@ type MountOpts struct {
 	FSType      string
 	Readonly    bool
 	Additional  []string // Additional mount options/flags passed to /bin/mount
+
+	// EncryptionPassphrase enables LUKS encryption of the volume if set.
+	EncryptionPassphrase string
+
+	// Format specifies how the filesystem is created if the volume is
+	// empty.
+	Format FormatOpts
+
+	// FsckPolicy specifies whether an existing filesystem is checked or
+	// repaired before it is mounted. DefaultFsckPolicy is used if empty.
+	FsckPolicy string
 }
 
 // MountService mounts volumes.
 type MountService interface {
-	Stage(volume *csi.Volume, stagingTargetPath string, opts MountOpts) error
+	// VerifyDevice waits for the device of the volume to appear and checks
+	// that it belongs to the volume. It fails with ErrDeviceNotFound or
+	// ErrDeviceMismatch otherwise.
+	VerifyDevice(ctx context.Context, volume *csi.Volume) error
+	Stage(ctx context.Context, volume *csi.Volume, stagingTargetPath string, opts MountOpts) error
 	Unstage(volume *csi.Volume, stagingTargetPath string) error
 	Publish(volume *csi.Volume, targetPath string, stagingTargetPath string, opts MountOpts) error
-	Unpublish(volume *csi.Volume, targetPath string) error
+	Unpublish(targetPath string) error
 	PathExists(path string) (bool, error)
 }
 
 // LinuxMountService mounts volumes on a Linux system.
 type LinuxMountService struct {
-	logger  log.Logger
-	mounter *mount.SafeFormatAndMount
+	logger      log.Logger
+	mounter     *mount.SafeFormatAndMount
+	crypt       cryptSetup
+	fsckMetrics FsckMetrics
+
+	// sysfs is the path sysfs is mounted at and deviceWaitTimeout how long
+	// to wait for the device of a volume to appear.
+	sysfs             string
+	deviceWaitTimeout time.Duration
 }
 
-func NewLinuxMountService(logger log.Logger) *LinuxMountService {
+// NewLinuxMountService returns a mount service recording filesystem checks in
+// fsckMetrics, which may be nil.
+func NewLinuxMountService(logger log.Logger, fsckMetrics FsckMetrics) *LinuxMountService {
+	mounter := &mount.SafeFormatAndMount{
+		Interface: mount.New(""),
+		Exec:      exec.New(),
+	}
 	return &LinuxMountService{
-		logger: logger,
-		mounter: &mount.SafeFormatAndMount{
-			Interface: mount.New(""),
-			Exec:      exec.New(),
-		},
+		logger:            logger,
+		mounter:           mounter,
+		crypt:             cryptSetup{exec: mounter.Exec},
+		fsckMetrics:       fsckMetrics,
+		sysfs:             sysfsPath,
+		deviceWaitTimeout: deviceWaitTimeout,
 	}
 }
 
-func (s *LinuxMountService) Stage(volume *csi.Volume, stagingTargetPath string, opts MountOpts) error {
+func (s *LinuxMountService) Stage(ctx context.Context, volume *csi.Volume, stagingTargetPath string, opts MountOpts) error {
 	if opts.FSType == "" {
 		opts.FSType = DefaultFSType
 	}
@@ -58,6 +90,7 @@ func (s *LinuxMountService) Stage(volume *csi.Volume, stagingTargetPath string,
 		"volume-name", volume.Name,
 		"staging-target-path", stagingTargetPath,
 		"fs-type", opts.FSType,
+		"encrypted", opts.EncryptionPassphrase != "",
 	)
 
 	isNotMountPoint, err := s.mounter.IsLikelyNotMountPoint(stagingTargetPath)
@@ -75,16 +108,149 @@ func (s *LinuxMountService) Stage(volume *csi.Volume, stagingTargetPath string,
 		return nil
 	}
 
-	return s.mounter.FormatAndMount(volume.LinuxDevice, stagingTargetPath, opts.FSType, nil)
+	if err := s.VerifyDevice(ctx, volume); err != nil {
+		return err
+	}
+
+	device := volume.LinuxDevice
+	if opts.EncryptionPassphrase != "" {
+		if device, err = s.openEncrypted(volume, opts.EncryptionPassphrase); err != nil {
+			return err
+		}
+	}
+
+	options := StageMountOptions(opts.FSType, opts.Additional)
+	level.Debug(s.logger).Log(
+		"msg", "mounting volume at staging target path",
+		"volume-name", volume.Name,
+		"mount-options", strings.Join(options, ", "),
+	)
+	return s.formatAndMount(volume, device, stagingTargetPath, opts, options)
+}
+
+// VerifyDevice waits for the device of the volume to appear and checks that it
+// belongs to the volume, so a device reported for the wrong volume is never
+// written to.
+func (s *LinuxMountService) VerifyDevice(ctx context.Context, volume *csi.Volume) error {
+	if err := waitForDevice(ctx, volume.LinuxDevice, s.deviceWaitTimeout); err != nil {
+		return err
+	}
+	resolved, err := verifyDevice(s.sysfs, volume.LinuxDevice, volume.ID)
+	if err != nil {
+		level.Error(s.logger).Log(
+			"msg", "failed to verify device of volume",
+			"volume-name", volume.Name,
+			"device", volume.LinuxDevice,
+			"err", err,
+		)
+		return err
+	}
+	level.Debug(s.logger).Log(
+		"msg", "verified device of volume",
+		"volume-name", volume.Name,
+		"device", volume.LinuxDevice,
+		"resolved-device", resolved,
+	)
+	return nil
+}
+
+// openEncrypted opens the LUKS encrypted volume and returns the path of the
+// decrypted device. Empty volumes are encrypted first, volumes with
+// unencrypted data on them are refused.
+func (s *LinuxMountService) openEncrypted(volume *csi.Volume, passphrase string) (string, error) {
+	mapperDevice := luksMapperDevice(volume.ID)
+	opened, err := deviceExists(mapperDevice)
+	if err != nil {
+		return "", err
+	}
+	if opened {
+		return mapperDevice, nil
+	}
+
+	isLuks, err := s.crypt.IsLuks(volume.LinuxDevice)
+	if err != nil {
+		return "", err
+	}
+	if !isLuks {
+		format, err := s.mounter.GetDiskFormat(volume.LinuxDevice)
+		if err != nil {
+			return "", err
+		}
+		if format != "" {
+			return "", fmt.Errorf("refusing to encrypt device %s which contains unencrypted %s data", volume.LinuxDevice, format)
+		}
+		level.Info(s.logger).Log(
+			"msg", "encrypting volume",
+			"volume-name", volume.Name,
+			"device", volume.LinuxDevice,
+		)
+		if err := s.crypt.Format(volume.LinuxDevice, passphrase); err != nil {
+			return "", err
+		}
+	}
+
+	if err := s.crypt.Open(volume.LinuxDevice, luksMapperName(volume.ID), passphrase); err != nil {
+		return "", err
+	}
+	return mapperDevice, nil
 }
 
+// MountPath returns a path the volume is mounted at on this system.
+func (s *LinuxMountService) MountPath(volume *csi.Volume) (string, error) {
+	device := volume.LinuxDevice
+	if opened, err := deviceExists(luksMapperDevice(volume.ID)); err != nil {
+		return "", err
+	} else if opened {
+		device = luksMapperDevice(volume.ID)
+	}
+	device, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return "", err
+	}
+
+	mountPoints, err := s.mounter.List()
+	if err != nil {
+		return "", err
+	}
+	for _, mountPoint := range mountPoints {
+		mountDevice, err := filepath.EvalSymlinks(mountPoint.Device)
+		if err != nil {
+			continue
+		}
+		if mountDevice == device {
+			return mountPoint.Path, nil
+		}
+	}
+	return "", fmt.Errorf("volume %d is not mounted", volume.ID)
+}
+
+// Unstage unmounts the staging target path and closes the LUKS mapping
+// mounted there, if any. It only depends on what is mounted on this system,
+// so stale mounts are cleaned up even if the volume does not exist anymore.
 func (s *LinuxMountService) Unstage(volume *csi.Volume, stagingTargetPath string) error {
 	level.Debug(s.logger).Log(
 		"msg", "unstaging volume",
-		"volume-name", volume.Name,
+		"volume-id", volume.ID,
 		"staging-target-path", stagingTargetPath,
 	)
-	return mount.CleanupMountPoint(stagingTargetPath, s.mounter, false)
+	if err := mount.CleanupMountPoint(stagingTargetPath, s.mounter, false); err != nil {
+		return err
+	}
+
+	// The LUKS device is looked up by the volume ID rather than the
+	// unmounted device, so that it is also closed if an earlier unstage
+	// failed or was interrupted after unmounting it.
+	opened, err := deviceExists(luksMapperDevice(volume.ID))
+	if err != nil {
+		return err
+	}
+	if opened {
+		if err := s.crypt.Close(luksMapperName(volume.ID)); err != nil {
+			return err
+		}
+	}
+	s.deleteFsckMetrics(volume)
+	return nil
 }
 
 func (s *LinuxMountService) Publish(volume *csi.Volume, targetPath string, stagingTargetPath string, opts MountOpts) error {
@@ -125,7 +291,7 @@ func (s *LinuxMountService) Publish(volume *csi.Volume, targetPath string, stagi
 	if opts.Readonly {
 		options = append(options, "ro")
 	}
-	options = append(options, opts.Additional...)
+	options = append(options, mountFlagOptions(opts.Additional)...)
 
 	level.Debug(s.logger).Log(
 		"msg", "publishing volume",
@@ -145,10 +311,9 @@ func (s *LinuxMountService) Publish(volume *csi.Volume, targetPath string, stagi
 	return nil
 }
 
-func (s *LinuxMountService) Unpublish(volume *csi.Volume, targetPath string) error {
+func (s *LinuxMountService) Unpublish(targetPath string) error {
 	level.Debug(s.logger).Log(
 		"msg", "unpublishing volume",
-		"volume-name", volume.Name,
 		"target-path", targetPath,
 	)
 	return mount.CleanupMountPoint(targetPath, s.mounter, true)
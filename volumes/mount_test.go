@@ -1,3 +1,67 @@
 package volumes
 
+import (
+	"reflect"
+	"testing"
+)
+
 var _ MountService = (*LinuxMountService)(nil)
+
+func TestValidateMountFlags(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		FSType string
+		Flags  []string
+		Valid  bool
+	}{
+		{Name: "no flags", Valid: true},
+		{Name: "generic flags", FSType: "xfs", Flags: []string{"noatime", "discard,nodev"}, Valid: true},
+		{Name: "fstab flags", FSType: "ext4", Flags: []string{"defaults,nofail", "_netdev"}, Valid: true},
+		{Name: "fs specific flags", FSType: "ext4", Flags: []string{"errors=continue", "commit=30"}, Valid: true},
+		{Name: "default fs type", Flags: []string{"data=writeback"}, Valid: true},
+		{Name: "flag of other fs", FSType: "ext4", Flags: []string{"nouuid"}},
+		{Name: "bind", Flags: []string{"bind"}},
+		{Name: "hidden in list", Flags: []string{"noatime,remount"}},
+		{Name: "empty flag", Flags: []string{"noatime,"}},
+		{Name: "disallowed value", FSType: "ext4", Flags: []string{"errors=panic"}},
+		{Name: "missing value", FSType: "ext4", Flags: []string{"commit="}},
+		{Name: "invalid value", FSType: "xfs", Flags: []string{"logbufs=8 x"}},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			err := ValidateMountFlags(testCase.FSType, testCase.Flags)
+			if testCase.Valid && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !testCase.Valid && err == nil {
+				t.Fatal("expected flags to be rejected")
+			}
+		})
+	}
+}
+
+func TestStageMountOptions(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		FSType   string
+		Flags    []string
+		Expected []string
+	}{
+		{Name: "defaults", FSType: "ext4", Expected: []string{"errors=remount-ro"}},
+		{Name: "default fs type", Flags: []string{"noatime"}, Expected: []string{"errors=remount-ro", "noatime"}},
+		{Name: "overridden default", FSType: "ext4", Flags: []string{"noatime,errors=continue"}, Expected: []string{"noatime", "errors=continue"}},
+		{Name: "xfs", FSType: "xfs", Flags: []string{"discard"}, Expected: []string{"nouuid", "discard"}},
+		{Name: "no defaults", FSType: "btrfs", Flags: []string{"discard"}, Expected: []string{"discard"}},
+		{Name: "fstab flags dropped", FSType: "xfs", Flags: []string{"defaults,noatime", "nofail", "_netdev"}, Expected: []string{"nouuid", "noatime"}},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			options := StageMountOptions(testCase.FSType, testCase.Flags)
+			if !reflect.DeepEqual(options, testCase.Expected) {
+				t.Errorf("unexpected options: %v", options)
+			}
+		})
+	}
+}
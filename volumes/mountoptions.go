@@ -0,0 +1,196 @@
+package volumes
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// defaultMountOptions are the options filesystems are mounted with unless
+// overridden by a mount flag with the same name.
+var defaultMountOptions = map[string][]string{
+	// Remount read-only on errors instead of continuing on a corrupted
+	// filesystem.
+	"ext4": {"errors=remount-ro"},
+	// Clones of a volume share the UUID of its filesystem, XFS refuses to
+	// mount them on the same node without nouuid.
+	"xfs": {"nouuid"},
+}
+
+// allowedMountOptions are the mount flags accepted for every filesystem.
+// Options ending with "=" take a value.
+var allowedMountOptions = map[string]bool{
+	"ro":          true,
+	"rw":          true,
+	"atime":       true,
+	"noatime":     true,
+	"relatime":    true,
+	"norelatime":  true,
+	"strictatime": true,
+	"lazytime":    true,
+	"nolazytime":  true,
+	"diratime":    true,
+	"nodiratime":  true,
+	"sync":        true,
+	"async":       true,
+	"dirsync":     true,
+	"nodev":       true,
+	"noexec":      true,
+	"nosuid":      true,
+	"discard":     true,
+	"nodiscard":   true,
+}
+
+// ignoredMountOptions are mount flags which are accepted for every filesystem
+// but dropped, as they only matter for mounts listed in /etc/fstab. They are
+// commonly copied into StorageClasses from there.
+var ignoredMountOptions = map[string]bool{
+	"defaults": true,
+	"nofail":   true,
+	"_netdev":  true,
+}
+
+// allowedFSMountOptions are the mount flags accepted for a filesystem in
+// addition to allowedMountOptions.
+var allowedFSMountOptions = map[string]map[string]bool{
+	"ext3": {
+		"errors=":      true,
+		"commit=":      true,
+		"data=":        true,
+		"barrier":      true,
+		"nobarrier":    true,
+		"acl":          true,
+		"noacl":        true,
+		"user_xattr":   true,
+		"nouser_xattr": true,
+	},
+	"ext4": {
+		"errors=":          true,
+		"commit=":          true,
+		"data=":            true,
+		"barrier":          true,
+		"nobarrier":        true,
+		"acl":              true,
+		"noacl":            true,
+		"user_xattr":       true,
+		"nouser_xattr":     true,
+		"delalloc":         true,
+		"nodelalloc":       true,
+		"auto_da_alloc":    true,
+		"noauto_da_alloc":  true,
+		"journal_checksum": true,
+		"stripe=":          true,
+	},
+	"xfs": {
+		"nouuid":     true,
+		"allocsize=": true,
+		"logbufs=":   true,
+		"logbsize=":  true,
+		"inode32":    true,
+		"inode64":    true,
+		"largeio":    true,
+		"nolargeio":  true,
+		"swalloc":    true,
+		"noquota":    true,
+		"uquota":     true,
+		"gquota":     true,
+		"pquota":     true,
+		"prjquota":   true,
+	},
+	"btrfs": {
+		"compress=":       true,
+		"compress-force=": true,
+		"commit=":         true,
+		"autodefrag":      true,
+		"noautodefrag":    true,
+		"ssd":             true,
+		"nossd":           true,
+		"space_cache=":    true,
+	},
+}
+
+// allowedMountOptionValues restricts the values of options which take a
+// value. Values of other options must match mountOptionValueRegexp.
+var allowedMountOptionValues = map[string]map[string]bool{
+	// errors=panic would take down the node.
+	"errors=": {"continue": true, "remount-ro": true},
+	"data=":   {"journal": true, "ordered": true, "writeback": true},
+}
+
+var mountOptionValueRegexp = regexp.MustCompile(`^[a-zA-Z0-9._:-]+$`)
+
+// ValidateMountFlags checks the mount flags requested for a filesystem of
+// type fsType against the allowed mount options. Flags which could affect
+// other mounts or the node, like bind or remount, are never allowed.
+func ValidateMountFlags(fsType string, flags []string) error {
+	if fsType == "" {
+		fsType = DefaultFSType
+	}
+	for _, flag := range flags {
+		for _, option := range strings.Split(flag, ",") {
+			name := mountOptionName(option)
+			if name == "" {
+				return fmt.Errorf("invalid mount flag %q", flag)
+			}
+			if ignoredMountOptions[name] {
+				continue
+			}
+			if !allowedMountOptions[name] && !allowedFSMountOptions[fsType][name] {
+				return fmt.Errorf("mount flag %q is not allowed for %s", option, fsType)
+			}
+			if strings.HasSuffix(name, "=") {
+				value := strings.TrimPrefix(option, name)
+				if allowed, ok := allowedMountOptionValues[name]; ok && !allowed[value] || !mountOptionValueRegexp.MatchString(value) {
+					return fmt.Errorf("invalid value for mount flag %q", option)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// StageMountOptions returns the options a filesystem of type fsType is
+// mounted with at the staging target path: the default options of the
+// filesystem followed by the mount flags, which override defaults with the
+// same name.
+func StageMountOptions(fsType string, flags []string) []string {
+	if fsType == "" {
+		fsType = DefaultFSType
+	}
+	options := mountFlagOptions(flags)
+	overridden := make(map[string]bool)
+	for _, option := range options {
+		overridden[mountOptionName(option)] = true
+	}
+	var defaults []string
+	for _, option := range defaultMountOptions[fsType] {
+		if !overridden[mountOptionName(option)] {
+			defaults = append(defaults, option)
+		}
+	}
+	return append(defaults, options...)
+}
+
+// mountFlagOptions splits mount flags into the options they consist of,
+// leaving out ignored options.
+func mountFlagOptions(flags []string) []string {
+	var options []string
+	for _, flag := range flags {
+		for _, option := range strings.Split(flag, ",") {
+			if option == "" || ignoredMountOptions[option] {
+				continue
+			}
+			options = append(options, option)
+		}
+	}
+	return options
+}
+
+// mountOptionName returns the name of a mount option, including the "=" for
+// options with a value.
+func mountOptionName(option string) string {
+	if i := strings.Index(option, "="); i >= 0 {
+		return option[:i+1]
+	}
+	return option
+}
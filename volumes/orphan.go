@@ -0,0 +1,199 @@
+package volumes
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/hetznercloud/csi-driver/csi"
+)
+
+// OrphanCollectorOpts specifies how orphaned volumes are handled.
+type OrphanCollectorOpts struct {
+	// Labels the volumes of the cluster carry.
+	Labels map[string]string
+
+	// IgnoreLabels are the keys of labels marking volumes which have no
+	// persistent volume by design, like volumes holding snapshots. Volumes
+	// carrying any of them are never orphans.
+	IgnoreLabels []string
+
+	// Interval between two checks for orphaned volumes.
+	Interval time.Duration
+
+	// GracePeriod is how long a volume must have existed and been orphaned
+	// before it is deleted.
+	GracePeriod time.Duration
+
+	// Delete enables deleting orphaned volumes once the grace period has
+	// passed. With DryRun, the volumes are only logged instead.
+	Delete bool
+	DryRun bool
+}
+
+// OrphanCollector finds the volumes of the cluster the CO does not know, which
+// are left behind if the driver or the CO crashes while creating a volume. The
+// orphans are reported in the log and as metric and are optionally deleted.
+// Attached volumes and volumes protected against deletion are never deleted,
+// so the volume service must refuse to delete attached volumes rather than
+// detach them first, like the IdempotentService does.
+type OrphanCollector struct {
+	logger        log.Logger
+	volumeService Service
+	knownVolumes  KnownVolumeLister
+	opts          OrphanCollectorOpts
+	orphans       prometheus.Gauge
+	deleted       prometheus.Counter
+	now           func() time.Time
+
+	// orphanedSince holds when each orphan has been found first.
+	orphanedSince map[uint64]time.Time
+}
+
+func NewOrphanCollector(
+	logger log.Logger,
+	volumeService Service,
+	knownVolumes KnownVolumeLister,
+	opts OrphanCollectorOpts,
+	orphans prometheus.Gauge,
+	deleted prometheus.Counter,
+) *OrphanCollector {
+	return &OrphanCollector{
+		logger:        logger,
+		volumeService: volumeService,
+		knownVolumes:  knownVolumes,
+		opts:          opts,
+		orphans:       orphans,
+		deleted:       deleted,
+		now:           time.Now,
+		orphanedSince: make(map[uint64]time.Time),
+	}
+}
+
+// Run checks for orphaned volumes until ctx is done.
+func (c *OrphanCollector) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := c.Collect(ctx); err != nil {
+			level.Error(c.logger).Log(
+				"msg", "failed to check for orphaned volumes",
+				"err", err,
+			)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Collect checks for orphaned volumes once.
+func (c *OrphanCollector) Collect(ctx context.Context) error {
+	// The volumes are listed before the known volumes, so a volume created
+	// in between is known if it shows up in the list.
+	clusterVolumes, err := c.volumeService.List(ctx, ListOpts{Labels: c.opts.Labels})
+	if err != nil {
+		return err
+	}
+	known, err := c.knownVolumes.KnownVolumeIDs(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := c.now()
+	orphanedSince := make(map[uint64]time.Time)
+	for _, volume := range clusterVolumes {
+		if known[volume.ID] || c.ignored(volume) {
+			continue
+		}
+		since, ok := c.orphanedSince[volume.ID]
+		if !ok {
+			since = now
+			level.Info(c.logger).Log(
+				"msg", "found orphaned volume",
+				"volume-id", volume.ID,
+				"volume-name", volume.Name,
+			)
+		}
+		orphanedSince[volume.ID] = since
+
+		if !c.opts.Delete || now.Sub(since) < c.opts.GracePeriod || now.Sub(volume.Created) < c.opts.GracePeriod {
+			continue
+		}
+		if volume.Server != nil || volume.DeleteProtection {
+			level.Info(c.logger).Log(
+				"msg", "not deleting orphaned volume which is attached or protected",
+				"volume-id", volume.ID,
+				"volume-name", volume.Name,
+			)
+			continue
+		}
+		if c.opts.DryRun {
+			level.Info(c.logger).Log(
+				"msg", "would delete orphaned volume (dry run)",
+				"volume-id", volume.ID,
+				"volume-name", volume.Name,
+			)
+			continue
+		}
+
+		// The volume may have been attached since it was listed.
+		current, err := c.volumeService.GetByID(WithoutCache(ctx), volume.ID)
+		if err == ErrVolumeNotFound {
+			delete(orphanedSince, volume.ID)
+			continue
+		}
+		if err != nil {
+			level.Error(c.logger).Log(
+				"msg", "failed to get orphaned volume",
+				"volume-id", volume.ID,
+				"err", err,
+			)
+			continue
+		}
+		if current.Server != nil || current.DeleteProtection || c.ignored(current) {
+			level.Info(c.logger).Log(
+				"msg", "not deleting orphaned volume which has been attached, protected or ignored since",
+				"volume-id", volume.ID,
+				"volume-name", volume.Name,
+			)
+			continue
+		}
+
+		level.Info(c.logger).Log(
+			"msg", "deleting orphaned volume",
+			"volume-id", volume.ID,
+			"volume-name", volume.Name,
+			"orphaned-since", since,
+		)
+		if err := c.volumeService.Delete(ctx, current); err != nil {
+			level.Error(c.logger).Log(
+				"msg", "failed to delete orphaned volume",
+				"volume-id", volume.ID,
+				"err", err,
+			)
+			continue
+		}
+		c.deleted.Inc()
+		delete(orphanedSince, volume.ID)
+	}
+
+	c.orphanedSince = orphanedSince
+	c.orphans.Set(float64(len(orphanedSince)))
+	return nil
+}
+
+func (c *OrphanCollector) ignored(volume *csi.Volume) bool {
+	for _, key := range c.opts.IgnoreLabels {
+		if _, ok := volume.Labels[key]; ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,155 @@
+package volumes_test
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/hetznercloud/csi-driver/csi"
+	"github.com/hetznercloud/csi-driver/mock"
+	"github.com/hetznercloud/csi-driver/volumes"
+)
+
+type knownVolumeLister map[uint64]bool
+
+func (l knownVolumeLister) KnownVolumeIDs(ctx context.Context) (map[uint64]bool, error) {
+	if l == nil {
+		return nil, io.EOF
+	}
+	return l, nil
+}
+
+func newTestOrphanCollector(volumeService volumes.Service, known knownVolumeLister, opts volumes.OrphanCollectorOpts) (*volumes.OrphanCollector, prometheus.Gauge, prometheus.Counter) {
+	orphans := prometheus.NewGauge(prometheus.GaugeOpts{Name: "orphans"})
+	deleted := prometheus.NewCounter(prometheus.CounterOpts{Name: "deleted"})
+	collector := volumes.NewOrphanCollector(log.NewNopLogger(), volumeService, known, opts, orphans, deleted)
+	return collector, orphans, deleted
+}
+
+func TestOrphanCollectorCollect(t *testing.T) {
+	var deletedIDs []uint64
+	volumeService := &mock.VolumeService{
+		ListFunc: func(ctx context.Context, opts volumes.ListOpts) ([]*csi.Volume, error) {
+			if opts.Labels["cluster"] != "test" {
+				t.Errorf("unexpected labels: %v", opts.Labels)
+			}
+			return []*csi.Volume{
+				{ID: 1},
+				{ID: 2},
+				{ID: 3, Server: &csi.Server{ID: 1}},
+				{ID: 4, DeleteProtection: true},
+				{ID: 5, Created: time.Now()},
+				{ID: 6},
+				{ID: 7},
+			}, nil
+		},
+		GetByIDFunc: func(ctx context.Context, id uint64) (*csi.Volume, error) {
+			switch id {
+			case 6:
+				// Attached after the volumes have been listed.
+				return &csi.Volume{ID: id, Server: &csi.Server{ID: 1}}, nil
+			case 7:
+				// Deleted after the volumes have been listed.
+				return nil, volumes.ErrVolumeNotFound
+			}
+			return &csi.Volume{ID: id}, nil
+		},
+		DeleteFunc: func(ctx context.Context, volume *csi.Volume) error {
+			deletedIDs = append(deletedIDs, volume.ID)
+			return nil
+		},
+	}
+
+	collector, orphans, deleted := newTestOrphanCollector(volumeService, knownVolumeLister{1: true}, volumes.OrphanCollectorOpts{
+		Labels:      map[string]string{"cluster": "test"},
+		GracePeriod: 0,
+		Delete:      true,
+	})
+	if err := collector.Collect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(deletedIDs) != 2 || deletedIDs[0] != 2 || deletedIDs[1] != 5 {
+		t.Errorf("unexpected deleted volumes: %v", deletedIDs)
+	}
+	if n := testutil.ToFloat64(deleted); n != 2 {
+		t.Errorf("unexpected deleted count: %v", n)
+	}
+	if n := testutil.ToFloat64(orphans); n != 3 {
+		t.Errorf("unexpected orphan count: %v", n)
+	}
+}
+
+func TestOrphanCollectorCollectIgnoredVolumes(t *testing.T) {
+	volumeService := &mock.VolumeService{
+		ListFunc: func(ctx context.Context, opts volumes.ListOpts) ([]*csi.Volume, error) {
+			return []*csi.Volume{
+				{ID: 1, Labels: map[string]string{"snapshot-source": "2"}},
+			}, nil
+		},
+		DeleteFunc: func(ctx context.Context, volume *csi.Volume) error {
+			t.Errorf("snapshot volume deleted: %d", volume.ID)
+			return nil
+		},
+	}
+
+	collector, orphans, _ := newTestOrphanCollector(volumeService, knownVolumeLister{}, volumes.OrphanCollectorOpts{
+		IgnoreLabels: []string{"snapshot-source"},
+		Delete:       true,
+	})
+	if err := collector.Collect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := testutil.ToFloat64(orphans); n != 0 {
+		t.Errorf("unexpected orphan count: %v", n)
+	}
+}
+
+func TestOrphanCollectorCollectGracePeriod(t *testing.T) {
+	volumeService := &mock.VolumeService{
+		ListFunc: func(ctx context.Context, opts volumes.ListOpts) ([]*csi.Volume, error) {
+			return []*csi.Volume{{ID: 1}, {ID: 2}}, nil
+		},
+		DeleteFunc: func(ctx context.Context, volume *csi.Volume) error {
+			t.Errorf("unexpected deletion of volume %d", volume.ID)
+			return nil
+		},
+	}
+
+	for _, opts := range []volumes.OrphanCollectorOpts{
+		{GracePeriod: time.Hour, Delete: true},
+		{GracePeriod: 0, Delete: true, DryRun: true},
+		{GracePeriod: 0},
+	} {
+		collector, orphans, _ := newTestOrphanCollector(volumeService, knownVolumeLister{}, opts)
+		for i := 0; i < 2; i++ {
+			if err := collector.Collect(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if n := testutil.ToFloat64(orphans); n != 2 {
+			t.Errorf("unexpected orphan count: %v", n)
+		}
+	}
+}
+
+func TestOrphanCollectorCollectKnownVolumesError(t *testing.T) {
+	volumeService := &mock.VolumeService{
+		ListFunc: func(ctx context.Context, opts volumes.ListOpts) ([]*csi.Volume, error) {
+			return []*csi.Volume{{ID: 1}}, nil
+		},
+		DeleteFunc: func(ctx context.Context, volume *csi.Volume) error {
+			t.Errorf("unexpected deletion of volume %d", volume.ID)
+			return nil
+		},
+	}
+
+	collector, _, _ := newTestOrphanCollector(volumeService, nil, volumes.OrphanCollectorOpts{Delete: true})
+	if err := collector.Collect(context.Background()); err == nil {
+		t.Error("expected error")
+	}
+}
@@ -1,6 +1,9 @@
 package volumes
 
 import (
+	"io"
+	"os"
+
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/hetznercloud/csi-driver/csi"
@@ -10,33 +13,59 @@ import (
 
 // ResizeService resizes volumes.
 type ResizeService interface {
-	Resize(volume *csi.Volume, volumePath string) error
+	// Resize grows the filesystem of the volume to the size of its device
+	// and returns the size of the device in bytes.
+	Resize(volume *csi.Volume, volumePath string) (int64, error)
 }
 
 // LinuxResizeService resizes volumes on a Linux system.
 type LinuxResizeService struct {
 	logger  log.Logger
 	resizer *mount.ResizeFs
+	crypt   cryptSetup
 }
 
 func NewLinuxResizeService(logger log.Logger) *LinuxResizeService {
+	executor := exec.New()
 	return &LinuxResizeService{
-		logger: logger,
-		resizer: mount.NewResizeFs(mount.SafeFormatAndMount{
-			Interface: mount.New(""),
-			Exec:      exec.New(),
-		}.Exec),
+		logger:  logger,
+		resizer: mount.NewResizeFs(executor),
+		crypt:   cryptSetup{exec: executor},
 	}
 }
 
-func (l *LinuxResizeService) Resize(volume *csi.Volume, volumePath string) error {
+func (l *LinuxResizeService) Resize(volume *csi.Volume, volumePath string) (int64, error) {
 	level.Debug(l.logger).Log(
 		"msg", "resizing volume",
 		"volume-name", volume.Name,
 		"volume-path", volumePath,
 	)
-	if _, err := l.resizer.Resize(volume.LinuxDevice, volumePath); err != nil {
-		return err
+
+	device := volume.LinuxDevice
+	mapperDevice := luksMapperDevice(volume.ID)
+	encrypted, err := deviceExists(mapperDevice)
+	if err != nil {
+		return 0, err
+	}
+	if encrypted {
+		if err := l.crypt.Resize(luksMapperName(volume.ID)); err != nil {
+			return 0, err
+		}
+		device = mapperDevice
+	}
+
+	if _, err := l.resizer.Resize(device, volumePath); err != nil {
+		return 0, err
+	}
+	return deviceSize(device)
+}
+
+// deviceSize returns the size of device in bytes.
+func deviceSize(device string) (int64, error) {
+	f, err := os.Open(device)
+	if err != nil {
+		return 0, err
 	}
-	return nil
+	defer f.Close()
+	return f.Seek(0, io.SeekEnd)
 }
@@ -1,3 +1,23 @@
 package volumes
 
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
 var _ ResizeService = (*LinuxResizeService)(nil)
+
+func TestDeviceSize(t *testing.T) {
+	device := filepath.Join(t.TempDir(), "sdb")
+	if err := ioutil.WriteFile(device, make([]byte, 4096), 0600); err != nil {
+		t.Fatal(err)
+	}
+	size, err := deviceSize(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 4096 {
+		t.Errorf("unexpected size: %d", size)
+	}
+}
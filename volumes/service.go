@@ -3,6 +3,7 @@ package volumes
 import (
 	"context"
 	"errors"
+	"io"
 
 	"github.com/hetznercloud/csi-driver/csi"
 )
@@ -15,22 +16,122 @@ var (
 	ErrNotAttached         = errors.New("volume is not attached")
 	ErrAttachLimitReached  = errors.New("max number of attachments per server reached")
 	ErrLockedServer        = errors.New("server is locked")
+	ErrDeleteProtected     = errors.New("volume is protected against deletion")
+	ErrVolumeCreating      = errors.New("volume is still being created")
+
+	ErrSnapshotNotFound      = errors.New("snapshot not found")
+	ErrSnapshotAlreadyExists = errors.New("snapshot does already exist")
+
+	ErrBackupNotFound      = errors.New("backup not found")
+	ErrBackupAlreadyExists = errors.New("backup does already exist")
+	ErrObjectNotFound      = errors.New("object not found")
 )
 
 type Service interface {
 	Create(ctx context.Context, opts CreateOpts) (*csi.Volume, error)
 	GetByID(ctx context.Context, id uint64) (*csi.Volume, error)
 	GetByName(ctx context.Context, name string) (*csi.Volume, error)
+	List(ctx context.Context, opts ListOpts) ([]*csi.Volume, error)
 	Delete(ctx context.Context, volume *csi.Volume) error
 	Attach(ctx context.Context, volume *csi.Volume, server *csi.Server) error
 	Detach(ctx context.Context, volume *csi.Volume, server *csi.Server) error
 	Resize(ctx context.Context, volume *csi.Volume, size int) error
+	SetLabels(ctx context.Context, volume *csi.Volume, labels map[string]string) error
+	SetDeleteProtection(ctx context.Context, volume *csi.Volume, enabled bool) error
 }
 
 // CreateOpts specifies the options for creating a volume.
 type CreateOpts struct {
-	Name     string
-	MinSize  int
-	MaxSize  int
-	Location string
+	Name             string
+	MinSize          int
+	MaxSize          int
+	Location         string
+	Labels           map[string]string
+	DeleteProtection bool
+
+	// ProvisioningStateLabel, if set, records the provisioning state of the
+	// volume while it is created and is removed once it is ready.
+	ProvisioningStateLabel string
+
+	// RequestHashLabel, if set, records the hash of the options the volume
+	// has been created with.
+	RequestHashLabel string
+}
+
+// ListOpts specifies the options for listing volumes.
+type ListOpts struct {
+	// Labels the volumes must carry. All volumes are listed if empty.
+	Labels map[string]string
+}
+
+// CopyService copies the contents of one volume to another.
+type CopyService interface {
+	Copy(ctx context.Context, src *csi.Volume, dst *csi.Volume) error
+}
+
+// SnapshotService manages point-in-time copies of volumes.
+type SnapshotService interface {
+	Create(ctx context.Context, opts CreateSnapshotOpts) (*csi.Snapshot, error)
+	GetByID(ctx context.Context, id uint64) (*csi.Snapshot, error)
+	List(ctx context.Context, opts ListSnapshotsOpts) ([]*csi.Snapshot, error)
+	Delete(ctx context.Context, snapshot *csi.Snapshot) error
+}
+
+// CreateSnapshotOpts specifies the options for creating a snapshot.
+type CreateSnapshotOpts struct {
+	Name           string
+	SourceVolumeID uint64
+	Labels         map[string]string
+}
+
+// ListSnapshotsOpts specifies the options for listing snapshots.
+type ListSnapshotsOpts struct {
+	// SourceVolumeID limits the result to the snapshots of a volume if set.
+	SourceVolumeID uint64
+	Labels         map[string]string
+}
+
+// BackupService stores the contents of volumes in object storage.
+type BackupService interface {
+	Backup(ctx context.Context, opts BackupOpts) (*csi.Backup, error)
+	Restore(ctx context.Context, name string, opts RestoreOpts) error
+	Get(ctx context.Context, name string) (*csi.Backup, error)
+	Delete(ctx context.Context, name string) error
+}
+
+// BackupOpts specifies the options for backing up a volume.
+type BackupOpts struct {
+	Name   string
+	Volume *csi.Volume
+	Mode   string
+
+	// Path is the path the volume is mounted at for filesystem backups or
+	// the device of the volume for block backups.
+	Path string
+}
+
+// RestoreOpts specifies where to restore a backup to. Filesystem backups are
+// extracted to Path, block backups are written to Device.
+type RestoreOpts struct {
+	Device string
+	Path   string
+}
+
+// ObjectStore stores objects in a bucket of S3-compatible object storage.
+type ObjectStore interface {
+	Put(ctx context.Context, key string, data []byte) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	List(ctx context.Context, prefix string) ([]string, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// ServerService looks up the servers volumes are attached to.
+type ServerService interface {
+	GetByID(ctx context.Context, id uint64) (*csi.Server, error)
+	List(ctx context.Context) ([]*csi.Server, error)
+}
+
+// KnownVolumeLister lists the volumes known to the CO.
+type KnownVolumeLister interface {
+	KnownVolumeIDs(ctx context.Context) (map[uint64]bool, error)
 }
@@ -0,0 +1,179 @@
+package volumes
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/hetznercloud/csi-driver/csi"
+)
+
+// snapshotStateCopying is the value of the state label while the contents of
+// the source volume are copied.
+const snapshotStateCopying = "copying"
+
+// SnapshotLabels are the keys of the labels of the volumes holding snapshots.
+type SnapshotLabels struct {
+	// Source holds the ID of the source volume.
+	Source string
+	// State is removed once the contents of the source volume have been
+	// copied.
+	State string
+}
+
+// CopySnapshotService stores snapshots as detached volumes holding a full
+// copy of their source volume.
+type CopySnapshotService struct {
+	logger        log.Logger
+	volumeService Service
+	copyJobs      *CopyJobs
+	labels        SnapshotLabels
+}
+
+func NewCopySnapshotService(logger log.Logger, volumeService Service, copyService CopyService, labels SnapshotLabels) *CopySnapshotService {
+	return &CopySnapshotService{
+		logger:        logger,
+		volumeService: volumeService,
+		copyJobs:      NewCopyJobs(logger, volumeService, copyService),
+		labels:        labels,
+	}
+}
+
+// Create creates a snapshot of a volume. The snapshot is returned right away
+// and becomes ready to use once the copy running in the background finished.
+// Calling Create again for a snapshot which is not ready restarts the copy
+// if it is not running anymore.
+func (s *CopySnapshotService) Create(ctx context.Context, opts CreateSnapshotOpts) (*csi.Snapshot, error) {
+	level.Info(s.logger).Log(
+		"msg", "creating snapshot",
+		"name", opts.Name,
+		"source-volume-id", opts.SourceVolumeID,
+	)
+
+	volume, err := s.volumeService.GetByName(ctx, opts.Name)
+	if err != nil && err != ErrVolumeNotFound {
+		return nil, err
+	}
+	if volume != nil {
+		if volume.Labels[s.labels.Source] != strconv.FormatUint(opts.SourceVolumeID, 10) {
+			level.Info(s.logger).Log(
+				"msg", "another volume with that name does already exist",
+				"name", opts.Name,
+			)
+			return nil, ErrSnapshotAlreadyExists
+		}
+		if _, copying := volume.Labels[s.labels.State]; !copying {
+			return s.toSnapshot(volume), nil
+		}
+	}
+
+	source, err := s.volumeService.GetByID(ctx, opts.SourceVolumeID)
+	if err != nil {
+		return nil, err
+	}
+
+	if volume == nil {
+		// The copy is only consistent if nothing writes to the source.
+		if source.Server != nil {
+			return nil, ErrAttached
+		}
+
+		labels := make(map[string]string)
+		for key, value := range opts.Labels {
+			labels[key] = value
+		}
+		labels[s.labels.Source] = strconv.FormatUint(source.ID, 10)
+		labels[s.labels.State] = snapshotStateCopying
+
+		volume, err = s.volumeService.Create(ctx, CreateOpts{
+			Name:     opts.Name,
+			MinSize:  source.Size,
+			Location: source.Location,
+			Labels:   labels,
+		})
+		if err == ErrVolumeAlreadyExists {
+			return nil, ErrSnapshotAlreadyExists
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s.copyJobs.Start(source, volume, s.labels.State)
+
+	level.Info(s.logger).Log(
+		"msg", "copying volume to snapshot",
+		"snapshot-id", volume.ID,
+		"source-volume-id", source.ID,
+	)
+	return s.toSnapshot(volume), nil
+}
+
+func (s *CopySnapshotService) GetByID(ctx context.Context, id uint64) (*csi.Snapshot, error) {
+	volume, err := s.volumeService.GetByID(ctx, id)
+	if err == ErrVolumeNotFound {
+		return nil, ErrSnapshotNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := volume.Labels[s.labels.Source]; !ok {
+		return nil, ErrSnapshotNotFound
+	}
+	return s.toSnapshot(volume), nil
+}
+
+func (s *CopySnapshotService) List(ctx context.Context, opts ListSnapshotsOpts) ([]*csi.Snapshot, error) {
+	labels := make(map[string]string)
+	for key, value := range opts.Labels {
+		labels[key] = value
+	}
+	if opts.SourceVolumeID != 0 {
+		labels[s.labels.Source] = strconv.FormatUint(opts.SourceVolumeID, 10)
+	}
+
+	allVolumes, err := s.volumeService.List(ctx, ListOpts{Labels: labels})
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []*csi.Snapshot
+	for _, volume := range allVolumes {
+		if _, ok := volume.Labels[s.labels.Source]; ok {
+			snapshots = append(snapshots, s.toSnapshot(volume))
+		}
+	}
+	return snapshots, nil
+}
+
+func (s *CopySnapshotService) Delete(ctx context.Context, snapshot *csi.Snapshot) error {
+	level.Info(s.logger).Log(
+		"msg", "deleting snapshot",
+		"snapshot-id", snapshot.ID,
+	)
+
+	// Make sure not to delete a regular volume.
+	if _, err := s.GetByID(ctx, snapshot.ID); err != nil {
+		return err
+	}
+	err := s.volumeService.Delete(ctx, &csi.Volume{ID: snapshot.ID})
+	if err == ErrVolumeNotFound {
+		return ErrSnapshotNotFound
+	}
+	return err
+}
+
+func (s *CopySnapshotService) toSnapshot(volume *csi.Volume) *csi.Snapshot {
+	_, copying := volume.Labels[s.labels.State]
+	sourceVolumeID, _ := strconv.ParseUint(volume.Labels[s.labels.Source], 10, 64)
+	return &csi.Snapshot{
+		ID:             volume.ID,
+		Name:           volume.Name,
+		SourceVolumeID: sourceVolumeID,
+		Size:           volume.Size,
+		Location:       volume.Location,
+		Created:        volume.Created,
+		ReadyToUse:     !copying,
+	}
+}
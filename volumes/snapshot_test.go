@@ -0,0 +1,191 @@
+package volumes_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/hetznercloud/csi-driver/csi"
+	"github.com/hetznercloud/csi-driver/mock"
+	"github.com/hetznercloud/csi-driver/volumes"
+)
+
+var _ volumes.SnapshotService = (*volumes.CopySnapshotService)(nil)
+
+var testSnapshotLabels = volumes.SnapshotLabels{
+	Source: "snapshot-source",
+	State:  "snapshot-state",
+}
+
+func TestCopySnapshotServiceCreate(t *testing.T) {
+	copied := make(chan struct{})
+
+	volumeService := &mock.VolumeService{
+		GetByNameFunc: func(ctx context.Context, name string) (*csi.Volume, error) {
+			return nil, volumes.ErrVolumeNotFound
+		},
+		GetByIDFunc: func(ctx context.Context, id uint64) (*csi.Volume, error) {
+			return &csi.Volume{ID: 1, Size: 20, Location: "loc"}, nil
+		},
+		CreateFunc: func(ctx context.Context, opts volumes.CreateOpts) (*csi.Volume, error) {
+			if opts.Name != "snap" || opts.MinSize != 20 || opts.Location != "loc" {
+				t.Errorf("unexpected options: %v", opts)
+			}
+			if opts.Labels["cluster"] != "test" ||
+				opts.Labels[testSnapshotLabels.Source] != "1" ||
+				opts.Labels[testSnapshotLabels.State] == "" {
+				t.Errorf("unexpected labels: %v", opts.Labels)
+			}
+			return &csi.Volume{ID: 2, Name: opts.Name, Size: opts.MinSize, Labels: opts.Labels}, nil
+		},
+		SetLabelsFunc: func(ctx context.Context, volume *csi.Volume, labels map[string]string) error {
+			if _, ok := labels[testSnapshotLabels.State]; ok {
+				t.Errorf("snapshot state label not removed: %v", labels)
+			}
+			close(copied)
+			return nil
+		},
+	}
+	copyService := &mock.VolumeCopyService{
+		CopyFunc: func(ctx context.Context, src *csi.Volume, dst *csi.Volume) error {
+			if src.ID != 1 || dst.ID != 2 {
+				t.Errorf("unexpected volumes copied: %d to %d", src.ID, dst.ID)
+			}
+			return nil
+		},
+	}
+
+	service := volumes.NewCopySnapshotService(log.NewNopLogger(), volumeService, copyService, testSnapshotLabels)
+
+	snapshot, err := service.Create(context.Background(), volumes.CreateSnapshotOpts{
+		Name:           "snap",
+		SourceVolumeID: 1,
+		Labels:         map[string]string{"cluster": "test"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.ID != 2 || snapshot.SourceVolumeID != 1 || snapshot.Size != 20 {
+		t.Errorf("unexpected snapshot: %v", snapshot)
+	}
+	if snapshot.ReadyToUse {
+		t.Error("snapshot ready before copy finished")
+	}
+	<-copied
+}
+
+func TestCopySnapshotServiceCreateExisting(t *testing.T) {
+	volumeService := &mock.VolumeService{
+		GetByNameFunc: func(ctx context.Context, name string) (*csi.Volume, error) {
+			return &csi.Volume{
+				ID:     2,
+				Name:   "snap",
+				Size:   20,
+				Labels: map[string]string{testSnapshotLabels.Source: "1"},
+			}, nil
+		},
+	}
+
+	service := volumes.NewCopySnapshotService(log.NewNopLogger(), volumeService, &mock.VolumeCopyService{}, testSnapshotLabels)
+
+	snapshot, err := service.Create(context.Background(), volumes.CreateSnapshotOpts{
+		Name:           "snap",
+		SourceVolumeID: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.ID != 2 || !snapshot.ReadyToUse {
+		t.Errorf("unexpected snapshot: %v", snapshot)
+	}
+}
+
+func TestCopySnapshotServiceCreateErrors(t *testing.T) {
+	testCases := []struct {
+		Name           string
+		ExistingVolume *csi.Volume
+		SourceVolume   *csi.Volume
+		SourceError    error
+		Err            error
+	}{
+		{
+			Name:           "name used by other volume",
+			ExistingVolume: &csi.Volume{ID: 2, Name: "snap"},
+			Err:            volumes.ErrSnapshotAlreadyExists,
+		},
+		{
+			Name: "name used by snapshot of other volume",
+			ExistingVolume: &csi.Volume{
+				ID:     2,
+				Name:   "snap",
+				Labels: map[string]string{testSnapshotLabels.Source: "3"},
+			},
+			Err: volumes.ErrSnapshotAlreadyExists,
+		},
+		{
+			Name:        "source not found",
+			SourceError: volumes.ErrVolumeNotFound,
+			Err:         volumes.ErrVolumeNotFound,
+		},
+		{
+			Name:         "source attached",
+			SourceVolume: &csi.Volume{ID: 1, Size: 10, Server: &csi.Server{ID: 5}},
+			Err:          volumes.ErrAttached,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			volumeService := &mock.VolumeService{
+				GetByNameFunc: func(ctx context.Context, name string) (*csi.Volume, error) {
+					if testCase.ExistingVolume == nil {
+						return nil, volumes.ErrVolumeNotFound
+					}
+					return testCase.ExistingVolume, nil
+				},
+				GetByIDFunc: func(ctx context.Context, id uint64) (*csi.Volume, error) {
+					return testCase.SourceVolume, testCase.SourceError
+				},
+			}
+
+			service := volumes.NewCopySnapshotService(log.NewNopLogger(), volumeService, &mock.VolumeCopyService{}, testSnapshotLabels)
+
+			_, err := service.Create(context.Background(), volumes.CreateSnapshotOpts{
+				Name:           "snap",
+				SourceVolumeID: 1,
+			})
+			if err != testCase.Err {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestCopySnapshotServiceGetByIDNotSnapshot(t *testing.T) {
+	volumeService := &mock.VolumeService{
+		GetByIDFunc: func(ctx context.Context, id uint64) (*csi.Volume, error) {
+			return &csi.Volume{ID: id}, nil
+		},
+	}
+
+	service := volumes.NewCopySnapshotService(log.NewNopLogger(), volumeService, &mock.VolumeCopyService{}, testSnapshotLabels)
+
+	if _, err := service.GetByID(context.Background(), 1); err != volumes.ErrSnapshotNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestCopySnapshotServiceDeleteNotSnapshot(t *testing.T) {
+	volumeService := &mock.VolumeService{
+		GetByIDFunc: func(ctx context.Context, id uint64) (*csi.Volume, error) {
+			return &csi.Volume{ID: id}, nil
+		},
+	}
+
+	service := volumes.NewCopySnapshotService(log.NewNopLogger(), volumeService, &mock.VolumeCopyService{}, testSnapshotLabels)
+
+	if err := service.Delete(context.Background(), &csi.Snapshot{ID: 1}); err != volumes.ErrSnapshotNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}